@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/google/gopacket/pcap"
+	"github.com/phensley/mongopacket/pkg/mongopacket"
+	"github.com/phensley/mongopacket/pkg/protocol"
+	"github.com/spf13/cobra"
+)
+
+var (
+	dumpInterface string
+	dumpVerbose   bool
+	dumpMaxLength int
+	dumpNamespace string
+	dumpCommand   string
+	dumpOpCode    string
+	dumpIP        string
+)
+
+var dumpCmd = &cobra.Command{
+	Use:   "dump [file.pcap]",
+	Short: "print each decoded message, from a capture file or a live interface",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			handle *pcap.Handle
+			err    error
+		)
+		switch {
+		case len(args) == 1:
+			handle, err = pcap.OpenOffline(args[0])
+		case dumpInterface != "":
+			handle, err = pcap.OpenLive(dumpInterface, 65535, false, pcap.BlockForever)
+			if err == nil {
+				err = handle.SetBPFFilter("tcp port 27017")
+			}
+		default:
+			log.Fatalln("dump: a capture file or --interface is required")
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer handle.Close()
+
+		var redactor *mongopacket.Redactor
+		if redactPath != "" {
+			redactor, err = mongopacket.LoadRedactor(redactPath)
+			if err != nil {
+				log.Fatalln(err)
+			}
+		}
+
+		dumpFilter, err := parseDumpFilter()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		d := &mongopacket.Dumper{
+			Out:       os.Stdout,
+			Verbose:   dumpVerbose,
+			MaxLength: dumpMaxLength,
+			Filter:    dumpFilter,
+		}
+		// Verbose output prints the documents in full anyway
+		if dumpVerbose && !cmd.Flags().Changed("max-length") {
+			d.MaxLength = 0
+		}
+
+		filter, err := parseFilter()
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		t := &mongopacket.TCPStream{
+			Handle:   handle,
+			Factory:  &mongopacket.MongoStreamFactory{DecodeOptions: decodeOptions},
+			Redactor: redactor,
+			Handler:  d.Event,
+			Filter:   filter,
+			Quiet:    true,
+		}
+		if err = t.Run(); err != nil {
+			log.Fatalln("mongopacket: ", err)
+		}
+	},
+}
+
+func init() {
+	f := dumpCmd.Flags()
+	f.StringVarP(&dumpInterface, "interface", "i", "", "capture live from this network interface")
+	f.BoolVarP(&dumpVerbose, "verbose", "v", false, "print each message's documents in full")
+	f.IntVar(&dumpMaxLength, "max-length", 512, "longest message summary printed, 0 for no limit")
+	f.StringVar(&dumpNamespace, "ns", "", "only messages for this database or database.collection")
+	f.StringVar(&dumpCommand, "command", "", "only messages for this command, e.g. find")
+	f.StringVar(&dumpOpCode, "opcode", "", "only messages with this opcode, e.g. OP_MSG")
+	f.StringVar(&dumpIP, "ip", "", "only messages to or from this address")
+	cmd.AddCommand(dumpCmd)
+}
+
+// Build a filter from the --ns, --command, --opcode and --ip flags. Replies
+// match through the request they respond to, as with --filter.
+func parseDumpFilter() (*mongopacket.Filter, error) {
+	var terms []string
+	if dumpNamespace != "" {
+		field := "db"
+		if strings.Contains(dumpNamespace, ".") {
+			field = "ns"
+		}
+		terms = append(terms, fmt.Sprintf("%s == %s", field, filterString(dumpNamespace)))
+	}
+	if dumpCommand != "" {
+		terms = append(terms, "cmd == "+filterString(dumpCommand))
+	}
+	if dumpOpCode != "" {
+		name, err := opcodeName(dumpOpCode)
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, "opcode == "+filterString(name))
+	}
+	if dumpIP != "" {
+		if net.ParseIP(dumpIP) == nil {
+			return nil, fmt.Errorf("dump: --ip %q is not an address", dumpIP)
+		}
+		terms = append(terms, fmt.Sprintf("(src == %s || dst == %s)", dumpIP, dumpIP))
+	}
+	if len(terms) == 0 {
+		return nil, nil
+	}
+	return mongopacket.ParseFilter(strings.Join(terms, " && "))
+}
+
+// Quote a string for a filter expression
+func filterString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
+
+// Look up an opcode by name, ignoring case, underscores and the OP_ prefix,
+// so that OP_GET_MORE, getmore and get_more are all OP_GET_MORE
+func opcodeName(name string) (string, error) {
+	norm := func(s string) string {
+		s = strings.ToUpper(strings.ReplaceAll(s, "_", ""))
+		return strings.TrimPrefix(s, "OP")
+	}
+	for _, op := range []protocol.OpCode{
+		protocol.OpReply, protocol.OpUpdate, protocol.OpInsert, protocol.OpQuery, protocol.OpGetMore,
+		protocol.OpDelete, protocol.OpKillCursors, protocol.OpCompressed, protocol.OpMsg,
+	} {
+		if norm(op.String()) == norm(name) {
+			return op.String(), nil
+		}
+	}
+	return "", fmt.Errorf("dump: unknown opcode %q", name)
+}
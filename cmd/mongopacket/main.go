@@ -2,58 +2,208 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/google/gopacket/pcap"
 	"github.com/phensley/mongopacket/pkg/mongopacket"
+	"github.com/phensley/mongopacket/pkg/protocol"
 	"github.com/spf13/cobra"
+)
 
-	_ "github.com/ClickHouse/clickhouse-go"
+var (
+	shapes      bool
+	redactPath  string
+	jsonMode    string
+	filterExpr  string
+	columnsPath string
+	storageType string
+	output      string
+	compress    bool
+	parquetOpts mongopacket.ParquetOptions
+	postgresURL string
+	hypertables bool
+	chURL       string
+	chOpts      mongopacket.ClickhouseOptions
 )
 
 var cmd = &cobra.Command{
-	Use:   "mongopacket",
+	Use:   "mongopacket file.pcap",
 	Short: "mongo database pcap parser",
+	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 
-		// TODO: parse arguments properly.
-
-		path := "./2020-06-08-xkkc7-event-2.pcap"
-
 		// Open PCAP file
-		pcap, err := pcap.OpenOffline(path)
+		pcap, err := pcap.OpenOffline(args[0])
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
 		defer pcap.Close()
 
-		// TODO: move stream into the package
+		opJSON, err := protocol.ParseExtJSONMode(jsonMode)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		var redactor *mongopacket.Redactor
+		if redactPath != "" {
+			redactor, err = mongopacket.LoadRedactor(redactPath)
+			if err != nil {
+				log.Fatalln(err)
+			}
+		}
 
-		storage, err := mongopacket.NewTSVStorage("xkkc7", 16*1024*1024)
+		filter, err := parseFilter()
 		if err != nil {
 			log.Fatalln(err)
 		}
 
-		// storage, err := mongopacket.NewClickhouse("tcp://zeus:9000/username=default&debug=false")
-		// if err != nil {
-		// 	log.Fatalln(err)
-		// }
+		var columns *mongopacket.Columns
+		if columnsPath != "" {
+			columns, err = mongopacket.LoadColumns(columnsPath)
+			if err != nil {
+				log.Fatalln(err)
+			}
+		}
+
+		// TODO: move stream into the package
+
+		storage, err := newStorage(columns, opJSON)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if p, ok := storage.(mongopacket.PartialStorage); ok {
+			fmt.Printf("%s storage doesn't store %s\n", storageType, strings.Join(p.Unstored(), ", "))
+		}
+		if s, ok := storage.(mongopacket.SchemaStorage); ok {
+			for _, m := range s.Migrated() {
+				if m.Version == 0 {
+					fmt.Printf("%s: %s\n", storageType, m.Description)
+				} else {
+					fmt.Printf("migrated %s schema to version %d: %s\n", storageType, m.Version, m.Description)
+				}
+			}
+		}
 
 		// Create our TCP stream decoder and start it
 		t := &mongopacket.TCPStream{
-			Handle:  pcap,
-			Factory: &mongopacket.MongoStreamFactory{},
-			Storage: storage,
+			Handle:   pcap,
+			Factory:  &mongopacket.MongoStreamFactory{Columns: columns, DecodeOptions: decodeOptions},
+			Storage:  storage,
+			Shapes:   shapes,
+			Redactor: redactor,
+			Filter:   filter,
+
+			// Progress output would be mixed with the records
+			Quiet: output == "-",
 		}
 		err = t.Run()
 		if err != nil {
 			log.Fatalln("mongopacket: ", err)
 		}
+		if c, ok := storage.(io.Closer); ok {
+			if err = c.Close(); err != nil {
+				log.Fatalln(err)
+			}
+		}
 	},
 }
 
+// Create the storage selected by --storage and --output
+func newStorage(columns *mongopacket.Columns, opJSON protocol.ExtJSONMode) (mongopacket.Storage, error) {
+	switch storageType {
+	case "tsv":
+		if output == "-" {
+			return nil, fmt.Errorf("tsv storage can't be written to stdout")
+		}
+		s, err := mongopacket.NewTSVStorage(output, 16*1024*1024, columns)
+		if err != nil {
+			return nil, err
+		}
+		s.OpJSON = opJSON
+		return s, nil
+
+	case "jsonl":
+		var s *mongopacket.JSONLStorage
+		if output == "-" {
+			s = mongopacket.NewJSONLWriter(os.Stdout, compress, columns)
+		} else {
+			var err error
+			if s, err = mongopacket.NewJSONLStorage(output, compress, columns); err != nil {
+				return nil, err
+			}
+		}
+		s.OpJSON = opJSON
+		return s, nil
+
+	case "parquet":
+		if output == "-" {
+			return nil, fmt.Errorf("parquet storage can't be written to stdout")
+		}
+		s := mongopacket.NewParquetStorage(output, parquetOpts, columns)
+		s.OpJSON = opJSON
+		return s, nil
+
+	case "sqlite":
+		if output == "-" {
+			return nil, fmt.Errorf("sqlite storage can't be written to stdout")
+		}
+		s, err := mongopacket.NewSQLite(output+".db", columns)
+		if err != nil {
+			return nil, err
+		}
+		s.OpJSON = opJSON
+		return s, nil
+
+	case "clickhouse":
+		s, err := mongopacket.NewClickhouse(chURL, chOpts, columns)
+		if err != nil {
+			return nil, err
+		}
+		s.OpJSON = opJSON
+		return s, nil
+
+	case "postgres":
+		s, err := mongopacket.NewPostgres(postgresURL, hypertables, columns)
+		if err != nil {
+			return nil, err
+		}
+		s.OpJSON = opJSON
+		return s, nil
+	}
+	return nil, fmt.Errorf("unknown storage %q", storageType)
+}
+
+// Parse the --filter expression, if one was given
+func parseFilter() (*mongopacket.Filter, error) {
+	if filterExpr == "" {
+		return nil, nil
+	}
+	return mongopacket.ParseFilter(filterExpr)
+}
+
+// The commands only look up fields in documents and re-marshal their bytes,
+// so documents are validated as they are decoded but never unmarshaled
+var decodeOptions = &protocol.DecodeOptions{RawDocuments: true}
+
 func main() {
+	cmd.Flags().BoolVar(&shapes, "shapes", false, "report count and latency percentiles per query shape")
+	cmd.Flags().StringVar(&columnsPath, "columns", "", "JSON file mapping column names to BSON paths and types")
+	cmd.Flags().StringVar(&storageType, "storage", "tsv", "storage for events: tsv, jsonl, parquet, sqlite, postgres or clickhouse")
+	cmd.Flags().StringVarP(&output, "output", "o", "xkkc7", "prefix of the output files, or - to write JSON lines to stdout")
+	cmd.Flags().BoolVar(&compress, "gzip", false, "gzip compress JSON lines output")
+	cmd.Flags().Int64Var(&parquetOpts.RowGroupRows, "row-group-rows", 0, "rows in each parquet row group, 0 for the default")
+	cmd.Flags().Int64Var(&parquetOpts.MaxFileSize, "max-file-size", 0, "bytes after which parquet output rolls over to a new file, 0 for no limit")
+	cmd.Flags().StringVar(&chURL, "clickhouse-url", "tcp://localhost:9000?username=default", "clickhouse connection url")
+	cmd.Flags().DurationVar(&chOpts.TTL, "ttl", 0, "clickhouse drops packets and events older than this, 0 to keep them")
+	cmd.Flags().IntVar(&chOpts.Inserts, "inserts", 2, "clickhouse batches inserted in parallel")
+	cmd.Flags().StringVar(&postgresURL, "postgres-url", "postgres://localhost/mongopacket?sslmode=disable", "postgres connection url")
+	cmd.Flags().BoolVar(&hypertables, "hypertables", false, "create timescaledb hypertables when the extension is installed")
+	cmd.Flags().StringVar(&jsonMode, "json", "relaxed", "extended JSON mode for stored ops: relaxed or canonical")
+	cmd.PersistentFlags().StringVar(&redactPath, "redact", "", "JSON file with rules for redacting stored or printed values")
+	cmd.PersistentFlags().StringVar(&filterExpr, "filter", "", `only events matching this expression, e.g. 'cmd == "find" && latency > 100ms'`)
 	cmd.Execute()
 }
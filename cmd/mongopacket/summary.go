@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/google/gopacket/pcap"
+	"github.com/phensley/mongopacket/pkg/mongopacket"
+	"github.com/spf13/cobra"
+)
+
+var summaryJSON bool
+
+var summaryCmd = &cobra.Command{
+	Use:   "summary file.pcap",
+	Short: "print ops by command, namespace, client app and server, with latency percentiles",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		handle, err := pcap.OpenOffline(args[0])
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer handle.Close()
+
+		s := mongopacket.NewSummarizer()
+		filter, err := parseFilter()
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		t := &mongopacket.TCPStream{
+			Handle:  handle,
+			Factory: &mongopacket.MongoStreamFactory{DecodeOptions: decodeOptions},
+			Handler: s.Add,
+			Filter:  filter,
+			Quiet:   true,
+		}
+		if err = t.Run(); err != nil {
+			log.Fatalln("mongopacket: ", err)
+		}
+
+		if summaryJSON {
+			err = mongopacket.WriteSummaryJSON(os.Stdout, s.Rows())
+		} else {
+			err = mongopacket.WriteSummaryText(os.Stdout, s.Rows())
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+	},
+}
+
+func init() {
+	summaryCmd.Flags().BoolVar(&summaryJSON, "json", false, "print the summary as JSON")
+	cmd.AddCommand(summaryCmd)
+}
@@ -0,0 +1,179 @@
+package mongopacket
+
+import (
+	"time"
+
+	"github.com/phensley/mongopacket/pkg/protocol"
+)
+
+type authState struct {
+	evt      *AuthEvent
+	pending  *MongoEvent // step awaiting its reply
+	rejected bool        // the server ignored speculative authentication
+	seen     time.Time   // latest step or reply
+}
+
+// AuthTracker follows the authentication conversation on each connection,
+// from the first saslStart, authenticate or speculative handshake to the
+// reply that accepts or rejects the credentials.
+type AuthTracker struct {
+	convs  map[connKey]*authState
+	done   []*AuthEvent
+	last   time.Time
+	pruned time.Time
+}
+
+// NewAuthTracker ..
+func NewAuthTracker() *AuthTracker {
+	return &AuthTracker{
+		convs: map[connKey]*authState{},
+	}
+}
+
+// Add an event to the tracker. For replies, req is the matching request if
+// it was seen, see RequestMatcher.
+func (t *AuthTracker) Add(e *MongoEvent, req *MongoEvent) {
+	if e.End.After(t.last) {
+		t.last = e.End
+	}
+	t.prune()
+
+	k := connKey{endpoint(e.SrcIP, e.SrcPort), endpoint(e.DstIP, e.DstPort)}
+	if protocol.IsResponse(e.Op) {
+		k = connKey{k.server, k.client}
+		t.reply(k, e, req)
+	} else if e.Auth != nil {
+		t.request(k, e)
+	}
+
+	if e.StreamEnd != 0 {
+		t.finish(k, AuthIncomplete)
+	}
+}
+
+// Finished returns the conversations that have ended since the last call
+func (t *AuthTracker) Finished() []*AuthEvent {
+	done := t.done
+	t.done = nil
+	return done
+}
+
+// Close ends all open conversations, and returns the conversations that have
+// ended since the last call to Finished.
+func (t *AuthTracker) Close() []*AuthEvent {
+	for k := range t.convs {
+		t.finish(k, AuthCaptureEnd)
+	}
+	return t.Finished()
+}
+
+// Record a step sent by the client
+func (t *AuthTracker) request(k connKey, e *MongoEvent) {
+	a := e.Auth
+	st := t.convs[k]
+	switch {
+	case st != nil && a.Command == "saslContinue":
+		st.evt.RoundTrips++
+
+	case st != nil && st.rejected:
+		// The driver falls back to a full conversation when the server
+		// ignores speculative authentication
+		st.rejected = false
+		st.evt.RoundTrips++
+		st.evt.Mechanism = a.Mechanism
+		if a.User != "" {
+			st.evt.User = a.User
+		}
+		if a.Database != "" {
+			st.evt.Database = a.Database
+		}
+
+	default:
+		t.finish(k, AuthIncomplete)
+		st = &authState{
+			evt: &AuthEvent{
+				Group:       e.Group,
+				StreamID:    e.StreamID,
+				SrcIP:       e.SrcIP,
+				SrcPort:     e.SrcPort,
+				DstIP:       e.DstIP,
+				DstPort:     e.DstPort,
+				AppName:     e.AppName,
+				Mechanism:   a.Mechanism,
+				User:        a.User,
+				Database:    a.Database,
+				Speculative: a.Speculative,
+				Start:       e.Start,
+				RoundTrips:  1,
+			},
+		}
+		t.convs[k] = st
+	}
+
+	st.pending = e
+	st.seen = e.End
+	st.evt.End = e.End
+}
+
+// Record the server's reply to a step
+func (t *AuthTracker) reply(k connKey, e *MongoEvent, req *MongoEvent) {
+	st := t.convs[k]
+	if st == nil || req == nil || req != st.pending {
+		return
+	}
+	st.pending = nil
+	st.seen = e.End
+	st.evt.End = e.End
+
+	if out := e.Outcome; out != nil && !out.OK {
+		st.evt.ErrorCode = out.Code
+		st.evt.ErrorName = out.CodeName
+		t.finish(k, AuthFailed)
+		return
+	}
+
+	doc := protocol.ReplyOf(e.Op)
+	if doc == nil {
+		return
+	}
+	if req.Auth.Speculative {
+		spec, ok := doc.Lookup("speculativeAuthenticate").DocumentOK()
+		if !ok {
+			st.rejected = true
+			return
+		}
+		doc = protocol.NewDocument(spec)
+	}
+
+	// authenticate finishes in a single step, SASL replies say when the
+	// conversation is done
+	done, _ := doc.Lookup("done").BooleanOK()
+	if done || req.Auth.Command == "authenticate" {
+		t.finish(k, AuthSucceeded)
+	}
+}
+
+// Stop tracking a conversation
+func (t *AuthTracker) finish(k connKey, outcome string) {
+	st := t.convs[k]
+	if st == nil {
+		return
+	}
+	delete(t.convs, k)
+
+	st.evt.Outcome = outcome
+	t.done = append(t.done, st.evt)
+}
+
+// Forget conversations on connections that have been idle for too long
+func (t *AuthTracker) prune() {
+	if t.last.Sub(t.pruned) < connectionIdle {
+		return
+	}
+	for k, st := range t.convs {
+		if t.last.Sub(st.seen) > connectionIdle {
+			t.finish(k, AuthIncomplete)
+		}
+	}
+	t.pruned = t.last
+}
@@ -0,0 +1,205 @@
+package mongopacket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/phensley/mongopacket/pkg/protocol"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// A connection from the test client, see testEvent, whose messages are
+// sent 5ms apart
+type testConn struct {
+	t    testing.TB
+	port string
+	id   uint32
+	at   time.Duration
+}
+
+// A request sent by the client, with the values the stream sets
+func (c *testConn) send(body bson.D) *MongoEvent {
+	c.id++
+	e := testEvent(c.t, c.id, 0, c.at, body)
+	e.SrcPort = c.port
+	e.Auth = protocol.AuthOf(e.Op)
+	e.Shape = protocol.ShapeOf(e.Op)
+	c.at += 5 * time.Millisecond
+	return e
+}
+
+// The server's reply to a request
+func (c *testConn) answer(req *MongoEvent, body bson.D) *MongoEvent {
+	c.id++
+	e := testEvent(c.t, c.id, req.Op.GetHeader().RequestID, c.at, body)
+	e.DstPort = c.port
+	c.at += 5 * time.Millisecond
+	return e
+}
+
+// When the test clock reads at
+func testTime(at time.Duration) time.Time {
+	return time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC).Add(at)
+}
+
+func saslStart(mechanism, first string) bson.D {
+	return bson.D{
+		{Key: "saslStart", Value: int32(1)},
+		{Key: "mechanism", Value: mechanism},
+		{Key: "payload", Value: primitive.Binary{Data: []byte(first)}},
+	}
+}
+
+func saslContinue() bson.D {
+	return bson.D{
+		{Key: "saslContinue", Value: int32(1)},
+		{Key: "conversationId", Value: int32(1)},
+		{Key: "payload", Value: primitive.Binary{Data: []byte("c=biws,r=nonce,p=proof")}},
+		{Key: "$db", Value: "admin"},
+	}
+}
+
+func saslReply(done bool) bson.D {
+	return bson.D{
+		{Key: "conversationId", Value: int32(1)},
+		{Key: "done", Value: done},
+		{Key: "payload", Value: primitive.Binary{Data: []byte("r=nonce,s=salt,i=4096")}},
+		{Key: "ok", Value: 1.0},
+	}
+}
+
+func TestAuthTracker(t *testing.T) {
+	scram := append(saslStart("SCRAM-SHA-256", "n,,n=alice,r=nonce"), bson.E{Key: "$db", Value: "admin"})
+	hello := func(spec bson.D) bson.D {
+		return bson.D{
+			{Key: "hello", Value: int32(1)},
+			{Key: "speculativeAuthenticate", Value: spec},
+			{Key: "$db", Value: "admin"},
+		}
+	}
+	ok := bson.D{{Key: "ok", Value: 1.0}}
+
+	// Steps sent by the client, each with the server's reply
+	type step struct{ req, reply bson.D }
+	tests := []struct {
+		name  string
+		steps []step
+		want  AuthEvent
+	}{
+		{"SCRAM", []step{
+			{scram, saslReply(false)},
+			{saslContinue(), saslReply(false)},
+			{saslContinue(), saslReply(true)},
+		}, AuthEvent{Mechanism: "SCRAM-SHA-256", User: "alice", Database: "admin", RoundTrips: 3, Outcome: AuthSucceeded}},
+		{"rejected", []step{
+			{scram, bson.D{{Key: "ok", Value: 0.0}, {Key: "code", Value: int32(18)}, {Key: "codeName", Value: "AuthenticationFailed"}}},
+		}, AuthEvent{Mechanism: "SCRAM-SHA-256", User: "alice", Database: "admin", RoundTrips: 1, Outcome: AuthFailed,
+			ErrorCode: 18, ErrorName: "AuthenticationFailed"}},
+		{"MONGODB-CR", []step{
+			{bson.D{
+				{Key: "authenticate", Value: int32(1)},
+				{Key: "user", Value: "erin"},
+				{Key: "nonce", Value: "2375531c32080ae8"},
+				{Key: "key", Value: "21742f26431831d5cfca035a08c5bdf6"},
+				{Key: "$db", Value: "records"},
+			}, ok},
+		}, AuthEvent{User: "erin", Database: "records", RoundTrips: 1, Outcome: AuthSucceeded}},
+
+		// The handshake's reply continues the speculative conversation
+		{"speculative", []step{
+			{hello(append(saslStart("SCRAM-SHA-256", "n,,n=alice,r=nonce"), bson.E{Key: "db", Value: "admin"})),
+				bson.D{{Key: "isWritablePrimary", Value: true}, {Key: "speculativeAuthenticate", Value: saslReply(false)}, {Key: "ok", Value: 1.0}}},
+			{saslContinue(), saslReply(true)},
+		}, AuthEvent{Mechanism: "SCRAM-SHA-256", User: "alice", Database: "admin", Speculative: true, RoundTrips: 2, Outcome: AuthSucceeded}},
+		{"speculative X509", []step{
+			{hello(bson.D{
+				{Key: "authenticate", Value: int32(1)},
+				{Key: "mechanism", Value: "MONGODB-X509"},
+				{Key: "db", Value: "$external"},
+			}), bson.D{
+				{Key: "isWritablePrimary", Value: true},
+				{Key: "speculativeAuthenticate", Value: bson.D{{Key: "dbname", Value: "$external"}, {Key: "user", Value: "CN=client"}}},
+				{Key: "ok", Value: 1.0},
+			}},
+		}, AuthEvent{Mechanism: "MONGODB-X509", Database: "$external", Speculative: true, RoundTrips: 1, Outcome: AuthSucceeded}},
+
+		// The server ignores speculative authentication, and the driver
+		// starts over in full
+		{"speculative ignored", []step{
+			{hello(append(saslStart("SCRAM-SHA-256", "n,,n=alice,r=nonce"), bson.E{Key: "db", Value: "admin"})),
+				bson.D{{Key: "isWritablePrimary", Value: true}, {Key: "ok", Value: 1.0}}},
+			{append(saslStart("SCRAM-SHA-1", "n,,n=alice,r=nonce"), bson.E{Key: "$db", Value: "admin"}), saslReply(false)},
+			{saslContinue(), saslReply(true)},
+		}, AuthEvent{Mechanism: "SCRAM-SHA-1", User: "alice", Database: "admin", Speculative: true, RoundTrips: 3, Outcome: AuthSucceeded}},
+	}
+	for _, tt := range tests {
+		tr := NewAuthTracker()
+		c := &testConn{t: t, port: "50123"}
+		for _, s := range tt.steps {
+			req := c.send(s.req)
+			tr.Add(req, nil)
+			tr.Add(c.answer(req, s.reply), req)
+		}
+		done := tr.Close()
+		if len(done) != 1 {
+			t.Errorf("%s: %d conversations", tt.name, len(done))
+			continue
+		}
+		got := *done[0]
+		want := tt.want
+		want.SrcIP, want.SrcPort, want.DstIP, want.DstPort = "10.2.3.4", "50123", "10.1.0.9", "27017(mongodb)"
+		want.AppName = "shop"
+		want.Start = testTime(0)
+		want.End = testTime(c.at - 5*time.Millisecond)
+		if got != want {
+			t.Errorf("%s:\n got %+v\nwant %+v", tt.name, got, want)
+		}
+	}
+}
+
+// Conversations that aren't seen to finish
+func TestAuthTrackerIncomplete(t *testing.T) {
+	start := append(saslStart("SCRAM-SHA-256", "n,,n=alice,r=nonce"), bson.E{Key: "$db", Value: "admin"})
+	tr := NewAuthTracker()
+
+	// The connection closes before the server replies
+	a := &testConn{t: t, port: "50001"}
+	tr.Add(a.send(start), nil)
+	end := a.send(bson.D{{Key: "endSessions", Value: bson.A{}}, {Key: "$db", Value: "admin"}})
+	end.StreamEnd = 1
+	tr.Add(end, nil)
+
+	// The client starts over on the same connection
+	b := &testConn{t: t, port: "50002"}
+	tr.Add(b.send(start), nil)
+	tr.Add(b.send(start), nil)
+	outcomes := func(events []*AuthEvent) map[string]string {
+		got := map[string]string{}
+		for _, e := range events {
+			got[e.SrcPort] += e.Outcome + " "
+		}
+		return got
+	}
+	check := func(got, want map[string]string) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Errorf("ended %v, want %v", got, want)
+		}
+		for port, o := range want {
+			if got[port] != o {
+				t.Errorf("connection %s ended %q, want %q", port, got[port], o)
+			}
+		}
+	}
+	check(outcomes(tr.Finished()), map[string]string{"50001": "incomplete ", "50002": "incomplete "})
+
+	// Conversations left idle for longer than connectionIdle are dropped
+	// once a later event is seen, and one still open ends with the capture
+	c := &testConn{t: t, port: "50003", at: b.at}
+	tr.Add(c.send(start), nil)
+	d := &testConn{t: t, port: "50004", at: c.at + connectionIdle + time.Minute}
+	tr.Add(d.send(start), nil)
+	check(outcomes(tr.Finished()), map[string]string{"50002": "incomplete ", "50003": "incomplete "})
+	check(outcomes(tr.Close()), map[string]string{"50004": "capture_end "})
+}
@@ -5,12 +5,24 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/ClickHouse/clickhouse-go"
+	"github.com/ClickHouse/clickhouse-go/lib/data"
+	"github.com/phensley/mongopacket/pkg/protocol"
 )
 
 // Store packet and Mongo messages into Clickhouse
 
-const createPacketSQL = `
+// Tables are only created and changed by the migrations in migrate.go. Each
+// statement is named for the schema version that wrote it and is never
+// edited, so a database migrated by an older build is rebuilt the same way.
+
+// Packets and events as first written, before schema versioning, which are
+// recognized and rebuilt when found without a schema version
+const createPacketV0SQL = `
 CREATE TABLE IF NOT EXISTS mp_packets (
 	group String,
 	packet_id UInt64,
@@ -33,24 +45,34 @@ PRIMARY KEY (packet_id)
 ORDER BY (packet_id)
 `
 
-const insertPacketSQL = `
-INSERT INTO mp_packets (
-	group, packet_id, time, time_us,
-	seq, ack,
-	src, src_port, dst, dst_port,
-	flag_syn,	flag_fin,	flag_rst,	flag_psh,	flag_ack,
-	size
-)
-VALUES (
-	?, ?, ?, ?,
-	?, ?,
-	?, ?, ?, ?,
-	?, ?, ?, ?, ?,
-	?
-)
+const createEventV0SQL = `
+CREATE TABLE IF NOT EXISTS mp_events (
+	group String,
+	event_id UInt64,
+	start_time DateTime,
+	start_time_us UInt64,
+	end_time DateTime,
+	end_time_us UInt64,
+	stream_id UInt64,
+	stream_start UInt8,
+	stream_end UInt8,
+	request_id UInt32,
+	response_to UInt32,
+	src String,
+	src_port String,
+	dst String,
+	dst_port String,
+	opcode String,
+	op String,
+	packets String
+) ENGINE = MergeTree()
+PRIMARY KEY (event_id)
+ORDER BY (event_id)
 `
 
-const createEventSQL = `
+// Events as written once they had their outcomes, still without
+// DateTime64 times
+const createEventV0OutcomeSQL = `
 CREATE TABLE IF NOT EXISTS mp_events (
 	group String,
 	event_id UInt64,
@@ -69,67 +91,801 @@ CREATE TABLE IF NOT EXISTS mp_events (
 	dst_port String,
 	opcode String,
 	op String,
-	packets String
+	packets String,
+	app_name String,
+	driver String,
+	shape String,
+	shape_hash String,
+	ok Nullable(UInt8),
+	error_code Int64,
+	error_name String,
+	error_message String,
+	write_errors UInt32,
+	error_labels Array(String)
 ) ENGINE = MergeTree()
 PRIMARY KEY (event_id)
 ORDER BY (event_id)
 `
 
-const insertEventSQL = `
-INSERT INTO mp_events (
-	group, event_id,
-	start_time, start_time_us,
-	end_time, end_time_us,
-	stream_id, stream_start, stream_end,
-	request_id, response_to,
-	src, src_port, dst, dst_port,
-	opcode, op, packets
-) VALUES (
-	?, ?,
-	?, ?,
-	?, ?,
-	?, ?, ?,
-	?, ?,
-	?, ?, ?, ?,
-	?, ?, ?
-)
+// Schema version 1. Packets and events are partitioned by group and day,
+// so a capture can be dropped a partition at a time, and expired by the TTL
+// if one is set
+const createPacketV1SQL = `
+CREATE TABLE IF NOT EXISTS mp_packets (
+	group LowCardinality(String),
+	packet_id UInt64,
+	time DateTime64(6),
+	seq UInt32,
+	ack UInt32,
+	src String,
+	src_port String,
+	dst String,
+	dst_port String,
+	flag_syn UInt8,
+	flag_fin UInt8,
+	flag_rst UInt8,
+	flag_psh UInt8,
+	flag_ack UInt8,
+	size UInt32
+) ENGINE = MergeTree()
+PARTITION BY (group, toDate(time))
+ORDER BY (time, packet_id)
+`
+
+const createEventV1SQL = `
+CREATE TABLE IF NOT EXISTS mp_events (
+	group LowCardinality(String),
+	event_id UInt64,
+	start_time DateTime64(6),
+	end_time DateTime64(6),
+	stream_id UInt64,
+	stream_start UInt8,
+	stream_end UInt8,
+	request_id UInt32,
+	response_to UInt32,
+	src String,
+	src_port String,
+	dst String,
+	dst_port String,
+	opcode LowCardinality(String),
+	command LowCardinality(String),
+	namespace LowCardinality(String),
+	op String,
+	packets String,
+	app_name LowCardinality(String),
+	driver LowCardinality(String),
+	shape String,
+	shape_hash String,
+	ok Nullable(UInt8),
+	error_code Int64,
+	error_name LowCardinality(String),
+	error_message String,
+	write_errors UInt32,
+	error_labels Array(String)
+) ENGINE = MergeTree()
+PARTITION BY (group, toDate(start_time))
+ORDER BY (start_time, event_id)
+`
+
+const createShapeV1SQL = `
+CREATE TABLE IF NOT EXISTS mp_shapes (
+	group String,
+	shape_hash String,
+	command String,
+	namespace String,
+	shape String,
+	count UInt64,
+	replies UInt64,
+	errors UInt64,
+	total_us UInt64,
+	mean_us UInt64,
+	p50_us UInt64,
+	p90_us UInt64,
+	p99_us UInt64,
+	max_us UInt64
+) ENGINE = MergeTree()
+PRIMARY KEY (group, shape_hash)
+ORDER BY (group, shape_hash)
+`
+
+// The other records as version 1 created them, with DateTime columns and
+// their microseconds alongside
+const createDecodeErrorV1SQL = `
+CREATE TABLE IF NOT EXISTS mp_decode_errors (
+	group String,
+	event_id UInt64,
+	time DateTime,
+	time_us UInt64,
+	stream_id UInt64,
+	src String,
+	src_port String,
+	dst String,
+	dst_port String,
+	kind String,
+	opcode String,
+	offset Int32,
+	field String,
+	message_length Int32,
+	packets UInt32,
+	error String
+) ENGINE = MergeTree()
+PRIMARY KEY (event_id)
+ORDER BY (event_id)
+`
+
+const createCursorV1SQL = `
+CREATE TABLE IF NOT EXISTS mp_cursors (
+	group String,
+	cursor_id Int64,
+	stream_id UInt64,
+	src String,
+	src_port String,
+	dst String,
+	dst_port String,
+	namespace String,
+	command String,
+	start_time DateTime,
+	start_time_us UInt64,
+	end_time DateTime,
+	end_time_us UInt64,
+	batches UInt32,
+	documents UInt64,
+	idle_total_us UInt64,
+	idle_max_us UInt64,
+	end_reason String
+) ENGINE = MergeTree()
+PRIMARY KEY (start_time_us, cursor_id)
+ORDER BY (start_time_us, cursor_id)
+`
+
+const createTransactionV1SQL = `
+CREATE TABLE IF NOT EXISTS mp_transactions (
+	group String,
+	session_id String,
+	txn_number Int64,
+	stream_id UInt64,
+	src String,
+	src_port String,
+	dst String,
+	dst_port String,
+	start_time DateTime,
+	start_time_us UInt64,
+	commit_time_us UInt64,
+	end_time DateTime,
+	end_time_us UInt64,
+	started UInt8,
+	statement_count UInt32,
+	outcome String,
+	error_code Int64,
+	error_name String,
+	error_labels Array(String),
+	statements String
+) ENGINE = MergeTree()
+PRIMARY KEY (start_time_us, session_id, txn_number)
+ORDER BY (start_time_us, session_id, txn_number)
+`
+
+const createRetryV1SQL = `
+CREATE TABLE IF NOT EXISTS mp_retries (
+	group String,
+	session_id String,
+	txn_number Int64,
+	stmt_id Int32,
+	command String,
+	namespace String,
+	attempt UInt32,
+	time DateTime,
+	time_us UInt64,
+	request_id UInt32,
+	stream_id UInt64,
+	src String,
+	src_port String,
+	dst String,
+	dst_port String,
+	original_time_us UInt64,
+	original_request_id UInt32,
+	original_stream_id UInt64,
+	original_dst String,
+	original_dst_port String,
+	same_connection UInt8,
+	previous_replied UInt8,
+	previous_reply_time_us UInt64,
+	previous_error_code Int64,
+	previous_error_name String,
+	previous_error_labels Array(String)
+) ENGINE = MergeTree()
+PRIMARY KEY (time_us, session_id, txn_number)
+ORDER BY (time_us, session_id, txn_number)
+`
+
+const createRetryRateV1SQL = `
+CREATE VIEW IF NOT EXISTS mp_retry_rate AS
+SELECT group, time, count() AS retries
+FROM mp_retries
+GROUP BY group, time
+ORDER BY group, time
+`
+
+const createConnectionV1SQL = `
+CREATE TABLE IF NOT EXISTS mp_connections (
+	group String,
+	stream_id UInt64,
+	src String,
+	src_port String,
+	dst String,
+	dst_port String,
+	time DateTime,
+	time_us UInt64,
+	app_name String,
+	driver_name String,
+	driver_version String,
+	os_type String,
+	os_name String,
+	os_architecture String,
+	os_version String,
+	platform String,
+	requested_compression Array(String),
+	sasl_supported_mechs String,
+	replied UInt8,
+	max_wire_version Int64,
+	min_wire_version Int64,
+	compression Array(String),
+	connection_id Int64,
+	max_message_size_bytes Int64,
+	server_sasl_mechs Array(String)
+) ENGINE = MergeTree()
+PRIMARY KEY (time_us, stream_id)
+ORDER BY (time_us, stream_id)
+`
+
+const createAuthV1SQL = `
+CREATE TABLE IF NOT EXISTS mp_auth (
+	group String,
+	stream_id UInt64,
+	src String,
+	src_port String,
+	dst String,
+	dst_port String,
+	app_name String,
+	mechanism String,
+	user String,
+	database String,
+	speculative UInt8,
+	start_time DateTime,
+	start_time_us UInt64,
+	end_time_us UInt64,
+	duration_us UInt64,
+	round_trips UInt32,
+	outcome String,
+	error_code Int64,
+	error_name String
+) ENGINE = MergeTree()
+PRIMARY KEY (start_time_us, stream_id)
+ORDER BY (start_time_us, stream_id)
+`
+
+// Schema version 2. The other records are partitioned and ordered by time
+// like events
+const createDecodeErrorV2SQL = `
+CREATE TABLE IF NOT EXISTS mp_decode_errors (
+	group LowCardinality(String),
+	event_id UInt64,
+	time DateTime64(6),
+	stream_id UInt64,
+	src String,
+	src_port String,
+	dst String,
+	dst_port String,
+	kind LowCardinality(String),
+	opcode LowCardinality(String),
+	offset Int32,
+	field String,
+	message_length Int32,
+	packets UInt32,
+	error String
+) ENGINE = MergeTree()
+PARTITION BY (group, toDate(time))
+ORDER BY (time, event_id)
+`
+
+const createCursorV2SQL = `
+CREATE TABLE IF NOT EXISTS mp_cursors (
+	group LowCardinality(String),
+	cursor_id Int64,
+	stream_id UInt64,
+	src String,
+	src_port String,
+	dst String,
+	dst_port String,
+	namespace LowCardinality(String),
+	command LowCardinality(String),
+	start_time DateTime64(6),
+	end_time DateTime64(6),
+	batches UInt32,
+	documents UInt64,
+	idle_total_us UInt64,
+	idle_max_us UInt64,
+	end_reason LowCardinality(String)
+) ENGINE = MergeTree()
+PARTITION BY (group, toDate(start_time))
+ORDER BY (start_time, cursor_id)
+`
+
+const createTransactionV2SQL = `
+CREATE TABLE IF NOT EXISTS mp_transactions (
+	group LowCardinality(String),
+	session_id String,
+	txn_number Int64,
+	stream_id UInt64,
+	src String,
+	src_port String,
+	dst String,
+	dst_port String,
+	start_time DateTime64(6),
+	commit_time Nullable(DateTime64(6)),
+	end_time DateTime64(6),
+	started UInt8,
+	statement_count UInt32,
+	outcome LowCardinality(String),
+	error_code Int64,
+	error_name LowCardinality(String),
+	error_labels Array(String),
+	statements String
+) ENGINE = MergeTree()
+PARTITION BY (group, toDate(start_time))
+ORDER BY (start_time, session_id, txn_number)
+`
+
+const createRetryV2SQL = `
+CREATE TABLE IF NOT EXISTS mp_retries (
+	group LowCardinality(String),
+	session_id String,
+	txn_number Int64,
+	stmt_id Int32,
+	command LowCardinality(String),
+	namespace LowCardinality(String),
+	attempt UInt32,
+	time DateTime64(6),
+	request_id UInt32,
+	stream_id UInt64,
+	src String,
+	src_port String,
+	dst String,
+	dst_port String,
+	original_time DateTime64(6),
+	original_request_id UInt32,
+	original_stream_id UInt64,
+	original_dst String,
+	original_dst_port String,
+	same_connection UInt8,
+	previous_replied UInt8,
+	previous_reply_time Nullable(DateTime64(6)),
+	previous_error_code Int64,
+	previous_error_name LowCardinality(String),
+	previous_error_labels Array(String)
+) ENGINE = MergeTree()
+PARTITION BY (group, toDate(time))
+ORDER BY (time, session_id, txn_number)
 `
 
-// Clickhouse database connection state
+// Retries per second, to gauge the load generated by a failover
+const createRetryRateV2SQL = `
+CREATE VIEW IF NOT EXISTS mp_retry_rate AS
+SELECT group, toStartOfSecond(time) AS second, count() AS retries
+FROM mp_retries
+GROUP BY group, second
+ORDER BY group, second
+`
+
+const createConnectionV2SQL = `
+CREATE TABLE IF NOT EXISTS mp_connections (
+	group LowCardinality(String),
+	stream_id UInt64,
+	src String,
+	src_port String,
+	dst String,
+	dst_port String,
+	time DateTime64(6),
+	app_name LowCardinality(String),
+	driver_name LowCardinality(String),
+	driver_version LowCardinality(String),
+	os_type LowCardinality(String),
+	os_name LowCardinality(String),
+	os_architecture LowCardinality(String),
+	os_version LowCardinality(String),
+	platform LowCardinality(String),
+	requested_compression Array(String),
+	sasl_supported_mechs String,
+	replied UInt8,
+	max_wire_version Int64,
+	min_wire_version Int64,
+	compression Array(String),
+	connection_id Int64,
+	max_message_size_bytes Int64,
+	server_sasl_mechs Array(String)
+) ENGINE = MergeTree()
+PARTITION BY (group, toDate(time))
+ORDER BY (time, stream_id)
+`
+
+const createAuthV2SQL = `
+CREATE TABLE IF NOT EXISTS mp_auth (
+	group LowCardinality(String),
+	stream_id UInt64,
+	src String,
+	src_port String,
+	dst String,
+	dst_port String,
+	app_name LowCardinality(String),
+	mechanism LowCardinality(String),
+	user String,
+	database LowCardinality(String),
+	speculative UInt8,
+	start_time DateTime64(6),
+	end_time DateTime64(6),
+	duration_us UInt64,
+	round_trips UInt32,
+	outcome LowCardinality(String),
+	error_code Int64,
+	error_name LowCardinality(String)
+) ENGINE = MergeTree()
+PARTITION BY (group, toDate(start_time))
+ORDER BY (start_time, stream_id)
+`
+
+// Schema version 3. Shapes are partitioned by group and the day of their
+// first request like the other records
+const createShapeV3SQL = `
+CREATE TABLE IF NOT EXISTS mp_shapes (
+	group LowCardinality(String),
+	shape_hash String,
+	command LowCardinality(String),
+	namespace LowCardinality(String),
+	shape String,
+	first_time DateTime64(6),
+	last_time DateTime64(6),
+	count UInt64,
+	replies UInt64,
+	errors UInt64,
+	total_us UInt64,
+	mean_us UInt64,
+	p50_us UInt64,
+	p90_us UInt64,
+	p99_us UInt64,
+	max_us UInt64
+) ENGINE = MergeTree()
+PARTITION BY (group, toDate(first_time))
+ORDER BY (first_time, shape_hash)
+`
+
+// ClickhouseOptions ..
+type ClickhouseOptions struct {
+	TTL     time.Duration // packets and events older than this are dropped, 0 to keep them
+	Inserts int           // batches inserted in parallel, 2 if 0
+}
+
+// Clickhouse database connection state. Batches are inserted in the
+// background while decoding carries on; a failed insert is returned by the
+// next Save or Flush.
 type Clickhouse struct {
-	db *sql.DB
+	db          *sql.DB
+	dsn         string
+	columns     *Columns
+	migrated    []SchemaMigration
+	insertEvent string // insert into mp_events with the user-defined columns
+
+	inserts chan func(conn clickhouse.Clickhouse) error
+	pending sync.WaitGroup // batches queued or being inserted
+	workers sync.WaitGroup
+	lock    sync.Mutex
+	err     error // first failed insert
+
+	// OpJSON selects the Extended JSON mode used to store ops
+	OpJSON protocol.ExtJSONMode
 }
 
-// NewClickhouse ..
-func NewClickhouse(url string) (*Clickhouse, error) {
-	db, err := sql.Open("clickhouse", url)
+// NewClickhouse creates the tables or migrates them to the latest schema
+// version. The user-defined columns, if any, are added to mp_events.
+func NewClickhouse(url string, opts ClickhouseOptions, columns *Columns) (*Clickhouse, error) {
+	dsn := clickhouseDSN(url)
+	db, err := sql.Open("clickhouse", dsn)
 	if err != nil {
 		return nil, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	ping, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
+	if err = db.PingContext(ping); err != nil {
+		db.Close()
+		return nil, err
+	}
 
-	// Creating the tables if they don't exist
-	if err = execute(ctx, db, createPacketSQL, nil); err != nil {
-		fmt.Println("FAIL", err)
+	// Creating or upgrading the tables, which may copy every row of a
+	// rebuilt table, so it isn't given a deadline
+	ctx := context.Background()
+	migrated, err := migrateSchema(ctx, db, clickhouseDialect, clickhouseMigrations, chTables)
+	if err != nil {
+		db.Close()
 		return nil, err
 	}
-	if err = execute(ctx, db, createEventSQL, nil); err != nil {
+	names, types := columns.Names(), columns.clickhouseTypes()
+	for i, name := range names {
+		alter := fmt.Sprintf("ALTER TABLE mp_events ADD COLUMN IF NOT EXISTS %s %s", name, types[i])
+		if err = execute(ctx, db, alter, nil); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	if err = clickhouseTTL(ctx, db, "mp_packets", "time", opts.TTL); err != nil {
+		db.Close()
 		return nil, err
 	}
+	if err = clickhouseTTL(ctx, db, "mp_events", "start_time", opts.TTL); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	n := opts.Inserts
+	if n <= 0 {
+		n = 2
+	}
+	c := &Clickhouse{
+		db:          db,
+		dsn:         dsn,
+		columns:     columns,
+		migrated:    migrated,
+		insertEvent: insertColumnarSQL("mp_events", append(schemaNames(chTables["mp_events"]), names...)),
+		inserts:     make(chan func(clickhouse.Clickhouse) error, n),
+	}
+	c.workers.Add(n)
+	for i := 0; i < n; i++ {
+		go c.insertLoop()
+	}
+	return c, nil
+}
+
+// Sets the TTL of a table on its time column, or removes it when the TTL is
+// 0, so a TTL set by an earlier run doesn't keep expiring rows
+func clickhouseTTL(ctx context.Context, db *sql.DB, table, column string, ttl time.Duration) error {
+	if ttl > 0 {
+		alter := fmt.Sprintf("ALTER TABLE %s MODIFY TTL toDateTime(%s) + toIntervalSecond(%d)", table, column, int64(ttl/time.Second))
+		return execute(ctx, db, alter, nil)
+	}
 
-	return &Clickhouse{db: db}, nil
+	// Removing a TTL from a table without one is an error
+	var engine string
+	err := db.QueryRowContext(ctx,
+		"SELECT engine_full FROM system.tables WHERE database = currentDatabase() AND name = ?", table).Scan(&engine)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(engine, " TTL ") {
+		return nil
+	}
+	return execute(ctx, db, fmt.Sprintf("ALTER TABLE %s REMOVE TTL", table), nil)
+}
+
+// The driver's native protocol predates LowCardinality columns, so ask the
+// server to exchange them as their ordinary types
+func clickhouseDSN(url string) string {
+	if strings.Contains(url, "low_cardinality_allow_in_native_format") {
+		return url
+	}
+	sep := "?"
+	if strings.Contains(url, "?") {
+		sep = "&"
+	}
+	return url + sep + "low_cardinality_allow_in_native_format=0"
+}
+
+// Inserts queued batches, each worker over its own native connection
+func (c *Clickhouse) insertLoop() {
+	defer c.workers.Done()
+	var conn clickhouse.Clickhouse
+	for insert := range c.inserts {
+		var err error
+		if conn == nil {
+			conn, err = clickhouse.OpenDirect(c.dsn)
+		}
+		if err == nil {
+			err = insert(conn)
+		}
+		if err != nil {
+			c.fail(err)
+
+			// Start over with a new connection, in case the failed one
+			// is left mid-insert
+			if conn != nil {
+				conn.Close()
+				conn = nil
+			}
+		}
+		c.pending.Done()
+	}
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// Queues a batch for insert, returning the error of an earlier failed
+// insert
+func (c *Clickhouse) queue(insert func(conn clickhouse.Clickhouse) error) error {
+	c.pending.Add(1)
+	c.inserts <- insert
+	return c.failed()
+}
+
+// Queues a batch written to a block a column at a time, write writing
+// column i of row j
+func (c *Clickhouse) queueBlock(insertSQL string, columns, rows int, write func(b *data.Block, i, j int) error) error {
+	if rows == 0 {
+		return c.failed()
+	}
+	return c.queue(func(conn clickhouse.Clickhouse) error {
+		return insertBlock(conn, insertSQL, rows, func(b *data.Block) error {
+			for i := 0; i < columns; i++ {
+				for j := 0; j < rows; j++ {
+					if err := write(b, i, j); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+	})
+}
+
+func (c *Clickhouse) fail(err error) {
+	c.lock.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.lock.Unlock()
+}
+
+func (c *Clickhouse) failed() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+// Writes a batch as one block, filled a column at a time
+func insertBlock(conn clickhouse.Clickhouse, insertSQL string, rows int, write func(block *data.Block) error) error {
+	if _, err := conn.Begin(); err != nil {
+		return err
+	}
+	if _, err := conn.Prepare(insertSQL); err != nil {
+		conn.Rollback()
+		return err
+	}
+	block, err := conn.Block()
+	if err != nil {
+		conn.Rollback()
+		return err
+	}
+	block.Reserve()
+	block.NumRows += uint64(rows)
+	if err = write(block); err != nil {
+		conn.Rollback()
+		return err
+	}
+	return conn.Commit()
+}
+
+// An insert statement for the named columns
+func insertColumnarSQL(table string, names []string) string {
+	return fmt.Sprintf("INSERT INTO %s (%s)", table, strings.Join(names, ", "))
+}
+
+// The columns of a table, given the name and type of column i
+func tableSchema(n int, column func(i int) (string, string)) []schemaColumn {
+	cols := make([]schemaColumn, n)
+	for i := range cols {
+		cols[i].name, cols[i].typ = column(i)
+	}
+	return cols
+}
+
+// Tables and the columns written to them, which are checked when the
+// database is opened
+var chTables = map[string][]schemaColumn{
+	"mp_packets":       tableSchema(len(chPacketColumns), func(i int) (string, string) { return chPacketColumns[i].name, chPacketColumns[i].typ }),
+	"mp_events":        tableSchema(len(chEventColumns), func(i int) (string, string) { return chEventColumns[i].name, chEventColumns[i].typ }),
+	"mp_decode_errors": tableSchema(len(chDecodeErrorColumns), func(i int) (string, string) { return chDecodeErrorColumns[i].name, chDecodeErrorColumns[i].typ }),
+	"mp_cursors":       tableSchema(len(chCursorColumns), func(i int) (string, string) { return chCursorColumns[i].name, chCursorColumns[i].typ }),
+	"mp_transactions":  tableSchema(len(chTransactionColumns), func(i int) (string, string) { return chTransactionColumns[i].name, chTransactionColumns[i].typ }),
+	"mp_retries":       tableSchema(len(chRetryColumns), func(i int) (string, string) { return chRetryColumns[i].name, chRetryColumns[i].typ }),
+	"mp_connections":   tableSchema(len(chConnectionColumns), func(i int) (string, string) { return chConnectionColumns[i].name, chConnectionColumns[i].typ }),
+	"mp_auth":          tableSchema(len(chAuthColumns), func(i int) (string, string) { return chAuthColumns[i].name, chAuthColumns[i].typ }),
+	"mp_shapes":        tableSchema(len(chShapeColumns), func(i int) (string, string) { return chShapeColumns[i].name, chShapeColumns[i].typ }),
+}
+
+// A mongo event with its values ready to be written to a block
+type chEvent struct {
+	*MongoEvent
+	header             *protocol.Header
+	command, namespace string
+	op, packets        string
+	shape, hash        string
+	ok                 *uint8
+	code               int64
+	name, message      string
+	writeErrors        uint32
+	labels             []string
+}
+
+// Columns of mp_events, in insert order, followed by the user-defined columns
+var chEventColumns = []struct {
+	name  string
+	typ   string
+	write func(b *data.Block, c int, e *chEvent) error
+}{
+	{"group", "LowCardinality(String)", func(b *data.Block, c int, e *chEvent) error { return b.WriteString(c, e.Group) }},
+	{"event_id", "UInt64", func(b *data.Block, c int, e *chEvent) error { return b.WriteUInt64(c, e.EventID) }},
+	{"start_time", "DateTime64(6)", func(b *data.Block, c int, e *chEvent) error { return b.WriteInt64(c, micros(e.Start)) }},
+	{"end_time", "DateTime64(6)", func(b *data.Block, c int, e *chEvent) error { return b.WriteInt64(c, micros(e.End)) }},
+	{"stream_id", "UInt64", func(b *data.Block, c int, e *chEvent) error { return b.WriteUInt64(c, e.StreamID) }},
+	{"stream_start", "UInt8", func(b *data.Block, c int, e *chEvent) error { return b.WriteUInt8(c, e.StreamStart) }},
+	{"stream_end", "UInt8", func(b *data.Block, c int, e *chEvent) error { return b.WriteUInt8(c, e.StreamEnd) }},
+	{"request_id", "UInt32", func(b *data.Block, c int, e *chEvent) error { return b.WriteUInt32(c, e.header.RequestID) }},
+	{"response_to", "UInt32", func(b *data.Block, c int, e *chEvent) error { return b.WriteUInt32(c, e.header.ResponseTo) }},
+	{"src", "String", func(b *data.Block, c int, e *chEvent) error { return b.WriteString(c, e.SrcIP) }},
+	{"src_port", "String", func(b *data.Block, c int, e *chEvent) error { return b.WriteString(c, e.SrcPort) }},
+	{"dst", "String", func(b *data.Block, c int, e *chEvent) error { return b.WriteString(c, e.DstIP) }},
+	{"dst_port", "String", func(b *data.Block, c int, e *chEvent) error { return b.WriteString(c, e.DstPort) }},
+	{"opcode", "LowCardinality(String)", func(b *data.Block, c int, e *chEvent) error { return b.WriteString(c, e.header.Type().String()) }},
+	{"command", "LowCardinality(String)", func(b *data.Block, c int, e *chEvent) error { return b.WriteString(c, e.command) }},
+	{"namespace", "LowCardinality(String)", func(b *data.Block, c int, e *chEvent) error { return b.WriteString(c, e.namespace) }},
+	{"op", "String", func(b *data.Block, c int, e *chEvent) error { return b.WriteString(c, e.op) }},
+	{"packets", "String", func(b *data.Block, c int, e *chEvent) error { return b.WriteString(c, e.packets) }},
+	{"app_name", "LowCardinality(String)", func(b *data.Block, c int, e *chEvent) error { return b.WriteString(c, e.AppName) }},
+	{"driver", "LowCardinality(String)", func(b *data.Block, c int, e *chEvent) error { return b.WriteString(c, e.Driver) }},
+	{"shape", "String", func(b *data.Block, c int, e *chEvent) error { return b.WriteString(c, e.shape) }},
+	{"shape_hash", "String", func(b *data.Block, c int, e *chEvent) error { return b.WriteString(c, e.hash) }},
+	{"ok", "Nullable(UInt8)", func(b *data.Block, c int, e *chEvent) error { return b.WriteUInt8Nullable(c, e.ok) }},
+	{"error_code", "Int64", func(b *data.Block, c int, e *chEvent) error { return b.WriteInt64(c, e.code) }},
+	{"error_name", "LowCardinality(String)", func(b *data.Block, c int, e *chEvent) error { return b.WriteString(c, e.name) }},
+	{"error_message", "String", func(b *data.Block, c int, e *chEvent) error { return b.WriteString(c, e.message) }},
+	{"write_errors", "UInt32", func(b *data.Block, c int, e *chEvent) error { return b.WriteUInt32(c, e.writeErrors) }},
+	{"error_labels", "Array(String)", func(b *data.Block, c int, e *chEvent) error { return b.WriteArray(c, e.labels) }},
+}
+
+// Writes a user-defined column. Times are stored as DateTime64(6), which
+// has the same encoding as microseconds.
+func (c *Columns) writeClickhouse(b *data.Block, col, i int, v interface{}) error {
+	switch c.cols[i].Type {
+	case ColumnString:
+		s, ok := v.(string)
+		if !ok {
+			return b.WriteStringNullable(col, nil)
+		}
+		return b.WriteStringNullable(col, &s)
+	case ColumnFloat:
+		f, ok := v.(float64)
+		if !ok {
+			return b.WriteFloat64Nullable(col, nil)
+		}
+		return b.WriteFloat64Nullable(col, &f)
+	case ColumnBool:
+		x, ok := v.(bool)
+		if !ok {
+			return b.WriteUInt8Nullable(col, nil)
+		}
+		u := boolInt(x)
+		return b.WriteUInt8Nullable(col, &u)
+	}
+	n, ok := columnValue(v, false).(int64)
+	if !ok {
+		return b.WriteInt64Nullable(col, nil)
+	}
+	return b.WriteInt64Nullable(col, &n)
 }
 
 // SaveMongoEvents ..
 func (c *Clickhouse) SaveMongoEvents(events []*MongoEvent) error {
-	var rows [][]interface{}
+	var rows []*chEvent
 	for _, e := range events {
-		start := e.Start.UnixNano() / 1e3
-		end := e.End.UnixNano() / 1e3
-
-		op, err := json.Marshal(e.Op)
+		op, err := protocol.MarshalExtJSON(e.Op, c.OpJSON)
 		if err != nil {
 			fmt.Println("error json-encoding mongo operation", err)
 			continue
@@ -140,55 +896,427 @@ func (c *Clickhouse) SaveMongoEvents(events []*MongoEvent) error {
 			continue
 		}
 
-		rows = append(rows, []interface{}{
-			e.Group,
-			e.EventID,
-			start / 1e6,
-			start,
-			end / 1e6,
-			end,
-			e.StreamID, e.StreamStart, e.StreamEnd,
-			e.Op.GetHeader().RequestID, e.Op.GetHeader().ResponseTo,
-			e.SrcIP, e.SrcPort, e.DstIP, e.DstPort,
-			e.Op.GetHeader().OpCode.String(),
-			string(op),
-			string(pkts),
-		})
+		row := &chEvent{
+			MongoEvent: e,
+			header:     e.Op.GetHeader(),
+			op:         string(op),
+			packets:    string(pkts),
+			labels:     []string{},
+		}
+		row.command, row.namespace = commandNamespace(e.Op)
+		if e.Shape != nil {
+			row.shape, row.hash = e.Shape.Shape, e.Shape.Hash
+		}
 
+		// Requests have no outcome, leaving ok null
+		if o := e.Outcome; o != nil {
+			ok := boolInt(o.OK)
+			row.ok = &ok
+			row.code, row.name, row.message = o.Code, o.CodeName, o.Message
+			row.writeErrors = uint32(o.WriteErrors)
+			if o.ErrorLabels != nil {
+				row.labels = o.ErrorLabels
+			}
+		}
+		rows = append(rows, row)
 	}
-	return execute(context.Background(), c.db, insertEventSQL, rows)
+
+	// The user-defined columns follow
+	columns := len(chEventColumns) + len(c.columns.Names())
+	return c.queueBlock(c.insertEvent, columns, len(rows), func(b *data.Block, i, j int) error {
+		e := rows[j]
+		if i < len(chEventColumns) {
+			return chEventColumns[i].write(b, i, e)
+		}
+		var v interface{}
+		if u := i - len(chEventColumns); u < len(e.Columns) {
+			v = e.Columns[u]
+		}
+		return c.columns.writeClickhouse(b, i, i-len(chEventColumns), v)
+	})
 }
 
+// Columns of mp_packets, in insert order
+var chPacketColumns = []struct {
+	name  string
+	typ   string
+	write func(b *data.Block, c int, p *PacketEvent) error
+}{
+	{"group", "LowCardinality(String)", func(b *data.Block, c int, p *PacketEvent) error { return b.WriteString(c, p.Group) }},
+	{"packet_id", "UInt64", func(b *data.Block, c int, p *PacketEvent) error { return b.WriteUInt64(c, p.PacketID) }},
+	{"time", "DateTime64(6)", func(b *data.Block, c int, p *PacketEvent) error { return b.WriteInt64(c, micros(p.Time)) }},
+	{"seq", "UInt32", func(b *data.Block, c int, p *PacketEvent) error { return b.WriteUInt32(c, p.Seq) }},
+	{"ack", "UInt32", func(b *data.Block, c int, p *PacketEvent) error { return b.WriteUInt32(c, p.Ack) }},
+	{"src", "String", func(b *data.Block, c int, p *PacketEvent) error { return b.WriteString(c, p.SrcIP) }},
+	{"src_port", "String", func(b *data.Block, c int, p *PacketEvent) error { return b.WriteString(c, p.SrcPort) }},
+	{"dst", "String", func(b *data.Block, c int, p *PacketEvent) error { return b.WriteString(c, p.DstIP) }},
+	{"dst_port", "String", func(b *data.Block, c int, p *PacketEvent) error { return b.WriteString(c, p.DstPort) }},
+	{"flag_syn", "UInt8", func(b *data.Block, c int, p *PacketEvent) error { return b.WriteUInt8(c, p.FlagSYN) }},
+	{"flag_fin", "UInt8", func(b *data.Block, c int, p *PacketEvent) error { return b.WriteUInt8(c, p.FlagFIN) }},
+	{"flag_rst", "UInt8", func(b *data.Block, c int, p *PacketEvent) error { return b.WriteUInt8(c, p.FlagRST) }},
+	{"flag_psh", "UInt8", func(b *data.Block, c int, p *PacketEvent) error { return b.WriteUInt8(c, p.FlagPSH) }},
+	{"flag_ack", "UInt8", func(b *data.Block, c int, p *PacketEvent) error { return b.WriteUInt8(c, p.FlagACK) }},
+	{"size", "UInt32", func(b *data.Block, c int, p *PacketEvent) error { return b.WriteUInt32(c, uint32(p.SizeTCP)) }},
+}
+
+var insertPacketSQL = insertColumnarSQL("mp_packets",
+	schemaNames(chTables["mp_packets"]))
+
 // SavePacketEvents ..
 func (c *Clickhouse) SavePacketEvents(packets []*PacketEvent) error {
-	var rows [][]interface{}
-	for _, p := range packets {
-		t := p.Time.UnixNano() / 1e3
-		rows = append(rows, []interface{}{
-			p.Group,
-			p.PacketID,
-			t / 1e6,
-			t,
-			p.Seq,
-			p.Ack,
-			p.SrcIP,
-			p.SrcPort,
-			p.DstIP,
-			p.DstPort,
-			p.FlagSYN,
-			p.FlagFIN,
-			p.FlagRST,
-			p.FlagPSH,
-			p.FlagACK,
-			p.SizeTCP,
-		})
+	// The caller reuses the slice for the next batch
+	rows := append([]*PacketEvent(nil), packets...)
+	return c.queueBlock(insertPacketSQL, len(chPacketColumns), len(rows), func(b *data.Block, i, j int) error {
+		return chPacketColumns[i].write(b, i, rows[j])
+	})
+}
+
+// Columns of mp_decode_errors, in insert order
+var chDecodeErrorColumns = []struct {
+	name  string
+	typ   string
+	write func(b *data.Block, c int, e *DecodeErrorEvent) error
+}{
+	{"group", "LowCardinality(String)", func(b *data.Block, c int, e *DecodeErrorEvent) error { return b.WriteString(c, e.Group) }},
+	{"event_id", "UInt64", func(b *data.Block, c int, e *DecodeErrorEvent) error { return b.WriteUInt64(c, e.EventID) }},
+	{"time", "DateTime64(6)", func(b *data.Block, c int, e *DecodeErrorEvent) error { return b.WriteInt64(c, micros(e.Time)) }},
+	{"stream_id", "UInt64", func(b *data.Block, c int, e *DecodeErrorEvent) error { return b.WriteUInt64(c, e.StreamID) }},
+	{"src", "String", func(b *data.Block, c int, e *DecodeErrorEvent) error { return b.WriteString(c, e.SrcIP) }},
+	{"src_port", "String", func(b *data.Block, c int, e *DecodeErrorEvent) error { return b.WriteString(c, e.SrcPort) }},
+	{"dst", "String", func(b *data.Block, c int, e *DecodeErrorEvent) error { return b.WriteString(c, e.DstIP) }},
+	{"dst_port", "String", func(b *data.Block, c int, e *DecodeErrorEvent) error { return b.WriteString(c, e.DstPort) }},
+	{"kind", "LowCardinality(String)", func(b *data.Block, c int, e *DecodeErrorEvent) error { return b.WriteString(c, e.Kind) }},
+	{"opcode", "LowCardinality(String)", func(b *data.Block, c int, e *DecodeErrorEvent) error { return b.WriteString(c, e.OpCode) }},
+	{"offset", "Int32", func(b *data.Block, c int, e *DecodeErrorEvent) error { return b.WriteInt32(c, int32(e.Offset)) }},
+	{"field", "String", func(b *data.Block, c int, e *DecodeErrorEvent) error { return b.WriteString(c, e.Field) }},
+	{"message_length", "Int32", func(b *data.Block, c int, e *DecodeErrorEvent) error { return b.WriteInt32(c, int32(e.MessageLength)) }},
+	{"packets", "UInt32", func(b *data.Block, c int, e *DecodeErrorEvent) error { return b.WriteUInt32(c, uint32(e.Packets)) }},
+	{"error", "String", func(b *data.Block, c int, e *DecodeErrorEvent) error { return b.WriteString(c, e.Error) }},
+}
+
+var insertDecodeErrorSQL = insertColumnarSQL("mp_decode_errors",
+	schemaNames(chTables["mp_decode_errors"]))
+
+// SaveDecodeErrors ..
+func (c *Clickhouse) SaveDecodeErrors(errors []*DecodeErrorEvent) error {
+	rows := append([]*DecodeErrorEvent(nil), errors...)
+	return c.queueBlock(insertDecodeErrorSQL, len(chDecodeErrorColumns), len(rows), func(b *data.Block, i, j int) error {
+		return chDecodeErrorColumns[i].write(b, i, rows[j])
+	})
+}
+
+// Columns of mp_cursors, in insert order
+var chCursorColumns = []struct {
+	name  string
+	typ   string
+	write func(b *data.Block, c int, e *CursorEvent) error
+}{
+	{"group", "LowCardinality(String)", func(b *data.Block, c int, e *CursorEvent) error { return b.WriteString(c, e.Group) }},
+	{"cursor_id", "Int64", func(b *data.Block, c int, e *CursorEvent) error { return b.WriteInt64(c, e.CursorID) }},
+	{"stream_id", "UInt64", func(b *data.Block, c int, e *CursorEvent) error { return b.WriteUInt64(c, e.StreamID) }},
+	{"src", "String", func(b *data.Block, c int, e *CursorEvent) error { return b.WriteString(c, e.SrcIP) }},
+	{"src_port", "String", func(b *data.Block, c int, e *CursorEvent) error { return b.WriteString(c, e.SrcPort) }},
+	{"dst", "String", func(b *data.Block, c int, e *CursorEvent) error { return b.WriteString(c, e.DstIP) }},
+	{"dst_port", "String", func(b *data.Block, c int, e *CursorEvent) error { return b.WriteString(c, e.DstPort) }},
+	{"namespace", "LowCardinality(String)", func(b *data.Block, c int, e *CursorEvent) error { return b.WriteString(c, e.Namespace) }},
+	{"command", "LowCardinality(String)", func(b *data.Block, c int, e *CursorEvent) error { return b.WriteString(c, e.Command) }},
+	{"start_time", "DateTime64(6)", func(b *data.Block, c int, e *CursorEvent) error { return b.WriteInt64(c, micros(e.Start)) }},
+	{"end_time", "DateTime64(6)", func(b *data.Block, c int, e *CursorEvent) error { return b.WriteInt64(c, micros(e.End)) }},
+	{"batches", "UInt32", func(b *data.Block, c int, e *CursorEvent) error { return b.WriteUInt32(c, uint32(e.Batches)) }},
+	{"documents", "UInt64", func(b *data.Block, c int, e *CursorEvent) error { return b.WriteUInt64(c, uint64(e.Documents)) }},
+	{"idle_total_us", "UInt64", func(b *data.Block, c int, e *CursorEvent) error {
+		return b.WriteUInt64(c, uint64(e.IdleTotal.Microseconds()))
+	}},
+	{"idle_max_us", "UInt64", func(b *data.Block, c int, e *CursorEvent) error {
+		return b.WriteUInt64(c, uint64(e.IdleMax.Microseconds()))
+	}},
+	{"end_reason", "LowCardinality(String)", func(b *data.Block, c int, e *CursorEvent) error { return b.WriteString(c, e.EndReason) }},
+}
+
+var insertCursorSQL = insertColumnarSQL("mp_cursors",
+	schemaNames(chTables["mp_cursors"]))
+
+// SaveCursorEvents ..
+func (c *Clickhouse) SaveCursorEvents(cursors []*CursorEvent) error {
+	rows := append([]*CursorEvent(nil), cursors...)
+	return c.queueBlock(insertCursorSQL, len(chCursorColumns), len(rows), func(b *data.Block, i, j int) error {
+		return chCursorColumns[i].write(b, i, rows[j])
+	})
+}
+
+// A transaction with its statements encoded as JSON
+type chTransaction struct {
+	*TransactionEvent
+	statements string
+}
+
+// Columns of mp_transactions, in insert order
+var chTransactionColumns = []struct {
+	name  string
+	typ   string
+	write func(b *data.Block, c int, e *chTransaction) error
+}{
+	{"group", "LowCardinality(String)", func(b *data.Block, c int, e *chTransaction) error { return b.WriteString(c, e.Group) }},
+	{"session_id", "String", func(b *data.Block, c int, e *chTransaction) error { return b.WriteString(c, e.SessionID) }},
+	{"txn_number", "Int64", func(b *data.Block, c int, e *chTransaction) error { return b.WriteInt64(c, e.TxnNumber) }},
+	{"stream_id", "UInt64", func(b *data.Block, c int, e *chTransaction) error { return b.WriteUInt64(c, e.StreamID) }},
+	{"src", "String", func(b *data.Block, c int, e *chTransaction) error { return b.WriteString(c, e.SrcIP) }},
+	{"src_port", "String", func(b *data.Block, c int, e *chTransaction) error { return b.WriteString(c, e.SrcPort) }},
+	{"dst", "String", func(b *data.Block, c int, e *chTransaction) error { return b.WriteString(c, e.DstIP) }},
+	{"dst_port", "String", func(b *data.Block, c int, e *chTransaction) error { return b.WriteString(c, e.DstPort) }},
+	{"start_time", "DateTime64(6)", func(b *data.Block, c int, e *chTransaction) error { return b.WriteInt64(c, micros(e.Start)) }},
+	{"commit_time", "Nullable(DateTime64(6))", func(b *data.Block, c int, e *chTransaction) error {
+		return b.WriteInt64Nullable(c, nullableMicros(e.CommitStart, !e.CommitStart.IsZero()))
+	}},
+	{"end_time", "DateTime64(6)", func(b *data.Block, c int, e *chTransaction) error { return b.WriteInt64(c, micros(e.End)) }},
+	{"started", "UInt8", func(b *data.Block, c int, e *chTransaction) error { return b.WriteUInt8(c, boolInt(e.Started)) }},
+	{"statement_count", "UInt32", func(b *data.Block, c int, e *chTransaction) error {
+		return b.WriteUInt32(c, uint32(len(e.Statements)))
+	}},
+	{"outcome", "LowCardinality(String)", func(b *data.Block, c int, e *chTransaction) error { return b.WriteString(c, e.Outcome) }},
+	{"error_code", "Int64", func(b *data.Block, c int, e *chTransaction) error { return b.WriteInt64(c, e.ErrorCode) }},
+	{"error_name", "LowCardinality(String)", func(b *data.Block, c int, e *chTransaction) error { return b.WriteString(c, e.ErrorName) }},
+	{"error_labels", "Array(String)", func(b *data.Block, c int, e *chTransaction) error {
+		return b.WriteArray(c, stringArray(e.ErrorLabels))
+	}},
+	{"statements", "String", func(b *data.Block, c int, e *chTransaction) error { return b.WriteString(c, e.statements) }},
+}
+
+var insertTransactionSQL = insertColumnarSQL("mp_transactions",
+	schemaNames(chTables["mp_transactions"]))
+
+// SaveTransactionEvents ..
+func (c *Clickhouse) SaveTransactionEvents(txns []*TransactionEvent) error {
+	var rows []*chTransaction
+	for _, e := range txns {
+		stmts, err := json.Marshal(e.Statements)
+		if err != nil {
+			fmt.Println("error json-encoding transaction statements", err)
+			continue
+		}
+		rows = append(rows, &chTransaction{TransactionEvent: e, statements: string(stmts)})
 	}
-	return execute(context.Background(), c.db, insertPacketSQL, rows)
+	return c.queueBlock(insertTransactionSQL, len(chTransactionColumns), len(rows), func(b *data.Block, i, j int) error {
+		return chTransactionColumns[i].write(b, i, rows[j])
+	})
+}
+
+// Columns of mp_retries, in insert order
+var chRetryColumns = []struct {
+	name  string
+	typ   string
+	write func(b *data.Block, c int, e *RetryEvent) error
+}{
+	{"group", "LowCardinality(String)", func(b *data.Block, c int, e *RetryEvent) error { return b.WriteString(c, e.Group) }},
+	{"session_id", "String", func(b *data.Block, c int, e *RetryEvent) error { return b.WriteString(c, e.SessionID) }},
+	{"txn_number", "Int64", func(b *data.Block, c int, e *RetryEvent) error { return b.WriteInt64(c, e.TxnNumber) }},
+	{"stmt_id", "Int32", func(b *data.Block, c int, e *RetryEvent) error { return b.WriteInt32(c, e.StmtID) }},
+	{"command", "LowCardinality(String)", func(b *data.Block, c int, e *RetryEvent) error { return b.WriteString(c, e.Command) }},
+	{"namespace", "LowCardinality(String)", func(b *data.Block, c int, e *RetryEvent) error { return b.WriteString(c, e.Namespace) }},
+	{"attempt", "UInt32", func(b *data.Block, c int, e *RetryEvent) error { return b.WriteUInt32(c, uint32(e.Attempt)) }},
+	{"time", "DateTime64(6)", func(b *data.Block, c int, e *RetryEvent) error { return b.WriteInt64(c, micros(e.Time)) }},
+	{"request_id", "UInt32", func(b *data.Block, c int, e *RetryEvent) error { return b.WriteUInt32(c, e.RequestID) }},
+	{"stream_id", "UInt64", func(b *data.Block, c int, e *RetryEvent) error { return b.WriteUInt64(c, e.StreamID) }},
+	{"src", "String", func(b *data.Block, c int, e *RetryEvent) error { return b.WriteString(c, e.SrcIP) }},
+	{"src_port", "String", func(b *data.Block, c int, e *RetryEvent) error { return b.WriteString(c, e.SrcPort) }},
+	{"dst", "String", func(b *data.Block, c int, e *RetryEvent) error { return b.WriteString(c, e.DstIP) }},
+	{"dst_port", "String", func(b *data.Block, c int, e *RetryEvent) error { return b.WriteString(c, e.DstPort) }},
+	{"original_time", "DateTime64(6)", func(b *data.Block, c int, e *RetryEvent) error { return b.WriteInt64(c, micros(e.OriginalTime)) }},
+	{"original_request_id", "UInt32", func(b *data.Block, c int, e *RetryEvent) error { return b.WriteUInt32(c, e.OriginalRequestID) }},
+	{"original_stream_id", "UInt64", func(b *data.Block, c int, e *RetryEvent) error { return b.WriteUInt64(c, e.OriginalStreamID) }},
+	{"original_dst", "String", func(b *data.Block, c int, e *RetryEvent) error { return b.WriteString(c, e.OriginalDstIP) }},
+	{"original_dst_port", "String", func(b *data.Block, c int, e *RetryEvent) error { return b.WriteString(c, e.OriginalDstPort) }},
+	{"same_connection", "UInt8", func(b *data.Block, c int, e *RetryEvent) error { return b.WriteUInt8(c, boolInt(e.SameConnection)) }},
+	{"previous_replied", "UInt8", func(b *data.Block, c int, e *RetryEvent) error { return b.WriteUInt8(c, boolInt(e.PreviousReplied)) }},
+	{"previous_reply_time", "Nullable(DateTime64(6))", func(b *data.Block, c int, e *RetryEvent) error {
+		return b.WriteInt64Nullable(c, nullableMicros(e.PreviousReplyTime, e.PreviousReplied))
+	}},
+	{"previous_error_code", "Int64", func(b *data.Block, c int, e *RetryEvent) error { return b.WriteInt64(c, e.PreviousErrorCode) }},
+	{"previous_error_name", "LowCardinality(String)", func(b *data.Block, c int, e *RetryEvent) error { return b.WriteString(c, e.PreviousErrorName) }},
+	{"previous_error_labels", "Array(String)", func(b *data.Block, c int, e *RetryEvent) error {
+		return b.WriteArray(c, stringArray(e.PreviousErrorLabels))
+	}},
+}
+
+var insertRetrySQL = insertColumnarSQL("mp_retries",
+	schemaNames(chTables["mp_retries"]))
+
+// SaveRetryEvents ..
+func (c *Clickhouse) SaveRetryEvents(retries []*RetryEvent) error {
+	rows := append([]*RetryEvent(nil), retries...)
+	return c.queueBlock(insertRetrySQL, len(chRetryColumns), len(rows), func(b *data.Block, i, j int) error {
+		return chRetryColumns[i].write(b, i, rows[j])
+	})
+}
+
+// Columns of mp_connections, in insert order
+var chConnectionColumns = []struct {
+	name  string
+	typ   string
+	write func(b *data.Block, c int, e *ConnectionEvent) error
+}{
+	{"group", "LowCardinality(String)", func(b *data.Block, c int, e *ConnectionEvent) error { return b.WriteString(c, e.Group) }},
+	{"stream_id", "UInt64", func(b *data.Block, c int, e *ConnectionEvent) error { return b.WriteUInt64(c, e.StreamID) }},
+	{"src", "String", func(b *data.Block, c int, e *ConnectionEvent) error { return b.WriteString(c, e.SrcIP) }},
+	{"src_port", "String", func(b *data.Block, c int, e *ConnectionEvent) error { return b.WriteString(c, e.SrcPort) }},
+	{"dst", "String", func(b *data.Block, c int, e *ConnectionEvent) error { return b.WriteString(c, e.DstIP) }},
+	{"dst_port", "String", func(b *data.Block, c int, e *ConnectionEvent) error { return b.WriteString(c, e.DstPort) }},
+	{"time", "DateTime64(6)", func(b *data.Block, c int, e *ConnectionEvent) error { return b.WriteInt64(c, micros(e.Time)) }},
+	{"app_name", "LowCardinality(String)", func(b *data.Block, c int, e *ConnectionEvent) error { return b.WriteString(c, e.AppName) }},
+	{"driver_name", "LowCardinality(String)", func(b *data.Block, c int, e *ConnectionEvent) error { return b.WriteString(c, e.DriverName) }},
+	{"driver_version", "LowCardinality(String)", func(b *data.Block, c int, e *ConnectionEvent) error { return b.WriteString(c, e.DriverVersion) }},
+	{"os_type", "LowCardinality(String)", func(b *data.Block, c int, e *ConnectionEvent) error { return b.WriteString(c, e.OSType) }},
+	{"os_name", "LowCardinality(String)", func(b *data.Block, c int, e *ConnectionEvent) error { return b.WriteString(c, e.OSName) }},
+	{"os_architecture", "LowCardinality(String)", func(b *data.Block, c int, e *ConnectionEvent) error { return b.WriteString(c, e.OSArchitecture) }},
+	{"os_version", "LowCardinality(String)", func(b *data.Block, c int, e *ConnectionEvent) error { return b.WriteString(c, e.OSVersion) }},
+	{"platform", "LowCardinality(String)", func(b *data.Block, c int, e *ConnectionEvent) error { return b.WriteString(c, e.Platform) }},
+	{"requested_compression", "Array(String)", func(b *data.Block, c int, e *ConnectionEvent) error {
+		return b.WriteArray(c, stringArray(e.RequestedCompression))
+	}},
+	{"sasl_supported_mechs", "String", func(b *data.Block, c int, e *ConnectionEvent) error { return b.WriteString(c, e.SaslSupportedMechs) }},
+	{"replied", "UInt8", func(b *data.Block, c int, e *ConnectionEvent) error { return b.WriteUInt8(c, boolInt(e.Replied)) }},
+	{"max_wire_version", "Int64", func(b *data.Block, c int, e *ConnectionEvent) error { return b.WriteInt64(c, e.MaxWireVersion) }},
+	{"min_wire_version", "Int64", func(b *data.Block, c int, e *ConnectionEvent) error { return b.WriteInt64(c, e.MinWireVersion) }},
+	{"compression", "Array(String)", func(b *data.Block, c int, e *ConnectionEvent) error {
+		return b.WriteArray(c, stringArray(e.Compression))
+	}},
+	{"connection_id", "Int64", func(b *data.Block, c int, e *ConnectionEvent) error { return b.WriteInt64(c, e.ConnectionID) }},
+	{"max_message_size_bytes", "Int64", func(b *data.Block, c int, e *ConnectionEvent) error {
+		return b.WriteInt64(c, e.MaxMessageSizeBytes)
+	}},
+	{"server_sasl_mechs", "Array(String)", func(b *data.Block, c int, e *ConnectionEvent) error {
+		return b.WriteArray(c, stringArray(e.ServerSaslMechs))
+	}},
+}
+
+var insertConnectionSQL = insertColumnarSQL("mp_connections",
+	schemaNames(chTables["mp_connections"]))
+
+// SaveConnectionEvents ..
+func (c *Clickhouse) SaveConnectionEvents(conns []*ConnectionEvent) error {
+	rows := append([]*ConnectionEvent(nil), conns...)
+	return c.queueBlock(insertConnectionSQL, len(chConnectionColumns), len(rows), func(b *data.Block, i, j int) error {
+		return chConnectionColumns[i].write(b, i, rows[j])
+	})
+}
+
+// Columns of mp_auth, in insert order
+var chAuthColumns = []struct {
+	name  string
+	typ   string
+	write func(b *data.Block, c int, e *AuthEvent) error
+}{
+	{"group", "LowCardinality(String)", func(b *data.Block, c int, e *AuthEvent) error { return b.WriteString(c, e.Group) }},
+	{"stream_id", "UInt64", func(b *data.Block, c int, e *AuthEvent) error { return b.WriteUInt64(c, e.StreamID) }},
+	{"src", "String", func(b *data.Block, c int, e *AuthEvent) error { return b.WriteString(c, e.SrcIP) }},
+	{"src_port", "String", func(b *data.Block, c int, e *AuthEvent) error { return b.WriteString(c, e.SrcPort) }},
+	{"dst", "String", func(b *data.Block, c int, e *AuthEvent) error { return b.WriteString(c, e.DstIP) }},
+	{"dst_port", "String", func(b *data.Block, c int, e *AuthEvent) error { return b.WriteString(c, e.DstPort) }},
+	{"app_name", "LowCardinality(String)", func(b *data.Block, c int, e *AuthEvent) error { return b.WriteString(c, e.AppName) }},
+	{"mechanism", "LowCardinality(String)", func(b *data.Block, c int, e *AuthEvent) error { return b.WriteString(c, e.Mechanism) }},
+	{"user", "String", func(b *data.Block, c int, e *AuthEvent) error { return b.WriteString(c, e.User) }},
+	{"database", "LowCardinality(String)", func(b *data.Block, c int, e *AuthEvent) error { return b.WriteString(c, e.Database) }},
+	{"speculative", "UInt8", func(b *data.Block, c int, e *AuthEvent) error { return b.WriteUInt8(c, boolInt(e.Speculative)) }},
+	{"start_time", "DateTime64(6)", func(b *data.Block, c int, e *AuthEvent) error { return b.WriteInt64(c, micros(e.Start)) }},
+	{"end_time", "DateTime64(6)", func(b *data.Block, c int, e *AuthEvent) error { return b.WriteInt64(c, micros(e.End)) }},
+	{"duration_us", "UInt64", func(b *data.Block, c int, e *AuthEvent) error {
+		return b.WriteUInt64(c, uint64(e.End.Sub(e.Start).Microseconds()))
+	}},
+	{"round_trips", "UInt32", func(b *data.Block, c int, e *AuthEvent) error { return b.WriteUInt32(c, uint32(e.RoundTrips)) }},
+	{"outcome", "LowCardinality(String)", func(b *data.Block, c int, e *AuthEvent) error { return b.WriteString(c, e.Outcome) }},
+	{"error_code", "Int64", func(b *data.Block, c int, e *AuthEvent) error { return b.WriteInt64(c, e.ErrorCode) }},
+	{"error_name", "LowCardinality(String)", func(b *data.Block, c int, e *AuthEvent) error { return b.WriteString(c, e.ErrorName) }},
+}
+
+var insertAuthSQL = insertColumnarSQL("mp_auth",
+	schemaNames(chTables["mp_auth"]))
+
+// SaveAuthEvents ..
+func (c *Clickhouse) SaveAuthEvents(auths []*AuthEvent) error {
+	rows := append([]*AuthEvent(nil), auths...)
+	return c.queueBlock(insertAuthSQL, len(chAuthColumns), len(rows), func(b *data.Block, i, j int) error {
+		return chAuthColumns[i].write(b, i, rows[j])
+	})
+}
+
+// Columns of mp_shapes, in insert order
+var chShapeColumns = []struct {
+	name  string
+	typ   string
+	write func(b *data.Block, c int, s *ShapeStats) error
+}{
+	{"group", "LowCardinality(String)", func(b *data.Block, c int, s *ShapeStats) error { return b.WriteString(c, s.Group) }},
+	{"shape_hash", "String", func(b *data.Block, c int, s *ShapeStats) error { return b.WriteString(c, s.Hash) }},
+	{"command", "LowCardinality(String)", func(b *data.Block, c int, s *ShapeStats) error { return b.WriteString(c, s.Command) }},
+	{"namespace", "LowCardinality(String)", func(b *data.Block, c int, s *ShapeStats) error { return b.WriteString(c, s.Namespace) }},
+	{"shape", "String", func(b *data.Block, c int, s *ShapeStats) error { return b.WriteString(c, s.Shape) }},
+	{"first_time", "DateTime64(6)", func(b *data.Block, c int, s *ShapeStats) error { return b.WriteInt64(c, micros(s.First)) }},
+	{"last_time", "DateTime64(6)", func(b *data.Block, c int, s *ShapeStats) error { return b.WriteInt64(c, micros(s.Last)) }},
+	{"count", "UInt64", func(b *data.Block, c int, s *ShapeStats) error { return b.WriteUInt64(c, uint64(s.Count)) }},
+	{"replies", "UInt64", func(b *data.Block, c int, s *ShapeStats) error { return b.WriteUInt64(c, uint64(s.Replies)) }},
+	{"errors", "UInt64", func(b *data.Block, c int, s *ShapeStats) error { return b.WriteUInt64(c, uint64(s.Errors)) }},
+	{"total_us", "UInt64", func(b *data.Block, c int, s *ShapeStats) error {
+		return b.WriteUInt64(c, uint64(s.Total.Microseconds()))
+	}},
+	{"mean_us", "UInt64", func(b *data.Block, c int, s *ShapeStats) error {
+		return b.WriteUInt64(c, uint64(s.Mean.Microseconds()))
+	}},
+	{"p50_us", "UInt64", func(b *data.Block, c int, s *ShapeStats) error { return b.WriteUInt64(c, uint64(s.P50.Microseconds())) }},
+	{"p90_us", "UInt64", func(b *data.Block, c int, s *ShapeStats) error { return b.WriteUInt64(c, uint64(s.P90.Microseconds())) }},
+	{"p99_us", "UInt64", func(b *data.Block, c int, s *ShapeStats) error { return b.WriteUInt64(c, uint64(s.P99.Microseconds())) }},
+	{"max_us", "UInt64", func(b *data.Block, c int, s *ShapeStats) error { return b.WriteUInt64(c, uint64(s.Max.Microseconds())) }},
+}
+
+var insertShapeSQL = insertColumnarSQL("mp_shapes",
+	schemaNames(chTables["mp_shapes"]))
+
+// SaveShapeStats ..
+func (c *Clickhouse) SaveShapeStats(stats []*ShapeStats) error {
+	rows := append([]*ShapeStats(nil), stats...)
+	return c.queueBlock(insertShapeSQL, len(chShapeColumns), len(rows), func(b *data.Block, i, j int) error {
+		return chShapeColumns[i].write(b, i, rows[j])
+	})
+}
+
+// Microseconds of a time for a Nullable(DateTime64(6)) column, nil unless
+// the time is set
+func nullableMicros(t time.Time, set bool) *int64 {
+	if !set {
+		return nil
+	}
+	us := micros(t)
+	return &us
+}
+
+// Array columns can't be inserted from a nil slice
+func stringArray(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+// Migrated lists the schema migrations applied when the database was
+// opened, see SchemaStorage
+func (c *Clickhouse) Migrated() []SchemaMigration {
+	return c.migrated
+}
+
+// Flush waits for the queued batches to be inserted
+func (c *Clickhouse) Flush() error {
+	c.pending.Wait()
+	return c.failed()
 }
 
 // Close ..
 func (c *Clickhouse) Close() error {
-	return c.db.Close()
+	err := c.Flush()
+	close(c.inserts)
+	c.workers.Wait()
+	if cerr := c.db.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
 func execute(ctx context.Context, db *sql.DB, statementSQL string, args [][]interface{}) error {
@@ -0,0 +1,291 @@
+package mongopacket
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/lib/binary"
+	"github.com/ClickHouse/clickhouse-go/lib/column"
+	"github.com/ClickHouse/clickhouse-go/lib/data"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Each table's columns match its CREATE statement, and their writers write
+// a row the driver can encode as the types the server exchanges
+func TestClickhouseColumns(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	end := start.Add(20 * time.Millisecond)
+
+	req := testEvent(t, 1, 0, 0, bson.D{{Key: "find", Value: "items"}, {Key: "$db", Value: "orders"}})
+	event := &chEvent{MongoEvent: req, header: req.Op.GetHeader(), labels: []string{}}
+	packet := &PacketEvent{Time: start, SizeTCP: 60}
+	decodeError := &DecodeErrorEvent{Time: start, Offset: -1, MessageLength: 16, Packets: 1}
+	cursor := &CursorEvent{Start: start, End: end, Batches: 2, IdleTotal: time.Millisecond}
+	txn := &chTransaction{TransactionEvent: &TransactionEvent{Start: start, End: end}, statements: "[]"}
+	retry := &RetryEvent{Time: end, OriginalTime: start, PreviousReplied: true, PreviousReplyTime: start}
+	conn := &ConnectionEvent{Time: start, Compression: []string{"zstd"}}
+	auth := &AuthEvent{Start: start, End: end, RoundTrips: 2}
+	shape := &ShapeStats{First: start, Last: end, Count: 3, Total: time.Millisecond}
+
+	tables := []struct {
+		name   string
+		create string
+		write  func(b *data.Block, c int) error
+	}{
+		{"mp_events", createEventV1SQL,
+			func(b *data.Block, c int) error { return chEventColumns[c].write(b, c, event) }},
+		{"mp_packets", createPacketV1SQL,
+			func(b *data.Block, c int) error { return chPacketColumns[c].write(b, c, packet) }},
+		{"mp_decode_errors", createDecodeErrorV2SQL,
+			func(b *data.Block, c int) error { return chDecodeErrorColumns[c].write(b, c, decodeError) }},
+		{"mp_cursors", createCursorV2SQL,
+			func(b *data.Block, c int) error { return chCursorColumns[c].write(b, c, cursor) }},
+		{"mp_transactions", createTransactionV2SQL,
+			func(b *data.Block, c int) error { return chTransactionColumns[c].write(b, c, txn) }},
+		{"mp_retries", createRetryV2SQL,
+			func(b *data.Block, c int) error { return chRetryColumns[c].write(b, c, retry) }},
+		{"mp_connections", createConnectionV2SQL,
+			func(b *data.Block, c int) error { return chConnectionColumns[c].write(b, c, conn) }},
+		{"mp_auth", createAuthV2SQL,
+			func(b *data.Block, c int) error { return chAuthColumns[c].write(b, c, auth) }},
+		{"mp_shapes", createShapeV3SQL,
+			func(b *data.Block, c int) error { return chShapeColumns[c].write(b, c, shape) }},
+	}
+	for _, table := range tables {
+		written := chTables[table.name]
+		created := createdColumns(table.create)
+		if len(created) != len(written) {
+			t.Errorf("%s: %d columns created, %d written", table.name, len(created), len(written))
+			continue
+		}
+
+		block := &data.Block{}
+		for i, col := range created {
+			if col != written[i] {
+				t.Errorf("%s column %d is created as %v, written as %v", table.name, i, col, written[i])
+			}
+
+			// LowCardinality columns are exchanged as their ordinary type,
+			// see clickhouseDSN
+			typ := col.typ
+			if strings.HasPrefix(typ, "LowCardinality(") {
+				typ = typ[len("LowCardinality(") : len(typ)-1]
+			}
+			c, err := column.Factory(col.name, typ, time.UTC)
+			if err != nil {
+				t.Fatal(err)
+			}
+			block.Columns = append(block.Columns, c)
+		}
+		block.NumColumns = uint64(len(block.Columns))
+		block.Reserve()
+		block.NumRows = 1
+		for c, col := range written {
+			if err := table.write(block, c); err != nil {
+				t.Errorf("writing %s.%s: %v", table.name, col.name, err)
+			}
+		}
+
+		var buf bytes.Buffer
+		if err := block.Write(&data.ServerInfo{}, binary.NewEncoder(&buf)); err != nil {
+			t.Fatal(err)
+		}
+		read := &data.Block{}
+		if err := read.Read(&data.ServerInfo{Timezone: time.UTC}, binary.NewDecoder(&buf)); err != nil {
+			t.Fatal(err)
+		}
+		if read.NumRows != 1 || read.NumColumns != block.NumColumns {
+			t.Errorf("%s: read %d rows of %d columns", table.name, read.NumRows, read.NumColumns)
+		}
+	}
+}
+
+// Each rebuild selects a value for every column of the table it fills, as
+// the statements before it created the table, or for each column it names
+func TestClickhouseRebuilds(t *testing.T) {
+	lists := [][]string{}
+	for _, legacy := range clickhouseDialect.legacy {
+		lists = append(lists, legacy.statements)
+	}
+	for _, m := range clickhouseMigrations {
+		lists = append(lists, m.Statements)
+	}
+	for _, statements := range lists {
+		created := map[string][]schemaColumn{}
+		for _, stmt := range statements {
+			f := strings.Fields(stmt)
+			if f[0] == "CREATE" && f[1] == "TABLE" {
+				created[f[5]] = createdColumns(stmt)
+			}
+			if f[0] != "INSERT" {
+				continue
+			}
+			table := f[2]
+			if _, ok := created[table]; !ok {
+				t.Errorf("%s is filled before it's created", table)
+				continue
+			}
+			sel := stmt[strings.Index(stmt, "SELECT")+len("SELECT") : strings.LastIndex(stmt, "FROM")]
+			values := len(topLevelList(sel))
+
+			columns := len(created[table])
+			if strings.HasPrefix(f[3], "(") {
+				list := stmt[strings.Index(stmt, "(")+1 : strings.Index(stmt, ")")]
+				names := topLevelList(list)
+				columns = len(names)
+				for _, name := range names {
+					if !hasColumn(created[table], name) {
+						t.Errorf("%s has no column %s", table, name)
+					}
+				}
+			}
+			if values != columns {
+				t.Errorf("%s: %d values selected for %d columns", table, values, columns)
+			}
+		}
+	}
+}
+
+// The items of a comma separated list, outside parentheses
+func topLevelList(s string) []string {
+	var items []string
+	depth, start := 0, 0
+	for i, r := range s {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				items = append(items, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(items, strings.TrimSpace(s[start:]))
+}
+
+func hasColumn(cols []schemaColumn, name string) bool {
+	for _, col := range cols {
+		if col.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Tables created before schema versioning are recognized by the columns
+// the catalog gives them, user-defined ones included
+func TestClickhouseLegacyLayouts(t *testing.T) {
+	catalog := func(creates ...string) map[string]map[string]string {
+		tables := map[string]map[string]string{}
+		for _, create := range creates {
+			cols := map[string]string{"tenant": "LowCardinality(String)"}
+			for _, col := range createdColumns(create) {
+				cols[col.name] = col.typ
+			}
+			tables[strings.Fields(create)[5]] = cols
+		}
+		return tables
+	}
+
+	for i, tables := range []map[string]map[string]string{
+		catalog(createPacketV1SQL, createEventV1SQL),
+		catalog(createPacketV0SQL, createEventV0OutcomeSQL),
+		catalog(createPacketV0SQL, createEventV0SQL),
+	} {
+		legacy, err := matchLegacySchema(clickhouseDialect, tables)
+		if err != nil {
+			t.Errorf("layout %d: %v", i, err)
+			continue
+		}
+		if legacy != &clickhouseDialect.legacy[i] {
+			t.Errorf("layout %d is recognized as %q", i, legacy.description)
+		}
+	}
+
+	tables := catalog(createPacketV0SQL, createEventV0SQL)
+	tables["mp_events"]["start_time_us"] = "Int64"
+	if _, err := matchLegacySchema(clickhouseDialect, tables); err == nil || !strings.Contains(err.Error(), "unknown layout") {
+		t.Errorf("unknown layout: %v", err)
+	}
+}
+
+// Runs against the server at MONGOPACKET_CLICKHOUSE_URL, e.g.
+// tcp://localhost:9000, creating the tables as they were first written in
+// a database of their own which is dropped afterwards
+func TestClickhouseBaseline(t *testing.T) {
+	base := os.Getenv("MONGOPACKET_CLICKHOUSE_URL")
+	if base == "" {
+		t.Skip("MONGOPACKET_CLICKHOUSE_URL not set")
+	}
+	db, err := sql.Open("clickhouse", clickhouseDSN(base))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	database := fmt.Sprintf("mp_test_%d", time.Now().UnixNano())
+	if _, err = db.Exec("CREATE DATABASE " + database); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Exec("DROP DATABASE " + database)
+
+	u, err := url.Parse(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	q.Set("database", database)
+	u.RawQuery = q.Encode()
+
+	legacy, err := sql.Open("clickhouse", clickhouseDSN(u.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer legacy.Close()
+	for _, stmt := range []string{
+		createPacketV0SQL,
+		createEventV0SQL,
+		`
+INSERT INTO mp_events (group, event_id, start_time_us, end_time_us, opcode, op, packets)
+SELECT 'g', 7, 1709294400000000, 1709294400020000, 'OP_MSG', '{}', '[]'`,
+	} {
+		if _, err = legacy.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := NewClickhouse(u.String(), ClickhouseOptions{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	got := migratedVersions(c.Migrated())
+	if len(got) != len(clickhouseMigrations)+1 || got[0] != 0 {
+		t.Errorf("baseline tables migrated %v", got)
+	}
+	// The columns added since take their defaults
+	var opcode, command string
+	var start int64
+	var ok sql.NullInt64
+	err = c.db.QueryRow("SELECT opcode, command, toUnixTimestamp64Micro(start_time), ok FROM mp_events WHERE event_id = 7").Scan(&opcode, &command, &start, &ok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opcode != "OP_MSG" || command != "" || start != 1709294400000000 || ok.Valid {
+		t.Errorf("baseline row has opcode %q, command %q, start %d, ok %v", opcode, command, start, ok)
+	}
+	var kept uint64
+	if err = c.db.QueryRow("SELECT count() FROM mp_events_v0").Scan(&kept); err != nil || kept != 1 {
+		t.Errorf("mp_events_v0 kept %d rows: %v", kept, err)
+	}
+}
@@ -0,0 +1,229 @@
+package mongopacket
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/phensley/mongopacket/pkg/protocol"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// Types of user-defined columns
+const (
+	ColumnString = "string" // strings, with other values as relaxed Extended JSON
+	ColumnInt    = "int"    // integers, and doubles truncated
+	ColumnFloat  = "float"  // any number
+	ColumnBool   = "bool"   // booleans, stored as 0 or 1
+	ColumnTime   = "time"   // dates, stored as microseconds since the epoch where there is no time type
+)
+
+// Column promotes a value from each op's documents to a column of its own.
+// The path is looked up in a request's command, a reply, or the first
+// document of a legacy op. Values that are missing or can't be converted to
+// the column's type are left empty.
+type Column struct {
+	Name string `json:"name"` // column name, lower case letters, digits and underscores
+	Path string `json:"path"` // dotted path, e.g. filter.tenantId or $readPreference.mode
+	Type string `json:"type"` // one of the Column* values
+
+	path []string
+}
+
+// ColumnConfig lists the columns added to the stored events, in order.
+//
+//	{
+//	  "columns": [
+//	    {"name": "tenant_id", "path": "filter.tenantId", "type": "string"},
+//	    {"name": "read_pref", "path": "$readPreference.mode", "type": "string"},
+//	    {"name": "write_concern", "path": "writeConcern.w", "type": "string"},
+//	    {"name": "comment", "path": "comment", "type": "string"}
+//	  ]
+//	}
+type ColumnConfig struct {
+	Columns []*Column `json:"columns"`
+}
+
+// Columns extracts the values of user-defined columns from ops
+type Columns struct {
+	cols []*Column
+}
+
+var columnName = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// LoadColumns reads a column config from a JSON file
+func LoadColumns(path string) (*Columns, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &ColumnConfig{}
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("column config %s: %s", path, err)
+	}
+	return NewColumns(cfg)
+}
+
+// NewColumns ..
+func NewColumns(cfg *ColumnConfig) (*Columns, error) {
+	c := &Columns{}
+	// ClickHouse also stores the start and end times as dates, and the
+	// command and namespace of each request
+	seen := map[string]bool{"start_time": true, "end_time": true, "command": true, "namespace": true}
+	for _, name := range eventsHeader {
+		seen[name] = true
+	}
+	for _, col := range cfg.Columns {
+		if !columnName.MatchString(col.Name) {
+			return nil, fmt.Errorf("column %q: names may only contain lower case letters, digits and underscores", col.Name)
+		}
+		if seen[col.Name] {
+			return nil, fmt.Errorf("column %q: name is already used", col.Name)
+		}
+		seen[col.Name] = true
+		if col.Path == "" {
+			return nil, fmt.Errorf("column %q: path is required", col.Name)
+		}
+		switch col.Type {
+		case ColumnString, ColumnInt, ColumnFloat, ColumnBool, ColumnTime:
+		default:
+			return nil, fmt.Errorf("column %q: unknown type %q", col.Name, col.Type)
+		}
+		col.path = strings.Split(col.Path, ".")
+		c.cols = append(c.cols, col)
+	}
+	return c, nil
+}
+
+// Names of the columns, in order
+func (c *Columns) Names() []string {
+	if c == nil {
+		return nil
+	}
+	names := make([]string, len(c.cols))
+	for i, col := range c.cols {
+		names[i] = col.Name
+	}
+	return names
+}
+
+// Extract the column values from an op, in order. Missing values are nil;
+// the others are a string, int64, float64, bool or time.Time.
+func (c *Columns) Extract(op protocol.Op) []interface{} {
+	if c == nil || len(c.cols) == 0 {
+		return nil
+	}
+	doc := opDocument(op)
+	vals := make([]interface{}, len(c.cols))
+	for i, col := range c.cols {
+		if doc == nil {
+			break
+		}
+		v := doc.Lookup(col.path...)
+
+		// Legacy commands sent through mongos carry the read preference
+		// in a wrapper around the command
+		if v.Type == 0 {
+			if q, ok := op.(*protocol.Query); ok && q.Query != nil && q.Query != doc {
+				v = q.Query.Lookup(col.path...)
+			}
+		}
+		vals[i] = col.convert(v)
+	}
+	return vals
+}
+
+func (col *Column) convert(v bson.RawValue) interface{} {
+	switch v.Type {
+	case 0, bsontype.Null, bsontype.Undefined:
+		return nil
+	}
+	switch col.Type {
+	case ColumnString:
+		if s, ok := v.StringValueOK(); ok {
+			return s
+		}
+		return protocol.CompactJSON(v)
+
+	case ColumnInt:
+		if n, ok := protocol.IntValue(v); ok {
+			return n
+		}
+
+	case ColumnFloat:
+		switch v.Type {
+		case bsontype.Double:
+			return v.Double()
+		case bsontype.Int32, bsontype.Int64:
+			n, _ := protocol.IntValue(v)
+			return float64(n)
+		}
+
+	case ColumnBool:
+		if b, ok := v.BooleanOK(); ok {
+			return b
+		}
+
+	case ColumnTime:
+		if t, ok := v.TimeOK(); ok {
+			return t
+		}
+	}
+	return nil
+}
+
+// ClickHouse type of each column
+func (c *Columns) clickhouseTypes() []string {
+	if c == nil {
+		return nil
+	}
+	types := make([]string, len(c.cols))
+	for i, col := range c.cols {
+		switch col.Type {
+		case ColumnString:
+			types[i] = "Nullable(String)"
+		case ColumnInt:
+			types[i] = "Nullable(Int64)"
+		case ColumnTime:
+			types[i] = "Nullable(DateTime64(6))"
+		case ColumnFloat:
+			types[i] = "Nullable(Float64)"
+		case ColumnBool:
+			types[i] = "Nullable(UInt8)"
+		}
+	}
+	return types
+}
+
+// Converts a column value for storage: bools become 0 or 1, and times
+// microseconds since the epoch unless the storage has a time type
+func columnValue(v interface{}, timeType bool) interface{} {
+	switch x := v.(type) {
+	case bool:
+		return boolInt(x)
+	case time.Time:
+		if !timeType {
+			return x.UnixNano() / 1e3
+		}
+	}
+	return v
+}
+
+// Formats a column value for a TSV file, empty if it is missing
+func columnTSV(v interface{}) string {
+	switch x := columnValue(v, false).(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case float64:
+		return strconv.FormatFloat(x, 'g', -1, 64)
+	default:
+		return fmt.Sprintf("%d", x)
+	}
+}
@@ -0,0 +1,165 @@
+package mongopacket
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/phensley/mongopacket/pkg/protocol"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestNewColumns(t *testing.T) {
+	tests := []struct {
+		col Column
+		err string
+	}{
+		{Column{Name: "tenant_id", Path: "filter.tenantId", Type: ColumnString}, ""},
+		{Column{Name: "Tenant", Path: "filter.tenantId", Type: ColumnString}, "names may only contain"},
+		{Column{Name: "op", Path: "filter.tenantId", Type: ColumnString}, "already used"},
+		{Column{Name: "command", Path: "filter.tenantId", Type: ColumnString}, "already used"},
+		{Column{Name: "tenant_id", Type: ColumnString}, "path is required"},
+		{Column{Name: "tenant_id", Path: "filter.tenantId", Type: "text"}, `unknown type "text"`},
+	}
+	for _, tt := range tests {
+		col := tt.col
+		_, err := NewColumns(&ColumnConfig{Columns: []*Column{&col}})
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%+v: got %v, want %q", tt.col, err, tt.err)
+		}
+	}
+
+	c := &ColumnConfig{Columns: []*Column{
+		{Name: "a", Path: "a", Type: ColumnInt},
+		{Name: "a", Path: "b", Type: ColumnInt},
+	}}
+	if _, err := NewColumns(c); err == nil || !strings.Contains(err.Error(), "already used") {
+		t.Errorf("duplicate name: %v", err)
+	}
+}
+
+func TestColumnsExtract(t *testing.T) {
+	at := time.Date(2021, 3, 4, 5, 6, 7, 8000, time.UTC)
+	columns, err := NewColumns(&ColumnConfig{Columns: []*Column{
+		{Name: "tenant", Path: "filter.tenantId", Type: ColumnString},
+		{Name: "concern", Path: "writeConcern", Type: ColumnString},
+		{Name: "limit_int", Path: "limit", Type: ColumnInt},
+		{Name: "ratio_int", Path: "ratio", Type: ColumnInt},
+		{Name: "limit_float", Path: "limit", Type: ColumnFloat},
+		{Name: "ratio_float", Path: "ratio", Type: ColumnFloat},
+		{Name: "big_float", Path: "big", Type: ColumnFloat},
+		{Name: "single", Path: "singleBatch", Type: ColumnBool},
+		{Name: "since", Path: "filter.since", Type: ColumnTime},
+		{Name: "read_pref", Path: "$readPreference.mode", Type: ColumnString},
+
+		// Missing, null and values that can't be converted
+		{Name: "missing", Path: "filter.nope", Type: ColumnString},
+		{Name: "null", Path: "hint", Type: ColumnString},
+		{Name: "tenant_int", Path: "filter.tenantId", Type: ColumnInt},
+		{Name: "tenant_float", Path: "filter.tenantId", Type: ColumnFloat},
+		{Name: "limit_bool", Path: "limit", Type: ColumnBool},
+		{Name: "limit_time", Path: "limit", Type: ColumnTime},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := columns.Names(); len(got) != 16 || got[0] != "tenant" || got[15] != "limit_time" {
+		t.Errorf("names %v", got)
+	}
+
+	cmd := bson.D{
+		{Key: "find", Value: "orders"},
+		{Key: "filter", Value: bson.D{{Key: "tenantId", Value: "t1"}, {Key: "since", Value: primitive.NewDateTimeFromTime(at)}}},
+		{Key: "limit", Value: int32(10)},
+		{Key: "ratio", Value: 2.75},
+		{Key: "big", Value: int64(1) << 40},
+		{Key: "singleBatch", Value: true},
+		{Key: "hint", Value: nil},
+		{Key: "writeConcern", Value: bson.D{{Key: "w", Value: "majority"}}},
+	}
+	want := []interface{}{
+		"t1", `{"w":"majority"}`, int64(10), int64(2), 10.0, 2.75, float64(1 << 40), true, at.Truncate(time.Millisecond), nil,
+		nil, nil, nil, nil, nil, nil,
+	}
+
+	// Times are compared as instants, whatever their location
+	extract := func(op protocol.Op) []interface{} {
+		vals := columns.Extract(op)
+		for i, v := range vals {
+			if t, ok := v.(time.Time); ok {
+				vals[i] = t.UTC()
+			}
+		}
+		return vals
+	}
+
+	// A command, and the same command wrapped in $query by mongos, which
+	// carries the read preference in the wrapper
+	msg := testEvent(t, 1, 0, 0, append(cmd, bson.E{Key: "$db", Value: "shop"})).Op
+	if got := extract(msg); !reflect.DeepEqual(got, want) {
+		t.Errorf("command:\n got %#v\nwant %#v", got, want)
+	}
+	wrapped, err := bson.Marshal(bson.D{
+		{Key: "$query", Value: cmd},
+		{Key: "$readPreference", Value: bson.D{{Key: "mode", Value: "secondaryPreferred"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := &protocol.Query{
+		Header:             &protocol.Header{OpCode: protocol.OpQuery},
+		FullCollectionName: "shop.$cmd",
+		NumberToReturn:     -1,
+		Query:              protocol.NewDocument(wrapped),
+	}
+	want[9] = "secondaryPreferred"
+	if got := extract(query); !reflect.DeepEqual(got, want) {
+		t.Errorf("wrapped command:\n got %#v\nwant %#v", got, want)
+	}
+
+	// Replies are looked up too, and ops without documents have no values
+	reply := testEvent(t, 2, 1, 0, bson.D{{Key: "limit", Value: 3.9}, {Key: "ok", Value: 1.0}}).Op
+	if got := columns.Extract(reply); got[2] != int64(3) || got[4] != 3.9 || got[0] != nil {
+		t.Errorf("reply: %#v", got)
+	}
+	kill := &protocol.KillCursors{Header: &protocol.Header{OpCode: protocol.OpKillCursors}, CursorIDs: []int64{1}}
+	if got := columns.Extract(kill); len(got) != 16 || got[0] != nil || got[2] != nil {
+		t.Errorf("killCursors: %#v", got)
+	}
+
+	var none *Columns
+	if none.Extract(msg) != nil || none.Names() != nil {
+		t.Error("nil columns extracted values")
+	}
+}
+
+func TestColumnValue(t *testing.T) {
+	at := time.Date(2021, 3, 4, 5, 6, 7, 8000, time.UTC)
+	tests := []struct {
+		v    interface{}
+		tsv  string
+		flat interface{} // without a time type
+	}{
+		{"t1", "t1", "t1"},
+		{int64(-10), "-10", int64(-10)},
+		{2.75, "2.75", 2.75},
+		{1e21, "1e+21", 1e21},
+		{true, "1", uint8(1)},
+		{false, "0", uint8(0)},
+		{at, "1614834367000008", int64(1614834367000008)},
+		{nil, "", nil},
+	}
+	for _, tt := range tests {
+		if got := columnTSV(tt.v); got != tt.tsv {
+			t.Errorf("%v: tsv %q, want %q", tt.v, got, tt.tsv)
+		}
+		if got := columnValue(tt.v, false); got != tt.flat {
+			t.Errorf("%v: value %#v, want %#v", tt.v, got, tt.flat)
+		}
+	}
+	if got := columnValue(at, true); got != at {
+		t.Errorf("time kept as %#v", got)
+	}
+}
@@ -0,0 +1,162 @@
+package mongopacket
+
+import (
+	"time"
+
+	"github.com/phensley/mongopacket/pkg/protocol"
+)
+
+// How long a connection is remembered after its last event
+const connectionIdle = time.Hour
+
+// Identifies a connection by its endpoints
+type connKey struct {
+	client string
+	server string
+}
+
+type connState struct {
+	evt   *ConnectionEvent
+	hello *MongoEvent // handshake request awaiting its reply
+	seen  time.Time   // latest event on the connection
+}
+
+// ConnectionTracker parses the handshake that opens each connection, and
+// labels every later event on the connection with the client's application
+// name and driver.
+type ConnectionTracker struct {
+	conns  map[connKey]*connState
+	done   []*ConnectionEvent
+	last   time.Time
+	pruned time.Time
+}
+
+// NewConnectionTracker ..
+func NewConnectionTracker() *ConnectionTracker {
+	return &ConnectionTracker{
+		conns: map[connKey]*connState{},
+	}
+}
+
+// Add an event to the tracker. For replies, req is the matching request if
+// it was seen, see RequestMatcher.
+func (t *ConnectionTracker) Add(e *MongoEvent, req *MongoEvent) {
+	if e.End.After(t.last) {
+		t.last = e.End
+	}
+	t.prune()
+
+	k := connKey{endpoint(e.SrcIP, e.SrcPort), endpoint(e.DstIP, e.DstPort)}
+	response := protocol.IsResponse(e.Op)
+	if response {
+		k = connKey{k.server, k.client}
+	}
+
+	if !response {
+		if h := protocol.HelloOf(protocol.CommandOf(e.Op)); h != nil && h.HasClient {
+			t.open(k, e, h)
+		}
+	}
+
+	st := t.conns[k]
+	if st == nil {
+		return
+	}
+	st.seen = e.End
+	e.AppName = st.evt.AppName
+	e.Driver = st.evt.Driver
+
+	if response && req != nil && req == st.hello {
+		if doc := protocol.ReplyOf(e.Op); doc != nil {
+			r := protocol.HelloReplyOf(doc)
+			st.evt.Replied = true
+			st.evt.MaxWireVersion = r.MaxWireVersion
+			st.evt.MinWireVersion = r.MinWireVersion
+			st.evt.Compression = r.Compression
+			st.evt.ConnectionID = r.ConnectionID
+			st.evt.MaxMessageSizeBytes = r.MaxMessageSizeBytes
+			st.evt.ServerSaslMechs = r.SaslSupportedMechs
+		}
+		st.hello = nil
+		t.done = append(t.done, st.evt)
+	}
+
+	if e.StreamEnd != 0 {
+		t.close(k)
+	}
+}
+
+// Finished returns the connections whose handshake completed since the
+// last call
+func (t *ConnectionTracker) Finished() []*ConnectionEvent {
+	done := t.done
+	t.done = nil
+	return done
+}
+
+// Close forgets all connections, and returns the connections whose
+// handshake completed, or never received a reply, since the last call to
+// Finished.
+func (t *ConnectionTracker) Close() []*ConnectionEvent {
+	for k := range t.conns {
+		t.close(k)
+	}
+	return t.Finished()
+}
+
+// Record the handshake that opens a connection
+func (t *ConnectionTracker) open(k connKey, e *MongoEvent, h *protocol.Hello) {
+	// A new handshake replaces whatever was known about the endpoints
+	t.close(k)
+
+	t.conns[k] = &connState{
+		evt: &ConnectionEvent{
+			Group:                e.Group,
+			StreamID:             e.StreamID,
+			SrcIP:                e.SrcIP,
+			SrcPort:              e.SrcPort,
+			DstIP:                e.DstIP,
+			DstPort:              e.DstPort,
+			Time:                 e.Start,
+			AppName:              h.AppName,
+			Driver:               h.Driver(),
+			DriverName:           h.DriverName,
+			DriverVersion:        h.DriverVersion,
+			OSType:               h.OSType,
+			OSName:               h.OSName,
+			OSArchitecture:       h.OSArchitecture,
+			OSVersion:            h.OSVersion,
+			Platform:             h.Platform,
+			RequestedCompression: h.Compression,
+			SaslSupportedMechs:   h.SaslSupportedMechs,
+		},
+		hello: e,
+		seen:  e.End,
+	}
+}
+
+// Stop tracking a connection. A handshake that never received a reply is
+// still recorded.
+func (t *ConnectionTracker) close(k connKey) {
+	st := t.conns[k]
+	if st == nil {
+		return
+	}
+	delete(t.conns, k)
+	if st.hello != nil {
+		t.done = append(t.done, st.evt)
+	}
+}
+
+// Forget connections that have been idle for too long
+func (t *ConnectionTracker) prune() {
+	if t.last.Sub(t.pruned) < connectionIdle {
+		return
+	}
+	for k, st := range t.conns {
+		if t.last.Sub(st.seen) > connectionIdle {
+			t.close(k)
+		}
+	}
+	t.pruned = t.last
+}
@@ -0,0 +1,122 @@
+package mongopacket
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestConnectionTracker(t *testing.T) {
+	tr := NewConnectionTracker()
+	add := func(e, req *MongoEvent) *MongoEvent {
+		e.AppName = ""
+		tr.Add(e, req)
+		return e
+	}
+	hello := bson.D{
+		{Key: "hello", Value: int32(1)},
+		{Key: "client", Value: bson.D{
+			{Key: "application", Value: bson.D{{Key: "name", Value: "billing"}}},
+			{Key: "driver", Value: bson.D{{Key: "name", Value: "nodejs"}, {Key: "version", Value: "4.1.0"}}},
+			{Key: "os", Value: bson.D{
+				{Key: "type", Value: "Linux"}, {Key: "name", Value: "linux"},
+				{Key: "architecture", Value: "x64"}, {Key: "version", Value: "5.10.0"},
+			}},
+			{Key: "platform", Value: "Node.js v16.13.0, LE"},
+		}},
+		{Key: "compression", Value: bson.A{"zstd", "snappy"}},
+		{Key: "saslSupportedMechs", Value: "admin.alice"},
+		{Key: "$db", Value: "admin"},
+	}
+	helloReply := bson.D{
+		{Key: "isWritablePrimary", Value: true},
+		{Key: "maxBsonObjectSize", Value: int32(16777216)},
+		{Key: "maxMessageSizeBytes", Value: int32(48000000)},
+		{Key: "compression", Value: bson.A{"zstd"}},
+		{Key: "connectionId", Value: int32(42)},
+		{Key: "minWireVersion", Value: int32(0)},
+		{Key: "maxWireVersion", Value: int32(13)},
+		{Key: "saslSupportedMechs", Value: bson.A{"SCRAM-SHA-1", "SCRAM-SHA-256"}},
+		{Key: "ok", Value: 1.0},
+	}
+	find := bson.D{{Key: "find", Value: "invoices"}, {Key: "$db", Value: "billing"}}
+	ok := bson.D{{Key: "ok", Value: 1.0}}
+
+	// The handshake is recorded once answered, and labels the events that
+	// follow in both directions
+	a := &testConn{t: t, port: "50001"}
+	req := a.send(hello)
+	req.StreamID = 7
+	add(req, nil)
+	add(a.answer(req, helloReply), req)
+	done := tr.Finished()
+	if len(done) != 1 {
+		t.Fatalf("%d handshakes, want 1", len(done))
+	}
+	want := ConnectionEvent{
+		StreamID: 7, SrcIP: "10.2.3.4", SrcPort: "50001", DstIP: "10.1.0.9", DstPort: "27017(mongodb)", Time: testTime(0),
+		AppName: "billing", Driver: "nodejs 4.1.0", DriverName: "nodejs", DriverVersion: "4.1.0",
+		OSType: "Linux", OSName: "linux", OSArchitecture: "x64", OSVersion: "5.10.0", Platform: "Node.js v16.13.0, LE",
+		RequestedCompression: []string{"zstd", "snappy"}, SaslSupportedMechs: "admin.alice",
+		Replied: true, MaxWireVersion: 13, Compression: []string{"zstd"}, ConnectionID: 42, MaxMessageSizeBytes: 48000000,
+		ServerSaslMechs: []string{"SCRAM-SHA-1", "SCRAM-SHA-256"},
+	}
+	if !reflect.DeepEqual(*done[0], want) {
+		t.Errorf("handshake:\n got %+v\nwant %+v", *done[0], want)
+	}
+	req = add(a.send(find), nil)
+	reply := add(a.answer(req, ok), req)
+	for _, e := range []*MongoEvent{req, reply} {
+		if e.AppName != "billing" || e.Driver != "nodejs 4.1.0" {
+			t.Errorf("event %d labelled %q %q", e.Op.GetHeader().RequestID, e.AppName, e.Driver)
+		}
+	}
+
+	// Monitoring handshakes without client metadata don't reopen it
+	req = add(a.send(bson.D{{Key: "hello", Value: int32(1)}, {Key: "$db", Value: "admin"}}), nil)
+	add(a.answer(req, helloReply), req)
+	if done := tr.Finished(); len(done) != 0 {
+		t.Errorf("heartbeat recorded as %d handshakes", len(done))
+	}
+	if req.AppName != "billing" {
+		t.Errorf("heartbeat labelled %q", req.AppName)
+	}
+
+	// A handshake that isn't answered is recorded when the connection ends
+	b := &testConn{t: t, port: "50002", at: a.at}
+	add(b.send(hello), nil)
+	end := b.send(find)
+	end.StreamEnd = 1
+	add(end, nil)
+	if done := tr.Finished(); len(done) != 1 || done[0].SrcPort != "50002" || done[0].Replied {
+		t.Errorf("unanswered handshake: %+v", done)
+	}
+	if e := add(b.send(find), nil); e.AppName != "" {
+		t.Errorf("event after the connection ended labelled %q", e.AppName)
+	}
+
+	// Connections idle for longer than connectionIdle are forgotten once a
+	// later event is seen, and one still awaiting its reply is recorded
+	c := &testConn{t: t, port: "50003", at: b.at}
+	req = add(c.send(hello), nil)
+	add(c.answer(req, helloReply), req)
+	e := &testConn{t: t, port: "50005", at: c.at}
+	add(e.send(hello), nil)
+	tr.Finished()
+	d := &testConn{t: t, port: "50004", at: c.at + connectionIdle + time.Minute}
+	add(d.send(hello), nil)
+	if done := tr.Finished(); len(done) != 1 || done[0].SrcPort != "50005" || done[0].Replied {
+		t.Errorf("idle connections: %+v", done)
+	}
+	c.at = d.at
+	if e := add(c.send(find), nil); e.AppName != "" {
+		t.Errorf("event on an idle connection labelled %q", e.AppName)
+	}
+
+	// Handshakes still awaiting replies end with the capture
+	if done := tr.Close(); len(done) != 1 || done[0].SrcPort != "50004" || done[0].Replied || done[0].AppName != "billing" {
+		t.Errorf("capture end: %+v", done)
+	}
+}
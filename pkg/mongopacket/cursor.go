@@ -0,0 +1,214 @@
+package mongopacket
+
+import (
+	"time"
+
+	"github.com/phensley/mongopacket/pkg/protocol"
+)
+
+// Identifies a cursor by the server that owns it and its id
+type cursorKey struct {
+	server string
+	id     int64
+}
+
+type cursorState struct {
+	evt       *CursorEvent
+	lastReply time.Time // when the most recent batch was received
+}
+
+// CursorTracker follows cursors from the command or query that opened them,
+// through their getMores, until they are exhausted or killed. Both OP_MSG
+// commands and the legacy OP_QUERY, OP_GET_MORE and OP_KILL_CURSORS messages
+// are understood.
+type CursorTracker struct {
+	cursors map[cursorKey]*cursorState
+	done    []*CursorEvent
+	last    time.Time
+}
+
+// NewCursorTracker ..
+func NewCursorTracker() *CursorTracker {
+	return &CursorTracker{
+		cursors: map[cursorKey]*cursorState{},
+	}
+}
+
+// Add an event to the tracker. For replies, req is the matching request if
+// it was seen, see RequestMatcher.
+func (t *CursorTracker) Add(e *MongoEvent, req *MongoEvent) {
+	if e.End.After(t.last) {
+		t.last = e.End
+	}
+
+	if !protocol.IsResponse(e.Op) {
+		t.request(e)
+		return
+	}
+	if req == nil {
+		return
+	}
+
+	server := endpoint(e.SrcIP, e.SrcPort)
+
+	// Legacy replies to OP_GET_MORE and OP_QUERY that isn't a command
+	if o, ok := e.Op.(*protocol.Reply); ok {
+		switch r := req.Op.(type) {
+		case *protocol.GetMore:
+			k := cursorKey{server, r.CursorID}
+			if o.Flags&protocol.ReplyFlagCursorNotFound != 0 {
+				t.finish(k, e.End, CursorNotFound)
+				return
+			}
+			t.batch(k, req, e, r.FullCollectionName, int(o.NumberReturned), o.CursorID == 0)
+			return
+
+		case *protocol.Query:
+			if protocol.CommandOf(r) == nil {
+				if o.CursorID != 0 && o.Flags&protocol.ReplyFlagQueryFailure == 0 {
+					k := cursorKey{server, o.CursorID}
+					t.open(k, req, e, r.FullCollectionName, "query", int(o.NumberReturned))
+				}
+				return
+			}
+		}
+	}
+
+	// Command replies
+	cmd := protocol.CommandOf(req.Op)
+	doc := protocol.ReplyOf(e.Op)
+	if cmd == nil || doc == nil {
+		return
+	}
+	status, _ := protocol.IntValue(doc.Lookup("ok"))
+
+	if cmd.Name == "getMore" {
+		id, _ := protocol.IntValue(cmd.Body.Lookup("getMore"))
+		k := cursorKey{server, id}
+		if status == 0 {
+			code, _ := protocol.IntValue(doc.Lookup("code"))
+			if code == protocol.CodeCursorNotFound {
+				t.finish(k, e.End, CursorNotFound)
+			} else {
+				t.finish(k, e.End, CursorError)
+			}
+			return
+		}
+		ns := cmd.Database
+		if coll, ok := cmd.Body.Lookup("collection").StringValueOK(); ok {
+			ns += "." + coll
+		}
+		next, _ := protocol.IntValue(doc.Lookup("cursor", "id"))
+		n := arrayLen(doc.Lookup("cursor", "nextBatch"))
+		t.batch(k, req, e, ns, n, next == 0)
+		return
+	}
+
+	// Any other command that returns a cursor opens it
+	if status == 0 {
+		return
+	}
+	id, _ := protocol.IntValue(doc.Lookup("cursor", "id"))
+	if id == 0 {
+		return
+	}
+	ns, found := doc.Lookup("cursor", "ns").StringValueOK()
+	if !found {
+		ns = cmd.Namespace()
+	}
+	n := arrayLen(doc.Lookup("cursor", "firstBatch"))
+	t.open(cursorKey{server, id}, req, e, ns, cmd.Name, n)
+}
+
+// Finished returns the cursors that have ended since the last call
+func (t *CursorTracker) Finished() []*CursorEvent {
+	done := t.done
+	t.done = nil
+	return done
+}
+
+// Close ends all open cursors at the time of the last event seen, and returns
+// the cursors that have ended since the last call to Finished.
+func (t *CursorTracker) Close() []*CursorEvent {
+	for k := range t.cursors {
+		t.finish(k, t.last, CursorCaptureEnd)
+	}
+	return t.Finished()
+}
+
+// Handle cursors killed by a request
+func (t *CursorTracker) request(e *MongoEvent) {
+	server := endpoint(e.DstIP, e.DstPort)
+
+	var ids []int64
+	if o, ok := e.Op.(*protocol.KillCursors); ok {
+		ids = o.CursorIDs
+	} else if cmd := protocol.CommandOf(e.Op); cmd != nil && cmd.Name == "killCursors" {
+		ids = intValues(cmd.Body.Lookup("cursors"))
+	}
+	for _, id := range ids {
+		t.finish(cursorKey{server, id}, e.Start, CursorKilled)
+	}
+}
+
+// Start tracking a cursor opened by req, with the first batch in reply
+func (t *CursorTracker) open(k cursorKey, req, reply *MongoEvent, ns, cmd string, n int) {
+	evt := newCursorEvent(k, req, ns)
+	evt.Command = cmd
+	evt.Batches = 1
+	evt.Documents = n
+	t.cursors[k] = &cursorState{
+		evt:       evt,
+		lastReply: reply.End,
+	}
+}
+
+// Record a batch returned by a getMore. Cursors opened before the capture
+// started are tracked from their first getMore.
+func (t *CursorTracker) batch(k cursorKey, req, reply *MongoEvent, ns string, n int, exhausted bool) {
+	st := t.cursors[k]
+	if st == nil {
+		st = &cursorState{evt: newCursorEvent(k, req, ns)}
+		t.cursors[k] = st
+	} else if idle := req.Start.Sub(st.lastReply); idle > 0 {
+		st.evt.IdleTotal += idle
+		if idle > st.evt.IdleMax {
+			st.evt.IdleMax = idle
+		}
+	}
+
+	st.evt.Batches++
+	st.evt.Documents += n
+	st.lastReply = reply.End
+
+	if exhausted {
+		t.finish(k, reply.End, CursorExhausted)
+	}
+}
+
+// Stop tracking a cursor
+func (t *CursorTracker) finish(k cursorKey, end time.Time, reason string) {
+	st := t.cursors[k]
+	if st == nil {
+		return
+	}
+	delete(t.cursors, k)
+
+	st.evt.End = end
+	st.evt.EndReason = reason
+	t.done = append(t.done, st.evt)
+}
+
+func newCursorEvent(k cursorKey, req *MongoEvent, ns string) *CursorEvent {
+	return &CursorEvent{
+		Group:     req.Group,
+		CursorID:  k.id,
+		StreamID:  req.StreamID,
+		SrcIP:     req.SrcIP,
+		SrcPort:   req.SrcPort,
+		DstIP:     req.DstIP,
+		DstPort:   req.DstPort,
+		Namespace: ns,
+		Start:     req.Start,
+	}
+}
@@ -0,0 +1,133 @@
+package mongopacket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/phensley/mongopacket/pkg/protocol"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// A legacy request sent by the client
+func (c *testConn) sendOp(op protocol.Op) *MongoEvent {
+	c.id++
+	op.GetHeader().RequestID = c.id
+	at := testTime(c.at)
+	c.at += 5 * time.Millisecond
+	return &MongoEvent{
+		Start: at, End: at,
+		SrcIP: "10.2.3.4", SrcPort: c.port, DstIP: "10.1.0.9", DstPort: "27017(mongodb)",
+		Op: op, AppName: "shop",
+	}
+}
+
+// The server's legacy reply to a request
+func (c *testConn) answerOp(req *MongoEvent, reply *protocol.Reply) *MongoEvent {
+	e := c.sendOp(reply)
+	reply.ResponseTo = req.Op.GetHeader().RequestID
+	e.SrcIP, e.SrcPort, e.DstIP, e.DstPort = e.DstIP, e.DstPort, e.SrcIP, e.SrcPort
+	return e
+}
+
+func getMore(id int64) bson.D {
+	return bson.D{{Key: "getMore", Value: id}, {Key: "collection", Value: "orders"}, {Key: "$db", Value: "shop"}}
+}
+
+func cursorReply(batch string, id int64, n int) bson.D {
+	docs := bson.A{}
+	for i := 0; i < n; i++ {
+		docs = append(docs, bson.D{{Key: "_id", Value: int32(i)}})
+	}
+	return bson.D{
+		{Key: "cursor", Value: bson.D{{Key: batch, Value: docs}, {Key: "id", Value: id}, {Key: "ns", Value: "shop.orders"}}},
+		{Key: "ok", Value: 1.0},
+	}
+}
+
+func TestCursorTracker(t *testing.T) {
+	tr := NewCursorTracker()
+	c := &testConn{t: t, port: "50123"}
+	exchange := func(body, reply bson.D) {
+		req := c.send(body)
+		tr.Add(req, nil)
+		tr.Add(c.answer(req, reply), req)
+	}
+	find := bson.D{{Key: "find", Value: "orders"}, {Key: "$db", Value: "shop"}}
+
+	// Read to the end, requesting batches 25ms and 55ms after the last
+	exchange(find, cursorReply("firstBatch", 101, 2))
+	c.at += 20 * time.Millisecond
+	exchange(getMore(101), cursorReply("nextBatch", 101, 3))
+	c.at += 50 * time.Millisecond
+	exchange(getMore(101), cursorReply("nextBatch", 0, 1))
+	exhaustedAt := testTime(c.at - 5*time.Millisecond)
+
+	// Killed by the client
+	exchange(bson.D{{Key: "aggregate", Value: "orders"}, {Key: "pipeline", Value: bson.A{}}, {Key: "$db", Value: "shop"}},
+		cursorReply("firstBatch", 102, 1))
+	killedAt := testTime(c.at)
+	exchange(bson.D{{Key: "killCursors", Value: "orders"}, {Key: "cursors", Value: bson.A{int64(102)}}, {Key: "$db", Value: "shop"}},
+		bson.D{{Key: "cursorsKilled", Value: bson.A{int64(102)}}, {Key: "ok", Value: 1.0}})
+
+	// Timed out on the server
+	exchange(find, cursorReply("firstBatch", 103, 1))
+	exchange(getMore(103), bson.D{
+		{Key: "ok", Value: 0.0}, {Key: "code", Value: int32(protocol.CodeCursorNotFound)}, {Key: "codeName", Value: "CursorNotFound"},
+	})
+
+	// Opened before the capture started, and still open when it ends with
+	// the last event seen
+	exchange(getMore(104), cursorReply("nextBatch", 104, 4))
+
+	// A legacy query whose getMore finds the cursor gone
+	query := c.sendOp(&protocol.Query{
+		Header:             &protocol.Header{OpCode: protocol.OpQuery},
+		FullCollectionName: "shop.orders",
+		Query:              protocol.NewDocument(bson.Raw{5, 0, 0, 0, 0}),
+	})
+	tr.Add(query, nil)
+	tr.Add(c.answerOp(query, &protocol.Reply{Header: &protocol.Header{OpCode: protocol.OpReply}, CursorID: 105, NumberReturned: 2}), query)
+	more := c.sendOp(&protocol.GetMore{Header: &protocol.Header{OpCode: protocol.OpGetMore}, FullCollectionName: "shop.orders", CursorID: 105})
+	tr.Add(more, nil)
+	tr.Add(c.answerOp(more, &protocol.Reply{Header: &protocol.Header{OpCode: protocol.OpReply}, Flags: protocol.ReplyFlagCursorNotFound}), more)
+	legacyAt := testTime(c.at - 5*time.Millisecond)
+
+	got := map[int64]*CursorEvent{}
+	for _, e := range append(tr.Finished(), tr.Close()...) {
+		got[e.CursorID] = e
+	}
+	want := []CursorEvent{
+		{CursorID: 101, Command: "find", Start: testTime(0), End: exhaustedAt, Batches: 3, Documents: 6,
+			IdleTotal: 80 * time.Millisecond, IdleMax: 55 * time.Millisecond, EndReason: CursorExhausted},
+		{CursorID: 102, Command: "aggregate", End: killedAt, Batches: 1, Documents: 1, EndReason: CursorKilled},
+		{CursorID: 103, Command: "find", Batches: 1, Documents: 1, EndReason: CursorNotFound},
+		{CursorID: 104, End: legacyAt, Batches: 1, Documents: 4, EndReason: CursorCaptureEnd},
+		{CursorID: 105, Command: "query", End: legacyAt, Batches: 1, Documents: 2, EndReason: CursorNotFound},
+	}
+	if len(got) != len(want) {
+		t.Errorf("%d cursors ended, want %d", len(got), len(want))
+	}
+	for _, w := range want {
+		e := got[w.CursorID]
+		if e == nil {
+			t.Errorf("cursor %d not ended", w.CursorID)
+			continue
+		}
+		if e.Namespace != "shop.orders" || e.SrcPort != "50123" || e.DstIP != "10.1.0.9" {
+			t.Errorf("cursor %d on %s from %s to %s", w.CursorID, e.Namespace, e.SrcPort, e.DstIP)
+		}
+		if e.Command != w.Command || e.Batches != w.Batches || e.Documents != w.Documents || e.EndReason != w.EndReason {
+			t.Errorf("cursor %d: got %s %d batches %d documents %s, want %s %d %d %s", w.CursorID,
+				e.Command, e.Batches, e.Documents, e.EndReason, w.Command, w.Batches, w.Documents, w.EndReason)
+		}
+		if e.IdleTotal != w.IdleTotal || e.IdleMax != w.IdleMax {
+			t.Errorf("cursor %d idle %v max %v, want %v %v", w.CursorID, e.IdleTotal, e.IdleMax, w.IdleTotal, w.IdleMax)
+		}
+		if !w.Start.IsZero() && !e.Start.Equal(w.Start) {
+			t.Errorf("cursor %d started %v, want %v", w.CursorID, e.Start, w.Start)
+		}
+		if !w.End.IsZero() && !e.End.Equal(w.End) {
+			t.Errorf("cursor %d ended %v, want %v", w.CursorID, e.End, w.End)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package mongopacket
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/phensley/mongopacket/pkg/protocol"
+)
+
+// Dumper prints each event on one line: time, connection, direction, and a
+// summary of the op. Verbose output adds the op's documents, one per line.
+type Dumper struct {
+	Out       io.Writer
+	Verbose   bool
+	MaxLength int     // longest summary printed, see protocol.Summary
+	Filter    *Filter // events printed, or nil for all of them
+}
+
+// Event prints an event if it matches the filter. For replies, req is the
+// matching request if it was seen. Its signature matches TCPStream.Handler.
+func (d *Dumper) Event(e *MongoEvent, req *MongoEvent) {
+	if !d.Filter.Match(e, req) {
+		return
+	}
+
+	// Connections are always shown client first
+	client := endpoint(e.SrcIP, e.SrcPort)
+	server := endpoint(e.DstIP, e.DstPort)
+	dir := "->"
+	if protocol.IsResponse(e.Op) {
+		client, server = server, client
+		dir = "<-"
+	}
+
+	line := fmt.Sprintf("%s %s %s %s %s",
+		e.Start.UTC().Format("2006-01-02T15:04:05.000000Z"),
+		client, dir, server,
+		protocol.Summary(e.Op, d.MaxLength))
+	if req != nil {
+		line += fmt.Sprintf(" (%s)", e.End.Sub(req.Start).Round(time.Microsecond))
+	}
+	fmt.Fprintln(d.Out, line)
+
+	if d.Verbose {
+		protocol.EachDocument(e.Op, func(doc *protocol.Document, seq string) {
+			if seq != "" {
+				fmt.Fprintf(d.Out, "    %s: %s\n", seq, doc)
+			} else {
+				fmt.Fprintf(d.Out, "    %s\n", doc)
+			}
+		})
+	}
+}
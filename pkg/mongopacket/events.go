@@ -11,8 +11,14 @@ type EventType int
 
 // Types of events we can log
 const (
-	EventTypePacket EventType = 1
-	EventTypeMongo  EventType = 2
+	EventTypePacket      EventType = 1
+	EventTypeMongo       EventType = 2
+	EventTypeDecodeError EventType = 3
+	EventTypeCursor      EventType = 4
+	EventTypeTransaction EventType = 5
+	EventTypeRetry       EventType = 6
+	EventTypeConnection  EventType = 7
+	EventTypeAuth        EventType = 8
 )
 
 // PacketEvent describes an individual packet
@@ -48,14 +54,236 @@ type MongoEvent struct {
 	SrcPort     string
 	DstIP       string
 	DstPort     string
-	Op          protocol.Op    // wire protocol message
-	Packets     []*EventPacket // packets that contained part of the Op data
+	Op          protocol.Op       // wire protocol message
+	Outcome     *protocol.Outcome // outcome reported by a reply, nil for requests
+	Auth        *protocol.Auth    // authentication step sent by the client, if any
+	Shape       *protocol.Shape   // shape of the query sent by the client, if any
+	AppName     string            // application name from the connection's handshake
+	Driver      string            // driver name and version from the connection's handshake
+	Columns     []interface{}     // values of the user-defined columns, see Columns
+	Packets     []*EventPacket    // packets that contained part of the Op data
 }
 
 // EventPacket describes a packet
 type EventPacket struct {
-	Time   string
-	Start  bool
-	End    bool
-	Length int64
+	Time   string `json:"time"`
+	Start  bool   `json:"start"`
+	End    bool   `json:"end"`
+	Length int64  `json:"length"`
+}
+
+// DecodeErrorEvent records a message that could not be decoded
+type DecodeErrorEvent struct {
+	Group         string
+	EventID       uint64    // unique id of this event across all streams
+	Time          time.Time // earliest packet seen for the message
+	StreamID      uint64    // id of the stream the message belongs to
+	SrcIP         string
+	SrcPort       string
+	DstIP         string
+	DstPort       string
+	Kind          string // kind of error, see protocol.ErrorKind
+	OpCode        string // opcode of the message, if the header was decoded
+	Offset        int    // byte offset of the error within the message, or -1
+	Field         string // field being decoded, if known
+	MessageLength int    // message length from the header
+	Packets       int    // number of packets that contained part of the message
+	Error         string // full error description
+}
+
+// Ways a cursor can end
+const (
+	CursorExhausted  = "exhausted"   // the database returned a cursor id of 0
+	CursorKilled     = "killed"      // the client killed the cursor
+	CursorNotFound   = "not_found"   // the database no longer knew the cursor
+	CursorError      = "error"       // a getMore failed for another reason
+	CursorCaptureEnd = "capture_end" // the capture ended while the cursor was open
+)
+
+// CursorEvent describes the lifetime of a cursor, from the request that
+// opened it to the reply, kill or capture end that finished it.
+type CursorEvent struct {
+	Group     string
+	CursorID  int64
+	StreamID  uint64 // id of the client stream that opened the cursor
+	SrcIP     string // client
+	SrcPort   string
+	DstIP     string // server
+	DstPort   string
+	Namespace string
+	Command   string        // command that opened the cursor, empty if opened before the capture
+	Start     time.Time     // when the opening request was sent
+	End       time.Time     // when the cursor ended
+	Batches   int           // number of batches returned, including the first
+	Documents int           // total documents returned
+	IdleTotal time.Duration // total time between receiving a batch and requesting the next
+	IdleMax   time.Duration // longest time between receiving a batch and requesting the next
+	EndReason string        // how the cursor ended, one of the Cursor* values
+}
+
+// Ways a transaction can end
+const (
+	TransactionCommitted    = "committed"     // commitTransaction succeeded
+	TransactionAborted      = "aborted"       // the client sent abortTransaction
+	TransactionError        = "error"         // a statement failed and the transaction was not committed
+	TransactionCommitFailed = "commit_failed" // commitTransaction failed and was not retried successfully
+	TransactionAbandoned    = "abandoned"     // the session moved on to another transaction
+	TransactionCaptureEnd   = "capture_end"   // the capture ended while the transaction was open
+)
+
+// TransactionEvent describes a multi-document transaction, identified by its
+// logical session id and transaction number.
+type TransactionEvent struct {
+	Group       string
+	SessionID   string // lsid.id
+	TxnNumber   int64
+	StreamID    uint64 // id of the client stream that sent the first statement
+	SrcIP       string // client
+	SrcPort     string
+	DstIP       string // server
+	DstPort     string
+	Start       time.Time               // when the first statement was sent
+	CommitStart time.Time               // when commitTransaction or abortTransaction was first sent, if it was
+	End         time.Time               // when the transaction ended
+	Started     bool                    // the first statement seen carried startTransaction
+	Statements  []*TransactionStatement // statements in the order they were sent
+	Outcome     string                  // how the transaction ended, one of the Transaction* values
+	ErrorCode   int64                   // code of the last error, if any
+	ErrorName   string                  // code name of the last error, if any
+	ErrorLabels []string                // error labels seen in any reply
+}
+
+// TransactionStatement is one command sent within a transaction
+type TransactionStatement struct {
+	Time      string // when the statement was sent
+	Command   string
+	Namespace string
+	RequestID uint32
+	Replied   bool  // a reply to the statement was seen
+	OK        bool  // the reply reported success
+	ErrorCode int64 // error code from the reply, if any
+}
+
+// RetryEvent describes a retried write: a request that repeats the lsid,
+// txnNumber and stmtId of an earlier request, possibly on another connection.
+type RetryEvent struct {
+	Group     string
+	SessionID string
+	TxnNumber int64
+	StmtID    int32
+	Command   string
+	Namespace string
+	Attempt   int       // 2 for the first retry, 3 for the second, and so on
+	Time      time.Time // when the retry was sent
+	RequestID uint32
+	StreamID  uint64
+	SrcIP     string
+	SrcPort   string
+	DstIP     string
+	DstPort   string
+
+	// The original attempt
+	OriginalTime      time.Time
+	OriginalRequestID uint32
+	OriginalStreamID  uint64
+	OriginalDstIP     string
+	OriginalDstPort   string
+	SameConnection    bool // the retry was sent on the same connection as the previous attempt
+
+	// Reply to the previous attempt, which triggered the retry
+	PreviousReplied     bool      // false if no reply was seen, e.g. the connection failed
+	PreviousReplyTime   time.Time // when the reply was received, if it was
+	PreviousErrorCode   int64
+	PreviousErrorName   string
+	PreviousErrorLabels []string
+}
+
+// RetryRate counts the retries sent in one second
+type RetryRate struct {
+	Time    time.Time
+	Retries int
+}
+
+// ConnectionEvent describes a connection, from the handshake the client
+// sends when it connects and the server's reply.
+type ConnectionEvent struct {
+	Group    string
+	StreamID uint64 // id of the client stream
+	SrcIP    string // client
+	SrcPort  string
+	DstIP    string // server
+	DstPort  string
+	Time     time.Time // when the handshake was sent
+
+	// Client metadata
+	AppName              string
+	Driver               string // driver name and version
+	DriverName           string
+	DriverVersion        string
+	OSType               string
+	OSName               string
+	OSArchitecture       string
+	OSVersion            string
+	Platform             string
+	RequestedCompression []string // compressors the client supports
+	SaslSupportedMechs   string   // user whose authentication mechanisms were requested
+
+	// Server reply
+	Replied             bool // false if no reply to the handshake was seen
+	MaxWireVersion      int64
+	MinWireVersion      int64
+	Compression         []string // compressors the server chose
+	ConnectionID        int64
+	MaxMessageSizeBytes int64
+	ServerSaslMechs     []string // authentication mechanisms available to the user
+}
+
+// Ways an authentication conversation can end
+const (
+	AuthSucceeded  = "succeeded"   // the server accepted the credentials
+	AuthFailed     = "failed"      // the server rejected the credentials
+	AuthIncomplete = "incomplete"  // the conversation was abandoned or not seen to finish
+	AuthCaptureEnd = "capture_end" // the capture ended during the conversation
+)
+
+// AuthEvent describes an authentication conversation on a connection. The
+// SASL payloads are never recorded.
+type AuthEvent struct {
+	Group       string
+	StreamID    uint64 // id of the client stream
+	SrcIP       string // client
+	SrcPort     string
+	DstIP       string // server
+	DstPort     string
+	AppName     string    // application name from the connection's handshake
+	Mechanism   string    // e.g. SCRAM-SHA-256, MONGODB-X509, GSSAPI or PLAIN
+	User        string    // user, if the mechanism reveals it
+	Database    string    // database the user is authenticated against
+	Speculative bool      // the conversation started in the connection handshake
+	Start       time.Time // when the first step was sent
+	End         time.Time // when the last reply was received
+	RoundTrips  int       // number of steps sent by the client
+	Outcome     string    // how the conversation ended, one of the Auth* values
+	ErrorCode   int64
+	ErrorName   string
+}
+
+// ShapeStats aggregates the requests that share a query shape
+type ShapeStats struct {
+	Group     string
+	Hash      string
+	Command   string
+	Namespace string
+	Shape     string
+	First     time.Time     // first request sent
+	Last      time.Time     // last request sent
+	Count     int           // requests sent
+	Replies   int           // requests whose reply was seen, giving their latency
+	Errors    int           // replies that reported an error
+	Total     time.Duration // total latency of the replies
+	Mean      time.Duration
+	P50       time.Duration
+	P90       time.Duration
+	P99       time.Duration
+	Max       time.Duration
 }
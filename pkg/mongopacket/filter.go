@@ -0,0 +1,900 @@
+package mongopacket
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/phensley/mongopacket/pkg/protocol"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// Filter selects events with an expression such as
+//
+//	cmd == "find" && ns =~ "^orders\." && latency > 100ms && src in 10.1.0.0/16
+//
+// Comparisons are joined with && and ||, negated with ! and grouped with
+// parentheses. A comparison is a field, an operator and a value:
+//
+//	==, !=, <, <=, >, >=   compare strings, numbers, durations, times and addresses
+//	=~, !~                 match a regular expression
+//	in, not in             test membership of a list [a, b] or a CIDR block
+//
+// A field on its own tests that it is present and not false, zero or empty.
+// Values are quoted strings or bare words, which are read as booleans,
+// numbers, durations, RFC 3339 times, addresses or strings, in that order.
+// A bare number compared with a duration is in milliseconds.
+//
+// Replies are filtered on the command, namespace and application of the
+// request they respond to. Fields that don't apply to an event, such as
+// latency for requests, are missing, and comparisons with missing fields are
+// false. See FilterFields for the fields, and FilterQueue to keep requests
+// whose replies match a filter on latency.
+type Filter struct {
+	expr    filterNode
+	src     string
+	latency bool // the expression refers to latency
+}
+
+// FilterFields describes the fields a filter expression can refer to. A
+// field starting with doc. looks up a path in the event's command, reply or
+// first document, e.g. doc.filter.status or doc.cursor.id.
+var FilterFields = map[string]string{
+	"opcode":      "opcode name, e.g. OP_MSG",
+	"id":          "request id from the header",
+	"response_to": "id of the request a reply responds to",
+	"len":         "message length in bytes",
+	"compressed":  "the message was compressed",
+	"reply":       "the message was sent by the database",
+	"cmd":         "command name, or the opcode of a legacy op",
+	"ns":          "database.collection, or the database of a command without a collection",
+	"db":          "database",
+	"coll":        "collection",
+	"app":         "application name from the connection's handshake",
+	"driver":      "driver name and version from the connection's handshake",
+	"user":        "user authenticating, for authentication steps",
+	"shape":       "query shape hash",
+	"ok":          "the reply reported success",
+	"error":       "the reply reported an error",
+	"code":        "error code from the reply",
+	"codename":    "error code name from the reply",
+	"errmsg":      "error message from the reply",
+	"src":         "source address",
+	"dst":         "destination address",
+	"src_port":    "source port",
+	"dst_port":    "destination port",
+	"client":      "client address",
+	"server":      "database address",
+	"stream":      "id of the TCP stream",
+	"time":        "when the message was sent",
+	"latency":     "time from the request to the reply, for replies",
+}
+
+// ParseFilter parses a filter expression
+func ParseFilter(src string) (*Filter, error) {
+	toks, err := lexFilter(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{toks: toks}
+	expr, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.errorf(t, "unexpected %s", t)
+	}
+	return &Filter{expr: expr, src: src, latency: p.latency}, nil
+}
+
+func (f *Filter) String() string {
+	return f.src
+}
+
+// Match evaluates the filter against an event. For replies, req is the
+// matching request if it was seen. A nil filter matches every event.
+func (f *Filter) Match(e *MongoEvent, req *MongoEvent) bool {
+	if f == nil {
+		return true
+	}
+	return f.expr.eval(&filterEvent{e: e, req: req})
+}
+
+// FilteredEvent is an event kept by a FilterQueue, along with the request
+// it replies to, if any
+type FilteredEvent struct {
+	Event   *MongoEvent
+	Request *MongoEvent
+}
+
+// FilterQueue applies a filter to events in capture order. Latency is only
+// known once the reply is seen, so when the filter refers to latency each
+// request awaiting a reply is held back, and kept just before its reply if
+// either matches. A request whose reply isn't seen within requestTimeout,
+// or by the end of the capture, is kept if it matches on its own.
+type FilterQueue struct {
+	filter *Filter
+	held   map[*MongoEvent]bool // requests awaiting replies, and whether each matched on its own
+	last   time.Time
+	pruned time.Time
+}
+
+// NewFilterQueue ..
+func NewFilterQueue(f *Filter) *FilterQueue {
+	return &FilterQueue{
+		filter: f,
+		held:   map[*MongoEvent]bool{},
+	}
+}
+
+// Add an event to the queue, returning the events kept in the order they
+// should be handled. For replies, req is the matching request if it was
+// seen, see RequestMatcher.
+func (q *FilterQueue) Add(e *MongoEvent, req *MongoEvent) []FilteredEvent {
+	if q.filter == nil || !q.filter.latency {
+		if q.filter.Match(e, req) {
+			return []FilteredEvent{{e, req}}
+		}
+		return nil
+	}
+
+	if e.End.After(q.last) {
+		q.last = e.End
+	}
+	kept := q.prune()
+
+	matched := q.filter.Match(e, req)
+	if !protocol.IsResponse(e.Op) {
+		if expectsReply(e.Op) {
+			q.held[e] = matched
+		} else if matched {
+			kept = append(kept, FilteredEvent{e, nil})
+		}
+		return kept
+	}
+
+	if alone, ok := q.held[req]; ok {
+		delete(q.held, req)
+		if alone || matched {
+			kept = append(kept, FilteredEvent{req, nil})
+		}
+	}
+	if matched {
+		kept = append(kept, FilteredEvent{e, req})
+	}
+	return kept
+}
+
+// Close returns the requests still held that match on their own, as the
+// capture ends
+func (q *FilterQueue) Close() []FilteredEvent {
+	return q.release(func(e *MongoEvent) bool { return true })
+}
+
+// Release requests that have waited too long for a reply, in step with
+// RequestMatcher, which forgets them too
+func (q *FilterQueue) prune() []FilteredEvent {
+	if q.last.Sub(q.pruned) < requestTimeout {
+		return nil
+	}
+	q.pruned = q.last
+	return q.release(func(e *MongoEvent) bool {
+		return q.last.Sub(e.End) > requestTimeout
+	})
+}
+
+// Stop holding the requests selected, returning those that match on their
+// own in time order
+func (q *FilterQueue) release(expired func(e *MongoEvent) bool) []FilteredEvent {
+	var kept []FilteredEvent
+	for e, alone := range q.held {
+		if !expired(e) {
+			continue
+		}
+		delete(q.held, e)
+		if alone {
+			kept = append(kept, FilteredEvent{e, nil})
+		}
+	}
+	sort.Slice(kept, func(i, j int) bool {
+		return kept[i].Event.Start.Before(kept[j].Event.Start)
+	})
+	return kept
+}
+
+// An event being filtered, with the values derived from it looked up once
+type filterEvent struct {
+	e   *MongoEvent
+	req *MongoEvent
+
+	cmd     *protocol.Command
+	ns      string
+	doc     *protocol.Document
+	request bool
+	body    bool
+}
+
+// The request an event belongs to: the event itself, or the request a reply
+// responds to. Nil if the reply's request wasn't seen.
+func (x *filterEvent) requestEvent() *MongoEvent {
+	if !x.request {
+		x.request = true
+		r := x.e
+		if protocol.IsResponse(x.e.Op) {
+			r = x.req
+		}
+		if r != nil {
+			x.cmd = protocol.CommandOf(r.Op)
+			x.ns, _ = namespaceOf(r.Op)
+		}
+	}
+	if protocol.IsResponse(x.e.Op) {
+		return x.req
+	}
+	return x.e
+}
+
+// The command document, reply or first document of the event
+func (x *filterEvent) document() *protocol.Document {
+	if !x.body {
+		x.body = true
+		x.doc = opDocument(x.e.Op)
+	}
+	return x.doc
+}
+
+// Looks up a field's value, returning false if the field is missing
+type filterGetter func(x *filterEvent) (interface{}, bool)
+
+func nonEmpty(s string) (interface{}, bool) {
+	return s, s != ""
+}
+
+func parseIP(s string) (interface{}, bool) {
+	ip := net.ParseIP(s)
+	return ip, ip != nil
+}
+
+func parsePort(s string) (interface{}, bool) {
+	// Ports may be formatted with their service name, e.g. 27017(mongodb)
+	if i := strings.IndexByte(s, '('); i >= 0 {
+		s = s[:i]
+	}
+	n, err := strconv.Atoi(s)
+	return float64(n), err == nil
+}
+
+var filterGetters = map[string]filterGetter{
+	"opcode": func(x *filterEvent) (interface{}, bool) {
+		return x.e.Op.GetHeader().Type().String(), true
+	},
+	"id": func(x *filterEvent) (interface{}, bool) {
+		return float64(x.e.Op.GetHeader().RequestID), true
+	},
+	"response_to": func(x *filterEvent) (interface{}, bool) {
+		return float64(x.e.Op.GetHeader().ResponseTo), true
+	},
+	"len": func(x *filterEvent) (interface{}, bool) {
+		return float64(x.e.Op.GetHeader().MessageLength), true
+	},
+	"compressed": func(x *filterEvent) (interface{}, bool) {
+		return x.e.Op.GetHeader().Compressed, true
+	},
+	"reply": func(x *filterEvent) (interface{}, bool) {
+		return protocol.IsResponse(x.e.Op), true
+	},
+	"cmd": func(x *filterEvent) (interface{}, bool) {
+		r := x.requestEvent()
+		if r == nil {
+			return nil, false
+		}
+		if x.cmd != nil {
+			return x.cmd.Name, true
+		}
+		return r.Op.GetHeader().Type().String(), true
+	},
+	"ns": func(x *filterEvent) (interface{}, bool) {
+		x.requestEvent()
+		return nonEmpty(x.ns)
+	},
+	"db": func(x *filterEvent) (interface{}, bool) {
+		x.requestEvent()
+		db := x.ns
+		if i := strings.IndexByte(db, '.'); i >= 0 {
+			db = db[:i]
+		}
+		return nonEmpty(db)
+	},
+	"coll": func(x *filterEvent) (interface{}, bool) {
+		x.requestEvent()
+		if i := strings.IndexByte(x.ns, '.'); i >= 0 {
+			return nonEmpty(x.ns[i+1:])
+		}
+		return nil, false
+	},
+	"app": func(x *filterEvent) (interface{}, bool) {
+		return nonEmpty(x.e.AppName)
+	},
+	"driver": func(x *filterEvent) (interface{}, bool) {
+		return nonEmpty(x.e.Driver)
+	},
+	"user": func(x *filterEvent) (interface{}, bool) {
+		if r := x.requestEvent(); r != nil && r.Auth != nil {
+			return nonEmpty(r.Auth.User)
+		}
+		return nil, false
+	},
+	"shape": func(x *filterEvent) (interface{}, bool) {
+		if r := x.requestEvent(); r != nil && r.Shape != nil {
+			return r.Shape.Hash, true
+		}
+		return nil, false
+	},
+	"ok": func(x *filterEvent) (interface{}, bool) {
+		if o := x.e.Outcome; o != nil {
+			return o.OK, true
+		}
+		return nil, false
+	},
+	"error": func(x *filterEvent) (interface{}, bool) {
+		if o := x.e.Outcome; o != nil {
+			return o.HasError(), true
+		}
+		return nil, false
+	},
+	"code": func(x *filterEvent) (interface{}, bool) {
+		if o := x.e.Outcome; o != nil {
+			return float64(o.Code), true
+		}
+		return nil, false
+	},
+	"codename": func(x *filterEvent) (interface{}, bool) {
+		if o := x.e.Outcome; o != nil {
+			return nonEmpty(o.CodeName)
+		}
+		return nil, false
+	},
+	"errmsg": func(x *filterEvent) (interface{}, bool) {
+		if o := x.e.Outcome; o != nil {
+			return nonEmpty(o.Message)
+		}
+		return nil, false
+	},
+	"src": func(x *filterEvent) (interface{}, bool) {
+		return parseIP(x.e.SrcIP)
+	},
+	"dst": func(x *filterEvent) (interface{}, bool) {
+		return parseIP(x.e.DstIP)
+	},
+	"src_port": func(x *filterEvent) (interface{}, bool) {
+		return parsePort(x.e.SrcPort)
+	},
+	"dst_port": func(x *filterEvent) (interface{}, bool) {
+		return parsePort(x.e.DstPort)
+	},
+	"client": func(x *filterEvent) (interface{}, bool) {
+		if protocol.IsResponse(x.e.Op) {
+			return parseIP(x.e.DstIP)
+		}
+		return parseIP(x.e.SrcIP)
+	},
+	"server": func(x *filterEvent) (interface{}, bool) {
+		if protocol.IsResponse(x.e.Op) {
+			return parseIP(x.e.SrcIP)
+		}
+		return parseIP(x.e.DstIP)
+	},
+	"stream": func(x *filterEvent) (interface{}, bool) {
+		return float64(x.e.StreamID), true
+	},
+	"time": func(x *filterEvent) (interface{}, bool) {
+		return x.e.Start, true
+	},
+	"latency": func(x *filterEvent) (interface{}, bool) {
+		if x.req == nil || !protocol.IsResponse(x.e.Op) {
+			return nil, false
+		}
+		return x.e.End.Sub(x.req.Start), true
+	},
+}
+
+// Getter for a field name, or for a path into the event's document
+func filterField(name string) (filterGetter, bool) {
+	if g, ok := filterGetters[name]; ok {
+		return g, true
+	}
+	if !strings.HasPrefix(name, "doc.") || len(name) == len("doc.") {
+		return nil, false
+	}
+	path := strings.Split(strings.TrimPrefix(name, "doc."), ".")
+	return func(x *filterEvent) (interface{}, bool) {
+		d := x.document()
+		if d == nil {
+			return nil, false
+		}
+		return bsonFilterValue(d.Lookup(path...))
+	}, true
+}
+
+// Converts a BSON value to one a filter can compare
+func bsonFilterValue(v bson.RawValue) (interface{}, bool) {
+	switch v.Type {
+	case 0:
+		return nil, false
+	case bsontype.String, bsontype.Symbol, bsontype.JavaScript:
+		return v.StringValue(), true
+	case bsontype.Boolean:
+		return v.Boolean(), true
+	case bsontype.DateTime:
+		return v.Time(), true
+	case bsontype.ObjectID:
+		return v.ObjectID().Hex(), true
+	case bsontype.Int32:
+		return float64(v.Int32()), true
+	case bsontype.Int64:
+		return float64(v.Int64()), true
+	case bsontype.Double:
+		return v.Double(), true
+	case bsontype.Null, bsontype.Undefined:
+		return nil, false
+	}
+	return v.String(), true
+}
+
+// Nodes of a parsed expression
+type filterNode interface {
+	eval(x *filterEvent) bool
+}
+
+type andNode struct {
+	left, right filterNode
+}
+
+func (n *andNode) eval(x *filterEvent) bool {
+	return n.left.eval(x) && n.right.eval(x)
+}
+
+type orNode struct {
+	left, right filterNode
+}
+
+func (n *orNode) eval(x *filterEvent) bool {
+	return n.left.eval(x) || n.right.eval(x)
+}
+
+type notNode struct {
+	expr filterNode
+}
+
+func (n *notNode) eval(x *filterEvent) bool {
+	return !n.expr.eval(x)
+}
+
+// A field on its own, true if it is present and not false, zero or empty
+type fieldNode struct {
+	get filterGetter
+}
+
+func (n *fieldNode) eval(x *filterEvent) bool {
+	v, ok := n.get(x)
+	if !ok {
+		return false
+	}
+	switch t := v.(type) {
+	case bool:
+		return t
+	case float64:
+		return t != 0
+	case string:
+		return t != ""
+	case time.Duration:
+		return t != 0
+	}
+	return true
+}
+
+type compareNode struct {
+	get filterGetter
+	op  string
+	lit filterLiteral
+}
+
+func (n *compareNode) eval(x *filterEvent) bool {
+	v, ok := n.get(x)
+	if !ok {
+		return false
+	}
+	c, ok := compareValue(v, n.lit)
+	if !ok {
+		// Values of different types are only ever unequal
+		return n.op == "!="
+	}
+	switch n.op {
+	case "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+type matchNode struct {
+	get    filterGetter
+	re     *regexp.Regexp
+	negate bool
+}
+
+func (n *matchNode) eval(x *filterEvent) bool {
+	v, ok := n.get(x)
+	if !ok {
+		return false
+	}
+	return n.re.MatchString(fmt.Sprint(v)) != n.negate
+}
+
+type inNode struct {
+	get    filterGetter
+	list   []filterLiteral
+	cidr   *net.IPNet
+	negate bool
+}
+
+func (n *inNode) eval(x *filterEvent) bool {
+	v, ok := n.get(x)
+	if !ok {
+		return false
+	}
+	found := false
+	if n.cidr != nil {
+		ip, ok := v.(net.IP)
+		found = ok && n.cidr.Contains(ip)
+	} else {
+		for _, lit := range n.list {
+			if c, ok := compareValue(v, lit); ok && c == 0 {
+				found = true
+				break
+			}
+		}
+	}
+	return found != n.negate
+}
+
+// A value in an expression, with its text and its value read as a boolean,
+// number, duration, time or address
+type filterLiteral struct {
+	text  string
+	value interface{}
+}
+
+func newFilterLiteral(text string, quoted bool) filterLiteral {
+	lit := filterLiteral{text: text, value: text}
+	if quoted {
+		return lit
+	}
+	if text == "true" || text == "false" {
+		lit.value = text == "true"
+	} else if f, err := strconv.ParseFloat(text, 64); err == nil {
+		lit.value = f
+	} else if d, err := time.ParseDuration(text); err == nil {
+		lit.value = d
+	} else if t, err := time.Parse(time.RFC3339Nano, text); err == nil {
+		lit.value = t
+	} else if ip := net.ParseIP(text); ip != nil {
+		lit.value = ip
+	}
+	return lit
+}
+
+// Compares a field's value with a literal, returning false if they can't be
+// compared
+func compareValue(v interface{}, lit filterLiteral) (int, bool) {
+	switch a := v.(type) {
+	case string:
+		return strings.Compare(a, lit.text), true
+
+	case float64:
+		if b, ok := lit.value.(float64); ok {
+			return compareFloat(a, b), true
+		}
+
+	case bool:
+		if b, ok := lit.value.(bool); ok && a == b {
+			return 0, true
+		} else if ok {
+			return 1, true
+		}
+
+	case time.Duration:
+		switch b := lit.value.(type) {
+		case time.Duration:
+			return compareFloat(float64(a), float64(b)), true
+		case float64:
+			return compareFloat(float64(a), b*float64(time.Millisecond)), true
+		}
+
+	case time.Time:
+		if b, ok := lit.value.(time.Time); ok {
+			return compareFloat(float64(a.Sub(b)), 0), true
+		}
+
+	case net.IP:
+		if b, ok := lit.value.(net.IP); ok {
+			return strings.Compare(string(a.To16()), string(b.To16())), true
+		}
+	}
+	return 0, false
+}
+
+func compareFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// Tokens of an expression
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokString
+	tokOp
+)
+
+type filterToken struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t filterToken) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of expression"
+	case tokString:
+		return strconv.Quote(t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// Operators, longest first so that <= is read before <
+var filterOps = []string{"&&", "||", "==", "!=", "<=", ">=", "=~", "!~", "<", ">", "!", "(", ")", "[", "]", ","}
+
+func lexFilter(src string) ([]filterToken, error) {
+	var toks []filterToken
+	i := 0
+outer:
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+
+		case c == '"' || c == '\'':
+			// Backslash escapes only the quote and itself, so that regular
+			// expressions can be written as they are
+			start := i
+			var b strings.Builder
+			for i++; i < len(src); i++ {
+				switch {
+				case src[i] == '\\' && i+1 < len(src) && (src[i+1] == c || src[i+1] == '\\'):
+					i++
+					b.WriteByte(src[i])
+				case src[i] == c:
+					i++
+					toks = append(toks, filterToken{kind: tokString, text: b.String(), pos: start})
+					continue outer
+				default:
+					b.WriteByte(src[i])
+				}
+			}
+			return nil, fmt.Errorf("filter: unterminated string at offset %d", start)
+		}
+
+		for _, op := range filterOps {
+			if strings.HasPrefix(src[i:], op) {
+				toks = append(toks, filterToken{kind: tokOp, text: op, pos: i})
+				i += len(op)
+				continue outer
+			}
+		}
+
+		start := i
+		for i < len(src) && !strings.ContainsRune(" \t\n\r\"'()[],!=<>&|~", rune(src[i])) {
+			i++
+		}
+		if i == start {
+			return nil, fmt.Errorf("filter: unexpected %q at offset %d", src[i], i)
+		}
+		toks = append(toks, filterToken{kind: tokWord, text: src[start:i], pos: start})
+	}
+	return append(toks, filterToken{kind: tokEOF, pos: len(src)}), nil
+}
+
+// Recursive descent parser, binding ! tighter than && and && tighter than ||
+type filterParser struct {
+	toks    []filterToken
+	pos     int
+	latency bool // a comparison refers to latency
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.toks[p.pos]
+}
+
+func (p *filterParser) next() filterToken {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *filterParser) accept(op string) bool {
+	if t := p.peek(); t.kind == tokOp && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) errorf(t filterToken, format string, args ...interface{}) error {
+	return fmt.Errorf("filter: %s at offset %d", fmt.Sprintf(format, args...), t.pos)
+}
+
+func (p *filterParser) or() (filterNode, error) {
+	left, err := p.and()
+	for err == nil && p.accept("||") {
+		var right filterNode
+		if right, err = p.and(); err == nil {
+			left = &orNode{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *filterParser) and() (filterNode, error) {
+	left, err := p.unary()
+	for err == nil && p.accept("&&") {
+		var right filterNode
+		if right, err = p.unary(); err == nil {
+			left = &andNode{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *filterParser) unary() (filterNode, error) {
+	if p.accept("!") {
+		expr, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{expr}, nil
+	}
+	if p.accept("(") {
+		expr, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.next(); t.kind != tokOp || t.text != ")" {
+			return nil, p.errorf(t, "expected ) but found %s", t)
+		}
+		return expr, nil
+	}
+	return p.comparison()
+}
+
+func (p *filterParser) comparison() (filterNode, error) {
+	t := p.next()
+	if t.kind != tokWord {
+		return nil, p.errorf(t, "expected a field but found %s", t)
+	}
+	get, ok := filterField(t.text)
+	if !ok {
+		return nil, p.errorf(t, "unknown field %q, expected one of %s or doc.<path>", t.text, fieldNames())
+	}
+	if t.text == "latency" {
+		p.latency = true
+	}
+
+	op := p.peek()
+	switch {
+	case op.kind == tokOp && (op.text == "==" || op.text == "!=" || op.text == "<" ||
+		op.text == "<=" || op.text == ">" || op.text == ">="):
+		p.next()
+		lit, err := p.literal()
+		if err != nil {
+			return nil, err
+		}
+		return &compareNode{get: get, op: op.text, lit: lit}, nil
+
+	case op.kind == tokOp && (op.text == "=~" || op.text == "!~"):
+		p.next()
+		lit, err := p.literal()
+		if err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile(lit.text)
+		if err != nil {
+			return nil, p.errorf(op, "%v", err)
+		}
+		return &matchNode{get: get, re: re, negate: op.text == "!~"}, nil
+
+	case op.kind == tokWord && (op.text == "in" || op.text == "not"):
+		p.next()
+		negate := op.text == "not"
+		if negate {
+			if t := p.next(); t.kind != tokWord || t.text != "in" {
+				return nil, p.errorf(t, "expected in but found %s", t)
+			}
+		}
+		return p.in(get, negate)
+	}
+	return &fieldNode{get: get}, nil
+}
+
+// The right hand side of in: a CIDR block or a list of values
+func (p *filterParser) in(get filterGetter, negate bool) (filterNode, error) {
+	n := &inNode{get: get, negate: negate}
+	if !p.accept("[") {
+		t := p.next()
+		_, cidr, err := net.ParseCIDR(t.text)
+		if t.kind != tokWord || err != nil {
+			return nil, p.errorf(t, "expected a list or CIDR block but found %s", t)
+		}
+		n.cidr = cidr
+		return n, nil
+	}
+	for !p.accept("]") {
+		if len(n.list) > 0 && !p.accept(",") {
+			t := p.peek()
+			return nil, p.errorf(t, "expected , or ] but found %s", t)
+		}
+		lit, err := p.literal()
+		if err != nil {
+			return nil, err
+		}
+		n.list = append(n.list, lit)
+	}
+	return n, nil
+}
+
+func (p *filterParser) literal() (filterLiteral, error) {
+	t := p.next()
+	switch t.kind {
+	case tokString:
+		return newFilterLiteral(t.text, true), nil
+	case tokWord:
+		return newFilterLiteral(t.text, false), nil
+	}
+	return filterLiteral{}, p.errorf(t, "expected a value but found %s", t)
+}
+
+func fieldNames() string {
+	names := make([]string, 0, len(filterGetters))
+	for name := range filterGetters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,269 @@
+package mongopacket
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/phensley/mongopacket/pkg/protocol"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// An event sent between a client at 10.2.3.4 and a server at 10.1.0.9
+func testEvent(t testing.TB, id, responseTo uint32, at time.Duration, body bson.D) *MongoEvent {
+	raw, err := bson.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	op := &protocol.Msg{
+		Header: &protocol.Header{OpCode: protocol.OpMsg, RequestID: id, ResponseTo: responseTo, MessageLength: int32(21 + len(raw))},
+		Body:   protocol.NewDocument(raw),
+	}
+	start := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC).Add(at)
+	e := &MongoEvent{
+		Start: start, End: start,
+		SrcIP: "10.2.3.4", SrcPort: "50123", DstIP: "10.1.0.9", DstPort: "27017(mongodb)",
+		Op: op, AppName: "shop",
+	}
+	if responseTo != 0 {
+		e.SrcIP, e.SrcPort, e.DstIP, e.DstPort = e.DstIP, e.DstPort, e.SrcIP, e.SrcPort
+		e.Outcome = protocol.OutcomeOf(op)
+	}
+	return e
+}
+
+func TestFilterMatch(t *testing.T) {
+	req := testEvent(t, 1, 0, 0, bson.D{
+		{Key: "find", Value: "items"},
+		{Key: "filter", Value: bson.D{{Key: "status", Value: "open"}}},
+		{Key: "limit", Value: int32(10)},
+		{Key: "$db", Value: "orders"},
+	})
+	reply := bson.D{
+		{Key: "cursor", Value: bson.D{{Key: "firstBatch", Value: bson.A{}}, {Key: "id", Value: int64(0)}}},
+		{Key: "ok", Value: 1.0},
+	}
+
+	// Replies to the request after 150ms and 50ms, and one whose request
+	// wasn't seen
+	events := map[string][2]*MongoEvent{
+		"req":    {req, nil},
+		"slow":   {testEvent(t, 2, 1, 150*time.Millisecond, reply), req},
+		"fast":   {testEvent(t, 3, 1, 50*time.Millisecond, reply), req},
+		"orphan": {testEvent(t, 4, 9, 0, reply), nil},
+	}
+	names := []string{"req", "slow", "fast", "orphan"}
+
+	tests := []struct {
+		expr string
+		want string // names of the matching events
+	}{
+		{`cmd == "find" && ns =~ "^orders\." && latency > 100ms && src in 10.1.0.0/16`, "slow"},
+		{`cmd == "find" && ns =~ "^orders\." && latency > 100ms && src in 10.2.0.0/16`, ""},
+
+		// ! binds tighter than &&, which binds tighter than ||
+		{`reply || cmd == "find" && latency > 100ms`, "slow fast orphan"},
+		{`(reply || cmd == "find") && latency > 100ms`, "slow"},
+		{`cmd == "insert" && reply || latency < 100ms`, "fast"},
+		{`cmd == "insert" && (reply || latency < 100ms)`, ""},
+		{`!reply && cmd == "find"`, "req"},
+		{`!(reply && ok)`, "req"},
+		{`!!reply`, "slow fast orphan"},
+		{`((reply))`, "slow fast orphan"},
+
+		// Addresses, lists and CIDR blocks
+		{`client in 10.2.0.0/16 && server in 10.1.0.0/24`, "req slow fast orphan"},
+		{`src in 10.1.0.0/16`, "slow fast orphan"},
+		{`src not in 10.1.0.0/16`, "req"},
+		{`dst == 10.1.0.9`, "req"},
+		{`src in [10.9.9.9, 10.2.3.4]`, "req"},
+		{`src in ::ffff:10.1.0.0/112`, "slow fast orphan"},
+		{`dst_port == 27017 && src_port > 50000`, "req"},
+		{`cmd in [insert, find]`, "req slow fast"},
+		{`cmd not in [insert, find]`, ""},
+
+		// Durations, with bare numbers in milliseconds, and times
+		{`latency > 100ms`, "slow"},
+		{`latency >= 150ms && latency <= 0.15s`, "slow"},
+		{`latency < 0.1s`, "fast"},
+		{`latency > 100`, "slow"},
+		{`latency == 50`, "fast"},
+		{`latency != 1m`, "slow fast"},
+		{`time > 2021-03-04T05:06:07.1Z`, "slow"},
+		{`time <= 2021-03-04T05:06:07Z`, "req orphan"},
+
+		// Missing fields never compare, even with != or not in
+		{`latency`, "slow fast"},
+		{`!latency`, "req orphan"},
+		{`latency != 100ms`, "slow fast"},
+		{`ns not in [x]`, "req slow fast"},
+		{`user == "bob" || user != "bob" || codename`, ""},
+		{`doc.filter.status == open`, "req"},
+		{`doc.filter.missing || doc.filter.status.deeper`, ""},
+		{`doc.cursor.id == 0 && doc.ok == 1`, "slow fast orphan"},
+		{`doc.limit >= 10 && len > 21`, "req"},
+
+		// Values of different types are only ever unequal, while strings
+		// compare with the text of any value
+		{`len > abc`, ""},
+		{`id < "9"`, ""},
+		{`id != "9"`, "req slow fast orphan"},
+		{`cmd > 5 && cmd < g`, "req slow fast"},
+		{`latency == fast`, ""},
+		{`src == "10.2.3.4"`, ""},
+		{`reply == 1`, ""},
+		{`reply != 1`, "req slow fast orphan"},
+		{`app == shop && app == "shop"`, "req slow fast orphan"},
+		{`id =~ "^[12]$"`, "req slow"},
+	}
+	for _, tt := range tests {
+		f, err := ParseFilter(tt.expr)
+		if err != nil {
+			t.Errorf("%s: %s", tt.expr, err)
+			continue
+		}
+		var got []string
+		for _, name := range names {
+			e := events[name]
+			if f.Match(e[0], e[1]) {
+				got = append(got, name)
+			}
+		}
+		if strings.Join(got, " ") != tt.want {
+			t.Errorf("%s: matched %q, want %q", tt.expr, strings.Join(got, " "), tt.want)
+		}
+	}
+
+	var f *Filter
+	if !f.Match(req, nil) {
+		t.Error("nil filter doesn't match")
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		pos  int
+		msg  string
+	}{
+		{`cmd ==`, 6, "expected a value but found end of expression"},
+		{`cmd == "find" &&`, 16, "expected a field but found end of expression"},
+		{`(cmd == find`, 12, "expected ) but found end of expression"},
+		{`cmd == find find`, 12, `unexpected "find"`},
+		{`nope == 1`, 0, `unknown field "nope"`},
+		{`doc. == 1`, 0, `unknown field "doc."`},
+		{`reply && == 1`, 9, `expected a field but found "=="`},
+		{`cmd == "find`, 7, "unterminated string"},
+		{`cmd & reply`, 4, "unexpected '&'"},
+		{`cmd =~ "("`, 4, "missing closing )"},
+		{`src in 10.1.0.0`, 7, `expected a list or CIDR block but found "10.1.0.0"`},
+		{`cmd in [a b]`, 10, `expected , or ] but found "b"`},
+		{`cmd not [a]`, 8, `expected in but found "["`},
+		{`cmd in [a,`, 10, "expected a value but found end of expression"},
+	}
+	for _, tt := range tests {
+		_, err := ParseFilter(tt.expr)
+		if err == nil {
+			t.Errorf("%s: no error", tt.expr)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.msg) || !strings.HasSuffix(err.Error(), fmt.Sprintf("at offset %d", tt.pos)) {
+			t.Errorf("%s: got %q, want %q at offset %d", tt.expr, err, tt.msg, tt.pos)
+		}
+	}
+}
+
+func TestFilterQueue(t *testing.T) {
+	find := bson.D{{Key: "find", Value: "orders"}, {Key: "$db", Value: "shop"}}
+	insert := bson.D{{Key: "insert", Value: "orders"}, {Key: "documents", Value: bson.A{}}, {Key: "$db", Value: "shop"}}
+	ok := bson.D{{Key: "ok", Value: 1.0}}
+
+	// Events in capture order
+	type step struct {
+		name  string
+		e     *MongoEvent
+		reply bool
+	}
+	c := &testConn{t: t, port: "50123"}
+	slow := c.send(find)
+	fast := c.send(find)
+	c.at += 10 * time.Millisecond
+	fastReply := c.answer(fast, ok)
+	c.at += 100 * time.Millisecond
+	slowReply := c.answer(slow, ok)
+	unacknowledged := c.send(insert)
+	unacknowledged.Op.(*protocol.Msg).Flags |= protocol.MsgFlagMoreToCome
+	lost := c.send(insert)
+	later := c.send(find)
+	c.at += requestTimeout + time.Minute
+	timedOut := c.send(find)
+	open := c.send(insert)
+	steps := []step{
+		{"slow", slow, false},
+		{"fast", fast, false},
+		{"fast-reply", fastReply, true},
+		{"slow-reply", slowReply, true},
+		{"unacknowledged", unacknowledged, false},
+		{"lost", lost, false},
+		{"later", later, false},
+		{"timed-out", timedOut, false},
+		{"open", open, false},
+	}
+	names := map[*MongoEvent]string{}
+	for _, s := range steps {
+		names[s.e] = s.name
+	}
+
+	tests := []struct {
+		expr string
+		want string // names of the events kept, in order, with | where each step's events end
+	}{
+		// Requests are kept just before their replies, and those that
+		// match on their own once they time out or the capture ends
+		{`latency > 100ms`, "|||slow slow-reply|||||"},
+		{`latency < 100ms`, "||fast fast-reply||||||"},
+		{`latency > 100ms || cmd == "insert"`, "|||slow slow-reply|unacknowledged|||lost|open"},
+		{`!(latency > 100ms)`, "||fast fast-reply|slow|unacknowledged|||lost later|timed-out open"},
+
+		// Without latency nothing is held
+		{`cmd == "find"`, "slow|fast|fast-reply|slow-reply|||later|timed-out|"},
+		{``, "slow|fast|fast-reply|slow-reply|unacknowledged|lost|later|timed-out|open"},
+	}
+	for _, tt := range tests {
+		var f *Filter
+		if tt.expr != "" {
+			var err error
+			if f, err = ParseFilter(tt.expr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		q := NewFilterQueue(f)
+		m := NewRequestMatcher()
+		var got []string
+		kept := func(events []FilteredEvent) string {
+			var s []string
+			for _, k := range events {
+				s = append(s, names[k.Event])
+				if protocol.IsResponse(k.Event.Op) && k.Request == nil {
+					t.Errorf("%s: %s kept without its request", tt.expr, names[k.Event])
+				}
+			}
+			return strings.Join(s, " ")
+		}
+		for i, s := range steps {
+			req := m.Match(s.e)
+			if s.reply != (req != nil) {
+				t.Fatalf("%s: matched %v", s.name, req)
+			}
+			k := kept(q.Add(s.e, req))
+			if i == len(steps)-1 {
+				k = strings.TrimSpace(k + " " + kept(q.Close()))
+			}
+			got = append(got, k)
+		}
+		if strings.Join(got, "|") != tt.want {
+			t.Errorf("%s: kept %q, want %q", tt.expr, strings.Join(got, "|"), tt.want)
+		}
+	}
+}
@@ -0,0 +1,444 @@
+package mongopacket
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/phensley/mongopacket/pkg/protocol"
+)
+
+// JSONLStorage writes each record as a JSON object on its own line. Every
+// object starts with a "type" field naming the kind of record, followed by
+// the same fields, in the same order, as the columns of TSVStorage. Ops,
+// packets and lists are embedded as JSON rather than strings, and flags are
+// booleans. Times are microseconds since the epoch.
+type JSONLStorage struct {
+	mongo   *jsonlWriter
+	packets *jsonlWriter
+	errors  *jsonlWriter
+	cursors *jsonlWriter
+	txns    *jsonlWriter
+	retries *jsonlWriter
+	conns   *jsonlWriter
+	auth    *jsonlWriter
+	shapes  *jsonlWriter
+
+	// Every distinct writer, to flush and close
+	writers []*jsonlWriter
+
+	columns []string // names of the user-defined columns
+
+	// OpJSON selects the Extended JSON mode used to store ops
+	OpJSON protocol.ExtJSONMode
+}
+
+// A buffered output, optionally gzip compressed
+type jsonlWriter struct {
+	buf  *bufio.Writer
+	gz   *gzip.Writer
+	file io.Closer
+}
+
+func newJSONLWriter(w io.Writer, compress bool) *jsonlWriter {
+	j := &jsonlWriter{}
+	if compress {
+		j.gz = gzip.NewWriter(w)
+		w = j.gz
+	}
+	j.buf = bufio.NewWriterSize(w, 1024*1024)
+	return j
+}
+
+func (j *jsonlWriter) write(r jsonRecord) error {
+	b, err := r.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	if _, err := j.buf.Write(b); err != nil {
+		return err
+	}
+	return j.buf.WriteByte('\n')
+}
+
+func (j *jsonlWriter) flush() error {
+	if err := j.buf.Flush(); err != nil {
+		return err
+	}
+	if j.gz != nil {
+		return j.gz.Flush()
+	}
+	return nil
+}
+
+func (j *jsonlWriter) close() error {
+	if err := j.buf.Flush(); err != nil {
+		return err
+	}
+	if j.gz != nil {
+		if err := j.gz.Close(); err != nil {
+			return err
+		}
+	}
+	if j.file != nil {
+		return j.file.Close()
+	}
+	return nil
+}
+
+// NewJSONLStorage writes each kind of record to its own file, named like
+// those of TSVStorage with a .jsonl or .jsonl.gz extension. The user-defined
+// columns, if any, are added to the mongo records.
+func NewJSONLStorage(pathPrefix string, compress bool, columns *Columns) (*JSONLStorage, error) {
+	s := &JSONLStorage{columns: columns.Names()}
+	open := func(name string) (*jsonlWriter, error) {
+		path := fmt.Sprintf("%s-%s.jsonl", pathPrefix, name)
+		if compress {
+			path += ".gz"
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create events output file: %s", err)
+		}
+		j := newJSONLWriter(f, compress)
+		j.file = f
+		s.writers = append(s.writers, j)
+		return j, nil
+	}
+
+	var err error
+	for _, o := range []struct {
+		w    **jsonlWriter
+		name string
+	}{
+		{&s.mongo, "mongo"},
+		{&s.packets, "packets"},
+		{&s.errors, "errors"},
+		{&s.cursors, "cursors"},
+		{&s.txns, "transactions"},
+		{&s.retries, "retries"},
+		{&s.conns, "connections"},
+		{&s.auth, "auth"},
+		{&s.shapes, "shapes"},
+	} {
+		if *o.w, err = open(o.name); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// NewJSONLWriter writes every record to w, e.g. os.Stdout, telling them
+// apart by their type field. Closing the storage leaves w open.
+func NewJSONLWriter(w io.Writer, compress bool, columns *Columns) *JSONLStorage {
+	j := newJSONLWriter(w, compress)
+	return &JSONLStorage{
+		mongo:   j,
+		packets: j,
+		errors:  j,
+		cursors: j,
+		txns:    j,
+		retries: j,
+		conns:   j,
+		auth:    j,
+		shapes:  j,
+		writers: []*jsonlWriter{j},
+		columns: columns.Names(),
+	}
+}
+
+// Record types
+const (
+	recordMongo       = "mongo"
+	recordPacket      = "packet"
+	recordDecodeError = "decode_error"
+	recordCursor      = "cursor"
+	recordTransaction = "transaction"
+	recordRetry       = "retry"
+	recordConnection  = "connection"
+	recordAuth        = "auth"
+	recordShape       = "shape"
+)
+
+// SaveMongoEvents ..
+func (s *JSONLStorage) SaveMongoEvents(evts []*MongoEvent) error {
+	for _, e := range evts {
+		op, err := protocol.MarshalExtJSON(e.Op, s.OpJSON)
+		if err != nil {
+			return err
+		}
+
+		var shape, hash string
+		if e.Shape != nil {
+			shape, hash = e.Shape.Shape, e.Shape.Hash
+		}
+
+		// Outcome fields are null for requests
+		outcome := make([]interface{}, 6)
+		if o := e.Outcome; o != nil {
+			outcome = []interface{}{o.OK, o.Code, o.CodeName, o.Message, o.WriteErrors, stringArray(o.ErrorLabels)}
+		}
+
+		h := e.Op.GetHeader()
+		values := []interface{}{
+			e.Group, e.EventID, micros(e.Start), micros(e.End),
+			e.StreamID, e.StreamStart == 1, e.StreamEnd == 1, h.RequestID, h.ResponseTo,
+			e.SrcIP, e.SrcPort, e.DstIP, e.DstPort,
+			h.Type().String(), json.RawMessage(op), e.Packets, e.AppName, e.Driver, shape, hash,
+		}
+		values = append(values, outcome...)
+		r, err := newRecord(recordMongo, eventsHeader, values...)
+		if err != nil {
+			return err
+		}
+
+		for i, name := range s.columns {
+			var v interface{}
+			if i < len(e.Columns) {
+				v = columnValue(e.Columns[i], false)
+			}
+			r = append(r, jsonField{name, v})
+		}
+
+		if err = s.mongo.write(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SavePacketEvents ..
+func (s *JSONLStorage) SavePacketEvents(evts []*PacketEvent) error {
+	for _, e := range evts {
+		r, err := newRecord(recordPacket, packetsHeader,
+			e.Group, e.PacketID, micros(e.Time), e.Seq, e.Ack,
+			e.SrcIP, e.SrcPort, e.DstIP, e.DstPort,
+			e.FlagSYN == 1, e.FlagFIN == 1, e.FlagRST == 1, e.FlagPSH == 1, e.FlagACK == 1,
+			e.SizeTCP)
+		if err != nil {
+			return err
+		}
+		if err = s.packets.write(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveDecodeErrors ..
+func (s *JSONLStorage) SaveDecodeErrors(evts []*DecodeErrorEvent) error {
+	for _, e := range evts {
+		r, err := newRecord(recordDecodeError, errorsHeader,
+			e.Group, e.EventID, micros(e.Time), e.StreamID,
+			e.SrcIP, e.SrcPort, e.DstIP, e.DstPort,
+			e.Kind, e.OpCode, e.Offset, e.Field, e.MessageLength, e.Packets,
+			e.Error)
+		if err != nil {
+			return err
+		}
+		if err = s.errors.write(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveCursorEvents ..
+func (s *JSONLStorage) SaveCursorEvents(evts []*CursorEvent) error {
+	for _, e := range evts {
+		r, err := newRecord(recordCursor, cursorsHeader,
+			e.Group, e.CursorID, e.StreamID,
+			e.SrcIP, e.SrcPort, e.DstIP, e.DstPort,
+			e.Namespace, e.Command, micros(e.Start), micros(e.End),
+			e.Batches, e.Documents, e.IdleTotal.Microseconds(), e.IdleMax.Microseconds(), e.EndReason)
+		if err != nil {
+			return err
+		}
+		if err = s.cursors.write(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveTransactionEvents ..
+func (s *JSONLStorage) SaveTransactionEvents(evts []*TransactionEvent) error {
+	for _, e := range evts {
+		var commit interface{}
+		if !e.CommitStart.IsZero() {
+			commit = micros(e.CommitStart)
+		}
+		r, err := newRecord(recordTransaction, transactionsHeader,
+			e.Group, e.SessionID, e.TxnNumber, e.StreamID,
+			e.SrcIP, e.SrcPort, e.DstIP, e.DstPort,
+			micros(e.Start), commit, micros(e.End), e.Started,
+			len(e.Statements), e.Outcome, e.ErrorCode, e.ErrorName, stringArray(e.ErrorLabels),
+			e.Statements)
+		if err != nil {
+			return err
+		}
+		if err = s.txns.write(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveRetryEvents ..
+func (s *JSONLStorage) SaveRetryEvents(evts []*RetryEvent) error {
+	for _, e := range evts {
+		var replied interface{}
+		if e.PreviousReplied {
+			replied = micros(e.PreviousReplyTime)
+		}
+		r, err := newRecord(recordRetry, retriesHeader,
+			e.Group, e.SessionID, e.TxnNumber, e.StmtID, e.Command, e.Namespace,
+			e.Attempt, micros(e.Time), e.RequestID, e.StreamID,
+			e.SrcIP, e.SrcPort, e.DstIP, e.DstPort,
+			micros(e.OriginalTime), e.OriginalRequestID, e.OriginalStreamID,
+			e.OriginalDstIP, e.OriginalDstPort, e.SameConnection,
+			e.PreviousReplied, replied,
+			e.PreviousErrorCode, e.PreviousErrorName, stringArray(e.PreviousErrorLabels))
+		if err != nil {
+			return err
+		}
+		if err = s.retries.write(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveConnectionEvents ..
+func (s *JSONLStorage) SaveConnectionEvents(evts []*ConnectionEvent) error {
+	for _, e := range evts {
+		r, err := newRecord(recordConnection, connectionsHeader,
+			e.Group, e.StreamID, e.SrcIP, e.SrcPort, e.DstIP, e.DstPort, micros(e.Time),
+			e.AppName, e.DriverName, e.DriverVersion,
+			e.OSType, e.OSName, e.OSArchitecture, e.OSVersion, e.Platform,
+			stringArray(e.RequestedCompression), e.SaslSupportedMechs,
+			e.Replied, e.MaxWireVersion, e.MinWireVersion, stringArray(e.Compression),
+			e.ConnectionID, e.MaxMessageSizeBytes, stringArray(e.ServerSaslMechs))
+		if err != nil {
+			return err
+		}
+		if err = s.conns.write(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveAuthEvents ..
+func (s *JSONLStorage) SaveAuthEvents(evts []*AuthEvent) error {
+	for _, e := range evts {
+		r, err := newRecord(recordAuth, authHeader,
+			e.Group, e.StreamID, e.SrcIP, e.SrcPort, e.DstIP, e.DstPort, e.AppName,
+			e.Mechanism, e.User, e.Database, e.Speculative,
+			micros(e.Start), micros(e.End), e.End.Sub(e.Start).Microseconds(), e.RoundTrips,
+			e.Outcome, e.ErrorCode, e.ErrorName)
+		if err != nil {
+			return err
+		}
+		if err = s.auth.write(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveShapeStats ..
+func (s *JSONLStorage) SaveShapeStats(stats []*ShapeStats) error {
+	for _, st := range stats {
+		r, err := newRecord(recordShape, shapesHeader,
+			st.Group, st.Hash, st.Command, st.Namespace, st.Shape,
+			st.Count, st.Replies, st.Errors,
+			st.Total.Microseconds(), st.Mean.Microseconds(),
+			st.P50.Microseconds(), st.P90.Microseconds(), st.P99.Microseconds(), st.Max.Microseconds())
+		if err != nil {
+			return err
+		}
+		if err = s.shapes.write(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush writes the buffered records. Compressed output is only complete
+// once the storage is closed.
+func (s *JSONLStorage) Flush() error {
+	for _, w := range s.writers {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close flushes the records and closes the files
+func (s *JSONLStorage) Close() error {
+	var first error
+	for _, w := range s.writers {
+		if err := w.close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	s.writers = nil
+	return first
+}
+
+// Microseconds since the epoch
+func micros(t time.Time) int64 {
+	return t.UnixNano() / 1e3
+}
+
+type jsonField struct {
+	key   string
+	value interface{}
+}
+
+// A JSON object that keeps its fields in order
+type jsonRecord []jsonField
+
+// Pairs the names in a header with values, after the record's type
+func newRecord(kind string, header []string, values ...interface{}) (jsonRecord, error) {
+	if len(header) != len(values) {
+		return nil, fmt.Errorf("%s record has %d values for %d fields", kind, len(values), len(header))
+	}
+	r := make(jsonRecord, 0, len(header)+1)
+	r = append(r, jsonField{"type", kind})
+	for i, key := range header {
+		r = append(r, jsonField{key, values[i]})
+	}
+	return r, nil
+}
+
+func (r jsonRecord) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, f := range r {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, err := json.Marshal(f.key)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		val, err := json.Marshal(f.value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", f.key, err)
+		}
+		b.Write(val)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
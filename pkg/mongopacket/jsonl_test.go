@@ -0,0 +1,220 @@
+package mongopacket
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// The keys of a JSON object in order, and its values
+func jsonObject(t testing.TB, line []byte) ([]string, map[string]interface{}) {
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.UseNumber()
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		t.Fatalf("%s: not an object", line)
+	}
+	var keys []string
+	values := map[string]interface{}{}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := tok.(string)
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+		values[key] = v
+	}
+	return keys, values
+}
+
+// One record of each type, saved to s
+func saveRecords(t testing.TB, s Storage, columns *Columns) {
+	at := testTime(0)
+	req := testEvent(t, 1, 0, 0, bson.D{
+		{Key: "find", Value: "orders"},
+		{Key: "filter", Value: bson.D{{Key: "tenantId", Value: "t1"}}},
+		{Key: "$db", Value: "shop"},
+	})
+	req.Group, req.EventID, req.StreamStart = "g", 7, 1
+	req.Columns = columns.Extract(req.Op)
+	req.Packets = []*EventPacket{{Time: "2021-03-04T05:06:07Z", Start: true, Length: 120}}
+	reply := testEvent(t, 2, 1, 5*time.Millisecond, bson.D{
+		{Key: "ok", Value: 0.0}, {Key: "code", Value: int32(13)}, {Key: "codeName", Value: "Unauthorized"},
+		{Key: "errmsg", Value: "not authorized"}, {Key: "errorLabels", Value: bson.A{"NoWritesPerformed"}},
+	})
+	reply.Group = "g"
+	reply.Columns = columns.Extract(reply.Op)
+
+	saves := []error{
+		s.SaveMongoEvents([]*MongoEvent{req, reply}),
+		s.SavePacketEvents([]*PacketEvent{{Group: "g", PacketID: 3, Time: at, FlagSYN: 1, SizeTCP: 40}}),
+		s.SaveDecodeErrors([]*DecodeErrorEvent{{Group: "g", Time: at, Kind: "bad_bson", Error: "bad bson"}}),
+		s.SaveCursorEvents([]*CursorEvent{{Group: "g", CursorID: 101, Start: at, End: at, IdleTotal: time.Millisecond}}),
+		s.SaveTransactionEvents([]*TransactionEvent{{Group: "g", Start: at, End: at, Statements: []*TransactionStatement{{Command: "insert"}}}}),
+		s.SaveRetryEvents([]*RetryEvent{{Group: "g", Attempt: 2, Time: at, OriginalTime: at, PreviousReplied: true, PreviousReplyTime: at}}),
+		s.SaveConnectionEvents([]*ConnectionEvent{{Group: "g", Time: at, AppName: "shop", Compression: []string{"zstd"}}}),
+		s.SaveAuthEvents([]*AuthEvent{{Group: "g", Start: at, End: at.Add(time.Millisecond), User: "alice"}}),
+		s.SaveShapeStats([]*ShapeStats{{Group: "g", Hash: "abc", Count: 2, P99: time.Millisecond}}),
+	}
+	for _, err := range saves {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Checks the records written by saveRecords, which are in the same order
+func checkRecords(t testing.TB, lines [][]byte) {
+	t.Helper()
+	want := []struct {
+		kind   string
+		header []string
+		values map[string]interface{}
+	}{
+		{recordMongo, append(append([]string{}, eventsHeader...), "tenant"), map[string]interface{}{
+			"group": "g", "event_id": json.Number("7"), "start_time_us": json.Number("1614834367000000"),
+			"stream_start": true, "stream_end": false, "request_id": json.Number("1"), "opcode": "OP_MSG",
+			"packets": []interface{}{map[string]interface{}{
+				"time": "2021-03-04T05:06:07Z", "start": true, "end": false, "length": json.Number("120"),
+			}},
+			"app_name": "shop", "ok": nil, "error_labels": nil, "tenant": "t1",
+		}},
+		{recordMongo, append(append([]string{}, eventsHeader...), "tenant"), map[string]interface{}{
+			"response_to": json.Number("1"), "packets": nil, "ok": false, "error_code": json.Number("13"),
+			"error_name": "Unauthorized", "error_message": "not authorized",
+			"error_labels": []interface{}{"NoWritesPerformed"}, "tenant": nil,
+		}},
+		{recordPacket, packetsHeader, map[string]interface{}{
+			"packet_id": json.Number("3"), "time_us": json.Number("1614834367000000"), "flag_syn": true, "flag_fin": false, "size": json.Number("40"),
+		}},
+		{recordDecodeError, errorsHeader, map[string]interface{}{"kind": "bad_bson", "error": "bad bson"}},
+		{recordCursor, cursorsHeader, map[string]interface{}{"cursor_id": json.Number("101"), "idle_total_us": json.Number("1000")}},
+		{recordTransaction, transactionsHeader, map[string]interface{}{
+			"commit_time_us": nil, "statement_count": json.Number("1"), "error_labels": []interface{}{},
+		}},
+		{recordRetry, retriesHeader, map[string]interface{}{
+			"attempt": json.Number("2"), "previous_replied": true, "previous_reply_time_us": json.Number("1614834367000000"),
+		}},
+		{recordConnection, connectionsHeader, map[string]interface{}{
+			"app_name": "shop", "compression": []interface{}{"zstd"}, "requested_compression": []interface{}{},
+		}},
+		{recordAuth, authHeader, map[string]interface{}{"user": "alice", "duration_us": json.Number("1000")}},
+		{recordShape, shapesHeader, map[string]interface{}{"shape_hash": "abc", "count": json.Number("2"), "p99_us": json.Number("1000")}},
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("%d records, want %d", len(lines), len(want))
+	}
+	for i, w := range want {
+		keys, values := jsonObject(t, lines[i])
+		if wantKeys := append([]string{"type"}, w.header...); !reflect.DeepEqual(keys, wantKeys) {
+			t.Errorf("%s fields %v, want %v", w.kind, keys, wantKeys)
+		}
+		if values["type"] != w.kind {
+			t.Errorf("record %d is %v, want %s", i, values["type"], w.kind)
+		}
+		for k, v := range w.values {
+			if !reflect.DeepEqual(values[k], v) {
+				t.Errorf("%s %s = %#v, want %#v", w.kind, k, values[k], v)
+			}
+		}
+		if op, ok := values["op"]; ok {
+			if _, ok := op.(map[string]interface{}); !ok {
+				t.Errorf("%s op is %T, not embedded", w.kind, op)
+			}
+		}
+	}
+}
+
+// Read the lines of a file or stream, decompressing it if needed
+func readLines(t testing.TB, r io.Reader, compressed bool) [][]byte {
+	if compressed {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = gz
+	}
+	var lines [][]byte
+	scan := bufio.NewScanner(r)
+	scan.Buffer(nil, 1024*1024)
+	for scan.Scan() {
+		lines = append(lines, append([]byte{}, scan.Bytes()...))
+	}
+	if err := scan.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+func TestJSONLStorage(t *testing.T) {
+	columns, err := NewColumns(&ColumnConfig{Columns: []*Column{{Name: "tenant", Path: "filter.tenantId", Type: ColumnString}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := []string{"mongo", "packets", "errors", "cursors", "transactions", "retries", "connections", "auth", "shapes"}
+
+	for _, compress := range []bool{false, true} {
+		prefix := filepath.Join(t.TempDir(), "capture")
+		s, err := NewJSONLStorage(prefix, compress, columns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		saveRecords(t, s, columns)
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		var lines [][]byte
+		for _, name := range files {
+			path := prefix + "-" + name + ".jsonl"
+			if compress {
+				path += ".gz"
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines = append(lines, readLines(t, f, compress)...)
+			f.Close()
+		}
+		checkRecords(t, lines)
+	}
+
+	// Every record in one stream, told apart by type
+	for _, compress := range []bool{false, true} {
+		var b bytes.Buffer
+		s := NewJSONLWriter(&b, compress, columns)
+		saveRecords(t, s, columns)
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		checkRecords(t, readLines(t, &b, compress))
+	}
+}
+
+func TestNewRecord(t *testing.T) {
+	r, err := newRecord(recordAuth, []string{"a", "b"}, 1, "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := r.MarshalJSON(); string(b) != `{"type":"auth","a":1,"b":"x"}` {
+		t.Errorf("record %s", b)
+	}
+	if _, err := newRecord(recordAuth, []string{"a", "b"}, 1); err == nil || !strings.Contains(err.Error(), "1 values for 2 fields") {
+		t.Errorf("mismatch: %v", err)
+	}
+}
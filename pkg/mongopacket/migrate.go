@@ -0,0 +1,597 @@
+package mongopacket
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Schema versions of the SQL storages. Each database records the migrations
+// applied to it in mp_schema. Opening a database applies the migrations it
+// is missing, and refuses one whose schema is newer than this build or
+// doesn't have the columns it writes.
+//
+// Tables are only ever changed by adding a migration to the end of a list,
+// never by editing an earlier one, e.g.
+//
+//	{
+//		Version:     2,
+//		Description: "add the session id to events",
+//		Statements:  []string{"ALTER TABLE mp_events ADD COLUMN session_id String"},
+//	},
+//
+// and updating the columns the storage writes to match.
+
+// SchemaMigration upgrades a database schema by one version
+type SchemaMigration struct {
+	Version     int
+	Description string
+	Statements  []string
+}
+
+// Statements for the schema version table and the table catalog, which
+// vary with the database
+type schemaDialect struct {
+	name    string
+	create  string // creates mp_schema
+	insert  string // records a version, the statements of it applied, its description and the unix time
+	columns string // lists the names and types of the columns of the table given
+
+	// A migration's statements and its mp_schema row are written in one
+	// transaction. Otherwise progress is recorded after each statement, so
+	// a failed migration carries on where it stopped.
+	transactional bool
+
+	// Layouts written before schema versioning
+	legacy []legacySchema
+}
+
+// A column and its type, as the database's catalog names it
+type schemaColumn struct {
+	name, typ string
+}
+
+// A layout of tables created before schema versioning, recognized by their
+// columns and brought to the first version by its statements, if any
+type legacySchema struct {
+	description string
+	tables      map[string]string // table name to the statement that created it
+	statements  []string
+}
+
+var clickhouseDialect = &schemaDialect{
+	name: "clickhouse",
+	create: `
+CREATE TABLE IF NOT EXISTS mp_schema (
+	version UInt32,
+	step UInt32,
+	description String,
+	applied DateTime
+) ENGINE = MergeTree()
+ORDER BY (version, step)
+`,
+	insert:  "INSERT INTO mp_schema (version, step, description, applied) VALUES (?, ?, ?, ?)",
+	columns: "SELECT name, type FROM system.columns WHERE database = currentDatabase() AND table = ?",
+	legacy: []legacySchema{
+		{
+			description: "tables created before schema versioning",
+			tables:      map[string]string{"mp_packets": createPacketV1SQL, "mp_events": createEventV1SQL},
+		},
+		{
+			description: "rebuild packets and events created before DateTime64 times, keeping the originals as mp_packets_v0 and mp_events_v0",
+			tables:      map[string]string{"mp_packets": createPacketV0SQL, "mp_events": createEventV0OutcomeSQL},
+			statements: concatStatements(clickhouseRebuildPacketsV0, []string{
+				"RENAME TABLE mp_events TO mp_events_v0",
+				createEventV1SQL,
+				`
+INSERT INTO mp_events SELECT
+group, event_id,
+fromUnixTimestamp64Micro(toInt64(start_time_us)),
+fromUnixTimestamp64Micro(toInt64(end_time_us)),
+stream_id, stream_start, stream_end, request_id, response_to,
+src, src_port, dst, dst_port,
+opcode, '', '',
+op, packets, app_name, driver, shape, shape_hash,
+ok, error_code, error_name, error_message, write_errors, error_labels
+FROM mp_events_v0`,
+			}),
+		},
+		{
+			// The columns added since take their defaults
+			description: "rebuild packets and events created without outcomes, keeping the originals as mp_packets_v0 and mp_events_v0",
+			tables:      map[string]string{"mp_packets": createPacketV0SQL, "mp_events": createEventV0SQL},
+			statements: concatStatements(clickhouseRebuildPacketsV0, []string{
+				"RENAME TABLE mp_events TO mp_events_v0",
+				createEventV1SQL,
+				`
+INSERT INTO mp_events (
+	group, event_id, start_time, end_time,
+	stream_id, stream_start, stream_end, request_id, response_to,
+	src, src_port, dst, dst_port, opcode, op, packets
+) SELECT
+group, event_id,
+fromUnixTimestamp64Micro(toInt64(start_time_us)),
+fromUnixTimestamp64Micro(toInt64(end_time_us)),
+stream_id, stream_start, stream_end, request_id, response_to,
+src, src_port, dst, dst_port, opcode, op, packets
+FROM mp_events_v0`,
+			}),
+		},
+	},
+}
+
+// Packets created before schema versioning, rebuilt as version 1 creates
+// them
+var clickhouseRebuildPacketsV0 = []string{
+	"RENAME TABLE mp_packets TO mp_packets_v0",
+	createPacketV1SQL,
+	`
+INSERT INTO mp_packets SELECT
+group, packet_id, fromUnixTimestamp64Micro(toInt64(time_us)),
+seq, ack, src, src_port, dst, dst_port,
+flag_syn, flag_fin, flag_rst, flag_psh, flag_ack, size
+FROM mp_packets_v0`,
+}
+
+var sqliteDialect = &schemaDialect{
+	name: "sqlite",
+	create: `
+CREATE TABLE IF NOT EXISTS mp_schema (
+	version INTEGER,
+	step INTEGER,
+	description TEXT,
+	applied INTEGER
+)
+`,
+	insert:        "INSERT INTO mp_schema (version, step, description, applied) VALUES (?, ?, ?, ?)",
+	columns:       "SELECT name, type FROM pragma_table_info(?)",
+	transactional: true,
+	legacy: []legacySchema{
+		{
+			description: "tables created before schema versioning",
+			tables:      map[string]string{"mp_packets": createSQLitePacketV1SQL, "mp_events": createSQLiteEventV1SQL},
+		},
+	},
+}
+
+var postgresDialect = &schemaDialect{
+	name: "postgres",
+	create: `
+CREATE TABLE IF NOT EXISTS mp_schema (
+	version integer,
+	step integer,
+	description text,
+	applied timestamptz
+)
+`,
+	insert: "INSERT INTO mp_schema (version, step, description, applied) VALUES ($1, $2, $3, to_timestamp($4))",
+	columns: `
+SELECT attname, format_type(atttypid, atttypmod) FROM pg_attribute
+WHERE attrelid = to_regclass($1) AND attnum > 0 AND NOT attisdropped
+`,
+	transactional: true,
+	legacy: []legacySchema{
+		{
+			description: "tables created before schema versioning",
+			tables:      map[string]string{"mp_packets": createPostgresPacketV1SQL, "mp_events": createPostgresEventV1SQL},
+		},
+	},
+}
+
+// A column written by SQLite and Postgres, with the type each one's catalog
+// gives it
+type sqlColumn struct {
+	name, sqlite, postgres string
+}
+
+// Columns of mp_packets in SQLite and Postgres, in the order they are written
+var sqlPacketColumns = []sqlColumn{
+	{"group", "TEXT", "text"},
+	{"packet_id", "INTEGER", "bigint"},
+	{"time", "INTEGER", "timestamp with time zone"},
+	{"time_us", "INTEGER", "bigint"},
+	{"seq", "INTEGER", "bigint"},
+	{"ack", "INTEGER", "bigint"},
+	{"src", "TEXT", "text"},
+	{"src_port", "TEXT", "text"},
+	{"dst", "TEXT", "text"},
+	{"dst_port", "TEXT", "text"},
+	{"flag_syn", "INTEGER", "smallint"},
+	{"flag_fin", "INTEGER", "smallint"},
+	{"flag_rst", "INTEGER", "smallint"},
+	{"flag_psh", "INTEGER", "smallint"},
+	{"flag_ack", "INTEGER", "smallint"},
+	{"size", "INTEGER", "integer"},
+}
+
+// Columns of mp_events in SQLite and Postgres, in the order they are written
+var sqlEventColumns = []sqlColumn{
+	{"group", "TEXT", "text"},
+	{"event_id", "INTEGER", "bigint"},
+	{"start_time", "INTEGER", "timestamp with time zone"},
+	{"start_time_us", "INTEGER", "bigint"},
+	{"end_time", "INTEGER", "timestamp with time zone"},
+	{"end_time_us", "INTEGER", "bigint"},
+	{"stream_id", "INTEGER", "bigint"},
+	{"stream_start", "INTEGER", "smallint"},
+	{"stream_end", "INTEGER", "smallint"},
+	{"request_id", "INTEGER", "bigint"},
+	{"response_to", "INTEGER", "bigint"},
+	{"src", "TEXT", "text"},
+	{"src_port", "TEXT", "text"},
+	{"dst", "TEXT", "text"},
+	{"dst_port", "TEXT", "text"},
+	{"opcode", "TEXT", "text"},
+	{"command", "TEXT", "text"},
+	{"namespace", "TEXT", "text"},
+	{"op", "TEXT", "jsonb"},
+	{"packets", "TEXT", "jsonb"},
+	{"app_name", "TEXT", "text"},
+	{"driver", "TEXT", "text"},
+	{"shape", "TEXT", "text"},
+	{"shape_hash", "TEXT", "text"},
+	{"ok", "INTEGER", "smallint"},
+	{"error_code", "INTEGER", "bigint"},
+	{"error_name", "TEXT", "text"},
+	{"error_message", "TEXT", "text"},
+	{"write_errors", "INTEGER", "integer"},
+	{"error_labels", "TEXT", "text[]"},
+}
+
+// Names of the columns, in order
+func sqlColumnNames(cols []sqlColumn) []string {
+	names := make([]string, len(cols))
+	for i, col := range cols {
+		names[i] = col.name
+	}
+	return names
+}
+
+// Names of the columns, in order
+func schemaNames(cols []schemaColumn) []string {
+	names := make([]string, len(cols))
+	for i, col := range cols {
+		names[i] = col.name
+	}
+	return names
+}
+
+// The columns with their SQLite or Postgres types
+func sqlSchema(cols []sqlColumn, postgres bool) []schemaColumn {
+	schema := make([]schemaColumn, len(cols))
+	for i, col := range cols {
+		schema[i] = schemaColumn{col.name, col.sqlite}
+		if postgres {
+			schema[i].typ = col.postgres
+		}
+	}
+	return schema
+}
+
+var clickhouseMigrations = []SchemaMigration{
+	{
+		Version:     1,
+		Description: "create tables",
+		Statements: []string{
+			createPacketV1SQL,
+			createEventV1SQL,
+			createDecodeErrorV1SQL,
+			createCursorV1SQL,
+			createTransactionV1SQL,
+			createRetryV1SQL,
+			createRetryRateV1SQL,
+			createConnectionV1SQL,
+			createAuthV1SQL,
+			createShapeV1SQL,
+		},
+	},
+	{
+		Version:     2,
+		Description: "store the other records' times as DateTime64 and order them by time",
+		Statements: concatStatements(
+			[]string{"DROP VIEW IF EXISTS mp_retry_rate"},
+			clickhouseRebuild("mp_decode_errors", createDecodeErrorV2SQL, `
+group, event_id, fromUnixTimestamp64Micro(toInt64(time_us)), stream_id,
+src, src_port, dst, dst_port,
+kind, opcode, offset, field, message_length, packets, error`),
+			clickhouseRebuild("mp_cursors", createCursorV2SQL, `
+group, cursor_id, stream_id,
+src, src_port, dst, dst_port,
+namespace, command,
+fromUnixTimestamp64Micro(toInt64(start_time_us)),
+fromUnixTimestamp64Micro(toInt64(end_time_us)),
+batches, documents, idle_total_us, idle_max_us, end_reason`),
+			clickhouseRebuild("mp_transactions", createTransactionV2SQL, `
+group, session_id, txn_number, stream_id,
+src, src_port, dst, dst_port,
+fromUnixTimestamp64Micro(toInt64(start_time_us)),
+if(commit_time_us = 0, NULL, fromUnixTimestamp64Micro(toInt64(commit_time_us))),
+fromUnixTimestamp64Micro(toInt64(end_time_us)),
+started, statement_count, outcome,
+error_code, error_name, error_labels, statements`),
+			clickhouseRebuild("mp_retries", createRetryV2SQL, `
+group, session_id, txn_number, stmt_id,
+command, namespace, attempt,
+fromUnixTimestamp64Micro(toInt64(time_us)), request_id, stream_id,
+src, src_port, dst, dst_port,
+fromUnixTimestamp64Micro(toInt64(original_time_us)), original_request_id, original_stream_id,
+original_dst, original_dst_port, same_connection,
+previous_replied,
+if(previous_replied = 0, NULL, fromUnixTimestamp64Micro(toInt64(previous_reply_time_us))),
+previous_error_code, previous_error_name, previous_error_labels`),
+			clickhouseRebuild("mp_connections", createConnectionV2SQL, `
+group, stream_id, src, src_port, dst, dst_port,
+fromUnixTimestamp64Micro(toInt64(time_us)),
+app_name, driver_name, driver_version,
+os_type, os_name, os_architecture, os_version, platform,
+requested_compression, sasl_supported_mechs,
+replied, max_wire_version, min_wire_version, compression,
+connection_id, max_message_size_bytes, server_sasl_mechs`),
+			clickhouseRebuild("mp_auth", createAuthV2SQL, `
+group, stream_id, src, src_port, dst, dst_port, app_name,
+mechanism, user, database, speculative,
+fromUnixTimestamp64Micro(toInt64(start_time_us)),
+fromUnixTimestamp64Micro(toInt64(end_time_us)),
+duration_us, round_trips, outcome, error_code, error_name`),
+			[]string{createRetryRateV2SQL},
+		),
+	},
+	{
+		// Shapes saved before have no times, and take the epoch
+		Version:     3,
+		Description: "partition shapes by group and day",
+		Statements: clickhouseRebuild("mp_shapes", createShapeV3SQL, `
+group, shape_hash, command, namespace, shape,
+toDateTime64(0, 6), toDateTime64(0, 6),
+count, replies, errors, total_us, mean_us, p50_us, p90_us, p99_us, max_us`),
+	},
+}
+
+// Recreates a table whose sort key changes, which MergeTree tables can't
+// alter, copying its rows with the expressions given in column order
+func clickhouseRebuild(table, create, selectSQL string) []string {
+	old := table + "_v1"
+	return []string{
+		fmt.Sprintf("RENAME TABLE %s TO %s", table, old),
+		create,
+		fmt.Sprintf("INSERT INTO %s SELECT %s FROM %s", table, selectSQL, old),
+		fmt.Sprintf("DROP TABLE %s", old),
+	}
+}
+
+func concatStatements(lists ...[]string) []string {
+	var all []string
+	for _, l := range lists {
+		all = append(all, l...)
+	}
+	return all
+}
+
+var sqliteMigrations = []SchemaMigration{
+	{
+		Version:     1,
+		Description: "create tables",
+		Statements:  []string{createSQLitePacketV1SQL, createSQLiteEventV1SQL},
+	},
+	{
+		Version:     2,
+		Description: "add the command and namespace to events",
+		Statements: []string{
+			"ALTER TABLE mp_events ADD COLUMN command TEXT",
+			"ALTER TABLE mp_events ADD COLUMN namespace TEXT",
+		},
+	},
+}
+
+var postgresMigrations = []SchemaMigration{
+	{
+		Version:     1,
+		Description: "create tables",
+		Statements:  []string{createPostgresPacketV1SQL, createPostgresEventV1SQL},
+	},
+	{
+		Version:     2,
+		Description: "add the command and namespace to events",
+		Statements: []string{
+			"ALTER TABLE mp_events ADD COLUMN command text, ADD COLUMN namespace text",
+		},
+	},
+}
+
+// Brings a database up to the latest schema version, then checks the tables
+// have the columns that will be written to them, with the right types. It
+// returns the migrations applied.
+func migrateSchema(ctx context.Context, db *sql.DB, d *schemaDialect, migrations []SchemaMigration, tables map[string][]schemaColumn) ([]SchemaMigration, error) {
+	if _, err := db.ExecContext(ctx, d.create); err != nil {
+		return nil, err
+	}
+
+	// The last version recorded, and how many of its statements were applied
+	var version, step int
+	var description string
+	err := db.QueryRowContext(ctx,
+		"SELECT version, step, description FROM mp_schema ORDER BY version DESC, step DESC LIMIT 1").Scan(&version, &step, &description)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	latest := migrations[len(migrations)-1].Version
+	if version > latest {
+		return nil, fmt.Errorf("%s schema is version %d, newer than the version %d this build writes", d.name, version, latest)
+	}
+
+	// Tables created before versioning have nothing in mp_schema, or only
+	// the progress of their upgrade, recorded as version 0
+	var pending []SchemaMigration
+	if version == 0 {
+		legacy, err := legacySchemaOf(ctx, db, d, step, description)
+		if err != nil {
+			return nil, err
+		}
+		if legacy != nil && len(legacy.statements) > 0 {
+			pending = append(pending, SchemaMigration{Description: legacy.description, Statements: legacy.statements})
+		}
+	}
+	for _, m := range migrations {
+		if m.Version >= version {
+			pending = append(pending, m)
+		}
+	}
+
+	var applied []SchemaMigration
+	for _, m := range pending {
+		from := 0
+		if m.Version == version {
+			from = step
+		}
+		if from == len(m.Statements) {
+			continue
+		}
+		if err := applyMigration(ctx, db, d, m, from); err != nil {
+			return nil, fmt.Errorf("%s schema version %d: %s", d.name, m.Version, err)
+		}
+		applied = append(applied, m)
+	}
+
+	for table, expected := range tables {
+		cols, err := tableColumns(ctx, db, d, table)
+		if err != nil {
+			return nil, err
+		}
+		for _, col := range expected {
+			typ, ok := cols[col.name]
+			if !ok {
+				return nil, fmt.Errorf("%s table %s has no column %s, the schema doesn't match version %d", d.name, table, col.name, latest)
+			}
+			if typ != col.typ {
+				return nil, fmt.Errorf("%s table %s column %s is %s, not %s, the schema doesn't match version %d",
+					d.name, table, col.name, typ, col.typ, latest)
+			}
+		}
+	}
+	return applied, nil
+}
+
+// Applies a migration's statements from the one given, recording progress
+// in mp_schema
+func applyMigration(ctx context.Context, db *sql.DB, d *schemaDialect, m SchemaMigration, from int) error {
+	if !d.transactional {
+		for i := from; i < len(m.Statements); i++ {
+			if _, err := db.ExecContext(ctx, m.Statements[i]); err != nil {
+				return err
+			}
+			row := []interface{}{m.Version, i + 1, m.Description, time.Now().Unix()}
+			if err := execute(ctx, db, d.insert, [][]interface{}{row}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, stmt := range m.Statements[from:] {
+		if _, err = tx.ExecContext(ctx, stmt); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err = tx.ExecContext(ctx, d.insert, m.Version, len(m.Statements), m.Description, time.Now().Unix()); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// The layout of tables created before versioning, nil if there are none.
+// An upgrade already under way is found by its description.
+func legacySchemaOf(ctx context.Context, db *sql.DB, d *schemaDialect, step int, description string) (*legacySchema, error) {
+	if step > 0 {
+		for i := range d.legacy {
+			if d.legacy[i].description == description {
+				return &d.legacy[i], nil
+			}
+		}
+		return nil, fmt.Errorf("%s schema upgrade %q was interrupted and isn't known to this build", d.name, description)
+	}
+
+	events, err := tableColumns(ctx, db, d, "mp_events")
+	if err != nil || len(events) == 0 {
+		return nil, err
+	}
+	catalog := map[string]map[string]string{}
+	for _, legacy := range d.legacy {
+		for table := range legacy.tables {
+			if catalog[table] == nil {
+				if catalog[table], err = tableColumns(ctx, db, d, table); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return matchLegacySchema(d, catalog)
+}
+
+// The first layout whose tables have all the columns it created, with the
+// same types, given each table's columns. Extra columns are the
+// user-defined ones, so a layout that's a superset of another is listed
+// before it.
+func matchLegacySchema(d *schemaDialect, catalog map[string]map[string]string) (*legacySchema, error) {
+	for i := range d.legacy {
+		legacy := &d.legacy[i]
+		matched := true
+		for table, create := range legacy.tables {
+			for _, col := range createdColumns(create) {
+				if catalog[table][col.name] != col.typ {
+					matched = false
+				}
+			}
+		}
+		if matched {
+			return legacy, nil
+		}
+	}
+	return nil, fmt.Errorf("%s table mp_events predates schema versioning and has an unknown layout, drop or rename the mp_ tables", d.name)
+}
+
+// Names and types of a table's columns, empty if the table doesn't exist
+func tableColumns(ctx context.Context, db *sql.DB, d *schemaDialect, table string) (map[string]string, error) {
+	rows, err := db.QueryContext(ctx, d.columns, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cols := map[string]string{}
+	for rows.Next() {
+		var name, typ string
+		if err := rows.Scan(&name, &typ); err != nil {
+			return nil, err
+		}
+		cols[name] = typ
+	}
+	return cols, rows.Err()
+}
+
+// Columns of the table created by a CREATE TABLE statement, with their types
+// named as the catalog names them
+func createdColumns(createSQL string) []schemaColumn {
+	start := strings.Index(createSQL, "(\n") + 2
+	end := start + strings.Index(createSQL[start:], "\n)")
+	var cols []schemaColumn
+	for _, line := range strings.Split(createSQL[start:end], "\n") {
+		def := strings.SplitN(strings.TrimSuffix(strings.TrimSpace(line), ","), " ", 2)
+		if len(def) != 2 {
+			continue
+		}
+		typ := strings.TrimSuffix(def[1], " NOT NULL")
+		if typ == "timestamptz" {
+			typ = "timestamp with time zone"
+		}
+		cols = append(cols, schemaColumn{strings.Trim(def[0], `"`), typ})
+	}
+	return cols
+}
@@ -0,0 +1,213 @@
+package mongopacket
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Versions of the migrations applied
+func migratedVersions(ms []SchemaMigration) []int {
+	var versions []int
+	for _, m := range ms {
+		versions = append(versions, m.Version)
+	}
+	return versions
+}
+
+func openSQLite(t *testing.T, path string) *sql.DB {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestMigrateSQLite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.db")
+	s, err := NewSQLite(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := migratedVersions(s.Migrated()); len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Errorf("new database migrated %v", got)
+	}
+	s.Close()
+
+	s, err = NewSQLite(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Migrated()) != 0 {
+		t.Errorf("reopened database migrated %v", migratedVersions(s.Migrated()))
+	}
+
+	// A newer schema is refused
+	if _, err = s.db.Exec("INSERT INTO mp_schema VALUES (9, 1, 'future', 0)"); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if _, err = NewSQLite(path, nil); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("newer schema: %v", err)
+	}
+}
+
+// Tables written before schema versioning are recognized and upgraded,
+// keeping their rows and user-defined columns
+func TestMigrateSQLiteLegacy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.db")
+	db := openSQLite(t, path)
+	for _, stmt := range []string{
+		createSQLitePacketV1SQL,
+		createSQLiteEventV1SQL,
+		"ALTER TABLE mp_events ADD COLUMN tenant TEXT",
+		`INSERT INTO mp_events ("group", event_id, tenant) VALUES ('g', 7, 'acme')`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	columns, err := NewColumns(&ColumnConfig{Columns: []*Column{{Name: "tenant", Path: "filter.tenant", Type: ColumnString}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSQLite(path, columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if got := migratedVersions(s.Migrated()); len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Errorf("legacy database migrated %v", got)
+	}
+	var tenant string
+	var command sql.NullString
+	if err = s.db.QueryRow("SELECT tenant, command FROM mp_events WHERE event_id = 7").Scan(&tenant, &command); err != nil {
+		t.Fatal(err)
+	}
+	if tenant != "acme" || command.Valid {
+		t.Errorf("legacy row has tenant %q, command %v", tenant, command)
+	}
+}
+
+func TestMigrateSQLiteRefused(t *testing.T) {
+	dir := t.TempDir()
+
+	// An unknown layout
+	path := filepath.Join(dir, "unknown.db")
+	db := openSQLite(t, path)
+	if _, err := db.Exec("CREATE TABLE mp_events (x INTEGER)"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if _, err := NewSQLite(path, nil); err == nil || !strings.Contains(err.Error(), "unknown layout") {
+		t.Errorf("unknown layout: %v", err)
+	}
+
+	// A column of the wrong type
+	path = filepath.Join(dir, "type.db")
+	s, err := NewSQLite(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		"ALTER TABLE mp_events DROP COLUMN driver",
+		"ALTER TABLE mp_events ADD COLUMN driver INTEGER",
+	} {
+		if _, err = s.db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+	if _, err = NewSQLite(path, nil); err == nil || !strings.Contains(err.Error(), "column driver is INTEGER, not TEXT") {
+		t.Errorf("wrong type: %v", err)
+	}
+}
+
+// A failed migration leaves no trace, and is applied in full when it next
+// succeeds
+func TestMigrateSQLiteRollback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.db")
+	s, err := NewSQLite(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	migrations := append([]SchemaMigration{}, sqliteMigrations...)
+	failing := append(migrations, SchemaMigration{
+		Version:     3,
+		Description: "add the session id",
+		Statements:  []string{"ALTER TABLE mp_events ADD COLUMN session_id TEXT", "NOT SQL"},
+	})
+	ctx := context.Background()
+	db := openSQLite(t, path)
+	defer db.Close()
+	if _, err = migrateSchema(ctx, db, sqliteDialect, failing, nil); err == nil {
+		t.Fatal("failing migration applied")
+	}
+	cols, err := tableColumns(ctx, db, sqliteDialect, "mp_events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cols["session_id"]; ok {
+		t.Error("failed migration left session_id")
+	}
+
+	fixed := append(migrations, SchemaMigration{
+		Version:     3,
+		Description: "add the session id",
+		Statements:  []string{"ALTER TABLE mp_events ADD COLUMN session_id TEXT"},
+	})
+	tables := map[string][]schemaColumn{"mp_events": {{"session_id", "TEXT"}}}
+	applied, err := migrateSchema(ctx, db, sqliteDialect, fixed, tables)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := migratedVersions(applied); len(got) != 1 || got[0] != 3 {
+		t.Errorf("migrated %v", got)
+	}
+	var version, step int
+	if err = db.QueryRow("SELECT version, step FROM mp_schema ORDER BY version DESC LIMIT 1").Scan(&version, &step); err != nil {
+		t.Fatal(err)
+	}
+	if version != 3 || step != 1 {
+		t.Errorf("recorded version %d step %d", version, step)
+	}
+}
+
+// The columns checked match the tables as first created, apart from those
+// added since
+func TestSQLColumnTypes(t *testing.T) {
+	added := map[string]bool{"command": true, "namespace": true}
+	for _, c := range []struct {
+		create   string
+		columns  []sqlColumn
+		postgres bool
+	}{
+		{createSQLitePacketV1SQL, sqlPacketColumns, false},
+		{createSQLiteEventV1SQL, sqlEventColumns, false},
+		{createPostgresPacketV1SQL, sqlPacketColumns, true},
+		{createPostgresEventV1SQL, sqlEventColumns, true},
+	} {
+		var want []schemaColumn
+		for _, col := range sqlSchema(c.columns, c.postgres) {
+			if !added[col.name] {
+				want = append(want, col)
+			}
+		}
+		got := createdColumns(c.create)
+		if len(got) != len(want) {
+			t.Errorf("%d columns created, %d checked", len(got), len(want))
+			continue
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Errorf("column %d is created as %v, checked as %v", i, got[i], want[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package mongopacket
+
+import (
+	"time"
+
+	"github.com/phensley/mongopacket/pkg/protocol"
+)
+
+// How long a request waits for its reply before it is forgotten
+const requestTimeout = 10 * time.Minute
+
+// Identifies a request by its connection and request id
+type requestKey struct {
+	client string
+	server string
+	id     uint32
+}
+
+// RequestMatcher pairs replies with the requests they respond to, using the
+// connection endpoints together with the RequestID and ResponseTo fields.
+type RequestMatcher struct {
+	pending map[requestKey]*MongoEvent
+	last    time.Time
+	pruned  time.Time
+}
+
+// NewRequestMatcher ..
+func NewRequestMatcher() *RequestMatcher {
+	return &RequestMatcher{
+		pending: map[requestKey]*MongoEvent{},
+	}
+}
+
+// Match records a request awaiting a reply, or returns the request that a
+// reply responds to. Nil is returned for requests, and for replies whose
+// request was not seen.
+func (m *RequestMatcher) Match(e *MongoEvent) *MongoEvent {
+	if e.End.After(m.last) {
+		m.last = e.End
+	}
+	m.prune()
+
+	h := e.Op.GetHeader()
+	if protocol.IsResponse(e.Op) {
+		k := requestKey{
+			client: endpoint(e.DstIP, e.DstPort),
+			server: endpoint(e.SrcIP, e.SrcPort),
+			id:     h.ResponseTo,
+		}
+		req := m.pending[k]
+		delete(m.pending, k)
+		return req
+	}
+
+	if expectsReply(e.Op) {
+		k := requestKey{
+			client: endpoint(e.SrcIP, e.SrcPort),
+			server: endpoint(e.DstIP, e.DstPort),
+			id:     h.RequestID,
+		}
+		m.pending[k] = e
+	}
+	return nil
+}
+
+// Forget requests that have waited too long for a reply, in case the reply
+// was lost.
+func (m *RequestMatcher) prune() {
+	if m.last.Sub(m.pruned) < requestTimeout {
+		return
+	}
+	for k, e := range m.pending {
+		if m.last.Sub(e.End) > requestTimeout {
+			delete(m.pending, k)
+		}
+	}
+	m.pruned = m.last
+}
+
+// Check if the database replies to a request
+func expectsReply(op protocol.Op) bool {
+	switch o := op.(type) {
+	case *protocol.Query, *protocol.GetMore:
+		return true
+	case *protocol.Msg:
+		return o.Flags&protocol.MsgFlagMoreToCome == 0
+	}
+	return false
+}
+
+func endpoint(ip, port string) string {
+	return ip + ":" + port
+}
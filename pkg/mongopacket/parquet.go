@@ -0,0 +1,418 @@
+package mongopacket
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/phensley/mongopacket/pkg/protocol"
+)
+
+// ParquetOptions configures the files written by ParquetStorage
+type ParquetOptions struct {
+	// Rows buffered before they are written as a row group. Zero uses the
+	// default of 128k rows.
+	RowGroupRows int64
+
+	// Size a file may reach before the next row group starts a new file.
+	// Files are checked as row groups are written, so they end up somewhat
+	// larger. Zero means no limit.
+	MaxFileSize int64
+}
+
+// Rows in a row group unless ParquetOptions sets another number
+const parquetRowGroupRows = 128 * 1024
+
+// ParquetStorage writes packet and mongo events to zstd compressed Parquet
+// files, numbered from 1, e.g. prefix-mongo-0001.parquet. Other records
+// aren't stored; use another storage for them.
+type ParquetStorage struct {
+	opts    ParquetOptions
+	mongo   *parquetFiles
+	packets *parquetFiles
+	columns *Columns
+
+	// Row type of mongo events, with the user-defined columns, if any
+	mongoType reflect.Type
+
+	// OpJSON selects the Extended JSON mode used to store ops
+	OpJSON protocol.ExtJSONMode
+}
+
+type parquetPacket struct {
+	Group    string `parquet:"group,dict"`
+	PacketID uint64 `parquet:"packet_id"`
+	Time     int64  `parquet:"time,timestamp(microsecond)"`
+	Seq      uint32 `parquet:"seq"`
+	Ack      uint32 `parquet:"ack"`
+	Src      string `parquet:"src,dict"`
+	SrcPort  string `parquet:"src_port,dict"`
+	Dst      string `parquet:"dst,dict"`
+	DstPort  string `parquet:"dst_port,dict"`
+	FlagSYN  bool   `parquet:"flag_syn"`
+	FlagFIN  bool   `parquet:"flag_fin"`
+	FlagRST  bool   `parquet:"flag_rst"`
+	FlagPSH  bool   `parquet:"flag_psh"`
+	FlagACK  bool   `parquet:"flag_ack"`
+	Size     int32  `parquet:"size"`
+}
+
+type parquetMongoEvent struct {
+	Group        string               `parquet:"group,dict"`
+	EventID      uint64               `parquet:"event_id"`
+	StartTime    int64                `parquet:"start_time,timestamp(microsecond)"`
+	EndTime      int64                `parquet:"end_time,timestamp(microsecond)"`
+	StreamID     uint64               `parquet:"stream_id"`
+	StreamStart  bool                 `parquet:"stream_start"`
+	StreamEnd    bool                 `parquet:"stream_end"`
+	RequestID    uint32               `parquet:"request_id"`
+	ResponseTo   uint32               `parquet:"response_to"`
+	Src          string               `parquet:"src,dict"`
+	SrcPort      string               `parquet:"src_port,dict"`
+	Dst          string               `parquet:"dst,dict"`
+	DstPort      string               `parquet:"dst_port,dict"`
+	OpCode       string               `parquet:"opcode,dict"`
+	Op           string               `parquet:"op"`
+	Packets      []parquetEventPacket `parquet:"packets,list"`
+	AppName      string               `parquet:"app_name,dict"`
+	Driver       string               `parquet:"driver,dict"`
+	Shape        string               `parquet:"shape"`
+	ShapeHash    string               `parquet:"shape_hash,dict"`
+	OK           *bool                `parquet:"ok,optional"`
+	ErrorCode    *int64               `parquet:"error_code,optional"`
+	ErrorName    *string              `parquet:"error_name,optional,dict"`
+	ErrorMessage *string              `parquet:"error_message,optional"`
+	WriteErrors  *int32               `parquet:"write_errors,optional"`
+	ErrorLabels  []string             `parquet:"error_labels,list"`
+}
+
+type parquetEventPacket struct {
+	Time   string `parquet:"time"`
+	Start  bool   `parquet:"start"`
+	End    bool   `parquet:"end"`
+	Length int64  `parquet:"length"`
+}
+
+// NewParquetStorage ..
+func NewParquetStorage(pathPrefix string, opts ParquetOptions, columns *Columns) *ParquetStorage {
+	s := &ParquetStorage{
+		opts:      opts,
+		columns:   columns,
+		mongoType: reflect.TypeOf(parquetMongoEvent{}),
+	}
+	if columns != nil && len(columns.cols) > 0 {
+		s.mongoType = parquetColumnsType(s.mongoType, columns.cols)
+	}
+	s.mongo = &parquetFiles{prefix: pathPrefix, name: "mongo", opts: opts, schema: parquet.SchemaOf(reflect.New(s.mongoType).Interface())}
+	s.packets = &parquetFiles{prefix: pathPrefix, name: "packets", opts: opts, schema: parquet.SchemaOf(parquetPacket{})}
+	return s
+}
+
+// Adds a nullable field for each user-defined column to the row type
+func parquetColumnsType(base reflect.Type, cols []*Column) reflect.Type {
+	fields := make([]reflect.StructField, 0, base.NumField()+len(cols))
+	for i := 0; i < base.NumField(); i++ {
+		fields = append(fields, base.Field(i))
+	}
+	for i, col := range cols {
+		var typ reflect.Type
+		tag := fmt.Sprintf(`parquet:"%s,optional"`, col.Name)
+		switch col.Type {
+		case ColumnString:
+			typ = reflect.TypeOf((*string)(nil))
+		case ColumnInt:
+			typ = reflect.TypeOf((*int64)(nil))
+		case ColumnFloat:
+			typ = reflect.TypeOf((*float64)(nil))
+		case ColumnBool:
+			typ = reflect.TypeOf((*bool)(nil))
+		case ColumnTime:
+			// Timestamps can't be pointers, so a missing time is the zero
+			// time, which is written as null
+			typ = reflect.TypeOf(time.Time{})
+			tag = fmt.Sprintf(`parquet:"%s,optional,timestamp(microsecond)"`, col.Name)
+		}
+		fields = append(fields, reflect.StructField{
+			Name: fmt.Sprintf("Column%d", i),
+			Type: typ,
+			Tag:  reflect.StructTag(tag),
+		})
+	}
+	return reflect.StructOf(fields)
+}
+
+// SaveMongoEvents ..
+func (s *ParquetStorage) SaveMongoEvents(evts []*MongoEvent) error {
+	for _, e := range evts {
+		op, err := protocol.MarshalExtJSON(e.Op, s.OpJSON)
+		if err != nil {
+			return err
+		}
+
+		h := e.Op.GetHeader()
+		row := parquetMongoEvent{
+			Group:       e.Group,
+			EventID:     e.EventID,
+			StartTime:   micros(e.Start),
+			EndTime:     micros(e.End),
+			StreamID:    e.StreamID,
+			StreamStart: e.StreamStart == 1,
+			StreamEnd:   e.StreamEnd == 1,
+			RequestID:   h.RequestID,
+			ResponseTo:  h.ResponseTo,
+			Src:         e.SrcIP,
+			SrcPort:     e.SrcPort,
+			Dst:         e.DstIP,
+			DstPort:     e.DstPort,
+			OpCode:      h.Type().String(),
+			Op:          string(op),
+			AppName:     e.AppName,
+			Driver:      e.Driver,
+		}
+		for _, p := range e.Packets {
+			row.Packets = append(row.Packets, parquetEventPacket{
+				Time:   p.Time,
+				Start:  p.Start,
+				End:    p.End,
+				Length: p.Length,
+			})
+		}
+		if e.Shape != nil {
+			row.Shape, row.ShapeHash = e.Shape.Shape, e.Shape.Hash
+		}
+
+		// Outcome columns are null for requests
+		if o := e.Outcome; o != nil {
+			writeErrors := int32(o.WriteErrors)
+			row.OK = &o.OK
+			row.ErrorCode = &o.Code
+			row.ErrorName = &o.CodeName
+			row.ErrorMessage = &o.Message
+			row.WriteErrors = &writeErrors
+			row.ErrorLabels = o.ErrorLabels
+		}
+
+		if err := s.mongo.write(s.mongoRow(&row, e.Columns)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copies a row into the row type with the user-defined columns
+func (s *ParquetStorage) mongoRow(row *parquetMongoEvent, values []interface{}) interface{} {
+	if s.columns == nil || len(s.columns.cols) == 0 {
+		return row
+	}
+	v := reflect.New(s.mongoType).Elem()
+	base := reflect.ValueOf(row).Elem()
+	for i := 0; i < base.NumField(); i++ {
+		v.Field(i).Set(base.Field(i))
+	}
+	for i := range s.columns.cols {
+		if i >= len(values) || values[i] == nil {
+			continue
+		}
+		f := v.Field(base.NumField() + i)
+		if f.Kind() != reflect.Ptr {
+			f.Set(reflect.ValueOf(values[i]))
+			continue
+		}
+		p := reflect.New(f.Type().Elem())
+		p.Elem().Set(reflect.ValueOf(values[i]))
+		f.Set(p)
+	}
+	return v.Addr().Interface()
+}
+
+// SavePacketEvents ..
+func (s *ParquetStorage) SavePacketEvents(evts []*PacketEvent) error {
+	for _, e := range evts {
+		row := &parquetPacket{
+			Group:    e.Group,
+			PacketID: e.PacketID,
+			Time:     micros(e.Time),
+			Seq:      e.Seq,
+			Ack:      e.Ack,
+			Src:      e.SrcIP,
+			SrcPort:  e.SrcPort,
+			Dst:      e.DstIP,
+			DstPort:  e.DstPort,
+			FlagSYN:  e.FlagSYN == 1,
+			FlagFIN:  e.FlagFIN == 1,
+			FlagRST:  e.FlagRST == 1,
+			FlagPSH:  e.FlagPSH == 1,
+			FlagACK:  e.FlagACK == 1,
+			Size:     int32(e.SizeTCP),
+		}
+		if err := s.packets.write(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unstored lists the records that aren't stored, see PartialStorage
+func (s *ParquetStorage) Unstored() []string {
+	return eventsOnlyUnstored
+}
+
+// SaveDecodeErrors is a no-op, see ParquetStorage
+func (s *ParquetStorage) SaveDecodeErrors(evts []*DecodeErrorEvent) error {
+	return nil
+}
+
+// SaveCursorEvents is a no-op, see ParquetStorage
+func (s *ParquetStorage) SaveCursorEvents(evts []*CursorEvent) error {
+	return nil
+}
+
+// SaveTransactionEvents is a no-op, see ParquetStorage
+func (s *ParquetStorage) SaveTransactionEvents(evts []*TransactionEvent) error {
+	return nil
+}
+
+// SaveRetryEvents is a no-op, see ParquetStorage
+func (s *ParquetStorage) SaveRetryEvents(evts []*RetryEvent) error {
+	return nil
+}
+
+// SaveConnectionEvents is a no-op, see ParquetStorage
+func (s *ParquetStorage) SaveConnectionEvents(evts []*ConnectionEvent) error {
+	return nil
+}
+
+// SaveAuthEvents is a no-op, see ParquetStorage
+func (s *ParquetStorage) SaveAuthEvents(evts []*AuthEvent) error {
+	return nil
+}
+
+// SaveShapeStats is a no-op, see ParquetStorage
+func (s *ParquetStorage) SaveShapeStats(stats []*ShapeStats) error {
+	return nil
+}
+
+// Flush writes the buffered rows as row groups. The files are only
+// readable once the storage is closed.
+func (s *ParquetStorage) Flush() error {
+	if err := s.mongo.flush(); err != nil {
+		return err
+	}
+	return s.packets.flush()
+}
+
+// Close writes the buffered rows and closes the files
+func (s *ParquetStorage) Close() error {
+	if err := s.mongo.close(); err != nil {
+		return err
+	}
+	return s.packets.close()
+}
+
+// A series of files holding one kind of row. Each file is created when the
+// first row is written to it.
+type parquetFiles struct {
+	prefix string
+	name   string
+	opts   ParquetOptions
+	schema *parquet.Schema
+
+	seq  int
+	file *os.File
+	buf  *bufio.Writer
+	out  *countingWriter
+	w    *parquet.Writer
+	rows int64 // rows in the current row group
+}
+
+func (p *parquetFiles) write(row interface{}) error {
+	if p.w == nil {
+		if err := p.open(); err != nil {
+			return err
+		}
+	}
+	if err := p.w.Write(row); err != nil {
+		return err
+	}
+
+	// Row groups are written as they fill up, growing the file. The writer
+	// would only write one when the next row arrives.
+	p.rows++
+	if p.rows < p.groupRows() {
+		return nil
+	}
+	if err := p.flush(); err != nil {
+		return err
+	}
+	if p.opts.MaxFileSize > 0 && p.out.n >= p.opts.MaxFileSize {
+		return p.close()
+	}
+	return nil
+}
+
+func (p *parquetFiles) groupRows() int64 {
+	if p.opts.RowGroupRows > 0 {
+		return p.opts.RowGroupRows
+	}
+	return parquetRowGroupRows
+}
+
+func (p *parquetFiles) open() error {
+	p.seq++
+	path := fmt.Sprintf("%s-%s-%04d.parquet", p.prefix, p.name, p.seq)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create events output file: %s", err)
+	}
+	p.file = f
+
+	// Bytes are counted as the writer produces them, and buffered after
+	p.buf = bufio.NewWriterSize(f, 1024*1024)
+	p.out = &countingWriter{w: p.buf}
+	p.w = parquet.NewWriter(p.out,
+		p.schema,
+		parquet.Compression(&parquet.Zstd),
+		parquet.MaxRowsPerRowGroup(p.groupRows()),
+		parquet.WriteBufferSize(0))
+	return nil
+}
+
+func (p *parquetFiles) flush() error {
+	if p.w == nil {
+		return nil
+	}
+	p.rows = 0
+	return p.w.Flush()
+}
+
+func (p *parquetFiles) close() error {
+	if p.w == nil {
+		return nil
+	}
+	err := p.w.Close()
+	if err == nil {
+		err = p.buf.Flush()
+	}
+	if cerr := p.file.Close(); err == nil {
+		err = cerr
+	}
+	p.w, p.file, p.buf, p.out = nil, nil, nil, nil
+	p.rows = 0
+	return err
+}
+
+// Counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,179 @@
+package mongopacket
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Read the rows of a Parquet file into values of the given row type
+func readParquet(t testing.TB, path string, typ reflect.Type) (*parquet.Schema, []reflect.Value) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r := parquet.NewReader(f)
+	defer r.Close()
+	var rows []reflect.Value
+	for {
+		row := reflect.New(typ)
+		if err := r.Read(row.Interface()); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, row.Elem())
+	}
+	return r.Schema(), rows
+}
+
+func TestParquetStorage(t *testing.T) {
+	at := time.Date(2021, 3, 4, 5, 6, 7, 8000, time.UTC)
+	columns, err := NewColumns(&ColumnConfig{Columns: []*Column{
+		{Name: "tenant", Path: "filter.tenantId", Type: ColumnString},
+		{Name: "limit", Path: "limit", Type: ColumnInt},
+		{Name: "ratio", Path: "ratio", Type: ColumnFloat},
+		{Name: "single", Path: "singleBatch", Type: ColumnBool},
+		{Name: "since", Path: "filter.since", Type: ColumnTime},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := filepath.Join(t.TempDir(), "capture")
+	s := NewParquetStorage(prefix, ParquetOptions{}, columns)
+
+	req := testEvent(t, 1, 0, 0, bson.D{
+		{Key: "find", Value: "orders"},
+		{Key: "filter", Value: bson.D{{Key: "tenantId", Value: "t1"}, {Key: "since", Value: primitive.NewDateTimeFromTime(at)}}},
+		{Key: "limit", Value: int32(10)},
+		{Key: "ratio", Value: 2.5},
+		{Key: "singleBatch", Value: true},
+		{Key: "$db", Value: "shop"},
+	})
+	req.Columns = columns.Extract(req.Op)
+	req.Packets = []*EventPacket{
+		{Time: "2021-03-04T05:06:07Z", Start: true, Length: 1460},
+		{Time: "2021-03-04T05:06:07.001Z", End: true, Length: 40},
+	}
+	reply := testEvent(t, 2, 1, 5*time.Millisecond, bson.D{
+		{Key: "ok", Value: 0.0}, {Key: "code", Value: int32(13)}, {Key: "codeName", Value: "Unauthorized"},
+		{Key: "errorLabels", Value: bson.A{"NoWritesPerformed"}},
+	})
+	reply.Columns = columns.Extract(reply.Op)
+	if err := s.SaveMongoEvents([]*MongoEvent{req, reply}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SavePacketEvents([]*PacketEvent{{Group: "g", PacketID: 3, Time: at, FlagSYN: 1, SizeTCP: 40}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	schema, rows := readParquet(t, prefix+"-mongo-0001.parquet", s.mongoType)
+	if len(rows) != 2 {
+		t.Fatalf("%d mongo rows, want 2", len(rows))
+	}
+	for _, name := range []string{"tenant", "limit", "ratio", "single", "since"} {
+		if f, ok := schema.Lookup(name); !ok || !f.Node.Optional() {
+			t.Errorf("column %s missing or required", name)
+		}
+	}
+	if f, ok := schema.Lookup("packets", "list", "element", "length"); !ok || f.Node.Type().Kind() != parquet.Int64 {
+		t.Errorf("packets are not a repeated group: %v", schema)
+	}
+
+	// The repeated packets group and the user-defined columns, set through
+	// the reflected row type
+	base := reflect.TypeOf(parquetMongoEvent{}).NumField()
+	ev := rows[0].Interface()
+	packets := rows[0].FieldByName("Packets").Interface().([]parquetEventPacket)
+	wantPackets := []parquetEventPacket{
+		{Time: "2021-03-04T05:06:07Z", Start: true, Length: 1460},
+		{Time: "2021-03-04T05:06:07.001Z", End: true, Length: 40},
+	}
+	if !reflect.DeepEqual(packets, wantPackets) {
+		t.Errorf("packets %+v, want %+v", packets, wantPackets)
+	}
+	want := []interface{}{"t1", int64(10), 2.5, true}
+	for i, w := range want {
+		f := rows[0].Field(base + i)
+		if f.IsNil() || f.Elem().Interface() != w {
+			t.Errorf("column %d = %v, want %v in %+v", i, f, w, ev)
+		}
+		if f := rows[1].Field(base + i); !f.IsNil() {
+			t.Errorf("reply column %d = %v, want null", i, f.Elem())
+		}
+	}
+	if since := rows[0].Field(base + 4).Interface().(time.Time); !since.Equal(at.Truncate(time.Millisecond)) {
+		t.Errorf("since %v, want %v", since, at.Truncate(time.Millisecond))
+	}
+	if since := rows[1].Field(base + 4).Interface().(time.Time); !since.IsZero() {
+		t.Errorf("reply since %v, want null", since)
+	}
+	if rows[0].FieldByName("OK").Interface().(*bool) != nil {
+		t.Error("request has an outcome")
+	}
+	if ok := rows[1].FieldByName("OK").Interface().(*bool); ok == nil || *ok {
+		t.Errorf("reply ok %v", ok)
+	}
+	if labels := rows[1].FieldByName("ErrorLabels").Interface().([]string); !reflect.DeepEqual(labels, []string{"NoWritesPerformed"}) {
+		t.Errorf("reply labels %v", labels)
+	}
+	if code := rows[1].FieldByName("ErrorCode").Interface().(*int64); code == nil || *code != 13 {
+		t.Errorf("reply code %v", code)
+	}
+
+	_, pkts := readParquet(t, prefix+"-packets-0001.parquet", reflect.TypeOf(parquetPacket{}))
+	if len(pkts) != 1 || pkts[0].Interface() != (parquetPacket{Group: "g", PacketID: 3, Time: micros(at), FlagSYN: true, Size: 40}) {
+		t.Errorf("packets %v", pkts)
+	}
+}
+
+// Files roll over once a row group takes them past the size limit
+func TestParquetRollover(t *testing.T) {
+	prefix := filepath.Join(t.TempDir(), "capture")
+	s := NewParquetStorage(prefix, ParquetOptions{RowGroupRows: 2, MaxFileSize: 1}, nil)
+	var evts []*MongoEvent
+	for i := uint32(1); i <= 5; i++ {
+		e := testEvent(t, i, 0, 0, bson.D{{Key: "ping", Value: int32(1)}, {Key: "$db", Value: "admin"}})
+		e.EventID = uint64(i)
+		evts = append(evts, e)
+	}
+	if err := s.SaveMongoEvents(evts); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []uint64
+	for i, n := range []int{2, 2, 1} {
+		path := fmt.Sprintf("%s-mongo-%04d.parquet", prefix, i+1)
+		_, rows := readParquet(t, path, reflect.TypeOf(parquetMongoEvent{}))
+		if len(rows) != n {
+			t.Errorf("%s: %d rows, want %d", path, len(rows), n)
+		}
+		for _, r := range rows {
+			ids = append(ids, r.FieldByName("EventID").Uint())
+		}
+	}
+	if !reflect.DeepEqual(ids, []uint64{1, 2, 3, 4, 5}) {
+		t.Errorf("event ids %v", ids)
+	}
+	if _, err := os.Stat(prefix + "-mongo-0004.parquet"); !os.IsNotExist(err) {
+		t.Errorf("extra file: %v", err)
+	}
+	if _, err := os.Stat(prefix + "-packets-0001.parquet"); !os.IsNotExist(err) {
+		t.Errorf("packets file created without rows: %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package mongopacket
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Runs against the database at MONGOPACKET_POSTGRES_URL, e.g.
+// postgres://localhost/mongopacket_test?sslmode=disable, creating the
+// tables in a schema of their own which is dropped afterwards
+func TestPostgres(t *testing.T) {
+	base := os.Getenv("MONGOPACKET_POSTGRES_URL")
+	if base == "" {
+		t.Skip("MONGOPACKET_POSTGRES_URL not set")
+	}
+	db, err := sql.Open("postgres", base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	schema := fmt.Sprintf("mp_test_%d", time.Now().UnixNano())
+	if _, err = db.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Exec("DROP SCHEMA " + schema + " CASCADE")
+
+	// Unknown connection parameters are sent to the server as settings
+	u, err := url.Parse(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	q.Set("search_path", schema)
+	u.RawQuery = q.Encode()
+
+	columns, err := NewColumns(&ColumnConfig{Columns: []*Column{
+		{Name: "tenant", Path: "filter.tenant", Type: ColumnString},
+		{Name: "limited", Path: "limit", Type: ColumnBool},
+		{Name: "since", Path: "filter.since", Type: ColumnTime},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewPostgres(u.String(), false, columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	since := time.Date(2021, 1, 2, 3, 4, 5, 6e6, time.UTC)
+	req := testEvent(t, 1, 0, 0, bson.D{
+		{Key: "find", Value: "items"},
+		{Key: "filter", Value: bson.D{{Key: "tenant", Value: "acme"}, {Key: "since", Value: since}}},
+		{Key: "limit", Value: true},
+		{Key: "$db", Value: "orders"},
+	})
+	req.Columns = columns.Extract(req.Op)
+	rep := testEvent(t, 2, 1, 20*time.Millisecond, bson.D{
+		{Key: "ok", Value: 0.0},
+		{Key: "code", Value: int32(251)},
+		{Key: "errorLabels", Value: bson.A{"TransientTransactionError"}},
+	})
+	if err = s.SaveMongoEvents([]*MongoEvent{req, rep}); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SaveMongoEvents(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SavePacketEvents([]*PacketEvent{{SrcIP: "10.2.3.4", Time: req.Start, FlagSYN: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopening the existing schema keeps the rows and adds a new
+	// user-defined column
+	columns, err = NewColumns(&ColumnConfig{Columns: []*Column{
+		{Name: "tenant", Path: "filter.tenant", Type: ColumnString},
+		{Name: "app", Path: "$db", Type: ColumnString},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewPostgres(u.String(), false, columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var (
+		command, ns, tenant, find string
+		limited                   int
+		got, start                time.Time
+		app                       sql.NullString
+	)
+	err = s.db.QueryRow(`SELECT command, namespace, tenant, limited, since, app, start_time, op->'Body'->>'find'
+		FROM mp_events WHERE request_id = 1`).Scan(&command, &ns, &tenant, &limited, &got, &app, &start, &find)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if command != "find" || ns != "orders.items" || tenant != "acme" || limited != 1 || app.Valid || find != "items" {
+		t.Errorf("got %s %s %s %d %v %s", command, ns, tenant, limited, app, find)
+	}
+	if !got.Equal(since) || !start.Equal(req.Start) {
+		t.Errorf("got since %s start %s, want %s %s", got, start, since, req.Start)
+	}
+
+	var (
+		ok     int
+		code   int64
+		labels string
+	)
+	err = s.db.QueryRow("SELECT ok, error_code, array_to_string(error_labels, ',') FROM mp_events WHERE response_to = 1").
+		Scan(&ok, &code, &labels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok != 0 || code != 251 || labels != "TransientTransactionError" {
+		t.Errorf("got ok %d code %d labels %s", ok, code, labels)
+	}
+
+	var packets, syn int
+	if err = s.db.QueryRow("SELECT count(*), max(flag_syn) FROM mp_packets").Scan(&packets, &syn); err != nil {
+		t.Fatal(err)
+	}
+	if packets != 1 || syn != 1 {
+		t.Errorf("got %d packets, syn %d", packets, syn)
+	}
+
+	var version int
+	if err = s.db.QueryRow("SELECT max(version) FROM mp_schema").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if latest := postgresMigrations[len(postgresMigrations)-1].Version; version != latest {
+		t.Errorf("got schema version %d, want %d", version, latest)
+	}
+}
@@ -0,0 +1,337 @@
+package mongopacket
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/phensley/mongopacket/pkg/protocol"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// Ways values can be redacted
+const (
+	RedactKeep     = "keep"     // store values as they are
+	RedactRemove   = "remove"   // replace values with protocol.Redacted
+	RedactHash     = "hash"     // replace values with a hash, so equal values can still be matched
+	RedactTruncate = "truncate" // cut strings and binary values to MaxLength bytes
+)
+
+// RedactionRule says how to redact the values sent to and from a database
+// or collection. Values at allowlisted field paths are always kept.
+type RedactionRule struct {
+	Namespace string   `json:"namespace"` // database, or database.collection
+	Mode      string   `json:"mode"`      // one of the Redact* values
+	MaxLength int      `json:"maxLength"` // longest value kept by truncate
+	Salt      string   `json:"salt"`      // mixed into hashes so values can't be guessed
+	Allow     []string `json:"allow"`     // field paths whose values are kept, e.g. "status" or "address.city"
+}
+
+// RedactionConfig lists the redaction rules. The most specific rule for a
+// namespace applies: its collection's, then its database's, then the
+// default. Values are kept if no rule applies.
+//
+//	{
+//	  "default": {"mode": "remove"},
+//	  "rules": [
+//	    {"namespace": "shop", "mode": "hash", "salt": "s3cret"},
+//	    {"namespace": "shop.orders", "mode": "remove", "allow": ["status", "items.sku"]}
+//	  ]
+//	}
+type RedactionConfig struct {
+	Default *RedactionRule   `json:"default"`
+	Rules   []*RedactionRule `json:"rules"`
+}
+
+// Top-level command fields that carry protocol details rather than data
+var commandMetadata = map[string]bool{
+	"$db":                      true,
+	"$clusterTime":             true,
+	"$readPreference":          true,
+	"lsid":                     true,
+	"txnNumber":                true,
+	"autocommit":               true,
+	"startTransaction":         true,
+	"stmtId":                   true,
+	"stmtIds":                  true,
+	"ordered":                  true,
+	"bypassDocumentValidation": true,
+	"batchSize":                true,
+	"limit":                    true,
+	"skip":                     true,
+	"singleBatch":              true,
+	"maxTimeMS":                true,
+	"readConcern":              true,
+	"writeConcern":             true,
+	"collection":               true,
+	"ok":                       true,
+	"code":                     true,
+	"codeName":                 true,
+	"errorLabels":              true,
+	"n":                        true,
+	"nModified":                true,
+	"operationTime":            true,
+	"electionId":               true,
+	"opTime":                   true,
+	"recoveryToken":            true,
+	"topologyVersion":          true,
+}
+
+// Redactor replaces the values in events before they are stored
+type Redactor struct {
+	rules map[string]*RedactionRule
+	def   *RedactionRule
+}
+
+// LoadRedactor reads a RedactionConfig from a JSON file
+func LoadRedactor(path string) (*Redactor, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &RedactionConfig{}
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("redaction config %s: %s", path, err)
+	}
+	return NewRedactor(cfg)
+}
+
+// NewRedactor ..
+func NewRedactor(cfg *RedactionConfig) (*Redactor, error) {
+	r := &Redactor{rules: map[string]*RedactionRule{}}
+	if cfg.Default != nil {
+		if err := checkRule(cfg.Default); err != nil {
+			return nil, err
+		}
+		r.def = cfg.Default
+	}
+	for _, rule := range cfg.Rules {
+		if err := checkRule(rule); err != nil {
+			return nil, err
+		}
+		if rule.Namespace == "" {
+			return nil, fmt.Errorf("redaction rule has no namespace")
+		}
+		r.rules[rule.Namespace] = rule
+	}
+	return r, nil
+}
+
+func checkRule(rule *RedactionRule) error {
+	switch rule.Mode {
+	case RedactKeep, RedactRemove, RedactHash:
+	case RedactTruncate:
+		if rule.MaxLength <= 0 {
+			return fmt.Errorf("redaction rule %q: truncate needs a positive maxLength", rule.Namespace)
+		}
+	default:
+		return fmt.Errorf("redaction rule %q: unknown mode %q", rule.Namespace, rule.Mode)
+	}
+	return nil
+}
+
+// Event returns a copy of the event with its values redacted, or the event
+// itself if its namespace keeps values. For replies, req is the matching
+// request if it was seen, and supplies the namespace. The event itself is
+// not modified, since the trackers may still refer to it.
+func (r *Redactor) Event(e *MongoEvent, req *MongoEvent) *MongoEvent {
+	if r == nil {
+		return e
+	}
+
+	ns := ""
+	command := false
+	if req != nil {
+		ns, command = namespaceOf(req.Op)
+	} else {
+		ns, command = namespaceOf(e.Op)
+	}
+	rule := r.rule(ns)
+	if rule == nil || rule.Mode == RedactKeep {
+		return e
+	}
+
+	reply := protocol.IsResponse(e.Op)
+	c := *e
+	c.Op = protocol.MapDocuments(e.Op, func(d *protocol.Document, seq string) *protocol.Document {
+		return rule.document(d, seq, command, reply)
+	})
+	if e.Outcome != nil && e.Outcome.Message != "" {
+		// Error messages may quote the values that caused them
+		o := *e.Outcome
+		o.Message = rule.string(o.Message)
+		c.Outcome = &o
+	}
+	return &c
+}
+
+// The most specific rule for a namespace
+func (r *Redactor) rule(ns string) *RedactionRule {
+	if rule := r.rules[ns]; rule != nil {
+		return rule
+	}
+	if i := strings.IndexByte(ns, '.'); i >= 0 {
+		if rule := r.rules[ns[:i]]; rule != nil {
+			return rule
+		}
+	}
+	return r.def
+}
+
+// The namespace an op refers to, and whether its documents are commands
+// and command replies rather than user documents
+func namespaceOf(op protocol.Op) (string, bool) {
+	if cmd := protocol.CommandOf(op); cmd != nil {
+		return cmd.Namespace(), true
+	}
+	switch o := op.(type) {
+	case *protocol.Msg:
+		return "", true
+	case *protocol.Query:
+		return o.FullCollectionName, false
+	case *protocol.Insert:
+		return o.FullCollectionName, false
+	case *protocol.Update:
+		return o.FullCollectionName, false
+	case *protocol.Delete:
+		return o.FullCollectionName, false
+	case *protocol.GetMore:
+		return o.FullCollectionName, false
+	}
+	return "", false
+}
+
+// Redact the values in a document. Command documents keep their protocol
+// fields, the value of the command name and the cursor's options and id.
+func (rule *RedactionRule) document(d *protocol.Document, seq string, command, reply bool) *protocol.Document {
+	name := ""
+	if command && !reply && seq == "" {
+		name = d.FirstKey()
+	}
+	return d.Rewrite(func(path []string, v bson.RawValue) (bson.RawValue, bool) {
+		switch {
+		case seq != "":
+			path = append([]string{seq, "0"}, path...)
+		case command:
+			if path[0] == name || commandMetadata[path[0]] {
+				return v, false
+			}
+			if path[0] == "cursor" && len(path) == 2 {
+				return v, false
+			}
+		default:
+			path = append([]string{""}, path...)
+		}
+		if rule.allowed(fieldPath(path)) {
+			return v, false
+		}
+		return rule.value(v)
+	})
+}
+
+// The user's field path to a value within a command, leaving out the
+// command field that holds the data, array indexes and query operators.
+// For example updates.0.q.status.$in.1 is status.
+func fieldPath(path []string) string {
+	root := path[0]
+	path = path[1:]
+
+	// Skip the statement or batch field within these
+	switch root {
+	case "updates", "deletes", "cursor":
+		for len(path) > 0 && isIndex(path[0]) {
+			path = path[1:]
+		}
+		if len(path) > 0 {
+			path = path[1:]
+		}
+	}
+
+	var keys []string
+	for _, k := range path {
+		if isIndex(k) || strings.HasPrefix(k, "$") {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	return strings.Join(keys, ".")
+}
+
+func isIndex(k string) bool {
+	if k == "" {
+		return false
+	}
+	for _, c := range k {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Check if a field path is allowlisted, or is within an allowlisted field
+func (rule *RedactionRule) allowed(path string) bool {
+	for _, a := range rule.Allow {
+		if path == a || strings.HasPrefix(path, a+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Redact a single value
+func (rule *RedactionRule) value(v bson.RawValue) (bson.RawValue, bool) {
+	switch rule.Mode {
+	case RedactRemove:
+		return stringValue(protocol.Redacted), true
+
+	case RedactHash:
+		h := sha256.New()
+		h.Write([]byte(rule.Salt))
+		h.Write([]byte{byte(v.Type)})
+		h.Write(v.Value)
+		return stringValue("sha256:" + hex.EncodeToString(h.Sum(nil))[:16]), true
+
+	case RedactTruncate:
+		switch v.Type {
+		case bsontype.String:
+			s := v.StringValue()
+			if len(s) > rule.MaxLength {
+				return stringValue(truncate(s, rule.MaxLength)), true
+			}
+		case bsontype.Binary:
+			subtype, data := v.Binary()
+			if len(data) > rule.MaxLength {
+				b := bsoncore.AppendBinary(nil, subtype, data[:rule.MaxLength])
+				return bson.RawValue{Type: bsontype.Binary, Value: b}, true
+			}
+		}
+	}
+	return v, false
+}
+
+// Redact a string outside of a document
+func (rule *RedactionRule) string(s string) string {
+	if v, ok := rule.value(stringValue(s)); ok {
+		return v.StringValue()
+	}
+	return s
+}
+
+func stringValue(s string) bson.RawValue {
+	return bson.RawValue{Type: bsontype.String, Value: bsoncore.AppendString(nil, s)}
+}
+
+// Cut a string to at most n bytes without splitting a character
+func truncate(s string, n int) string {
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
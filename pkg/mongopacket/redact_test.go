@@ -0,0 +1,238 @@
+package mongopacket
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/phensley/mongopacket/pkg/protocol"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// A request event carrying a command
+func commandEvent(t testing.TB, body bson.D) *MongoEvent {
+	raw, err := bson.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	op := &protocol.Msg{
+		Header: &protocol.Header{OpCode: protocol.OpMsg, RequestID: 1},
+		Body:   protocol.NewDocument(raw),
+	}
+	return &MongoEvent{Op: op}
+}
+
+// Look up a value in an event's command as a string
+func lookupString(e *MongoEvent, path ...string) string {
+	return e.Op.(*protocol.Msg).Body.Lookup(path...).String()
+}
+
+func TestRedactorModes(t *testing.T) {
+	find := bson.D{
+		{Key: "find", Value: "orders"},
+		{Key: "filter", Value: bson.D{
+			{Key: "email", Value: "ann@example.com"},
+			{Key: "status", Value: "open"},
+			{Key: "total", Value: bson.D{{Key: "$gt", Value: int32(100)}}},
+			{Key: "photo", Value: primitive.Binary{Data: []byte("0123456789")}},
+		}},
+		{Key: "limit", Value: int32(5)},
+		{Key: "$db", Value: "shop"},
+	}
+
+	tests := []struct {
+		name   string
+		rule   RedactionRule
+		email  string // filter.email after redaction, as relaxed JSON
+		status string
+		total  string
+		photo  string
+	}{
+		{"keep", RedactionRule{Mode: RedactKeep},
+			`"ann@example.com"`, `"open"`, `{"$numberInt":"100"}`, `{"$binary":{"base64":"MDEyMzQ1Njc4OQ==","subType":"00"}}`},
+		{"remove", RedactionRule{Mode: RedactRemove},
+			`"REDACTED"`, `"REDACTED"`, `"REDACTED"`, `"REDACTED"`},
+		{"remove allow", RedactionRule{Mode: RedactRemove, Allow: []string{"status", "total"}},
+			`"REDACTED"`, `"open"`, `{"$numberInt":"100"}`, `"REDACTED"`},
+		{"truncate", RedactionRule{Mode: RedactTruncate, MaxLength: 4},
+			`"ann@"`, `"open"`, `{"$numberInt":"100"}`, `{"$binary":{"base64":"MDEyMw==","subType":"00"}}`},
+		{"hash", RedactionRule{Mode: RedactHash, Salt: "s"},
+			`"sha256:` + hashOf(t, "s", "ann@example.com") + `"`, `"sha256:` + hashOf(t, "s", "open") + `"`, "", ""},
+	}
+	for _, tt := range tests {
+		rule := tt.rule
+		rule.Namespace = "shop.orders"
+		r, err := NewRedactor(&RedactionConfig{Rules: []*RedactionRule{&rule}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e := commandEvent(t, find)
+		out := r.Event(e, nil)
+		got := []string{
+			lookupString(out, "filter", "email"),
+			lookupString(out, "filter", "status"),
+			lookupString(out, "filter", "total", "$gt"),
+			lookupString(out, "filter", "photo"),
+		}
+		want := []string{tt.email, tt.status, tt.total, tt.photo}
+		for i := range got {
+			if want[i] != "" && got[i] != want[i] {
+				t.Errorf("%s: got %s, want %s", tt.name, got[i], want[i])
+			}
+		}
+
+		// The command and its protocol fields are kept
+		if lookupString(out, "find") != `"orders"` || lookupString(out, "$db") != `"shop"` || lookupString(out, "limit") != `{"$numberInt":"5"}` {
+			t.Errorf("%s: command redacted: %s", tt.name, out.Op.(*protocol.Msg).Body.Raw())
+		}
+
+		// The original event is left alone
+		if lookupString(e, "filter", "email") != `"ann@example.com"` {
+			t.Errorf("%s: original event modified", tt.name)
+		}
+	}
+}
+
+// The hash the hash mode stores for a string
+func hashOf(t testing.TB, salt, s string) string {
+	rule := &RedactionRule{Mode: RedactHash, Salt: salt}
+	v, ok := rule.value(stringValue(s))
+	if !ok {
+		t.Fatal("value not hashed")
+	}
+	h := strings.TrimPrefix(v.StringValue(), "sha256:")
+	if len(h) != 16 {
+		t.Fatalf("hash %s", h)
+	}
+	return h
+}
+
+func TestRedactHash(t *testing.T) {
+	// Equal values hash alike, and the salt changes the hash
+	if hashOf(t, "a", "x") != hashOf(t, "a", "x") {
+		t.Error("equal values hash differently")
+	}
+	if hashOf(t, "a", "x") == hashOf(t, "a", "y") {
+		t.Error("different values hash alike")
+	}
+	if hashOf(t, "a", "x") == hashOf(t, "b", "x") {
+		t.Error("salt doesn't change the hash")
+	}
+}
+
+func TestRedactorRules(t *testing.T) {
+	r, err := NewRedactor(&RedactionConfig{
+		Default: &RedactionRule{Mode: RedactRemove},
+		Rules: []*RedactionRule{
+			{Namespace: "shop", Mode: RedactTruncate, MaxLength: 2},
+			{Namespace: "shop.public", Mode: RedactKeep},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		coll string
+		db   string
+		want string
+	}{
+		{"public", "shop", `"open"`},
+		{"orders", "shop", `"op"`},
+		{"orders", "crm", `"REDACTED"`},
+	}
+	for _, tt := range tests {
+		e := commandEvent(t, bson.D{
+			{Key: "find", Value: tt.coll},
+			{Key: "filter", Value: bson.D{{Key: "status", Value: "open"}}},
+			{Key: "$db", Value: tt.db},
+		})
+		if got := lookupString(r.Event(e, nil), "filter", "status"); got != tt.want {
+			t.Errorf("%s.%s: got %s, want %s", tt.db, tt.coll, got, tt.want)
+		}
+	}
+
+	for _, rule := range []*RedactionRule{
+		{Namespace: "shop", Mode: "scramble"},
+		{Namespace: "shop", Mode: RedactTruncate},
+		{Mode: RedactRemove},
+	} {
+		if _, err := NewRedactor(&RedactionConfig{Rules: []*RedactionRule{rule}}); err == nil {
+			t.Errorf("rule %+v: no error", rule)
+		}
+	}
+}
+
+func TestRedactAllowlist(t *testing.T) {
+	rule := &RedactionRule{Namespace: "shop", Mode: RedactRemove, Allow: []string{"status", "items.sku"}}
+	r, err := NewRedactor(&RedactionConfig{Rules: []*RedactionRule{rule}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := commandEvent(t, bson.D{
+		{Key: "update", Value: "orders"},
+		{Key: "updates", Value: bson.A{bson.D{
+			{Key: "q", Value: bson.D{{Key: "status", Value: bson.D{{Key: "$in", Value: bson.A{"open", "held"}}}}}},
+			{Key: "u", Value: bson.D{{Key: "$set", Value: bson.D{
+				{Key: "items", Value: bson.A{bson.D{{Key: "sku", Value: "A1"}, {Key: "price", Value: 9.5}}}},
+			}}}},
+		}}},
+		{Key: "$db", Value: "shop"},
+	})
+	out := r.Event(e, nil)
+	for path, want := range map[string]string{
+		"updates.0.q.status.$in.1":       `"held"`,
+		"updates.0.u.$set.items.0.sku":   `"A1"`,
+		"updates.0.u.$set.items.0.price": `"REDACTED"`,
+		"updates.0.q.status.$in.0":       `"open"`,
+	} {
+		if got := lookupString(out, strings.Split(path, ".")...); got != want {
+			t.Errorf("%s: got %s, want %s", path, got, want)
+		}
+	}
+}
+
+func TestFieldPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"updates.0.q.status.$in.1", "status"},
+		{"updates.0.u.$set.items.0.sku", "items.sku"},
+		{"deletes.3.q.address.city", "address.city"},
+		{"filter.address.city.$eq", "address.city"},
+		{"filter.$or.1.total.$gt", "total"},
+		{"cursor.firstBatch.0.name", "name"},
+		{"cursor.nextBatch.12.tags.0", "tags"},
+		{"documents.0.email", "email"},
+		{"pipeline.0.$match.status", "status"},
+		{".email", "email"},
+	}
+	for _, tt := range tests {
+		if got := fieldPath(strings.Split(tt.path, ".")); got != tt.want {
+			t.Errorf("fieldPath(%s): got %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"hello", 3, "hel"},
+		{"héllo", 2, "h"},  // é is 2 bytes, at 1 and 2
+		{"héllo", 3, "hé"}, // ends after é
+		{"日本語", 4, "日"},    // each character is 3 bytes
+		{"日本語", 6, "日本"},
+		{"€", 2, ""},
+	}
+	for _, tt := range tests {
+		if got := truncate(tt.s, tt.n); got != tt.want {
+			t.Errorf("truncate(%q, %d): got %q, want %q", tt.s, tt.n, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package mongopacket
+
+import (
+	"sort"
+	"time"
+
+	"github.com/phensley/mongopacket/pkg/protocol"
+)
+
+// How long a write is remembered after its last attempt, waiting for a retry
+const retryWindow = 10 * time.Minute
+
+// Identifies a retryable write
+type retryKey struct {
+	session string
+	number  int64
+	stmt    int32
+}
+
+type retryState struct {
+	first    *MongoEvent // original attempt
+	last     *MongoEvent // most recent attempt
+	attempts int
+	reply    *MongoEvent // reply to the most recent attempt, if seen
+	seen     time.Time   // latest attempt or reply
+}
+
+// RetryTracker detects retried writes by matching requests that repeat the
+// lsid, txnNumber and stmtId of an earlier request. Each retry is linked to
+// the original attempt and to the reply that caused the driver to retry.
+type RetryTracker struct {
+	writes map[retryKey]*retryState
+	done   []*RetryEvent
+	rates  map[int64]int // retries per unix second
+	last   time.Time
+	pruned time.Time
+}
+
+// NewRetryTracker ..
+func NewRetryTracker() *RetryTracker {
+	return &RetryTracker{
+		writes: map[retryKey]*retryState{},
+		rates:  map[int64]int{},
+	}
+}
+
+// Add an event to the tracker. For replies, req is the matching request if
+// it was seen, see RequestMatcher.
+func (t *RetryTracker) Add(e *MongoEvent, req *MongoEvent) {
+	if e.End.After(t.last) {
+		t.last = e.End
+	}
+	t.prune()
+
+	if protocol.IsResponse(e.Op) {
+		if req == nil {
+			return
+		}
+		if cmd := protocol.CommandOf(req.Op); cmd != nil {
+			if k, ok := retryableKey(cmd); ok {
+				if st := t.writes[k]; st != nil && st.last == req {
+					st.reply = e
+					st.seen = e.End
+				}
+			}
+		}
+		return
+	}
+
+	cmd := protocol.CommandOf(e.Op)
+	if cmd == nil {
+		return
+	}
+	k, ok := retryableKey(cmd)
+	if !ok {
+		return
+	}
+
+	st := t.writes[k]
+	if st == nil {
+		t.writes[k] = &retryState{first: e, last: e, attempts: 1, seen: e.Start}
+		return
+	}
+
+	st.attempts++
+	prev := st.last
+	evt := &RetryEvent{
+		Group:             e.Group,
+		SessionID:         k.session,
+		TxnNumber:         k.number,
+		StmtID:            k.stmt,
+		Command:           cmd.Name,
+		Namespace:         cmd.Namespace(),
+		Attempt:           st.attempts,
+		Time:              e.Start,
+		RequestID:         e.Op.GetHeader().RequestID,
+		StreamID:          e.StreamID,
+		SrcIP:             e.SrcIP,
+		SrcPort:           e.SrcPort,
+		DstIP:             e.DstIP,
+		DstPort:           e.DstPort,
+		OriginalTime:      st.first.Start,
+		OriginalRequestID: st.first.Op.GetHeader().RequestID,
+		OriginalStreamID:  st.first.StreamID,
+		OriginalDstIP:     st.first.DstIP,
+		OriginalDstPort:   st.first.DstPort,
+		SameConnection:    prev.StreamID == e.StreamID,
+	}
+	if st.reply != nil {
+		evt.PreviousReplied = true
+		evt.PreviousReplyTime = st.reply.End
+		if out := protocol.OutcomeOf(st.reply.Op); out != nil {
+			evt.PreviousErrorCode = out.Code
+			evt.PreviousErrorName = out.CodeName
+			evt.PreviousErrorLabels = out.ErrorLabels
+		}
+	}
+	t.done = append(t.done, evt)
+	t.rates[e.Start.Unix()]++
+
+	st.last = e
+	st.reply = nil
+	st.seen = e.Start
+}
+
+// Finished returns the retries detected since the last call
+func (t *RetryTracker) Finished() []*RetryEvent {
+	done := t.done
+	t.done = nil
+	return done
+}
+
+// Rates returns the number of retries sent in each second that had any,
+// in time order. Only the peak is reported, the rates are not stored.
+func (t *RetryTracker) Rates() []*RetryRate {
+	var rates []*RetryRate
+	for sec, n := range t.rates {
+		rates = append(rates, &RetryRate{Time: time.Unix(sec, 0).UTC(), Retries: n})
+	}
+	sort.Slice(rates, func(i, j int) bool {
+		return rates[i].Time.Before(rates[j].Time)
+	})
+	return rates
+}
+
+// Forget writes that have not been retried within the retry window
+func (t *RetryTracker) prune() {
+	if t.last.Sub(t.pruned) < retryWindow {
+		return
+	}
+	for k, st := range t.writes {
+		if t.last.Sub(st.seen) > retryWindow {
+			delete(t.writes, k)
+		}
+	}
+	t.pruned = t.last
+}
+
+// Retryable writes carry lsid and txnNumber but, unlike statements in a
+// transaction, no autocommit field. Statements without a stmtId are treated
+// as statement 0.
+func retryableKey(cmd *protocol.Command) (retryKey, bool) {
+	if !cmd.Body.Lookup("autocommit").IsZero() {
+		return retryKey{}, false
+	}
+	number, found := protocol.IntValue(cmd.Body.Lookup("txnNumber"))
+	if !found {
+		return retryKey{}, false
+	}
+	session := sessionID(cmd.Body)
+	if session == "" {
+		return retryKey{}, false
+	}
+	stmt, _ := protocol.IntValue(cmd.Body.Lookup("stmtId"))
+	return retryKey{session, number, int32(stmt)}, true
+}
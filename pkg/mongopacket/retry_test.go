@@ -0,0 +1,115 @@
+package mongopacket
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// A retryable write, which carries a txnNumber but no autocommit
+func retryableWrite(cmd bson.D, session byte, txn int64, stmt int32) bson.D {
+	return append(cmd,
+		bson.E{Key: "lsid", Value: testSession(session)},
+		bson.E{Key: "txnNumber", Value: txn},
+		bson.E{Key: "stmtId", Value: stmt},
+		bson.E{Key: "$db", Value: "shop"},
+	)
+}
+
+func TestRetryTracker(t *testing.T) {
+	tr := NewRetryTracker()
+	send := func(c *testConn, stream uint64, body bson.D) *MongoEvent {
+		e := c.send(body)
+		e.StreamID = stream
+		tr.Add(e, nil)
+		return e
+	}
+	answer := func(c *testConn, stream uint64, req *MongoEvent, body bson.D) *MongoEvent {
+		e := c.answer(req, body)
+		e.StreamID = stream
+		tr.Add(e, req)
+		return e
+	}
+	insert := bson.D{{Key: "insert", Value: "orders"}, {Key: "documents", Value: bson.A{bson.D{{Key: "_id", Value: int32(1)}}}}}
+	ok := bson.D{{Key: "ok", Value: 1.0}}
+
+	// The primary steps down, failing the write with a retryable error, and
+	// the driver retries it on a connection to the new primary, whose reply
+	// is lost as it steps down in turn
+	a := &testConn{t: t, port: "50001"}
+	original := send(a, 1, retryableWrite(insert, 1, 7, 0))
+	failed := answer(a, 1, original, bson.D{
+		{Key: "ok", Value: 0.0}, {Key: "code", Value: int32(10107)}, {Key: "codeName", Value: "NotWritablePrimary"},
+		{Key: "errorLabels", Value: bson.A{"RetryableWriteError"}},
+	})
+	b := &testConn{t: t, port: "50002", at: a.at}
+	second := send(b, 2, retryableWrite(insert, 1, 7, 0))
+	third := send(b, 2, retryableWrite(insert, 1, 7, 0))
+	answer(b, 2, third, ok)
+
+	// Other statements, sessions and transactions aren't retries
+	send(b, 2, retryableWrite(insert, 1, 7, 1))
+	send(b, 2, retryableWrite(insert, 2, 7, 0))
+	send(b, 2, retryableWrite(insert, 1, 8, 0))
+	send(b, 2, txnStatement(insert, 3, 1, true))
+	send(b, 2, txnStatement(insert, 3, 1, false))
+
+	// Writes are forgotten once idle for longer than the retry window
+	c := &testConn{t: t, port: "50003", at: b.at + retryWindow + time.Minute}
+	send(c, 3, retryableWrite(insert, 2, 7, 0))
+	late := send(c, 3, retryableWrite(insert, 2, 9, 0))
+	c.at += time.Second
+	lateRetry := send(c, 3, retryableWrite(insert, 2, 9, 0))
+
+	got := tr.Finished()
+	if len(got) != 3 {
+		t.Fatalf("%d retries, want 3", len(got))
+	}
+	if len(tr.Finished()) != 0 {
+		t.Errorf("retries returned twice")
+	}
+
+	r := got[0]
+	if r.Attempt != 2 || r.SameConnection || r.StreamID != 2 || r.SrcPort != "50002" || !r.Time.Equal(second.Start) {
+		t.Errorf("first retry: attempt %d, same connection %v, stream %d from %s at %v", r.Attempt, r.SameConnection, r.StreamID, r.SrcPort, r.Time)
+	}
+	if r.OriginalStreamID != 1 || r.OriginalRequestID != original.Op.GetHeader().RequestID || !r.OriginalTime.Equal(original.Start) {
+		t.Errorf("first retry: original stream %d request %d at %v", r.OriginalStreamID, r.OriginalRequestID, r.OriginalTime)
+	}
+	if !r.PreviousReplied || !r.PreviousReplyTime.Equal(failed.End) || r.PreviousErrorCode != 10107 ||
+		r.PreviousErrorName != "NotWritablePrimary" || len(r.PreviousErrorLabels) != 1 || r.PreviousErrorLabels[0] != "RetryableWriteError" {
+		t.Errorf("first retry: previous reply %v at %v, error %d %s %v", r.PreviousReplied, r.PreviousReplyTime,
+			r.PreviousErrorCode, r.PreviousErrorName, r.PreviousErrorLabels)
+	}
+	if r.Command != "insert" || r.Namespace != "shop.orders" || r.TxnNumber != 7 || r.StmtID != 0 || r.SessionID[:2] != "01" {
+		t.Errorf("first retry: %s on %s, session %s txn %d stmt %d", r.Command, r.Namespace, r.SessionID, r.TxnNumber, r.StmtID)
+	}
+
+	// The second retry is numbered from the original attempt on the other
+	// connection, and follows one that wasn't answered
+	r = got[1]
+	if r.Attempt != 3 || !r.SameConnection || r.OriginalStreamID != 1 || !r.Time.Equal(third.Start) || r.PreviousReplied || r.PreviousErrorCode != 0 {
+		t.Errorf("second retry: attempt %d, same connection %v, original stream %d, at %v, previous replied %v error %d",
+			r.Attempt, r.SameConnection, r.OriginalStreamID, r.Time, r.PreviousReplied, r.PreviousErrorCode)
+	}
+
+	r = got[2]
+	if r.Attempt != 2 || r.TxnNumber != 9 || !r.OriginalTime.Equal(late.Start) || !r.Time.Equal(lateRetry.Start) {
+		t.Errorf("late retry: attempt %d txn %d, original at %v, at %v", r.Attempt, r.TxnNumber, r.OriginalTime, r.Time)
+	}
+
+	rates := tr.Rates()
+	want := []RetryRate{
+		{Time: second.Start.Truncate(time.Second), Retries: 2},
+		{Time: lateRetry.Start.Truncate(time.Second), Retries: 1},
+	}
+	if len(rates) != len(want) {
+		t.Fatalf("%d rates, want %d", len(rates), len(want))
+	}
+	for i, w := range want {
+		if !rates[i].Time.Equal(w.Time) || rates[i].Retries != w.Retries {
+			t.Errorf("rate %d: %d at %v, want %d at %v", i, rates[i].Retries, rates[i].Time, w.Retries, w.Time)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package mongopacket
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+type shapeState struct {
+	stats     *ShapeStats
+	latencies []time.Duration
+}
+
+// ShapeAggregator counts the requests sent with each query shape, and the
+// latency of their replies.
+type ShapeAggregator struct {
+	shapes map[string]*shapeState
+}
+
+// NewShapeAggregator ..
+func NewShapeAggregator() *ShapeAggregator {
+	return &ShapeAggregator{
+		shapes: map[string]*shapeState{},
+	}
+}
+
+// Add an event to the aggregator. For replies, req is the matching request
+// if it was seen, see RequestMatcher.
+func (a *ShapeAggregator) Add(e *MongoEvent, req *MongoEvent) {
+	if e.Shape != nil {
+		st := a.shapes[e.Shape.Hash]
+		if st == nil {
+			st = &shapeState{
+				stats: &ShapeStats{
+					Group:     e.Group,
+					Hash:      e.Shape.Hash,
+					Command:   e.Shape.Command,
+					Namespace: e.Shape.Namespace,
+					Shape:     e.Shape.Shape,
+					First:     e.Start,
+				},
+			}
+			a.shapes[e.Shape.Hash] = st
+		}
+		st.stats.Last = e.Start
+		st.stats.Count++
+		return
+	}
+
+	if req == nil || req.Shape == nil {
+		return
+	}
+	st := a.shapes[req.Shape.Hash]
+	if st == nil {
+		return
+	}
+	st.stats.Replies++
+	if e.Outcome != nil && e.Outcome.HasError() {
+		st.stats.Errors++
+	}
+	st.latencies = append(st.latencies, e.End.Sub(req.Start))
+}
+
+// Stats returns the statistics for each shape, ordered by total latency so
+// that the most expensive shapes come first.
+func (a *ShapeAggregator) Stats() []*ShapeStats {
+	var stats []*ShapeStats
+	for _, st := range a.shapes {
+		s := st.stats
+		sort.Slice(st.latencies, func(i, j int) bool {
+			return st.latencies[i] < st.latencies[j]
+		})
+		s.Total = 0
+		for _, l := range st.latencies {
+			s.Total += l
+		}
+		if n := len(st.latencies); n > 0 {
+			s.Mean = s.Total / time.Duration(n)
+			s.P50 = percentile(st.latencies, 50)
+			s.P90 = percentile(st.latencies, 90)
+			s.P99 = percentile(st.latencies, 99)
+			s.Max = st.latencies[n-1]
+		}
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Total != stats[j].Total {
+			return stats[i].Total > stats[j].Total
+		}
+		return stats[i].Count > stats[j].Count
+	})
+	return stats
+}
+
+// Print the most expensive shapes
+func printShapes(stats []*ShapeStats, limit int) {
+	if len(stats) > limit {
+		stats = stats[:limit]
+	}
+	for _, s := range stats {
+		fmt.Printf("%s %s %s count=%d errors=%d p50=%s p90=%s p99=%s max=%s\n  %s\n",
+			s.Hash, s.Command, s.Namespace, s.Count, s.Errors,
+			s.P50, s.P90, s.P99, s.Max, s.Shape)
+	}
+}
+
+// Nearest-rank percentile of sorted durations
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
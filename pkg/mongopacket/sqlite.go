@@ -0,0 +1,311 @@
+package mongopacket
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/phensley/mongopacket/pkg/protocol"
+
+	// Pure Go driver, so builds don't need cgo
+	_ "modernc.org/sqlite"
+)
+
+// Store packet and Mongo messages in a SQLite database file, mirroring the
+// Clickhouse tables
+
+// Tables as schema version 1 creates them; later versions alter them in
+// migrate.go
+const createSQLitePacketV1SQL = `
+CREATE TABLE IF NOT EXISTS mp_packets (
+	"group" TEXT,
+	packet_id INTEGER,
+	time INTEGER,
+	time_us INTEGER,
+	seq INTEGER,
+	ack INTEGER,
+	src TEXT,
+	src_port TEXT,
+	dst TEXT,
+	dst_port TEXT,
+	flag_syn INTEGER,
+	flag_fin INTEGER,
+	flag_rst INTEGER,
+	flag_psh INTEGER,
+	flag_ack INTEGER,
+	size INTEGER
+);
+CREATE INDEX IF NOT EXISTS mp_packets_time ON mp_packets (time_us);
+`
+
+const createSQLiteEventV1SQL = `
+CREATE TABLE IF NOT EXISTS mp_events (
+	"group" TEXT,
+	event_id INTEGER,
+	start_time INTEGER,
+	start_time_us INTEGER,
+	end_time INTEGER,
+	end_time_us INTEGER,
+	stream_id INTEGER,
+	stream_start INTEGER,
+	stream_end INTEGER,
+	request_id INTEGER,
+	response_to INTEGER,
+	src TEXT,
+	src_port TEXT,
+	dst TEXT,
+	dst_port TEXT,
+	opcode TEXT,
+	op TEXT,
+	packets TEXT,
+	app_name TEXT,
+	driver TEXT,
+	shape TEXT,
+	shape_hash TEXT,
+	ok INTEGER,
+	error_code INTEGER,
+	error_name TEXT,
+	error_message TEXT,
+	write_errors INTEGER,
+	error_labels TEXT
+);
+CREATE INDEX IF NOT EXISTS mp_events_request_id ON mp_events (request_id);
+CREATE INDEX IF NOT EXISTS mp_events_response_to ON mp_events (response_to);
+CREATE INDEX IF NOT EXISTS mp_events_stream_id ON mp_events (stream_id);
+CREATE INDEX IF NOT EXISTS mp_events_time ON mp_events (start_time_us);
+`
+
+// SQLite stores packet and mongo events in a single database file, which can
+// be opened anywhere. Each batch of events is written in one transaction.
+// Other records aren't stored, see Unstored; use another storage for them.
+type SQLite struct {
+	db          *sql.DB
+	columns     int // number of user-defined columns
+	migrated    []SchemaMigration
+	insertEvent string // insert into mp_events with the user-defined columns
+
+	// OpJSON selects the Extended JSON mode used to store ops
+	OpJSON protocol.ExtJSONMode
+}
+
+// NewSQLite opens or creates a database file and creates the tables or
+// migrates them to the latest schema version. The user-defined columns, if
+// any, are added to mp_events.
+func NewSQLite(path string, columns *Columns) (*SQLite, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite allows one writer at a time
+	db.SetMaxOpenConns(1)
+
+	// Creating or upgrading the tables
+	ctx := context.Background()
+	tables := map[string][]schemaColumn{
+		"mp_events":  sqlSchema(sqlEventColumns, false),
+		"mp_packets": sqlSchema(sqlPacketColumns, false),
+	}
+	migrated, err := migrateSchema(ctx, db, sqliteDialect, sqliteMigrations, tables)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// Add the user-defined columns missing from an existing table
+	existing, err := tableColumns(ctx, db, sqliteDialect, "mp_events")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	names := columns.Names()
+	for i, col := range names {
+		if _, ok := existing[col]; ok {
+			continue
+		}
+		alter := fmt.Sprintf("ALTER TABLE mp_events ADD COLUMN %s %s", col, columns.sqliteType(i))
+		if _, err = db.ExecContext(ctx, alter); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	return &SQLite{
+		db:          db,
+		columns:     len(names),
+		migrated:    migrated,
+		insertEvent: insertSQLiteSQL("mp_events", append(sqlColumnNames(sqlEventColumns), names...)),
+	}, nil
+}
+
+// An insert statement for the named columns, quoted since group is a keyword
+func insertSQLiteSQL(table string, names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = `"` + name + `"`
+	}
+	params := strings.TrimSuffix(strings.Repeat("?, ", len(names)), ", ")
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table, strings.Join(quoted, ", "), params)
+}
+
+var insertSQLitePacketSQL = insertSQLiteSQL("mp_packets", sqlColumnNames(sqlPacketColumns))
+
+// SQLite type of a user-defined column
+func (c *Columns) sqliteType(i int) string {
+	switch c.cols[i].Type {
+	case ColumnString:
+		return "TEXT"
+	case ColumnFloat:
+		return "REAL"
+	}
+	return "INTEGER"
+}
+
+// SaveMongoEvents ..
+func (s *SQLite) SaveMongoEvents(events []*MongoEvent) error {
+	var rows [][]interface{}
+	for _, e := range events {
+		start := e.Start.UnixNano() / 1e3
+		end := e.End.UnixNano() / 1e3
+
+		op, err := protocol.MarshalExtJSON(e.Op, s.OpJSON)
+		if err != nil {
+			fmt.Println("error json-encoding mongo operation", err)
+			continue
+		}
+		pkts, err := json.Marshal(e.Packets)
+		if err != nil {
+			fmt.Println("error json-encoding mongo event packets", err)
+			continue
+		}
+
+		var shape, hash string
+		if e.Shape != nil {
+			shape, hash = e.Shape.Shape, e.Shape.Hash
+		}
+
+		// Outcome columns are null for requests
+		outcome := make([]interface{}, 6)
+		if o := e.Outcome; o != nil {
+			labels, err := json.Marshal(stringArray(o.ErrorLabels))
+			if err != nil {
+				return err
+			}
+			outcome = []interface{}{boolInt(o.OK), o.Code, o.CodeName, o.Message, o.WriteErrors, string(labels)}
+		}
+
+		h := e.Op.GetHeader()
+		command, ns := commandNamespace(e.Op)
+		row := []interface{}{
+			e.Group,
+			e.EventID,
+			start / 1e6,
+			start,
+			end / 1e6,
+			end,
+			e.StreamID, e.StreamStart, e.StreamEnd,
+			h.RequestID, h.ResponseTo,
+			e.SrcIP, e.SrcPort, e.DstIP, e.DstPort,
+			h.Type().String(), command, ns,
+			string(op),
+			string(pkts),
+			e.AppName, e.Driver, shape, hash,
+		}
+		row = append(row, outcome...)
+		for i := 0; i < s.columns; i++ {
+			var v interface{}
+			if i < len(e.Columns) {
+				v = columnValue(e.Columns[i], false)
+			}
+			row = append(row, v)
+		}
+		rows = append(rows, row)
+	}
+	return execute(context.Background(), s.db, s.insertEvent, rows)
+}
+
+// SavePacketEvents ..
+func (s *SQLite) SavePacketEvents(packets []*PacketEvent) error {
+	var rows [][]interface{}
+	for _, p := range packets {
+		t := p.Time.UnixNano() / 1e3
+		rows = append(rows, []interface{}{
+			p.Group,
+			p.PacketID,
+			t / 1e6,
+			t,
+			p.Seq,
+			p.Ack,
+			p.SrcIP,
+			p.SrcPort,
+			p.DstIP,
+			p.DstPort,
+			p.FlagSYN,
+			p.FlagFIN,
+			p.FlagRST,
+			p.FlagPSH,
+			p.FlagACK,
+			p.SizeTCP,
+		})
+	}
+	return execute(context.Background(), s.db, insertSQLitePacketSQL, rows)
+}
+
+// Migrated lists the schema migrations applied when the database was
+// opened, see SchemaStorage
+func (s *SQLite) Migrated() []SchemaMigration {
+	return s.migrated
+}
+
+// Unstored lists the records that aren't stored, see PartialStorage
+func (s *SQLite) Unstored() []string {
+	return eventsOnlyUnstored
+}
+
+// SaveDecodeErrors is a no-op, see SQLite
+func (s *SQLite) SaveDecodeErrors(evts []*DecodeErrorEvent) error {
+	return nil
+}
+
+// SaveCursorEvents is a no-op, see SQLite
+func (s *SQLite) SaveCursorEvents(evts []*CursorEvent) error {
+	return nil
+}
+
+// SaveTransactionEvents is a no-op, see SQLite
+func (s *SQLite) SaveTransactionEvents(evts []*TransactionEvent) error {
+	return nil
+}
+
+// SaveRetryEvents is a no-op, see SQLite
+func (s *SQLite) SaveRetryEvents(evts []*RetryEvent) error {
+	return nil
+}
+
+// SaveConnectionEvents is a no-op, see SQLite
+func (s *SQLite) SaveConnectionEvents(evts []*ConnectionEvent) error {
+	return nil
+}
+
+// SaveAuthEvents is a no-op, see SQLite
+func (s *SQLite) SaveAuthEvents(evts []*AuthEvent) error {
+	return nil
+}
+
+// SaveShapeStats is a no-op, see SQLite
+func (s *SQLite) SaveShapeStats(stats []*ShapeStats) error {
+	return nil
+}
+
+// Flush is a no-op, since each batch is committed as it is saved
+func (s *SQLite) Flush() error {
+	return nil
+}
+
+// Close ..
+func (s *SQLite) Close() error {
+	return s.db.Close()
+}
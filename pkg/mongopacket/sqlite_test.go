@@ -0,0 +1,83 @@
+package mongopacket
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestSQLite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.db")
+	columns, err := NewColumns(&ColumnConfig{Columns: []*Column{
+		{Name: "tenant", Path: "filter.tenant", Type: ColumnString},
+		{Name: "limited", Path: "limit", Type: ColumnBool},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSQLite(path, columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := testEvent(t, 1, 0, 0, bson.D{
+		{Key: "find", Value: "items"},
+		{Key: "filter", Value: bson.D{{Key: "tenant", Value: "acme"}}},
+		{Key: "limit", Value: true},
+		{Key: "$db", Value: "orders"},
+	})
+	req.Columns = columns.Extract(req.Op)
+	rep := testEvent(t, 2, 1, 20*time.Millisecond, bson.D{{Key: "ok", Value: 0.0}, {Key: "code", Value: int32(11000)}})
+	if err = s.SaveMongoEvents([]*MongoEvent{req, rep}); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SavePacketEvents([]*PacketEvent{{SrcIP: "10.2.3.4", Time: req.Start}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopening keeps the rows, and adds a new user-defined column
+	columns, err = NewColumns(&ColumnConfig{Columns: []*Column{
+		{Name: "tenant", Path: "filter.tenant", Type: ColumnString},
+		{Name: "app", Path: "$db", Type: ColumnString},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewSQLite(path, columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var (
+		command, ns, tenant string
+		limited, start      int64
+		app                 interface{}
+	)
+	err = s.db.QueryRow("SELECT command, namespace, tenant, limited, app, start_time_us FROM mp_events WHERE request_id = 1").
+		Scan(&command, &ns, &tenant, &limited, &app, &start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if command != "find" || ns != "orders.items" || tenant != "acme" || limited != 1 || app != nil || start != req.Start.UnixNano()/1e3 {
+		t.Errorf("got %s %s %s %d %v %d", command, ns, tenant, limited, app, start)
+	}
+
+	var ok, code int64
+	if err = s.db.QueryRow("SELECT ok, error_code FROM mp_events WHERE response_to = 1").Scan(&ok, &code); err != nil {
+		t.Fatal(err)
+	}
+	if ok != 0 || code != 11000 {
+		t.Errorf("got ok %d code %d", ok, code)
+	}
+
+	var packets int
+	if err = s.db.QueryRow("SELECT count(*) FROM mp_packets").Scan(&packets); err != nil || packets != 1 {
+		t.Errorf("got %d packets, %v", packets, err)
+	}
+}
@@ -4,5 +4,55 @@ package mongopacket
 type Storage interface {
 	SaveMongoEvents(e []*MongoEvent) error
 	SavePacketEvents(e []*PacketEvent) error
+	SaveDecodeErrors(e []*DecodeErrorEvent) error
+	SaveCursorEvents(e []*CursorEvent) error
+	SaveTransactionEvents(e []*TransactionEvent) error
+	SaveRetryEvents(e []*RetryEvent) error
+	SaveConnectionEvents(e []*ConnectionEvent) error
+	SaveAuthEvents(e []*AuthEvent) error
+	SaveShapeStats(s []*ShapeStats) error
 	Flush() error
 }
+
+// PartialStorage is a Storage that drops some kinds of records. Unstored
+// names them, e.g. "cursor events", so they can be listed when the storage
+// is opened rather than silently lost.
+type PartialStorage interface {
+	Storage
+	Unstored() []string
+}
+
+// SchemaStorage is a Storage kept in a versioned schema. Migrated lists the
+// migrations applied when it was opened, so they can be reported.
+type SchemaStorage interface {
+	Storage
+	Migrated() []SchemaMigration
+}
+
+// The records dropped by storages that only store packet and mongo events
+var eventsOnlyUnstored = []string{
+	"decode errors",
+	"cursor events",
+	"transaction events",
+	"retry events",
+	"connection events",
+	"auth events",
+	"shape stats",
+}
+
+// Discard is a Storage that drops everything, for when events are only
+// inspected as they are decoded
+var Discard Storage = discard{}
+
+type discard struct{}
+
+func (discard) SaveMongoEvents(e []*MongoEvent) error             { return nil }
+func (discard) SavePacketEvents(e []*PacketEvent) error           { return nil }
+func (discard) SaveDecodeErrors(e []*DecodeErrorEvent) error      { return nil }
+func (discard) SaveCursorEvents(e []*CursorEvent) error           { return nil }
+func (discard) SaveTransactionEvents(e []*TransactionEvent) error { return nil }
+func (discard) SaveRetryEvents(e []*RetryEvent) error             { return nil }
+func (discard) SaveConnectionEvents(e []*ConnectionEvent) error   { return nil }
+func (discard) SaveAuthEvents(e []*AuthEvent) error               { return nil }
+func (discard) SaveShapeStats(s []*ShapeStats) error              { return nil }
+func (discard) Flush() error                                      { return nil }
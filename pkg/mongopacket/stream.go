@@ -1,8 +1,7 @@
 package mongopacket
 
 import (
-	"bufio"
-	"bytes"
+	"errors"
 	"fmt"
 	"sync/atomic"
 	"time"
@@ -18,6 +17,13 @@ type MongoStreamFactory struct {
 	eventID  uint64
 	verbose  bool
 	ch       chan<- *MongoEvent
+	errch    chan<- *DecodeErrorEvent
+
+	// Options used to decode each message, or nil for the defaults
+	DecodeOptions *protocol.DecodeOptions
+
+	// User-defined columns extracted from each message, or nil for none
+	Columns *Columns
 }
 
 // MongoStream decodes MongoDB wire protcol from packets
@@ -25,6 +31,9 @@ type MongoStream struct {
 	eventID *uint64  // pointer to event id sequence generator
 	payload *payload // partial payload waiting for more data
 	ch      chan<- *MongoEvent
+	errch   chan<- *DecodeErrorEvent
+	opts    *protocol.DecodeOptions
+	columns *Columns
 	verbose bool
 	ID      uint64
 	SrcIP   string
@@ -62,6 +71,9 @@ func (s *MongoStreamFactory) New(net, transport gopacket.Flow) tcpassembly.Strea
 	m := &MongoStream{
 		eventID: &s.eventID,
 		ch:      s.ch,
+		errch:   s.errch,
+		opts:    s.DecodeOptions,
+		columns: s.Columns,
 		verbose: s.verbose,
 		ID:      id,
 		SrcIP:   src.String(),
@@ -144,8 +156,13 @@ func (s *MongoStream) Reassembled(reassemblies []tcpassembly.Reassembly) {
 		msglen := int(protocol.DecodeInt32LE(curr.Data, i))
 
 		if msglen < 0 || msglen > protocol.MaxMessageSize {
+			s.decodeError(curr, msglen, &protocol.DecodeError{
+				Err:    protocol.ErrBadLength,
+				Field:  "messageLength",
+				Offset: 0,
+				Cause:  fmt.Errorf("message length %d", msglen),
+			})
 			curr = nil
-			fmt.Printf("%s: packet time BAD MESSAGE LENGTH %d\n", s, msglen)
 			continue
 		}
 
@@ -155,14 +172,12 @@ func (s *MongoStream) Reassembled(reassemblies []tcpassembly.Reassembly) {
 		}
 
 		// We can process at least one message from this payload!
-		id := atomic.AddUint64(s.eventID, 1)
-
-		// Adapt byte buffer to expected bufio.Reader
-		buf := bufio.NewReader(bytes.NewReader(curr.Data))
 
-		// Read the message
-		op, err := protocol.Read(buf)
+		// Decode the message directly from the payload bytes. The op may
+		// reference these bytes, so they are never overwritten below.
+		op, err := protocol.DecodeWithOptions(curr.Data[:msglen], s.opts)
 		if err == nil {
+			id := atomic.AddUint64(s.eventID, 1)
 			evt := &MongoEvent{
 				StreamID: s.ID,
 				EventID:  id,
@@ -171,9 +186,16 @@ func (s *MongoStream) Reassembled(reassemblies []tcpassembly.Reassembly) {
 				DstIP:    s.DstIP,
 				DstPort:  s.DstPort,
 				Op:       op,
+				Outcome:  protocol.OutcomeOf(op),
+				Auth:     protocol.AuthOf(op),
+				Shape:    protocol.ShapeOf(op),
 				Packets:  []*EventPacket{},
 			}
 
+			// Credentials must never reach storage
+			protocol.RedactAuth(op)
+			evt.Columns = s.columns.Extract(op)
+
 			start := curr.Packets[0].Time
 			end := start
 			for _, p := range curr.Packets {
@@ -207,17 +229,21 @@ func (s *MongoStream) Reassembled(reassemblies []tcpassembly.Reassembly) {
 					s, curr.Packets[0].Time, id, msglen, len(curr.Packets), op)
 			}
 
+		} else if framed(curr.Data) {
+			// The header is plausible, so only this message failed to decode.
+			// Skip exactly its bytes to keep the stream in sync.
+			s.decodeError(curr, msglen, err)
+
 		} else {
 			// Bad packet slipped through? Parsing bug?
-			fmt.Printf("%s: %s %d   BAD len %d packets %d   %s\n",
-				s,
-				curr.Packets[0].Time, id, msglen, len(curr.Packets), err,
-			)
+			s.decodeError(curr, msglen, err)
 
 			// We need to drop the first packet in case it is corrupt, but retain
 			// the rest.
 			if len(curr.Packets) > 1 {
-				fmt.Printf("%s:  dropping first packet\n", s)
+				if s.verbose {
+					fmt.Printf("%s:  dropping first packet\n", s)
+				}
 				curr.Packets = curr.Packets[1:]
 				curr.Data = []byte{}
 				for _, p := range curr.Packets {
@@ -225,7 +251,9 @@ func (s *MongoStream) Reassembled(reassemblies []tcpassembly.Reassembly) {
 				}
 
 			} else {
-				fmt.Printf("%s:  dropping current request\n", s)
+				if s.verbose {
+					fmt.Printf("%s:  dropping current request\n", s)
+				}
 				curr = nil
 			}
 			continue
@@ -241,7 +269,7 @@ func (s *MongoStream) Reassembled(reassemblies []tcpassembly.Reassembly) {
 				Packets: []*packet{},
 			}
 
-			next.Data = append(curr.Data[msglen:])
+			next.Data = curr.Data[msglen:]
 			next.Packets = append(next.Packets, curr.Packets[currlen-1])
 			curr = next
 		} else {
@@ -278,6 +306,50 @@ func (s *MongoStream) String() string {
 	)
 }
 
+// Record a message that failed to decode
+func (s *MongoStream) decodeError(curr *payload, msglen int, err error) {
+	evt := &DecodeErrorEvent{
+		EventID:       atomic.AddUint64(s.eventID, 1),
+		Time:          curr.Packets[0].Time,
+		StreamID:      s.ID,
+		SrcIP:         s.SrcIP,
+		SrcPort:       s.SrcPort,
+		DstIP:         s.DstIP,
+		DstPort:       s.DstPort,
+		Kind:          protocol.ErrorKind(err),
+		Offset:        -1,
+		MessageLength: msglen,
+		Packets:       len(curr.Packets),
+		Error:         err.Error(),
+	}
+
+	var derr *protocol.DecodeError
+	if errors.As(err, &derr) {
+		if derr.OpCode != protocol.OpInvalid {
+			evt.OpCode = derr.OpCode.String()
+		}
+		evt.Offset = derr.Offset
+		evt.Field = derr.Field
+	}
+
+	if s.verbose {
+		fmt.Printf("%s: %s %d   BAD len %d packets %d   %s\n",
+			s, evt.Time, evt.EventID, msglen, evt.Packets, err)
+	}
+
+	// Send event to channel for writing
+	s.errch <- evt
+}
+
+// Check if data starts with a plausible message header
+func framed(d []byte) bool {
+	h := &protocol.Header{}
+	if err := h.Decode(d); err != nil {
+		return false
+	}
+	return h.MessageLength >= protocol.HeaderLen && protocol.IsValidOpCode(h.OpCode)
+}
+
 // Display contents of packet as ASCII-ish, for debugging
 func showPacket(d []byte, max int) string {
 	s := ""
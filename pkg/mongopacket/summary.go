@@ -0,0 +1,168 @@
+package mongopacket
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/phensley/mongopacket/pkg/protocol"
+)
+
+// Groups the ops in a summary
+type summaryKey struct {
+	command   string
+	namespace string
+	app       string
+	server    string
+}
+
+type summaryState struct {
+	row       *SummaryRow
+	latencies []time.Duration
+}
+
+// SummaryRow describes the ops that share a command, namespace, client
+// application and server
+type SummaryRow struct {
+	Command    string `json:"command"`
+	Namespace  string `json:"namespace"`
+	AppName    string `json:"app_name"`
+	Server     string `json:"server"`
+	Count      int    `json:"count"`       // requests sent
+	Replies    int    `json:"replies"`     // requests whose reply was seen, giving their latency
+	Errors     int    `json:"errors"`      // replies that reported an error
+	BytesSent  int64  `json:"bytes_sent"`  // total size of the requests
+	BytesRecvd int64  `json:"bytes_recvd"` // total size of the replies
+	P50        int64  `json:"p50_us"`
+	P90        int64  `json:"p90_us"`
+	P99        int64  `json:"p99_us"`
+	Max        int64  `json:"max_us"`
+}
+
+// Summarizer tallies ops by command, namespace, client application and
+// server, with the latency of each reply measured from its request.
+type Summarizer struct {
+	groups map[summaryKey]*summaryState
+}
+
+// NewSummarizer ..
+func NewSummarizer() *Summarizer {
+	return &Summarizer{
+		groups: map[summaryKey]*summaryState{},
+	}
+}
+
+// Add an event to the summary. For replies, req is the matching request if
+// it was seen. Its signature matches TCPStream.Handler.
+func (s *Summarizer) Add(e *MongoEvent, req *MongoEvent) {
+	size := int64(e.Op.GetHeader().MessageLength)
+	if !protocol.IsResponse(e.Op) {
+		st := s.group(e)
+		st.row.Count++
+		st.row.BytesSent += size
+		return
+	}
+
+	// Replies without a request can't be attributed to a command
+	if req == nil {
+		return
+	}
+	st := s.group(req)
+	st.row.Replies++
+	st.row.BytesRecvd += size
+	if e.Outcome != nil && e.Outcome.HasError() {
+		st.row.Errors++
+	}
+	st.latencies = append(st.latencies, e.End.Sub(req.Start))
+}
+
+// The group a request belongs to
+func (s *Summarizer) group(req *MongoEvent) *summaryState {
+	k := summaryKey{
+		app:    req.AppName,
+		server: endpoint(req.DstIP, req.DstPort),
+	}
+	if cmd := protocol.CommandOf(req.Op); cmd != nil {
+		k.command = cmd.Name
+	} else {
+		k.command = req.Op.GetHeader().Type().String()
+	}
+	k.namespace, _ = namespaceOf(req.Op)
+
+	st := s.groups[k]
+	if st == nil {
+		st = &summaryState{
+			row: &SummaryRow{
+				Command:   k.command,
+				Namespace: k.namespace,
+				AppName:   k.app,
+				Server:    k.server,
+			},
+		}
+		s.groups[k] = st
+	}
+	return st
+}
+
+// Rows returns the summary, busiest groups first
+func (s *Summarizer) Rows() []*SummaryRow {
+	var rows []*SummaryRow
+	for _, st := range s.groups {
+		sort.Slice(st.latencies, func(i, j int) bool {
+			return st.latencies[i] < st.latencies[j]
+		})
+		r := st.row
+		r.P50 = percentile(st.latencies, 50).Microseconds()
+		r.P90 = percentile(st.latencies, 90).Microseconds()
+		r.P99 = percentile(st.latencies, 99).Microseconds()
+		if n := len(st.latencies); n > 0 {
+			r.Max = st.latencies[n-1].Microseconds()
+		}
+		rows = append(rows, r)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Count != rows[j].Count {
+			return rows[i].Count > rows[j].Count
+		}
+		if rows[i].Command != rows[j].Command {
+			return rows[i].Command < rows[j].Command
+		}
+		if rows[i].Namespace != rows[j].Namespace {
+			return rows[i].Namespace < rows[j].Namespace
+		}
+		if rows[i].AppName != rows[j].AppName {
+			return rows[i].AppName < rows[j].AppName
+		}
+		return rows[i].Server < rows[j].Server
+	})
+	return rows
+}
+
+// WriteSummaryText prints the summary as an aligned table
+func WriteSummaryText(w io.Writer, rows []*SummaryRow) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "COMMAND\tNAMESPACE\tAPP\tSERVER\tCOUNT\tERRORS\tSENT\tRECVD\tP50\tP90\tP99\tMAX")
+	us := func(v int64) time.Duration {
+		return time.Duration(v) * time.Microsecond
+	}
+	for _, r := range rows {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%s\t%s\t%s\t%s\n",
+			r.Command, r.Namespace, r.AppName, r.Server,
+			r.Count, r.Errors, r.BytesSent, r.BytesRecvd,
+			us(r.P50), us(r.P90), us(r.P99), us(r.Max))
+	}
+	return tw.Flush()
+}
+
+// WriteSummaryJSON prints the summary as a JSON array
+func WriteSummaryJSON(w io.Writer, rows []*SummaryRow) error {
+	if rows == nil {
+		rows = []*SummaryRow{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(rows)
+}
@@ -0,0 +1,150 @@
+package mongopacket
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/phensley/mongopacket/pkg/protocol"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestSummarizer(t *testing.T) {
+	s := NewSummarizer()
+	id := uint32(0)
+	size := func(e *MongoEvent) int64 {
+		return int64(e.Op.GetHeader().MessageLength)
+	}
+
+	// A request from an application, answered after latency if reply isn't
+	// nil. Returns the bytes sent and received.
+	exchange := func(app string, body bson.D, latency time.Duration, reply bson.D) (int64, int64) {
+		id++
+		req := testEvent(t, id, 0, 0, body)
+		req.AppName = app
+		s.Add(req, nil)
+		if reply == nil {
+			return size(req), 0
+		}
+		id++
+		e := testEvent(t, id, req.Op.GetHeader().RequestID, latency, reply)
+		s.Add(e, req)
+		return size(req), size(e)
+	}
+	find := func(coll string) bson.D {
+		return bson.D{{Key: "find", Value: coll}, {Key: "$db", Value: "shop"}}
+	}
+	insert := bson.D{{Key: "insert", Value: "orders"}, {Key: "documents", Value: bson.A{}}, {Key: "$db", Value: "shop"}}
+	ping := bson.D{{Key: "ping", Value: int32(1)}, {Key: "$db", Value: "admin"}}
+	ok := bson.D{{Key: "ok", Value: 1.0}}
+	failed := bson.D{{Key: "ok", Value: 0.0}, {Key: "code", Value: int32(50)}, {Key: "codeName", Value: "MaxTimeMSExpired"}}
+
+	orders := SummaryRow{Command: "find", Namespace: "shop.orders", AppName: "shop", Server: "10.1.0.9:27017(mongodb)"}
+	for i := 10; i >= 1; i-- {
+		reply := ok
+		if i == 7 {
+			reply = failed
+		}
+		sent, recvd := exchange("shop", find("orders"), time.Duration(i)*time.Millisecond, reply)
+		orders.Count++
+		orders.Replies++
+		orders.BytesSent += sent
+		orders.BytesRecvd += recvd
+	}
+	orders.Errors = 1
+	orders.P50, orders.P90, orders.P99, orders.Max = 5000, 9000, 10000, 10000
+
+	// Groups with the same count are ordered by command and namespace, then
+	// application
+	users := SummaryRow{Command: "find", Namespace: "shop.users", AppName: "shop", Server: orders.Server}
+	inserts := SummaryRow{Command: "insert", Namespace: "shop.orders", AppName: "shop", Server: orders.Server}
+	for i := 0; i < 3; i++ {
+		sent, recvd := exchange("shop", find("users"), 2*time.Millisecond, ok)
+		users.Count++
+		users.Replies++
+		users.BytesSent += sent
+		users.BytesRecvd += recvd
+
+		// Only the first insert's reply is seen
+		var reply bson.D
+		if i == 0 {
+			reply = ok
+		}
+		sent, recvd = exchange("shop", insert, 3*time.Millisecond, reply)
+		inserts.Count++
+		inserts.BytesSent += sent
+		inserts.BytesRecvd += recvd
+	}
+	users.P50, users.P90, users.P99, users.Max = 2000, 2000, 2000, 2000
+	inserts.Replies = 1
+	inserts.P50, inserts.P90, inserts.P99, inserts.Max = 3000, 3000, 3000, 3000
+
+	var pings []SummaryRow
+	for _, app := range []string{"reports", "billing"} {
+		sent, recvd := exchange(app, ping, time.Millisecond, ok)
+		pings = append(pings, SummaryRow{
+			Command: "ping", Namespace: "admin", AppName: app, Server: orders.Server, Count: 1, Replies: 1,
+			BytesSent: sent, BytesRecvd: recvd, P50: 1000, P90: 1000, P99: 1000, Max: 1000,
+		})
+	}
+
+	// Legacy ops are grouped by opcode, and replies whose request wasn't
+	// seen are left out
+	kill := &MongoEvent{
+		SrcIP: "10.2.3.4", SrcPort: "50123", DstIP: "10.1.0.9", DstPort: "27017(mongodb)",
+		Op: &protocol.KillCursors{Header: &protocol.Header{OpCode: protocol.OpKillCursors, MessageLength: 32}, CursorIDs: []int64{9}},
+	}
+	s.Add(kill, nil)
+	s.Add(testEvent(t, 99, 98, 0, ok), nil)
+	killed := SummaryRow{Command: "OP_KILL_CURSORS", Server: orders.Server, Count: 1, BytesSent: 32}
+
+	want := []SummaryRow{orders, users, inserts, killed, pings[1], pings[0]}
+	rows := s.Rows()
+	if len(rows) != len(want) {
+		t.Fatalf("%d rows, want %d", len(rows), len(want))
+	}
+	for i, w := range want {
+		if *rows[i] != w {
+			t.Errorf("row %d:\n got %+v\nwant %+v", i, *rows[i], w)
+		}
+	}
+
+	var b bytes.Buffer
+	if err := WriteSummaryJSON(&b, rows); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(b.String(), "[\n  {\n    \"command\": \"find\",\n    \"namespace\": \"shop.orders\",") {
+		t.Errorf("json:\n%s", b.String())
+	}
+	var decoded []map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	first := map[string]interface{}{
+		"command": "find", "namespace": "shop.orders", "app_name": "shop", "server": "10.1.0.9:27017(mongodb)",
+		"count": 10.0, "replies": 10.0, "errors": 1.0,
+		"bytes_sent": float64(orders.BytesSent), "bytes_recvd": float64(orders.BytesRecvd),
+		"p50_us": 5000.0, "p90_us": 9000.0, "p99_us": 10000.0, "max_us": 10000.0,
+	}
+	if len(decoded) != len(want) || !reflect.DeepEqual(decoded[0], first) {
+		t.Errorf("json rows %v", decoded)
+	}
+
+	b.Reset()
+	if err := WriteSummaryJSON(&b, NewSummarizer().Rows()); err != nil || b.String() != "[]\n" {
+		t.Errorf("empty summary %q, %v", b.String(), err)
+	}
+
+	b.Reset()
+	if err := WriteSummaryText(&b, rows); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != len(want)+1 || !strings.HasPrefix(lines[0], "COMMAND") ||
+		strings.Join(strings.Fields(lines[1])[8:], " ") != "5ms 9ms 10ms 10ms" {
+		t.Errorf("text:\n%s", b.String())
+	}
+}
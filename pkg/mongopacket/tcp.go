@@ -39,6 +39,27 @@ type TCPStream struct {
 	Handle  *pcap.Handle
 	Factory *MongoStreamFactory
 	Storage Storage
+
+	// Filter selects the events that are stored, aggregated and passed to
+	// the Handler, or nil for all of them. The trackers see every event. A
+	// filter on latency keeps the requests whose replies match, see
+	// FilterQueue.
+	Filter *Filter
+
+	// Redactor replaces the values in events before they are stored, or nil
+	// to store them as they are
+	Redactor *Redactor
+
+	// Handler is called with each event, redacted, once the trackers have
+	// seen it, along with the request it replies to, if any
+	Handler func(e *MongoEvent, req *MongoEvent)
+
+	// Quiet suppresses progress and report output
+	Quiet bool
+
+	// Shapes aggregates requests by query shape, reporting the count and
+	// latency percentiles of each shape when the capture ends
+	Shapes bool
 }
 
 var packetDetailsPool = sync.Pool{
@@ -51,6 +72,10 @@ var packetDetailsPool = sync.Pool{
 func (t *TCPStream) Run() error {
 	mongoport := layers.TCPPort(27017)
 
+	if t.Storage == nil {
+		t.Storage = Discard
+	}
+
 	pool := tcpassembly.NewStreamPool(t.Factory)
 	assembler := tcpassembly.NewAssembler(pool)
 
@@ -65,7 +90,9 @@ func (t *TCPStream) Run() error {
 	// Open connection to Clickhouse. We bulk-insert our data into CH database
 	// where it can be queried for analysis and to produce graphs.
 	ch := make(chan *MongoEvent, 0)
+	errch := make(chan *DecodeErrorEvent, 0)
 	t.Factory.ch = ch
+	t.Factory.errch = errch
 	t.Factory.verbose = false
 
 	wg := sync.WaitGroup{}
@@ -73,7 +100,9 @@ func (t *TCPStream) Run() error {
 
 	// When we exit the function, close the event channel and flush the storage
 	defer (func() {
-		fmt.Println("exiting")
+		if !t.Quiet {
+			fmt.Println("exiting")
+		}
 		time.Sleep(5000)
 		ch <- nil
 		wg.Wait()
@@ -85,35 +114,175 @@ func (t *TCPStream) Run() error {
 
 		iter := 0
 		evts := []*MongoEvent{}
+		errevts := []*DecodeErrorEvent{}
+		cursorevts := []*CursorEvent{}
+		txnevts := []*TransactionEvent{}
+		retryevts := []*RetryEvent{}
+		connevts := []*ConnectionEvent{}
+		authevts := []*AuthEvent{}
+
+		// Pair replies with requests to follow connections, authentication,
+		// cursors, transactions and retries
+		matcher := NewRequestMatcher()
+		conns := NewConnectionTracker()
+		auths := NewAuthTracker()
+		cursors := NewCursorTracker()
+		txns := NewTransactionTracker()
+		retries := NewRetryTracker()
+
+		var shapes *ShapeAggregator
+		if t.Shapes {
+			shapes = NewShapeAggregator()
+		}
+
+		// Events that pass the filter are aggregated, redacted, stored and
+		// handled. Requests may be held until their reply, see FilterQueue.
+		filtered := NewFilterQueue(t.Filter)
+		keep := func(f FilteredEvent) {
+			if shapes != nil {
+				shapes.Add(f.Event, f.Request)
+			}
+
+			// Redact a copy of the event, since the trackers may refer to it
+			out := t.Redactor.Event(f.Event, f.Request)
+			if out != f.Event {
+				// Columns hold the redacted values too
+				out.Columns = t.Factory.Columns.Extract(out.Op)
+			}
+			evts = append(evts, out)
+			if t.Handler != nil {
+				t.Handler(out, f.Request)
+			}
+		}
 
 	loop:
 		for {
 			select {
+			case errevt := <-errch:
+				errevts = append(errevts, errevt)
+
+				// Save batch of decode errors
+				if len(errevts) == 50000 {
+					t.Storage.SaveDecodeErrors(errevts)
+					errevts = errevts[:0]
+				}
+
 			case evt = <-ch:
 				if evt == nil {
 					break loop
 				}
 
 				iter++
-				if iter%10000 == 0 {
+				if iter%10000 == 0 && !t.Quiet {
 					fmt.Printf("Wrote %d events\n", iter)
 				}
 
-				evts = append(evts, evt)
+				req := matcher.Match(evt)
+				conns.Add(evt, req)
+				connevts = append(connevts, conns.Finished()...)
+				auths.Add(evt, req)
+				authevts = append(authevts, auths.Finished()...)
+				cursors.Add(evt, req)
+				cursorevts = append(cursorevts, cursors.Finished()...)
+				txns.Add(evt, req)
+				txnevts = append(txnevts, txns.Finished()...)
+				retries.Add(evt, req)
+				retryevts = append(retryevts, retries.Finished()...)
+				for _, f := range filtered.Add(evt, req) {
+					keep(f)
+				}
 
 				// Save batch of events
 				if len(evts) == 50000 {
 					t.Storage.SaveMongoEvents(evts)
 					evts = evts[:0]
 				}
+				if len(connevts) >= 50000 {
+					t.Storage.SaveConnectionEvents(connevts)
+					connevts = connevts[:0]
+				}
+				if len(authevts) >= 50000 {
+					t.Storage.SaveAuthEvents(authevts)
+					authevts = authevts[:0]
+				}
+				if len(cursorevts) >= 50000 {
+					t.Storage.SaveCursorEvents(cursorevts)
+					cursorevts = cursorevts[:0]
+				}
+				if len(txnevts) >= 50000 {
+					t.Storage.SaveTransactionEvents(txnevts)
+					txnevts = txnevts[:0]
+				}
+				if len(retryevts) >= 50000 {
+					t.Storage.SaveRetryEvents(retryevts)
+					retryevts = retryevts[:0]
+				}
 			}
 		}
 
-		// Save the last batch of events
+		// Save the last batch of events, with the requests still held
+		for _, f := range filtered.Close() {
+			keep(f)
+		}
 		if len(evts) > 0 {
 			t.Storage.SaveMongoEvents(evts)
 			evts = evts[:0]
 		}
+		if len(errevts) > 0 {
+			t.Storage.SaveDecodeErrors(errevts)
+			errevts = errevts[:0]
+		}
+
+		// Connections, conversations, cursors and transactions still open
+		// ended with the capture
+		connevts = append(connevts, conns.Close()...)
+		if len(connevts) > 0 {
+			t.Storage.SaveConnectionEvents(connevts)
+			connevts = connevts[:0]
+		}
+		authevts = append(authevts, auths.Close()...)
+		if len(authevts) > 0 {
+			t.Storage.SaveAuthEvents(authevts)
+			authevts = authevts[:0]
+		}
+		cursorevts = append(cursorevts, cursors.Close()...)
+		if len(cursorevts) > 0 {
+			t.Storage.SaveCursorEvents(cursorevts)
+			cursorevts = cursorevts[:0]
+		}
+		txnevts = append(txnevts, txns.Close()...)
+		if len(txnevts) > 0 {
+			t.Storage.SaveTransactionEvents(txnevts)
+			txnevts = txnevts[:0]
+		}
+		if len(retryevts) > 0 {
+			t.Storage.SaveRetryEvents(retryevts)
+			retryevts = retryevts[:0]
+		}
+
+		if shapes != nil {
+			stats := shapes.Stats()
+			if len(stats) > 0 {
+				t.Storage.SaveShapeStats(stats)
+			}
+			if !t.Quiet {
+				printShapes(stats, 10)
+			}
+		}
+
+		// Report the peak retry rate. The rate in each second isn't stored;
+		// it can be counted from the stored retry events by their time, as
+		// ClickHouse's mp_retry_rate view does
+		var peak *RetryRate
+		for _, r := range retries.Rates() {
+			if peak == nil || r.Retries > peak.Retries {
+				peak = r
+			}
+		}
+		if peak != nil && !t.Quiet {
+			fmt.Printf("Peak retry rate %d/s at %s (rates per second are not stored, count retry events by time)\n",
+				peak.Retries, peak.Time.Format(time.RFC3339))
+		}
 
 		wg.Done()
 	})()
@@ -140,7 +309,9 @@ func (t *TCPStream) Run() error {
 		if err != nil {
 			assembler.FlushAll()
 			if err == io.EOF {
-				fmt.Println("eof")
+				if !t.Quiet {
+					fmt.Println("eof")
+				}
 				break
 			}
 			fmt.Println("error 1", err)
@@ -154,7 +325,7 @@ func (t *TCPStream) Run() error {
 		}
 
 		n++
-		if n%10000 == 0 {
+		if n%10000 == 0 && !t.Quiet {
 			fmt.Printf("%d packets seen\n", n)
 		}
 
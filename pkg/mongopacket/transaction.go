@@ -0,0 +1,226 @@
+package mongopacket
+
+import (
+	"time"
+
+	"github.com/phensley/mongopacket/pkg/protocol"
+)
+
+// Identifies a transaction by its session and transaction number
+type txnKey struct {
+	session string
+	number  int64
+}
+
+type txnState struct {
+	evt      *TransactionEvent
+	requests map[*MongoEvent]*TransactionStatement // statements awaiting replies
+	outcome  string                                // tentative outcome if the transaction never finishes
+	last     time.Time                             // latest statement or reply
+	labels   map[string]bool
+}
+
+// TransactionTracker reconstructs multi-document transactions from the
+// commands that carry lsid, txnNumber and autocommit: false, ending each one
+// when it is committed or aborted.
+type TransactionTracker struct {
+	txns     map[txnKey]*txnState
+	sessions map[string]txnKey // most recent transaction on each session
+	done     []*TransactionEvent
+	last     time.Time
+}
+
+// NewTransactionTracker ..
+func NewTransactionTracker() *TransactionTracker {
+	return &TransactionTracker{
+		txns:     map[txnKey]*txnState{},
+		sessions: map[string]txnKey{},
+	}
+}
+
+// Add an event to the tracker. For replies, req is the matching request if
+// it was seen, see RequestMatcher.
+func (t *TransactionTracker) Add(e *MongoEvent, req *MongoEvent) {
+	if e.End.After(t.last) {
+		t.last = e.End
+	}
+
+	if !protocol.IsResponse(e.Op) {
+		t.request(e)
+		return
+	}
+	if req == nil {
+		return
+	}
+
+	cmd := protocol.CommandOf(req.Op)
+	out := protocol.OutcomeOf(e.Op)
+	if cmd == nil || out == nil {
+		return
+	}
+	k, ok := transactionKey(cmd)
+	if !ok {
+		return
+	}
+	st := t.txns[k]
+	if st == nil {
+		return
+	}
+	stmt := st.requests[req]
+	if stmt == nil {
+		return
+	}
+	delete(st.requests, req)
+
+	ok = out.OK
+	stmt.Replied = true
+	stmt.OK = ok
+	stmt.ErrorCode = out.Code
+	if e.End.After(st.last) {
+		st.last = e.End
+	}
+	for _, l := range out.ErrorLabels {
+		if !st.labels[l] {
+			st.labels[l] = true
+			st.evt.ErrorLabels = append(st.evt.ErrorLabels, l)
+		}
+	}
+	if !ok {
+		st.evt.ErrorCode = out.Code
+		st.evt.ErrorName = out.CodeName
+	}
+
+	switch cmd.Name {
+	case "commitTransaction":
+		if ok {
+			t.finish(k, e.End, TransactionCommitted)
+		} else {
+			st.outcome = TransactionCommitFailed
+		}
+	case "abortTransaction":
+		t.finish(k, e.End, TransactionAborted)
+	default:
+		if !ok {
+			st.outcome = TransactionError
+		}
+	}
+}
+
+// Finished returns the transactions that have ended since the last call
+func (t *TransactionTracker) Finished() []*TransactionEvent {
+	done := t.done
+	t.done = nil
+	return done
+}
+
+// Close ends all open transactions, and returns the transactions that have
+// ended since the last call to Finished.
+func (t *TransactionTracker) Close() []*TransactionEvent {
+	for k, st := range t.txns {
+		outcome := st.outcome
+		if outcome == "" {
+			outcome = TransactionCaptureEnd
+		}
+		t.finish(k, t.last, outcome)
+	}
+	return t.Finished()
+}
+
+// Record a statement sent within a transaction
+func (t *TransactionTracker) request(e *MongoEvent) {
+	cmd := protocol.CommandOf(e.Op)
+	if cmd == nil {
+		return
+	}
+	k, ok := transactionKey(cmd)
+	if !ok {
+		return
+	}
+
+	st := t.txns[k]
+	if st == nil {
+		// A new transaction on a session ends the previous one
+		if prev, found := t.sessions[k.session]; found {
+			if p := t.txns[prev]; p != nil {
+				outcome := p.outcome
+				if outcome == "" {
+					outcome = TransactionAbandoned
+				}
+				t.finish(prev, p.last, outcome)
+			}
+		}
+
+		started, _ := cmd.Body.Lookup("startTransaction").BooleanOK()
+		st = &txnState{
+			evt: &TransactionEvent{
+				Group:     e.Group,
+				SessionID: k.session,
+				TxnNumber: k.number,
+				StreamID:  e.StreamID,
+				SrcIP:     e.SrcIP,
+				SrcPort:   e.SrcPort,
+				DstIP:     e.DstIP,
+				DstPort:   e.DstPort,
+				Start:     e.Start,
+				Started:   started,
+			},
+			requests: map[*MongoEvent]*TransactionStatement{},
+			labels:   map[string]bool{},
+		}
+		t.txns[k] = st
+		t.sessions[k.session] = k
+	}
+
+	stmt := &TransactionStatement{
+		Time:      e.Start.UTC().Format(time.RFC3339Nano),
+		Command:   cmd.Name,
+		Namespace: cmd.Namespace(),
+		RequestID: e.Op.GetHeader().RequestID,
+	}
+	st.evt.Statements = append(st.evt.Statements, stmt)
+	st.requests[e] = stmt
+	if e.Start.After(st.last) {
+		st.last = e.Start
+	}
+
+	switch cmd.Name {
+	case "commitTransaction", "abortTransaction":
+		if st.evt.CommitStart.IsZero() {
+			st.evt.CommitStart = e.Start
+		}
+	}
+}
+
+// Stop tracking a transaction
+func (t *TransactionTracker) finish(k txnKey, end time.Time, outcome string) {
+	st := t.txns[k]
+	if st == nil {
+		return
+	}
+	delete(t.txns, k)
+	if t.sessions[k.session] == k {
+		delete(t.sessions, k.session)
+	}
+
+	st.evt.End = end
+	st.evt.Outcome = outcome
+	t.done = append(t.done, st.evt)
+}
+
+// Transactions are identified by lsid and txnNumber. Retryable writes also
+// carry these, so statements must also have autocommit: false.
+func transactionKey(cmd *protocol.Command) (txnKey, bool) {
+	autocommit, found := cmd.Body.Lookup("autocommit").BooleanOK()
+	if !found || autocommit {
+		return txnKey{}, false
+	}
+	number, found := protocol.IntValue(cmd.Body.Lookup("txnNumber"))
+	if !found {
+		return txnKey{}, false
+	}
+	session := sessionID(cmd.Body)
+	if session == "" {
+		return txnKey{}, false
+	}
+	return txnKey{session, number}, true
+}
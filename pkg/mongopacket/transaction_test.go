@@ -0,0 +1,128 @@
+package mongopacket
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The lsid of a test session, whose id bytes all hold n
+func testSession(n byte) bson.D {
+	return bson.D{{Key: "id", Value: primitive.Binary{Subtype: 4, Data: bytes.Repeat([]byte{n}, 16)}}}
+}
+
+// A statement of a transaction, the first of which starts it
+func txnStatement(cmd bson.D, session byte, txn int64, first bool) bson.D {
+	cmd = append(cmd, bson.E{Key: "lsid", Value: testSession(session)}, bson.E{Key: "txnNumber", Value: txn})
+	if first {
+		cmd = append(cmd, bson.E{Key: "startTransaction", Value: true})
+	}
+	return append(cmd, bson.E{Key: "autocommit", Value: false}, bson.E{Key: "$db", Value: "shop"})
+}
+
+func TestTransactionTracker(t *testing.T) {
+	tr := NewTransactionTracker()
+	c := &testConn{t: t, port: "50123"}
+	exchange := func(body, reply bson.D) *MongoEvent {
+		req := c.send(body)
+		tr.Add(req, nil)
+		e := c.answer(req, reply)
+		tr.Add(e, req)
+		return e
+	}
+	insert := bson.D{{Key: "insert", Value: "orders"}, {Key: "documents", Value: bson.A{bson.D{{Key: "_id", Value: int32(1)}}}}}
+	update := bson.D{{Key: "update", Value: "stock"}, {Key: "updates", Value: bson.A{}}}
+	commit := bson.D{{Key: "commitTransaction", Value: int32(1)}}
+	abort := bson.D{{Key: "abortTransaction", Value: int32(1)}}
+	ok := bson.D{{Key: "ok", Value: 1.0}}
+	failed := func(code int32, name, label string) bson.D {
+		return bson.D{
+			{Key: "ok", Value: 0.0}, {Key: "code", Value: code}, {Key: "codeName", Value: name},
+			{Key: "errorLabels", Value: bson.A{label}},
+		}
+	}
+
+	// Committed, then a second transaction on the session aborted
+	exchange(txnStatement(insert, 1, 1, true), ok)
+	exchange(txnStatement(update, 1, 1, false), ok)
+	committedAt := testTime(c.at)
+	committed := exchange(txnStatement(commit, 1, 1, false), ok)
+	exchange(txnStatement(insert, 1, 2, true), ok)
+	aborted := exchange(txnStatement(abort, 1, 2, false), ok)
+
+	// A failed statement aborts the transaction on the server, which is only
+	// seen to end when the session starts the next one, as is one that
+	// neither commits nor aborts
+	failure := exchange(txnStatement(insert, 2, 1, true), failed(112, "WriteConflict", "TransientTransactionError"))
+	abandoned := exchange(txnStatement(insert, 2, 2, true), ok)
+	exchange(txnStatement(insert, 2, 3, true), ok)
+
+	// The outcome of a commit is unknown when the capture ends
+	exchange(txnStatement(insert, 3, 1, true), ok)
+	exchange(txnStatement(commit, 3, 1, false), failed(50, "MaxTimeMSExpired", "UnknownTransactionCommitResult"))
+
+	// Retryable writes carry a txnNumber but aren't transactions
+	exchange(append(insert, bson.E{Key: "lsid", Value: testSession(4)}, bson.E{Key: "txnNumber", Value: int64(1)},
+		bson.E{Key: "$db", Value: "shop"}), ok)
+	last := c.at - 5*time.Millisecond
+
+	got := map[string]*TransactionEvent{}
+	for _, e := range append(tr.Finished(), tr.Close()...) {
+		got[fmt.Sprintf("%s/%d", e.SessionID[:2], e.TxnNumber)] = e
+	}
+	want := []struct {
+		key        string
+		outcome    string
+		end        time.Time
+		statements string
+		code       int64
+		labels     string
+	}{
+		{"01/1", TransactionCommitted, committed.End, "insert:ok update:ok commitTransaction:ok", 0, ""},
+		{"01/2", TransactionAborted, aborted.End, "insert:ok abortTransaction:ok", 0, ""},
+		{"02/1", TransactionError, failure.End, "insert:112", 112, "TransientTransactionError"},
+		{"02/2", TransactionAbandoned, abandoned.End, "insert:ok", 0, ""},
+		{"02/3", TransactionCaptureEnd, testTime(last), "insert:ok", 0, ""},
+		{"03/1", TransactionCommitFailed, testTime(last), "insert:ok commitTransaction:50", 50, "UnknownTransactionCommitResult"},
+	}
+	if len(got) != len(want) {
+		t.Errorf("%d transactions ended, want %d", len(got), len(want))
+	}
+	for _, w := range want {
+		e := got[w.key]
+		if e == nil {
+			t.Errorf("transaction %s not ended", w.key)
+			continue
+		}
+		if e.Outcome != w.outcome || !e.End.Equal(w.end) || !e.Started {
+			t.Errorf("transaction %s: got %s at %v, started %v, want %s at %v", w.key, e.Outcome, e.End, e.Started, w.outcome, w.end)
+		}
+		var statements []string
+		for _, s := range e.Statements {
+			result := "ok"
+			if !s.Replied {
+				result = "none"
+			} else if !s.OK {
+				result = fmt.Sprint(s.ErrorCode)
+			}
+			statements = append(statements, s.Command+":"+result)
+		}
+		if got := strings.Join(statements, " "); got != w.statements {
+			t.Errorf("transaction %s statements %q, want %q", w.key, got, w.statements)
+		}
+		if e.ErrorCode != w.code || strings.Join(e.ErrorLabels, ",") != w.labels {
+			t.Errorf("transaction %s error %d %v, want %d %s", w.key, e.ErrorCode, e.ErrorLabels, w.code, w.labels)
+		}
+	}
+	if e := got["01/1"]; e != nil && !e.CommitStart.Equal(committedAt) {
+		t.Errorf("commit sent at %v, want %v", e.CommitStart, committedAt)
+	}
+	if e := got["02/1"]; e != nil && e.ErrorName != "WriteConflict" {
+		t.Errorf("error name %q", e.ErrorName)
+	}
+}
@@ -6,12 +6,26 @@ import (
 	"fmt"
 	"os"
 	"strings"
+
+	"github.com/phensley/mongopacket/pkg/protocol"
 )
 
 // TSVStorage ..
 type TSVStorage struct {
 	mongo   *bufio.Writer
 	packets *bufio.Writer
+	errors  *bufio.Writer
+	cursors *bufio.Writer
+	txns    *bufio.Writer
+	retries *bufio.Writer
+	conns   *bufio.Writer
+	auth    *bufio.Writer
+	shapes  *bufio.Writer
+
+	// OpJSON selects the Extended JSON mode used to store ops
+	OpJSON protocol.ExtJSONMode
+
+	columns int // number of user-defined columns
 }
 
 var (
@@ -19,7 +33,9 @@ var (
 		"group", "event_id", "start_time_us", "end_time_us",
 		"stream_id", "stream_start", "stream_end", "request_id", "response_to",
 		"src", "src_port", "dst", "dst_port",
-		"opcode", "op", "packets",
+		"opcode", "op", "packets", "app_name", "driver", "shape", "shape_hash",
+		"ok", "error_code", "error_name", "error_message", "write_errors",
+		"error_labels",
 	}
 	packetsHeader = []string{
 		"group", "packet_id", "time_us", "seq", "ack",
@@ -27,11 +43,60 @@ var (
 		"flag_syn", "flag_fin", "flag_rst", "flag_psh", "flag_ack",
 		"size",
 	}
+	errorsHeader = []string{
+		"group", "event_id", "time_us", "stream_id",
+		"src", "src_port", "dst", "dst_port",
+		"kind", "opcode", "offset", "field", "message_length", "packets",
+		"error",
+	}
+	cursorsHeader = []string{
+		"group", "cursor_id", "stream_id",
+		"src", "src_port", "dst", "dst_port",
+		"namespace", "command", "start_time_us", "end_time_us",
+		"batches", "documents", "idle_total_us", "idle_max_us", "end_reason",
+	}
+	transactionsHeader = []string{
+		"group", "session_id", "txn_number", "stream_id",
+		"src", "src_port", "dst", "dst_port",
+		"start_time_us", "commit_time_us", "end_time_us", "started",
+		"statement_count", "outcome", "error_code", "error_name", "error_labels",
+		"statements",
+	}
+	retriesHeader = []string{
+		"group", "session_id", "txn_number", "stmt_id", "command", "namespace",
+		"attempt", "time_us", "request_id", "stream_id",
+		"src", "src_port", "dst", "dst_port",
+		"original_time_us", "original_request_id", "original_stream_id",
+		"original_dst", "original_dst_port", "same_connection",
+		"previous_replied", "previous_reply_time_us",
+		"previous_error_code", "previous_error_name", "previous_error_labels",
+	}
+	connectionsHeader = []string{
+		"group", "stream_id", "src", "src_port", "dst", "dst_port", "time_us",
+		"app_name", "driver_name", "driver_version",
+		"os_type", "os_name", "os_architecture", "os_version", "platform",
+		"requested_compression", "sasl_supported_mechs",
+		"replied", "max_wire_version", "min_wire_version", "compression",
+		"connection_id", "max_message_size_bytes", "server_sasl_mechs",
+	}
+	authHeader = []string{
+		"group", "stream_id", "src", "src_port", "dst", "dst_port", "app_name",
+		"mechanism", "user", "database", "speculative",
+		"start_time_us", "end_time_us", "duration_us", "round_trips",
+		"outcome", "error_code", "error_name",
+	}
+	shapesHeader = []string{
+		"group", "shape_hash", "command", "namespace", "shape",
+		"count", "replies", "errors",
+		"total_us", "mean_us", "p50_us", "p90_us", "p99_us", "max_us",
+	}
 )
 
-// NewTSVStorage ..
-func NewTSVStorage(pathPrefix string, bufsz int) (*TSVStorage, error) {
-	mongo, err := initTSV(pathPrefix, "mongo", eventsHeader, bufsz)
+// NewTSVStorage creates a file for each kind of event. The user-defined
+// columns, if any, are added to the events file.
+func NewTSVStorage(pathPrefix string, bufsz int, columns *Columns) (*TSVStorage, error) {
+	header := append(append([]string{}, eventsHeader...), columns.Names()...)
+	mongo, err := initTSV(pathPrefix, "mongo", header, bufsz)
 	if err != nil {
 		return nil, err
 	}
@@ -41,16 +106,59 @@ func NewTSVStorage(pathPrefix string, bufsz int) (*TSVStorage, error) {
 		return nil, err
 	}
 
+	errors, err := initTSV(pathPrefix, "errors", errorsHeader, bufsz)
+	if err != nil {
+		return nil, err
+	}
+
+	cursors, err := initTSV(pathPrefix, "cursors", cursorsHeader, bufsz)
+	if err != nil {
+		return nil, err
+	}
+
+	txns, err := initTSV(pathPrefix, "transactions", transactionsHeader, bufsz)
+	if err != nil {
+		return nil, err
+	}
+
+	retries, err := initTSV(pathPrefix, "retries", retriesHeader, bufsz)
+	if err != nil {
+		return nil, err
+	}
+
+	conns, err := initTSV(pathPrefix, "connections", connectionsHeader, bufsz)
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := initTSV(pathPrefix, "auth", authHeader, bufsz)
+	if err != nil {
+		return nil, err
+	}
+
+	shapes, err := initTSV(pathPrefix, "shapes", shapesHeader, bufsz)
+	if err != nil {
+		return nil, err
+	}
+
 	return &TSVStorage{
 		mongo:   mongo,
 		packets: packets,
+		errors:  errors,
+		cursors: cursors,
+		txns:    txns,
+		retries: retries,
+		conns:   conns,
+		auth:    auth,
+		shapes:  shapes,
+		columns: len(columns.Names()),
 	}, nil
 }
 
 // SaveMongoEvents ..
 func (t *TSVStorage) SaveMongoEvents(evts []*MongoEvent) error {
 	for _, e := range evts {
-		op, err := json.Marshal(e.Op)
+		op, err := protocol.MarshalExtJSON(e.Op, t.OpJSON)
 		if err != nil {
 			return err
 		}
@@ -74,9 +182,43 @@ func (t *TSVStorage) SaveMongoEvents(evts []*MongoEvent) error {
 			e.SrcPort,
 			e.DstIP,
 			e.DstPort,
-			e.Op.GetHeader().OpCode.String(),
+			e.Op.GetHeader().Type().String(),
 			string(op),
 			string(pkts),
+			e.AppName,
+			e.Driver,
+		}
+
+		shape, hash := "", ""
+		if e.Shape != nil {
+			shape, hash = e.Shape.Shape, e.Shape.Hash
+		}
+		row = append(row, shape, hash)
+
+		// Outcome columns are left empty for requests
+		outcome := make([]string, 6)
+		if o := e.Outcome; o != nil {
+			labels, err := json.Marshal(o.ErrorLabels)
+			if err != nil {
+				return err
+			}
+			outcome = []string{
+				fmt.Sprintf("%d", boolInt(o.OK)),
+				fmt.Sprintf("%d", o.Code),
+				o.CodeName,
+				o.Message,
+				fmt.Sprintf("%d", o.WriteErrors),
+				string(labels),
+			}
+		}
+		row = append(row, outcome...)
+
+		for i := 0; i < t.columns; i++ {
+			var v interface{}
+			if i < len(e.Columns) {
+				v = e.Columns[i]
+			}
+			row = append(row, columnTSV(v))
 		}
 
 		if err := writeRow(t.mongo, row); err != nil {
@@ -114,6 +256,265 @@ func (t *TSVStorage) SavePacketEvents(evts []*PacketEvent) error {
 	return nil
 }
 
+// SaveDecodeErrors ..
+func (t *TSVStorage) SaveDecodeErrors(evts []*DecodeErrorEvent) error {
+	for _, e := range evts {
+		row := []string{
+			e.Group,
+			fmt.Sprintf("%d", e.EventID),
+			fmt.Sprintf("%d", e.Time.UnixNano()/1e3),
+			fmt.Sprintf("%d", e.StreamID),
+			e.SrcIP,
+			e.SrcPort,
+			e.DstIP,
+			e.DstPort,
+			e.Kind,
+			e.OpCode,
+			fmt.Sprintf("%d", e.Offset),
+			e.Field,
+			fmt.Sprintf("%d", e.MessageLength),
+			fmt.Sprintf("%d", e.Packets),
+			e.Error,
+		}
+
+		if err := writeRow(t.errors, row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveCursorEvents ..
+func (t *TSVStorage) SaveCursorEvents(evts []*CursorEvent) error {
+	for _, e := range evts {
+		row := []string{
+			e.Group,
+			fmt.Sprintf("%d", e.CursorID),
+			fmt.Sprintf("%d", e.StreamID),
+			e.SrcIP,
+			e.SrcPort,
+			e.DstIP,
+			e.DstPort,
+			e.Namespace,
+			e.Command,
+			fmt.Sprintf("%d", e.Start.UnixNano()/1e3),
+			fmt.Sprintf("%d", e.End.UnixNano()/1e3),
+			fmt.Sprintf("%d", e.Batches),
+			fmt.Sprintf("%d", e.Documents),
+			fmt.Sprintf("%d", e.IdleTotal.Microseconds()),
+			fmt.Sprintf("%d", e.IdleMax.Microseconds()),
+			e.EndReason,
+		}
+
+		if err := writeRow(t.cursors, row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveTransactionEvents ..
+func (t *TSVStorage) SaveTransactionEvents(evts []*TransactionEvent) error {
+	for _, e := range evts {
+		labels, err := json.Marshal(e.ErrorLabels)
+		if err != nil {
+			return err
+		}
+
+		stmts, err := json.Marshal(e.Statements)
+		if err != nil {
+			return err
+		}
+
+		commit := int64(0)
+		if !e.CommitStart.IsZero() {
+			commit = e.CommitStart.UnixNano() / 1e3
+		}
+
+		row := []string{
+			e.Group,
+			e.SessionID,
+			fmt.Sprintf("%d", e.TxnNumber),
+			fmt.Sprintf("%d", e.StreamID),
+			e.SrcIP,
+			e.SrcPort,
+			e.DstIP,
+			e.DstPort,
+			fmt.Sprintf("%d", e.Start.UnixNano()/1e3),
+			fmt.Sprintf("%d", commit),
+			fmt.Sprintf("%d", e.End.UnixNano()/1e3),
+			fmt.Sprintf("%d", boolInt(e.Started)),
+			fmt.Sprintf("%d", len(e.Statements)),
+			e.Outcome,
+			fmt.Sprintf("%d", e.ErrorCode),
+			e.ErrorName,
+			string(labels),
+			string(stmts),
+		}
+
+		if err := writeRow(t.txns, row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveRetryEvents ..
+func (t *TSVStorage) SaveRetryEvents(evts []*RetryEvent) error {
+	for _, e := range evts {
+		labels, err := json.Marshal(e.PreviousErrorLabels)
+		if err != nil {
+			return err
+		}
+
+		replied := int64(0)
+		if e.PreviousReplied {
+			replied = e.PreviousReplyTime.UnixNano() / 1e3
+		}
+
+		row := []string{
+			e.Group,
+			e.SessionID,
+			fmt.Sprintf("%d", e.TxnNumber),
+			fmt.Sprintf("%d", e.StmtID),
+			e.Command,
+			e.Namespace,
+			fmt.Sprintf("%d", e.Attempt),
+			fmt.Sprintf("%d", e.Time.UnixNano()/1e3),
+			fmt.Sprintf("%d", e.RequestID),
+			fmt.Sprintf("%d", e.StreamID),
+			e.SrcIP,
+			e.SrcPort,
+			e.DstIP,
+			e.DstPort,
+			fmt.Sprintf("%d", e.OriginalTime.UnixNano()/1e3),
+			fmt.Sprintf("%d", e.OriginalRequestID),
+			fmt.Sprintf("%d", e.OriginalStreamID),
+			e.OriginalDstIP,
+			e.OriginalDstPort,
+			fmt.Sprintf("%d", boolInt(e.SameConnection)),
+			fmt.Sprintf("%d", boolInt(e.PreviousReplied)),
+			fmt.Sprintf("%d", replied),
+			fmt.Sprintf("%d", e.PreviousErrorCode),
+			e.PreviousErrorName,
+			string(labels),
+		}
+
+		if err := writeRow(t.retries, row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveConnectionEvents ..
+func (t *TSVStorage) SaveConnectionEvents(evts []*ConnectionEvent) error {
+	for _, e := range evts {
+		requested, err := json.Marshal(e.RequestedCompression)
+		if err != nil {
+			return err
+		}
+		compression, err := json.Marshal(e.Compression)
+		if err != nil {
+			return err
+		}
+		mechs, err := json.Marshal(e.ServerSaslMechs)
+		if err != nil {
+			return err
+		}
+
+		row := []string{
+			e.Group,
+			fmt.Sprintf("%d", e.StreamID),
+			e.SrcIP,
+			e.SrcPort,
+			e.DstIP,
+			e.DstPort,
+			fmt.Sprintf("%d", e.Time.UnixNano()/1e3),
+			e.AppName,
+			e.DriverName,
+			e.DriverVersion,
+			e.OSType,
+			e.OSName,
+			e.OSArchitecture,
+			e.OSVersion,
+			e.Platform,
+			string(requested),
+			e.SaslSupportedMechs,
+			fmt.Sprintf("%d", boolInt(e.Replied)),
+			fmt.Sprintf("%d", e.MaxWireVersion),
+			fmt.Sprintf("%d", e.MinWireVersion),
+			string(compression),
+			fmt.Sprintf("%d", e.ConnectionID),
+			fmt.Sprintf("%d", e.MaxMessageSizeBytes),
+			string(mechs),
+		}
+
+		if err := writeRow(t.conns, row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveAuthEvents ..
+func (t *TSVStorage) SaveAuthEvents(evts []*AuthEvent) error {
+	for _, e := range evts {
+		row := []string{
+			e.Group,
+			fmt.Sprintf("%d", e.StreamID),
+			e.SrcIP,
+			e.SrcPort,
+			e.DstIP,
+			e.DstPort,
+			e.AppName,
+			e.Mechanism,
+			e.User,
+			e.Database,
+			fmt.Sprintf("%d", boolInt(e.Speculative)),
+			fmt.Sprintf("%d", e.Start.UnixNano()/1e3),
+			fmt.Sprintf("%d", e.End.UnixNano()/1e3),
+			fmt.Sprintf("%d", e.End.Sub(e.Start).Microseconds()),
+			fmt.Sprintf("%d", e.RoundTrips),
+			e.Outcome,
+			fmt.Sprintf("%d", e.ErrorCode),
+			e.ErrorName,
+		}
+
+		if err := writeRow(t.auth, row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveShapeStats ..
+func (t *TSVStorage) SaveShapeStats(stats []*ShapeStats) error {
+	for _, s := range stats {
+		row := []string{
+			s.Group,
+			s.Hash,
+			s.Command,
+			s.Namespace,
+			s.Shape,
+			fmt.Sprintf("%d", s.Count),
+			fmt.Sprintf("%d", s.Replies),
+			fmt.Sprintf("%d", s.Errors),
+			fmt.Sprintf("%d", s.Total.Microseconds()),
+			fmt.Sprintf("%d", s.Mean.Microseconds()),
+			fmt.Sprintf("%d", s.P50.Microseconds()),
+			fmt.Sprintf("%d", s.P90.Microseconds()),
+			fmt.Sprintf("%d", s.P99.Microseconds()),
+			fmt.Sprintf("%d", s.Max.Microseconds()),
+		}
+
+		if err := writeRow(t.shapes, row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Flush ..
 func (t *TSVStorage) Flush() error {
 	if err := t.mongo.Flush(); err != nil {
@@ -122,6 +523,27 @@ func (t *TSVStorage) Flush() error {
 	if err := t.packets.Flush(); err != nil {
 		return err
 	}
+	if err := t.errors.Flush(); err != nil {
+		return err
+	}
+	if err := t.cursors.Flush(); err != nil {
+		return err
+	}
+	if err := t.txns.Flush(); err != nil {
+		return err
+	}
+	if err := t.retries.Flush(); err != nil {
+		return err
+	}
+	if err := t.conns.Flush(); err != nil {
+		return err
+	}
+	if err := t.auth.Flush(); err != nil {
+		return err
+	}
+	if err := t.shapes.Flush(); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -142,9 +564,20 @@ func initTSV(pathPrefix string, name string, header []string, bufsz int) (*bufio
 	return bufout, err
 }
 
+// Replaces characters that would break a row
+var tsvEscape = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+
+// Write a row, escaping every column so that no value can break it
 func writeRow(f *bufio.Writer, row []string) error {
-	if _, err := f.WriteString(strings.Join(row, "\t")); err != nil {
-		return err
+	for i, col := range row {
+		if i > 0 {
+			if err := f.WriteByte('\t'); err != nil {
+				return err
+			}
+		}
+		if _, err := f.WriteString(tsvEscape.Replace(col)); err != nil {
+			return err
+		}
 	}
 	if _, err := f.WriteString("\n"); err != nil {
 		return err
@@ -0,0 +1,63 @@
+package mongopacket
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Values with tabs and newlines stay within their column and row
+func TestTSVEscape(t *testing.T) {
+	prefix := filepath.Join(t.TempDir(), "capture")
+	s, err := NewTSVStorage(prefix, 4096, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := "a\tb\nc\rd"
+	at := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	e := testEvent(t, 1, 0, 0, bson.D{{Key: "find", Value: bad}, {Key: "$db", Value: "shop"}})
+	e.Group, e.AppName, e.Driver = bad, bad, bad
+	saves := []error{
+		s.SaveMongoEvents([]*MongoEvent{e}),
+		s.SaveDecodeErrors([]*DecodeErrorEvent{{Time: at, Kind: bad, OpCode: bad, Field: bad, Error: bad}}),
+		s.SaveCursorEvents([]*CursorEvent{{Start: at, End: at, Namespace: bad, Command: bad, EndReason: bad}}),
+		s.SaveTransactionEvents([]*TransactionEvent{{SessionID: bad, Start: at, End: at, Outcome: bad, ErrorName: bad}}),
+		s.SaveRetryEvents([]*RetryEvent{{SessionID: bad, Command: bad, Namespace: bad, Time: at, OriginalTime: at, PreviousErrorName: bad}}),
+		s.SaveConnectionEvents([]*ConnectionEvent{{
+			Time: at, AppName: bad, DriverName: bad, DriverVersion: bad,
+			OSType: bad, OSName: bad, OSArchitecture: bad, OSVersion: bad, Platform: bad, SaslSupportedMechs: bad,
+		}}),
+		s.SaveAuthEvents([]*AuthEvent{{Start: at, End: at, AppName: bad, Mechanism: bad, User: bad, Database: bad, Outcome: bad, ErrorName: bad}}),
+		s.SaveShapeStats([]*ShapeStats{{Group: bad, Hash: bad, Command: bad, Namespace: bad, Shape: bad}}),
+		s.Flush(),
+	}
+	for _, err := range saves {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"mongo", "errors", "cursors", "transactions", "retries", "connections", "auth", "shapes"} {
+		b, err := os.ReadFile(prefix + "-" + name + ".tsv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+		if len(rows) != 2 {
+			t.Errorf("%s: %d rows, want a header and one row", name, len(rows))
+			continue
+		}
+		header, row := strings.Split(rows[0], "\t"), strings.Split(rows[1], "\t")
+		if len(row) != len(header) {
+			t.Errorf("%s: %d columns, want %d", name, len(row), len(header))
+		}
+		if strings.Contains(rows[1], "\r") || !strings.Contains(rows[1], "a b c d") {
+			t.Errorf("%s: row %q", name, rows[1])
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package mongopacket
+
+import (
+	"fmt"
+
+	"github.com/phensley/mongopacket/pkg/protocol"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Helpers for reading values out of raw BSON documents
+
+// Number of elements in a BSON array value, or 0 if it is not an array
+func arrayLen(v bson.RawValue) int {
+	arr, ok := v.ArrayOK()
+	if !ok {
+		return 0
+	}
+	vals, err := arr.Values()
+	if err != nil {
+		return 0
+	}
+	return len(vals)
+}
+
+// Integer elements of a BSON array value
+func intValues(v bson.RawValue) []int64 {
+	arr, ok := v.ArrayOK()
+	if !ok {
+		return nil
+	}
+	vals, err := arr.Values()
+	if err != nil {
+		return nil
+	}
+	var ns []int64
+	for _, e := range vals {
+		if n, ok := protocol.IntValue(e); ok {
+			ns = append(ns, n)
+		}
+	}
+	return ns
+}
+
+// Logical session id of a command as a UUID string, or empty if the command
+// has no session
+func sessionID(body *protocol.Document) string {
+	v := body.Lookup("lsid", "id")
+	if _, data, ok := v.BinaryOK(); ok {
+		if len(data) == 16 {
+			return fmt.Sprintf("%x-%x-%x-%x-%x", data[0:4], data[4:6], data[6:8], data[8:10], data[10:16])
+		}
+		return fmt.Sprintf("%x", data)
+	}
+	if v.IsZero() {
+		return ""
+	}
+	return v.String()
+}
+
+// Command name and namespace of an op, empty if it has none
+func commandNamespace(op protocol.Op) (string, string) {
+	command := ""
+	if cmd := protocol.CommandOf(op); cmd != nil {
+		command = cmd.Name
+	}
+	ns, _ := namespaceOf(op)
+	return command, ns
+}
+
+// Convert a bool to 0 or 1 for storage
+func boolInt(b bool) uint8 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// The document describing an op: a request's command, a reply, or the first
+// document of a legacy op. Nil if the op has none.
+func opDocument(op protocol.Op) *protocol.Document {
+	if protocol.IsResponse(op) {
+		return protocol.ReplyOf(op)
+	}
+	if cmd := protocol.CommandOf(op); cmd != nil {
+		return cmd.Body
+	}
+	var doc *protocol.Document
+	protocol.EachDocument(op, func(d *protocol.Document, seq string) {
+		if doc == nil && seq == "" {
+			doc = d
+		}
+	})
+	return doc
+}
@@ -0,0 +1,136 @@
+package protocol
+
+import (
+	"strings"
+)
+
+// Auth is one step of an authentication conversation sent by a client:
+// saslStart, saslContinue, or authenticate for MONGODB-X509 and the legacy
+// MONGODB-CR. Drivers may also start the conversation speculatively in the
+// connection handshake.
+type Auth struct {
+	Command     string // saslStart, saslContinue or authenticate
+	Mechanism   string // e.g. SCRAM-SHA-256, MONGODB-X509, GSSAPI or PLAIN
+	User        string // user, if the mechanism reveals it
+	Database    string // database the user is authenticated against
+	Speculative bool   // sent as speculativeAuthenticate in a handshake
+}
+
+// AuthOf returns the authentication step carried by a request op, or nil if
+// the op is not part of an authentication conversation.
+func AuthOf(op Op) *Auth {
+	cmd := CommandOf(op)
+	if cmd == nil {
+		return nil
+	}
+	if !IsHello(cmd.Name) {
+		return authOf(cmd)
+	}
+
+	spec, ok := cmd.Body.Lookup("speculativeAuthenticate").DocumentOK()
+	if !ok {
+		return nil
+	}
+	inner := newCommand(cmd.Database, NewDocument(spec))
+	if inner == nil {
+		return nil
+	}
+	a := authOf(inner)
+	if a != nil {
+		a.Speculative = true
+	}
+	return a
+}
+
+func authOf(cmd *Command) *Auth {
+	switch cmd.Name {
+	case "saslStart", "saslContinue", "authenticate":
+	default:
+		return nil
+	}
+
+	a := &Auth{Command: cmd.Name, Database: cmd.Database}
+	if db, ok := cmd.Body.Lookup("db").StringValueOK(); ok {
+		a.Database = db
+	}
+	a.Mechanism, _ = cmd.Body.Lookup("mechanism").StringValueOK()
+	a.User, _ = cmd.Body.Lookup("user").StringValueOK()
+	if a.User == "" && cmd.Name == "saslStart" {
+		if _, payload, ok := cmd.Body.Lookup("payload").BinaryOK(); ok {
+			a.User = saslUser(a.Mechanism, payload)
+		}
+	}
+	return a
+}
+
+// Extract the user from the first message of a SASL conversation. SCRAM
+// sends "n,,n=user,r=nonce" and PLAIN sends "authzid\x00user\x00password".
+// Other mechanisms don't reveal the user.
+func saslUser(mechanism string, payload []byte) string {
+	switch mechanism {
+	case "SCRAM-SHA-1", "SCRAM-SHA-256":
+		// Skip the GS2 header: channel binding flag and authzid
+		parts := strings.Split(string(payload), ",")
+		if len(parts) < 3 {
+			return ""
+		}
+		for _, p := range parts[2:] {
+			if strings.HasPrefix(p, "n=") {
+				return scramUnescape.Replace(p[2:])
+			}
+		}
+
+	case "PLAIN":
+		parts := strings.Split(string(payload), "\x00")
+		if len(parts) == 3 {
+			return parts[1]
+		}
+	}
+	return ""
+}
+
+// SCRAM escapes commas and equals signs in user names
+var scramUnescape = strings.NewReplacer("=2C", ",", "=3D", "=")
+
+// RedactAuth removes the SASL payloads and keys from authentication commands
+// and their replies, so that credentials and proofs are never stored.
+func RedactAuth(op Op) {
+	switch o := op.(type) {
+	case *Msg:
+		if o.Body != nil {
+			o.Body.Redact(authPaths(o.Body)...)
+		}
+	case *Query:
+		if o.Query != nil {
+			o.Query.Redact(authPaths(o.Query)...)
+		}
+	case *Reply:
+		for _, d := range o.Documents {
+			d.Redact(authPaths(d)...)
+		}
+	}
+}
+
+// Paths to the secrets in an authentication command or reply
+func authPaths(d *Document) []string {
+	var paths []string
+	switch d.FirstKey() {
+	case "saslStart", "saslContinue", "authenticate":
+		paths = append(paths, "payload", "key")
+	case "$query", "query":
+		if inner, ok := d.Lookup(d.FirstKey()).DocumentOK(); ok {
+			for _, p := range authPaths(NewDocument(inner)) {
+				paths = append(paths, d.FirstKey()+"."+p)
+			}
+		}
+	}
+
+	// SASL replies carry the conversation id and whether it is done
+	if !d.Lookup("conversationId").IsZero() && !d.Lookup("done").IsZero() {
+		paths = append(paths, "payload")
+	}
+	if !d.Lookup("speculativeAuthenticate").IsZero() {
+		paths = append(paths, "speculativeAuthenticate.payload")
+	}
+	return paths
+}
@@ -0,0 +1,261 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Decode an OP_QUERY sent to a collection
+func decodeQuery(t testing.TB, coll string, query interface{}) Op {
+	q, err := bson.Marshal(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	op, err := Decode(encodeOp(OpQuery, 1, fields(int32(0), coll+"\x00", int32(0), int32(-1), q)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return op
+}
+
+// Decode an OP_REPLY with a single document
+func decodeReply(t testing.TB, reply interface{}) Op {
+	r, err := bson.Marshal(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	op, err := Decode(encodeOp(OpReply, 2, fields(int32(0), int64(0), int32(0), int32(1), r)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return op
+}
+
+// Decode an OP_MSG reply to the request with id 1
+func decodeMsgReply(t testing.TB, reply interface{}) Op {
+	op := decodeMsg(t, reply, "")
+	op.GetHeader().ResponseTo = 1
+	return op
+}
+
+func payload(s string) primitive.Binary {
+	return primitive.Binary{Data: []byte(s)}
+}
+
+func TestAuthOf(t *testing.T) {
+	scram := bson.D{
+		{Key: "saslStart", Value: int32(1)},
+		{Key: "mechanism", Value: "SCRAM-SHA-256"},
+		{Key: "payload", Value: payload("n,,n=alice,r=nonce")},
+		{Key: "options", Value: bson.D{{Key: "skipEmptyExchange", Value: true}}},
+	}
+
+	tests := []struct {
+		name string
+		op   Op
+		want *Auth
+	}{
+		{"saslStart", decodeMsg(t, append(scram, bson.E{Key: "$db", Value: "admin"}), ""),
+			&Auth{Command: "saslStart", Mechanism: "SCRAM-SHA-256", User: "alice", Database: "admin"}},
+		{"saslContinue", decodeMsg(t, bson.D{
+			{Key: "saslContinue", Value: int32(1)},
+			{Key: "conversationId", Value: int32(1)},
+			{Key: "payload", Value: payload("c=biws,r=nonce,p=proof")},
+			{Key: "$db", Value: "admin"},
+		}, ""),
+			&Auth{Command: "saslContinue", Database: "admin"}},
+		{"PLAIN", decodeMsg(t, bson.D{
+			{Key: "saslStart", Value: int32(1)},
+			{Key: "mechanism", Value: "PLAIN"},
+			{Key: "payload", Value: payload("\x00carol\x00secret")},
+			{Key: "$db", Value: "$external"},
+		}, ""),
+			&Auth{Command: "saslStart", Mechanism: "PLAIN", User: "carol", Database: "$external"}},
+
+		// Legacy drivers and mongos wrap the command in $query
+		{"query saslStart", decodeQuery(t, "admin.$cmd", bson.D{
+			{Key: "$query", Value: bson.D{
+				{Key: "saslStart", Value: int32(1)},
+				{Key: "mechanism", Value: "SCRAM-SHA-1"},
+				{Key: "payload", Value: payload("n,,n=dave,r=nonce")},
+			}},
+			{Key: "$readPreference", Value: bson.D{{Key: "mode", Value: "primary"}}},
+		}),
+			&Auth{Command: "saslStart", Mechanism: "SCRAM-SHA-1", User: "dave", Database: "admin"}},
+		{"MONGODB-CR", decodeQuery(t, "records.$cmd", bson.D{
+			{Key: "authenticate", Value: int32(1)},
+			{Key: "user", Value: "erin"},
+			{Key: "nonce", Value: "2375531c32080ae8"},
+			{Key: "key", Value: "21742f26431831d5cfca035a08c5bdf6"},
+		}),
+			&Auth{Command: "authenticate", User: "erin", Database: "records"}},
+
+		// Speculative authentication in the handshake, which names its
+		// database with db
+		{"speculative SCRAM", decodeMsg(t, bson.D{
+			{Key: "hello", Value: int32(1)},
+			{Key: "speculativeAuthenticate", Value: append(scram, bson.E{Key: "db", Value: "admin"})},
+			{Key: "$db", Value: "admin"},
+		}, ""),
+			&Auth{Command: "saslStart", Mechanism: "SCRAM-SHA-256", User: "alice", Database: "admin", Speculative: true}},
+		{"speculative X509", decodeQuery(t, "admin.$cmd", bson.D{
+			{Key: "isMaster", Value: int32(1)},
+			{Key: "speculativeAuthenticate", Value: bson.D{
+				{Key: "authenticate", Value: int32(1)},
+				{Key: "mechanism", Value: "MONGODB-X509"},
+				{Key: "user", Value: "CN=client,OU=apps"},
+				{Key: "db", Value: "$external"},
+			}},
+		}),
+			&Auth{Command: "authenticate", Mechanism: "MONGODB-X509", User: "CN=client,OU=apps", Database: "$external", Speculative: true}},
+
+		// Not authentication
+		{"hello", decodeMsg(t, bson.D{{Key: "hello", Value: int32(1)}, {Key: "$db", Value: "admin"}}, ""), nil},
+		{"find", decodeMsg(t, bson.D{{Key: "find", Value: "users"}, {Key: "$db", Value: "admin"}}, ""), nil},
+		{"reply", decodeMsgReply(t, bson.D{{Key: "conversationId", Value: int32(1)}, {Key: "ok", Value: 1.0}}), nil},
+	}
+	for _, tt := range tests {
+		got := AuthOf(tt.op)
+		if tt.want == nil || got == nil {
+			if got != tt.want {
+				t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+			}
+			continue
+		}
+		if *got != *tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, *got, *tt.want)
+		}
+	}
+}
+
+func TestSASLUser(t *testing.T) {
+	tests := []struct {
+		mechanism, payload, user string
+	}{
+		{"SCRAM-SHA-256", "n,,n=alice,r=nonce", "alice"},
+		{"SCRAM-SHA-1", "n,,n=a=2Cb=3Dc,r=nonce", "a,b=c"},
+		{"SCRAM-SHA-256", "y,a=admin,n=bob,r=nonce", "bob"},
+		{"SCRAM-SHA-256", "n=alice,r=nonce", ""},
+		{"SCRAM-SHA-256", "n,,r=nonce", ""},
+		{"PLAIN", "\x00carol\x00secret", "carol"},
+		{"PLAIN", "admin\x00carol\x00secret", "carol"},
+		{"PLAIN", "carol\x00secret", ""},
+		{"GSSAPI", "\x60\x82\x02", ""},
+	}
+	for _, tt := range tests {
+		if got := saslUser(tt.mechanism, []byte(tt.payload)); got != tt.user {
+			t.Errorf("%s %q: got %q, want %q", tt.mechanism, tt.payload, got, tt.user)
+		}
+	}
+}
+
+func TestRedactAuth(t *testing.T) {
+	secret := payload("secret")
+	tests := []struct {
+		name     string
+		op       Op
+		redacted []string // key paths replaced
+		kept     []string // key paths left alone
+	}{
+		{"saslStart", decodeMsg(t, bson.D{
+			{Key: "saslStart", Value: int32(1)},
+			{Key: "mechanism", Value: "SCRAM-SHA-256"},
+			{Key: "payload", Value: secret},
+			{Key: "$db", Value: "admin"},
+		}, ""), []string{"payload"}, []string{"mechanism", "$db"}},
+		{"saslContinue", decodeMsg(t, bson.D{
+			{Key: "saslContinue", Value: int32(1)},
+			{Key: "conversationId", Value: int32(1)},
+			{Key: "payload", Value: secret},
+			{Key: "$db", Value: "admin"},
+		}, ""), []string{"payload"}, []string{"conversationId"}},
+		{"query saslStart", decodeQuery(t, "admin.$cmd", bson.D{
+			{Key: "$query", Value: bson.D{
+				{Key: "saslStart", Value: int32(1)},
+				{Key: "mechanism", Value: "SCRAM-SHA-1"},
+				{Key: "payload", Value: secret},
+			}},
+		}), []string{"$query.payload"}, []string{"$query.mechanism"}},
+		{"MONGODB-CR", decodeQuery(t, "records.$cmd", bson.D{
+			{Key: "authenticate", Value: int32(1)},
+			{Key: "user", Value: "erin"},
+			{Key: "nonce", Value: "2375531c32080ae8"},
+			{Key: "key", Value: "21742f26431831d5cfca035a08c5bdf6"},
+		}), []string{"key"}, []string{"user", "nonce"}},
+		{"speculative hello", decodeMsg(t, bson.D{
+			{Key: "hello", Value: int32(1)},
+			{Key: "speculativeAuthenticate", Value: bson.D{
+				{Key: "saslStart", Value: int32(1)},
+				{Key: "mechanism", Value: "SCRAM-SHA-256"},
+				{Key: "payload", Value: secret},
+				{Key: "db", Value: "admin"},
+			}},
+			{Key: "$db", Value: "admin"},
+		}, ""), []string{"speculativeAuthenticate.payload"}, []string{"speculativeAuthenticate.mechanism", "hello"}},
+
+		// Replies
+		{"msg reply", decodeMsgReply(t, bson.D{
+			{Key: "conversationId", Value: int32(1)},
+			{Key: "done", Value: false},
+			{Key: "payload", Value: secret},
+			{Key: "ok", Value: 1.0},
+		}), []string{"payload"}, []string{"conversationId", "done"}},
+		{"legacy reply", decodeReply(t, bson.D{
+			{Key: "conversationId", Value: int32(1)},
+			{Key: "done", Value: true},
+			{Key: "payload", Value: secret},
+			{Key: "ok", Value: 1.0},
+		}), []string{"payload"}, []string{"done"}},
+		{"speculative reply", decodeMsgReply(t, bson.D{
+			{Key: "isWritablePrimary", Value: true},
+			{Key: "speculativeAuthenticate", Value: bson.D{
+				{Key: "conversationId", Value: int32(1)},
+				{Key: "done", Value: false},
+				{Key: "payload", Value: secret},
+			}},
+			{Key: "ok", Value: 1.0},
+		}), []string{"speculativeAuthenticate.payload"}, []string{"speculativeAuthenticate.conversationId", "isWritablePrimary"}},
+
+		// Payloads outside authentication are data
+		{"insert", decodeMsg(t, bson.D{
+			{Key: "insert", Value: "events"},
+			{Key: "payload", Value: secret},
+			{Key: "$db", Value: "app"},
+		}, ""), nil, []string{"payload"}},
+	}
+	for _, tt := range tests {
+		var before *Document
+		switch o := tt.op.(type) {
+		case *Msg:
+			before = NewDocument(o.Body.Raw())
+		case *Query:
+			before = NewDocument(o.Query.Raw())
+		case *Reply:
+			before = NewDocument(o.Documents[0].Raw())
+		}
+
+		RedactAuth(tt.op)
+		var after *Document
+		switch o := tt.op.(type) {
+		case *Msg:
+			after = o.Body
+		case *Query:
+			after = o.Query
+		case *Reply:
+			after = o.Documents[0]
+		}
+		for _, p := range tt.redacted {
+			if s, ok := after.Lookup(strings.Split(p, ".")...).StringValueOK(); !ok || s != Redacted {
+				t.Errorf("%s: %s not redacted: %v", tt.name, p, after.Lookup(strings.Split(p, ".")...))
+			}
+		}
+		for _, p := range tt.kept {
+			if !after.Lookup(strings.Split(p, ".")...).Equal(before.Lookup(strings.Split(p, ".")...)) {
+				t.Errorf("%s: %s changed to %v", tt.name, p, after.Lookup(strings.Split(p, ".")...))
+			}
+		}
+	}
+}
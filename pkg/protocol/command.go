@@ -0,0 +1,93 @@
+package protocol
+
+import "strings"
+
+// Command is a database command sent in an OP_MSG body or as an OP_QUERY
+// against a database's $cmd collection.
+type Command struct {
+	Name       string    // name of the command, the key of its first element
+	Database   string    // database the command runs against
+	Collection string    // value of the first element, if it names a collection
+	Body       *Document // the command document
+}
+
+// Namespace returns the database and collection the command targets, or just
+// the database if the command has no collection.
+func (c *Command) Namespace() string {
+	if c.Collection == "" {
+		return c.Database
+	}
+	return c.Database + "." + c.Collection
+}
+
+// CommandOf returns the command carried by a request op, or nil if the op is
+// not a command.
+func CommandOf(op Op) *Command {
+	switch o := op.(type) {
+	case *Msg:
+		if o.Body == nil || o.ResponseTo != 0 {
+			return nil
+		}
+		db, _ := o.Body.Lookup("$db").StringValueOK()
+		return newCommand(db, o.Body)
+
+	case *Query:
+		if o.Query == nil || !strings.HasSuffix(o.FullCollectionName, ".$cmd") {
+			return nil
+		}
+		db := strings.TrimSuffix(o.FullCollectionName, ".$cmd")
+
+		// Commands sent through mongos may be wrapped with read preferences
+		body := o.Query
+		switch body.FirstKey() {
+		case "$query", "query":
+			if d, ok := body.Lookup(body.FirstKey()).DocumentOK(); ok {
+				body = NewDocument(d)
+			}
+		}
+		return newCommand(db, body)
+	}
+	return nil
+}
+
+func newCommand(db string, body *Document) *Command {
+	name := body.FirstKey()
+	if name == "" {
+		return nil
+	}
+	coll, _ := body.Lookup(name).StringValueOK()
+	return &Command{
+		Name:       name,
+		Database:   db,
+		Collection: coll,
+		Body:       body,
+	}
+}
+
+// ReplyOf returns the command reply document carried by a response op: the
+// OP_MSG body, or the first document of an OP_REPLY. Nil is returned if the
+// op is not a response or has no documents.
+func ReplyOf(op Op) *Document {
+	switch o := op.(type) {
+	case *Msg:
+		if o.ResponseTo != 0 {
+			return o.Body
+		}
+	case *Reply:
+		if len(o.Documents) > 0 {
+			return o.Documents[0]
+		}
+	}
+	return nil
+}
+
+// IsResponse checks if an op was sent by the database in response to a request
+func IsResponse(op Op) bool {
+	switch o := op.(type) {
+	case *Reply:
+		return true
+	case *Msg:
+		return o.ResponseTo != 0
+	}
+	return false
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"compress/zlib"
+	"errors"
 	"fmt"
 	"io"
 
@@ -14,6 +15,8 @@ import (
 // CompressorID ..
 type CompressorID uint8
 
+var errUnknownCompressor = errors.New("unknown compressor")
+
 // Compressor identifiers
 const (
 	CompressorNoOp   CompressorID = 0
@@ -22,56 +25,143 @@ const (
 	CompressorZstd   CompressorID = 3
 )
 
+// String representation
+func (c CompressorID) String() string {
+	switch c {
+	case CompressorNoOp:
+		return "noop"
+	case CompressorSnappy:
+		return "snappy"
+	case CompressorZlib:
+		return "zlib"
+	case CompressorZstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("unknown: %d", uint8(c))
+}
+
 // Decompress a message before decoding it
 func Decompress(r *bufio.Reader, h *Header) ([]byte, error) {
-	var raw [9]byte
-	d := raw[:]
-
-	// Read compression header
-	if _, err := io.ReadFull(r, d); err != nil {
+	body, err := readBody(r, h)
+	if err != nil {
 		return nil, err
 	}
+	return DecompressBytes(body, h)
+}
+
+// DecompressBytes decompresses a message body that follows the header,
+// recording the compression details on the header. The uncompressed size from
+// the compression header is checked against MaxMessageSize before anything is
+// allocated, and must match the size of the decompressed data. Data compressed
+// with the no-op compressor is returned as a sub-slice of b.
+func DecompressBytes(b []byte, h *Header) ([]byte, error) {
+	p := newBuffer(b, h, nil)
 
 	// Decode opcode, size, compressor ID
-	h.OpCode = OpCode(DecodeInt32LE(d, 0))
-	size := DecodeInt32LE(d, 4)
-	id := CompressorID(d[8])
-
-	// read compressed data
-	sz := h.MessageLength - HeaderLen - 9
-	data := make([]byte, sz)
-	if _, err := io.ReadFull(r, data); err != nil {
+	off := p.off
+	opcode, err := p.int32("originalOpcode")
+	if err != nil {
 		return nil, err
 	}
+	orig := OpCode(opcode)
+	if !IsValidOpCode(orig) || orig == OpCompressed {
+		return nil, p.error(ErrUnknownOpCode, "originalOpcode", off, fmt.Errorf("opcode %d", opcode))
+	}
 
-	// Decompress data with the given compressor ID
+	off = p.off
+	size, err := p.int32("uncompressedSize")
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 || size > MaxMessageSize-HeaderLen {
+		return nil, p.error(ErrBadLength, "uncompressedSize", off, fmt.Errorf("uncompressed size %d", size))
+	}
+
+	off = p.off
+	cid, err := p.byte("compressorId")
+	if err != nil {
+		return nil, err
+	}
+	id := CompressorID(cid)
+
+	h.OriginalOpCode = orig
+	h.CompressorID = id
+
+	// Remaining bytes are the compressed data
+	data := b[p.off:]
+
+	out, err := decompress(id, int(size), data)
+	if err == errUnknownCompressor {
+		return nil, p.error(ErrDecompress, "compressorId", off, fmt.Errorf("unknown compressor id %d", id))
+	}
+	if err != nil {
+		return nil, p.error(ErrDecompress, "compressedMessage", p.off, err)
+	}
+
+	if len(data) > 0 {
+		h.CompressionRatio = float64(len(out)) / float64(len(data))
+	}
+	return out, nil
+}
+
+// Decompress data with the given compressor ID, checking that it produces
+// exactly size bytes.
+func decompress(id CompressorID, size int, data []byte) ([]byte, error) {
 	switch id {
 	case CompressorNoOp:
+		if len(data) != size {
+			return nil, sizeMismatch(size, len(data))
+		}
 		return data, nil
 
 	case CompressorSnappy:
-		out := make([]byte, size)
-		return snappy.Decode(out, data)
+		// Check the size encoded in the snappy block before allocating
+		n, err := snappy.DecodedLen(data)
+		if err != nil {
+			return nil, err
+		}
+		if n != size {
+			return nil, sizeMismatch(size, n)
+		}
+		return snappy.Decode(make([]byte, size), data)
 
 	case CompressorZlib:
 		dec, err := zlib.NewReader(bytes.NewReader(data))
 		if err != nil {
 			return nil, err
 		}
-		out := make([]byte, size)
-		if _, err = io.ReadFull(dec, out); err != nil {
-			return nil, err
-		}
-		return out, nil
+		defer dec.Close()
+		return readExactly(dec, size)
 
 	case CompressorZstd:
-		out := make([]byte, size)
 		dec := zstd.NewReader(bytes.NewReader(data))
-		if _, err := io.ReadFull(dec, out); err != nil {
-			return nil, err
-		}
-		return out, nil
+		defer dec.Close()
+		return readExactly(dec, size)
+	}
+
+	return nil, errUnknownCompressor
+}
+
+// Read exactly size bytes from a decompressor, failing if it produces more
+// or less than that.
+func readExactly(r io.Reader, size int) ([]byte, error) {
+	out := make([]byte, size)
+	n, err := io.ReadFull(r, out)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		return nil, sizeMismatch(size, n)
 	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Make sure the stream ends here
+	var extra [1]byte
+	if n, _ := io.ReadFull(r, extra[:]); n > 0 {
+		return nil, fmt.Errorf("decompressed size exceeds expected %d", size)
+	}
+	return out, nil
+}
 
-	return nil, fmt.Errorf("unknown compressor id %d", id)
+func sizeMismatch(expected, actual int) error {
+	return fmt.Errorf("decompressed size %d, expected %d", actual, expected)
 }
@@ -0,0 +1,127 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"testing"
+
+	"github.com/DataDog/zstd"
+	"github.com/golang/snappy"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Compress data with a compressor
+func compress(t testing.TB, id CompressorID, data []byte) []byte {
+	switch id {
+	case CompressorSnappy:
+		return snappy.Encode(nil, data)
+	case CompressorZlib:
+		var b bytes.Buffer
+		w := zlib.NewWriter(&b)
+		w.Write(data)
+		w.Close()
+		return b.Bytes()
+	case CompressorZstd:
+		out, err := zstd.Compress(nil, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	return data
+}
+
+// Encode an OP_COMPRESSED wrapping a message body with the given original
+// opcode and uncompressed size
+func encodeCompressed(id CompressorID, orig OpCode, size int32, data []byte) []byte {
+	return encodeOp(OpCompressed, 9, fields(int32(orig), size, []byte{byte(id)}, data))
+}
+
+func TestDecompress(t *testing.T) {
+	doc := bson.D{
+		{Key: "insert", Value: "events"},
+		{Key: "documents", Value: bson.A{bson.D{{Key: "note", Value: string(bytes.Repeat([]byte("compress me "), 50))}}}},
+		{Key: "$db", Value: "app"},
+	}
+	msg := encodeMsg(t, 9, doc)
+	body := msg[HeaderLen:]
+	raw, _ := bson.Marshal(doc)
+
+	for _, id := range []CompressorID{CompressorNoOp, CompressorSnappy, CompressorZlib, CompressorZstd} {
+		data := compress(t, id, body)
+		b := encodeCompressed(id, OpMsg, int32(len(body)), data)
+
+		// Decoding from bytes and reading from a stream agree
+		decoded, err := Decode(b)
+		if err != nil {
+			t.Errorf("%s: %v", id, err)
+			continue
+		}
+		read, err := Read(bufio.NewReader(bytes.NewReader(b)))
+		if err != nil {
+			t.Errorf("%s: read: %v", id, err)
+			continue
+		}
+		for _, op := range []Op{decoded, read} {
+			m, ok := op.(*Msg)
+			if !ok {
+				t.Errorf("%s: decoded %T", id, op)
+				continue
+			}
+			if !bytes.Equal(m.Body.Raw(), raw) {
+				t.Errorf("%s: body %v", id, m.Body)
+			}
+			h := m.Header
+			if !h.Compressed || h.CompressorID != id || h.OriginalOpCode != OpMsg || h.Type() != OpMsg {
+				t.Errorf("%s: header %+v", id, h)
+			}
+			if h.CompressedLength != int32(len(b)) || h.MessageLength != int32(len(msg)) {
+				t.Errorf("%s: lengths %d compressed, %d uncompressed, want %d %d", id, h.CompressedLength, h.MessageLength, len(b), len(msg))
+			}
+			if want := float64(len(body)) / float64(len(data)); h.CompressionRatio != want {
+				t.Errorf("%s: ratio %f, want %f", id, h.CompressionRatio, want)
+			}
+		}
+	}
+}
+
+// A message that fails to decompress, with the kind of error and the field
+type decompressTest struct {
+	name  string
+	msg   []byte
+	err   error
+	field string
+}
+
+func TestDecompressErrors(t *testing.T) {
+	body := encodeMsg(t, 9, bson.D{{Key: "ping", Value: int32(1)}, {Key: "$db", Value: "admin"}})[HeaderLen:]
+	size := int32(len(body))
+	tests := []decompressTest{
+		{"too large", encodeCompressed(CompressorNoOp, OpMsg, MaxMessageSize, body), ErrBadLength, "uncompressedSize"},
+		{"negative size", encodeCompressed(CompressorNoOp, OpMsg, -1, body), ErrBadLength, "uncompressedSize"},
+		{"unknown opcode", encodeCompressed(CompressorNoOp, OpCode(9999), size, body), ErrUnknownOpCode, "originalOpcode"},
+		{"nested", encodeCompressed(CompressorNoOp, OpCompressed, size, body), ErrUnknownOpCode, "originalOpcode"},
+		{"unknown compressor", encodeCompressed(CompressorID(9), OpMsg, size, body), ErrDecompress, "compressorId"},
+		{"corrupt zlib", encodeCompressed(CompressorZlib, OpMsg, size, body), ErrDecompress, "compressedMessage"},
+		{"truncated header", encodeOp(OpCompressed, 9, fields(int32(OpMsg), size)), ErrTruncated, "compressorId"},
+	}
+
+	// The uncompressed size must match the output of every compressor
+	for _, id := range []CompressorID{CompressorNoOp, CompressorSnappy, CompressorZlib, CompressorZstd} {
+		data := compress(t, id, body)
+		tests = append(tests,
+			decompressTest{id.String() + " short", encodeCompressed(id, OpMsg, size+1, data), ErrDecompress, "compressedMessage"},
+			decompressTest{id.String() + " long", encodeCompressed(id, OpMsg, size-1, data), ErrDecompress, "compressedMessage"},
+		)
+	}
+
+	for _, tt := range tests {
+		_, err := Decode(tt.msg)
+		var de *DecodeError
+		if !errors.As(err, &de) || !errors.Is(err, tt.err) || de.Field != tt.field {
+			t.Errorf("%s: got %v, want %v in %s", tt.name, err, tt.err, tt.field)
+		}
+	}
+}
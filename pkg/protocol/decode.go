@@ -2,10 +2,15 @@ package protocol
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
 )
 
 // MaxDocumentSize https://docs.mongodb.com/manual/reference/limits/#bson-documents
@@ -27,56 +32,292 @@ func decodeInt64LE(b []byte, i int) int64 {
 		int64(b[i+4])<<32 | int64(b[i+5])<<40 | int64(b[i+6])<<48 | int64(b[i+7])<<56
 }
 
-// Encode an int32 to the byte array starting at offset
-func encodeInt32LE(b []byte, i int, n int32) {
-	b[i] = byte(n)
-	b[i+1] = byte(n >> 8)
-	b[i+2] = byte(n >> 16)
-	b[i+3] = byte(n >> 24)
+// buffer decodes values from a byte slice starting at an explicit offset.
+// Strings and documents are returned as sub-slices of the underlying bytes
+// wherever possible, so the slice must not be modified while the decoded
+// values are in use. Each value is named by its field so that failures can
+// be reported as a *DecodeError.
+type buffer struct {
+	b    []byte
+	off  int
+	base int // offset of b within the message body
+	h    *Header
+	opts *DecodeOptions
 }
 
-// Read a null-terminated string.
-// See http://bsonspec.org/spec.html#grammar
-func cstring(r *bufio.Reader) (string, error) {
-	// read the string including the null byte
-	b, err := r.ReadBytes('\x00')
+// Create a buffer over a message body
+func newBuffer(b []byte, h *Header, opts *DecodeOptions) *buffer {
+	return &buffer{b: b, h: h, opts: opts}
+}
+
+// Create a buffer over a sub-slice of this buffer's bytes starting at offset i
+func (p *buffer) sub(b []byte, i int) *buffer {
+	return &buffer{b: b, base: p.base + i, h: p.h, opts: p.opts}
+}
+
+// Number of bytes not yet consumed
+func (p *buffer) remaining() int {
+	return len(p.b) - p.off
+}
+
+// Create an error of the given kind for a field at offset off of b
+func (p *buffer) error(kind error, field string, off int, cause error) error {
+	e := &DecodeError{
+		Err:    kind,
+		Offset: HeaderLen + p.base + off,
+		Field:  field,
+		Cause:  cause,
+	}
+	if p.h != nil {
+		e.OpCode = p.h.Type()
+	}
+	return e
+}
+
+// Consume the next n bytes
+func (p *buffer) next(n int, field string) ([]byte, error) {
+	if n < 0 {
+		return nil, p.error(ErrBadLength, field, p.off, fmt.Errorf("size %d", n))
+	}
+	if p.remaining() < n {
+		return nil, p.error(ErrTruncated, field, p.off, p.lengthError(p.off+n))
+	}
+	b := p.b[p.off : p.off+n]
+	p.off += n
+	return b, nil
+}
+
+func (p *buffer) byte(field string) (byte, error) {
+	b, err := p.next(1, field)
 	if err != nil {
-		return "", err
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (p *buffer) int32(field string) (int32, error) {
+	b, err := p.next(4, field)
+	if err != nil {
+		return 0, err
+	}
+	return DecodeInt32LE(b, 0), nil
+}
+
+func (p *buffer) uint32(field string) (uint32, error) {
+	b, err := p.next(4, field)
+	if err != nil {
+		return 0, err
+	}
+	return DecodeUint32LE(b, 0), nil
+}
+
+func (p *buffer) int64(field string) (int64, error) {
+	b, err := p.next(8, field)
+	if err != nil {
+		return 0, err
+	}
+	return decodeInt64LE(b, 0), nil
+}
+
+// Check that the entire buffer was consumed. In strict mode any trailing
+// bytes are an error.
+func (p *buffer) done() error {
+	if p.remaining() > 0 && p.opts != nil && p.opts.Strict {
+		return p.error(ErrBadLength, "", p.off, p.lengthError(p.off))
 	}
+	return nil
+}
 
-	return string(b[0 : len(b)-1]), nil
+// Report a length mismatch, with off the number of bytes of b consumed or required
+func (p *buffer) lengthError(off int) *LengthError {
+	e := &LengthError{Consumed: HeaderLen + p.base + off}
+	if p.h != nil {
+		e.OpCode = p.h.Type()
+		e.Length = int(p.h.MessageLength)
+	} else {
+		e.Length = HeaderLen + p.base + len(p.b)
+	}
+	return e
 }
 
-// Read a raw BSON-encoded document as a byte array
+// Decode a null-terminated string.
 // See http://bsonspec.org/spec.html#grammar
-func document(r *bufio.Reader) (bson.D, int, error) {
-	var raw [4]byte
-	d := raw[:]
+func (p *buffer) cstring(field string) (string, error) {
+	i := bytes.IndexByte(p.b[p.off:], 0)
+	if i < 0 {
+		return "", p.error(ErrTruncated, field, p.off, errors.New("unterminated cstring"))
+	}
+	s := string(p.b[p.off : p.off+i])
+	p.off += i + 1
+	return s, nil
+}
 
-	// Read the BSON document's length
-	if _, err := io.ReadFull(r, d); err != nil {
-		return nil, 0, fmt.Errorf("failed document size read %s", err)
+// Decode a BSON document as a sub-slice of the buffer, without copying or
+// unmarshaling it.
+// See http://bsonspec.org/spec.html#grammar
+func (p *buffer) document(field string) (bson.Raw, error) {
+	if p.remaining() < 4 {
+		return nil, p.error(ErrTruncated, field, p.off, p.lengthError(p.off+4))
 	}
-	length := DecodeInt32LE(d, 0)
+	length := DecodeInt32LE(p.b, p.off)
 
-	// Sanity-check the length
-	if length < 0 || length > MaxDocumentSize {
-		return nil, 0, fmt.Errorf("bad document size %d", length)
+	// Sanity-check the length. The smallest document is 5 bytes: its length
+	// and the trailing null byte.
+	if length < 5 || length > MaxDocumentSize {
+		return nil, p.error(ErrBadLength, field, p.off, fmt.Errorf("document size %d", length))
 	}
 
-	// Document starts with its own length in 4 bytes.
-	rawdoc := make([]byte, length)
-	encodeInt32LE(rawdoc[:], 0, length)
+	b, err := p.next(int(length), field)
+	if err != nil {
+		return nil, err
+	}
+	return bson.Raw(b), nil
+}
 
-	// Read doc raw bytes
-	if _, err := io.ReadFull(r, rawdoc[4:]); err != nil {
-		return nil, 0, fmt.Errorf("document body read %s", err)
+// Unmarshal a raw document. It is validated, then converted to the values
+// bson.Unmarshal would give directly from the bytes, which is several times
+// faster than the driver's reflection-based decoder.
+func unmarshal(raw bson.Raw) (bson.D, error) {
+	if err := bsoncore.Document(raw).Validate(); err != nil {
+		return nil, &DecodeError{Err: ErrBadBSON, Offset: -1, Cause: err}
+	}
+	if doc, ok := documentD(raw); ok {
+		return doc, nil
 	}
 
-	// Unmarhal BSON bytes to document
+	// Code with scope is rare enough to leave to the driver
 	var doc bson.D
-	if err := bson.Unmarshal(rawdoc, &doc); err != nil {
-		return nil, 0, fmt.Errorf("document bson decode %s", err)
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return nil, &DecodeError{Err: ErrBadBSON, Offset: -1, Cause: err}
+	}
+	return doc, nil
+}
+
+// Convert a validated document, or report false if it holds a value that
+// isn't converted here
+func documentD(raw []byte) (bson.D, bool) {
+	doc := bson.D{}
+	elems := raw[4 : len(raw)-1]
+	for len(elems) > 0 {
+		e, rem, ok := bsoncore.ReadElement(elems)
+		if !ok {
+			return nil, false
+		}
+		v, ok := valueOf(e.Value())
+		if !ok {
+			return nil, false
+		}
+		doc = append(doc, bson.E{Key: e.Key(), Value: v})
+		elems = rem
+	}
+	return doc, true
+}
+
+func arrayA(raw []byte) (bson.A, bool) {
+	arr := bson.A{}
+	elems := raw[4 : len(raw)-1]
+	for len(elems) > 0 {
+		e, rem, ok := bsoncore.ReadElement(elems)
+		if !ok {
+			return nil, false
+		}
+		v, ok := valueOf(e.Value())
+		if !ok {
+			return nil, false
+		}
+		arr = append(arr, v)
+		elems = rem
+	}
+	return arr, true
+}
+
+// The value bson.Unmarshal gives an element of a bson.D
+func valueOf(v bsoncore.Value) (interface{}, bool) {
+	switch v.Type {
+	case bsontype.Double:
+		return v.Double(), true
+	case bsontype.String:
+		return v.StringValue(), true
+	case bsontype.EmbeddedDocument:
+		return documentD(v.Data)
+	case bsontype.Array:
+		return arrayA(v.Data)
+	case bsontype.Binary:
+		subtype, data := v.Binary()
+		return primitive.Binary{Subtype: subtype, Data: data}, true
+	case bsontype.Undefined:
+		return primitive.Undefined{}, true
+	case bsontype.ObjectID:
+		return v.ObjectID(), true
+	case bsontype.Boolean:
+		return v.Boolean(), true
+	case bsontype.DateTime:
+		return primitive.DateTime(v.DateTime()), true
+	case bsontype.Null:
+		return nil, true
+	case bsontype.Regex:
+		pattern, options := v.Regex()
+		return primitive.Regex{Pattern: pattern, Options: options}, true
+	case bsontype.DBPointer:
+		ns, oid := v.DBPointer()
+		return primitive.DBPointer{DB: ns, Pointer: oid}, true
+	case bsontype.JavaScript:
+		return primitive.JavaScript(v.JavaScript()), true
+	case bsontype.Symbol:
+		return primitive.Symbol(v.Symbol()), true
+	case bsontype.Int32:
+		return v.Int32(), true
+	case bsontype.Timestamp:
+		t, i := v.Timestamp()
+		return primitive.Timestamp{T: t, I: i}, true
+	case bsontype.Int64:
+		return v.Int64(), true
+	case bsontype.Decimal128:
+		return v.Decimal128(), true
+	case bsontype.MinKey:
+		return primitive.MinKey{}, true
+	case bsontype.MaxKey:
+		return primitive.MaxKey{}, true
+	}
+	return nil, false
+}
+
+// Decode a BSON document from the buffer. The document is unmarshaled
+// immediately unless raw documents were requested, in which case it is only
+// validated.
+func (p *buffer) decodeDocument(field string) (*Document, error) {
+	off := p.off
+	raw, err := p.document(field)
+	if err != nil {
+		return nil, err
+	}
+
+	d := NewDocument(raw)
+	if p.opts != nil && p.opts.RawDocuments {
+		if err := raw.Validate(); err != nil {
+			return nil, p.error(ErrBadBSON, field, off, err)
+		}
+		return d, nil
+	}
+
+	if _, err := d.D(); err != nil {
+		return nil, p.error(ErrBadBSON, field, off, errors.Unwrap(err))
+	}
+	return d, nil
+}
+
+// Read the body of a message, following the header, into a byte slice
+func readBody(r *bufio.Reader, h *Header) ([]byte, error) {
+	// Check the length before allocating the body, so a bad header can't
+	// force a huge allocation
+	sz := int(h.MessageLength) - HeaderLen
+	if sz < 0 || h.MessageLength > MaxMessageSize {
+		return nil, &DecodeError{Err: ErrBadLength, OpCode: h.OpCode, Field: "messageLength",
+			Cause: fmt.Errorf("message length %d", h.MessageLength)}
+	}
+	b := make([]byte, sz)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, &DecodeError{Err: ErrTruncated, OpCode: h.OpCode, Offset: HeaderLen, Field: "body", Cause: err}
 	}
-	return doc, int(length), nil
+	return b, nil
 }
@@ -0,0 +1,345 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Encode an OP_MSG with a single body section
+func encodeMsg(t testing.TB, requestID uint32, body interface{}) []byte {
+	doc, err := bson.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encodeOp(OpMsg, requestID, append([]byte{0, 0, 0, 0, SectionKindBody}, doc...))
+}
+
+// Encode a message with the given body
+func encodeOp(op OpCode, requestID uint32, body []byte) []byte {
+	b := make([]byte, HeaderLen, HeaderLen+len(body))
+	b = append(b, body...)
+	putInt32LE(b, 0, int32(len(b)))
+	putInt32LE(b, 4, int32(requestID))
+	putInt32LE(b, 12, int32(op))
+	return b
+}
+
+func putInt32LE(b []byte, i int, n int32) {
+	b[i] = byte(n)
+	b[i+1] = byte(n >> 8)
+	b[i+2] = byte(n >> 16)
+	b[i+3] = byte(n >> 24)
+}
+
+// Concatenate message fields, little-endian
+func fields(vs ...interface{}) []byte {
+	var b []byte
+	for _, v := range vs {
+		switch v := v.(type) {
+		case int32:
+			b = append(b, 0, 0, 0, 0)
+			putInt32LE(b, len(b)-4, v)
+		case int64:
+			b = append(b, 0, 0, 0, 0, 0, 0, 0, 0)
+			putInt32LE(b, len(b)-8, int32(v))
+			putInt32LE(b, len(b)-4, int32(v>>32))
+		case string:
+			b = append(b, v...)
+		case []byte:
+			b = append(b, v...)
+		}
+	}
+	return b
+}
+
+func TestDecodeLength(t *testing.T) {
+	doc, err := bson.Marshal(bson.D{{Key: "x", Value: int32(1)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		op       OpCode
+		body     []byte
+		strict   bool
+		err      error
+		field    string
+		missing  int
+		trailing int
+	}{
+		// Trailing bytes are ignored unless decoding is strict
+		{"killcursors trailing", OpKillCursors, fields(int32(0), int32(1), int64(7), "abc"), false, nil, "", 0, 0},
+		{"killcursors trailing strict", OpKillCursors, fields(int32(0), int32(1), int64(7), "abc"), true, ErrBadLength, "", 0, 3},
+		{"getmore trailing strict", OpGetMore, fields(int32(0), "db.c\x00", int32(10), int64(7), "ab"), true, ErrBadLength, "", 0, 2},
+		{"reply trailing strict", OpReply, fields(int32(0), int64(0), int32(0), int32(1), doc, "a"), true, ErrBadLength, "", 0, 1},
+		{"reply exact strict", OpReply, fields(int32(0), int64(0), int32(0), int32(1), doc), true, nil, "", 0, 0},
+
+		// Short bodies are always errors
+		{"insert no name", OpInsert, fields(int32(0), "db.c"), false, ErrTruncated, "fullCollectionName", 0, 0},
+		{"insert short document", OpInsert, fields(int32(0), "db.c\x00", doc[:8]), false, ErrTruncated, "documents", len(doc) - 8, 0},
+		{"insert short length", OpInsert, fields(int32(0), "db.c\x00", doc, "ab"), false, ErrTruncated, "documents", 2, 0},
+		{"killcursors no count", OpKillCursors, fields(int32(0)), false, ErrTruncated, "numberOfCursorIDs", 4, 0},
+		{"killcursors short ids", OpKillCursors, fields(int32(0), int32(2), int64(7)), false, ErrTruncated, "cursorIDs", 8, 0},
+		{"killcursors short id", OpKillCursors, fields(int32(0), int32(1), int32(7)), true, ErrTruncated, "cursorIDs", 4, 0},
+	}
+	for _, tt := range tests {
+		m := encodeOp(tt.op, 1, tt.body)
+		_, err := DecodeWithOptions(m, &DecodeOptions{Strict: tt.strict})
+		if tt.err == nil {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tt.name, err)
+			}
+			continue
+		}
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+
+		var de *DecodeError
+		if !errors.As(err, &de) || de.Field != tt.field || de.OpCode != tt.op {
+			t.Errorf("%s: got field %q of %v", tt.name, de.Field, de.OpCode)
+		}
+		if tt.err == ErrTruncated && tt.missing == 0 {
+			continue
+		}
+		var le *LengthError
+		if !errors.As(err, &le) {
+			t.Errorf("%s: no length error in %v", tt.name, err)
+			continue
+		}
+		if le.Length != len(m) || le.Missing() != tt.missing || le.Trailing() != tt.trailing {
+			t.Errorf("%s: got length %d missing %d trailing %d, want %d %d %d", tt.name,
+				le.Length, le.Missing(), le.Trailing(), len(m), tt.missing, tt.trailing)
+		}
+
+		// The bufio path reports the same error
+		_, rerr := ReadWithOptions(bufio.NewReader(bytes.NewReader(m)), &DecodeOptions{Strict: tt.strict})
+		if rerr == nil || rerr.Error() != err.Error() {
+			t.Errorf("%s: Read got %v, Decode got %v", tt.name, rerr, err)
+		}
+	}
+}
+
+func TestReadBadLength(t *testing.T) {
+	for _, n := range []int32{-1, HeaderLen - 1, MaxMessageSize + 1, 1<<31 - 1} {
+		var h [HeaderLen]byte
+		putInt32LE(h[:], 0, n)
+		putInt32LE(h[:], 12, int32(OpMsg))
+
+		_, err := Read(bufio.NewReader(bytes.NewReader(h[:])))
+		if !errors.Is(err, ErrBadLength) {
+			t.Errorf("Read with message length %d: got %v, want %v", n, err, ErrBadLength)
+		}
+		_, err = Decode(h[:])
+		if !errors.Is(err, ErrBadLength) {
+			t.Errorf("Decode with message length %d: got %v, want %v", n, err, ErrBadLength)
+		}
+	}
+}
+
+// Documents are unmarshaled to the same values as bson.Unmarshal gives
+func TestUnmarshal(t *testing.T) {
+	oid := primitive.NewObjectID()
+	dec, err := primitive.ParseDecimal128("12.50")
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs := []bson.D{
+		{},
+		{
+			{Key: "double", Value: 1.5},
+			{Key: "string", Value: "héllo"},
+			{Key: "doc", Value: bson.D{{Key: "a", Value: int32(1)}, {Key: "b", Value: bson.D{}}}},
+			{Key: "array", Value: bson.A{int32(1), "two", bson.D{{Key: "c", Value: true}}, bson.A{}}},
+			{Key: "binary", Value: primitive.Binary{Subtype: 4, Data: []byte("0123456789abcdef")}},
+			{Key: "undefined", Value: primitive.Undefined{}},
+			{Key: "oid", Value: oid},
+			{Key: "bool", Value: false},
+			{Key: "date", Value: primitive.DateTime(1614834367000)},
+			{Key: "null", Value: nil},
+			{Key: "regex", Value: primitive.Regex{Pattern: "^a.*", Options: "i"}},
+			{Key: "dbpointer", Value: primitive.DBPointer{DB: "shop.orders", Pointer: oid}},
+			{Key: "js", Value: primitive.JavaScript("function() {}")},
+			{Key: "symbol", Value: primitive.Symbol("sym")},
+			{Key: "int32", Value: int32(-7)},
+			{Key: "timestamp", Value: primitive.Timestamp{T: 1614834367, I: 3}},
+			{Key: "int64", Value: int64(1) << 40},
+			{Key: "decimal", Value: dec},
+			{Key: "min", Value: primitive.MinKey{}},
+			{Key: "max", Value: primitive.MaxKey{}},
+		},
+
+		// Left to the driver
+		{{Key: "where", Value: primitive.CodeWithScope{Code: "x == y", Scope: bson.D{{Key: "y", Value: int32(2)}}}}},
+	}
+	for _, d := range docs {
+		raw, err := bson.Marshal(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want bson.D
+		if err = bson.Unmarshal(raw, &want); err != nil {
+			t.Fatal(err)
+		}
+		got, err := unmarshal(raw)
+		if err != nil {
+			t.Errorf("%v: %v", d, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %#v\nwant %#v", got, want)
+		}
+	}
+
+	// Malformed documents are errors
+	raw, err := bson.Marshal(bson.D{{Key: "s", Value: "abc"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range [][]byte{
+		append([]byte{}, raw[:len(raw)-1]...),
+		append(append([]byte{}, raw[:len(raw)-1]...), 1),
+		append(append([]byte{}, raw[:7]...), append([]byte{0x20, 0, 0, 0}, raw[11:]...)...),
+	} {
+		if _, err := unmarshal(bad); !errors.Is(err, ErrBadBSON) {
+			t.Errorf("%x: got %v, want %v", bad, err, ErrBadBSON)
+		}
+	}
+}
+
+// The capture benchmark: a find command with a filter, as sent by a driver
+func benchMessages(b *testing.B, n int) []byte {
+	var buf []byte
+	for i := 0; i < n; i++ {
+		buf = append(buf, encodeMsg(b, uint32(i), bson.D{
+			{Key: "find", Value: "orders"},
+			{Key: "filter", Value: bson.D{
+				{Key: "status", Value: "open"},
+				{Key: "customer", Value: bson.D{{Key: "$in", Value: bson.A{int32(1), int32(2), int32(3)}}}},
+			}},
+			{Key: "sort", Value: bson.D{{Key: "created", Value: int32(-1)}}},
+			{Key: "limit", Value: int32(20)},
+			{Key: "lsid", Value: bson.D{{Key: "id", Value: "0123456789abcdef"}}},
+			{Key: "$db", Value: "shop"},
+		})...)
+	}
+	return buf
+}
+
+// BenchmarkRead compares the byte slice decoders with the original decode
+// path, which wrapped each message in a bufio.Reader and copied every
+// document before unmarshaling it
+func BenchmarkRead(b *testing.B) {
+	const n = 1000
+	data := benchMessages(b, n)
+
+	// Split the capture into messages, as MongoStream does
+	var msgs [][]byte
+	for off := 0; off < len(data); {
+		l := int(DecodeInt32LE(data, off))
+		msgs = append(msgs, data[off:off+l])
+		off += l
+	}
+
+	b.Run("baseline", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			for _, m := range msgs {
+				if err := baselineRead(bufio.NewReader(bytes.NewReader(m))); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("Read", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			for _, m := range msgs {
+				if _, err := Read(bufio.NewReader(bytes.NewReader(m))); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("Decode", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			for _, m := range msgs {
+				if _, err := Decode(m); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("DecodeRaw", func(b *testing.B) {
+		opts := &DecodeOptions{RawDocuments: true}
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			for _, m := range msgs {
+				op, err := DecodeWithOptions(m, opts)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if CommandOf(op) == nil {
+					b.Fatal("no command")
+				}
+			}
+		}
+	})
+}
+
+// The OP_MSG decode path before messages were decoded from byte slices
+func baselineRead(r *bufio.Reader) error {
+	h := &Header{}
+	if err := h.Read(r); err != nil {
+		return err
+	}
+	var raw [4]byte
+	d := raw[:]
+	if _, err := io.ReadFull(r, d); err != nil {
+		return err
+	}
+	flags := MsgFlags(DecodeUint32LE(d, 0))
+
+	sz := int(h.MessageLength) - HeaderLen - 4
+	for sz > 0 {
+		if sz == 4 && flags&MsgFlagChecksumPresent != 0 {
+			_, err := io.ReadFull(r, d)
+			return err
+		}
+		kind, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		sz--
+		if kind != SectionKindBody {
+			return fmt.Errorf("section kind %d", kind)
+		}
+
+		if _, err := io.ReadFull(r, d); err != nil {
+			return err
+		}
+		length := DecodeInt32LE(d, 0)
+		rawdoc := make([]byte, length)
+		putInt32LE(rawdoc, 0, length)
+		if _, err := io.ReadFull(r, rawdoc[4:]); err != nil {
+			return err
+		}
+		var doc bson.D
+		if err := bson.Unmarshal(rawdoc, &doc); err != nil {
+			return err
+		}
+		sz -= int(length)
+	}
+	return nil
+}
@@ -1,11 +1,6 @@
 package protocol
 
-import (
-	"bufio"
-	"io"
-
-	"go.mongodb.org/mongo-driver/bson"
-)
+import "bufio"
 
 // DeleteFlags ..
 type DeleteFlags int32
@@ -21,7 +16,7 @@ type Delete struct {
 	*Header
 	FullCollectionName string
 	Flags              DeleteFlags
-	Selector           bson.D
+	Selector           *Document
 }
 
 // GetHeader ..
@@ -31,40 +26,49 @@ func (o *Delete) GetHeader() *Header {
 
 // Read a Delete message off the wire
 func (o *Delete) Read(r *bufio.Reader, h *Header) error {
+	b, err := readBody(r, h)
+	if err != nil {
+		return err
+	}
+	return o.Decode(b, h, nil)
+}
+
+// Decode a Delete message body
+func (o *Delete) Decode(b []byte, h *Header, opts *DecodeOptions) error {
 	o.Header = h
 
+	p := newBuffer(b, h, opts)
+
 	// Skip reserved field
-	if _, err := r.Discard(4); err != nil {
+	if _, err := p.next(4, "ZERO"); err != nil {
 		return err
 	}
 
 	// Decode full collection name
-	name, err := cstring(r)
+	name, err := p.cstring("fullCollectionName")
 	if err != nil {
 		return err
 	}
 	o.FullCollectionName = name
 
-	var buf [4]byte
-	d := buf[:]
-
 	// Decode flags
-	if _, err := io.ReadFull(r, d); err != nil {
+	flags, err := p.int32("flags")
+	if err != nil {
 		return err
 	}
-	o.Flags = DeleteFlags(DecodeInt32LE(d, 0))
+	o.Flags = DeleteFlags(flags)
 
 	// Decode document
-	doc, _, err := document(r)
+	doc, err := p.decodeDocument("selector")
 	if err != nil {
 		return err
 	}
 	o.Selector = doc
 
-	return nil
+	return p.done()
 }
 
-// String representation
+// String summarizes the op, see Summary
 func (o *Delete) String() string {
-	return o.Header.String()
+	return Summary(o, MaxStringLength)
 }
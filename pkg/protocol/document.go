@@ -0,0 +1,75 @@
+package protocol
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// DecodeOptions control how messages are decoded
+type DecodeOptions struct {
+	// RawDocuments keeps documents as bson.Raw and defers unmarshaling them
+	// until they are first used. Otherwise documents are unmarshaled to bson.D
+	// as they are decoded. Either way malformed documents are decoding
+	// errors, so raw documents suit callers that only look up fields and
+	// re-marshal the bytes, as the mongopacket commands do.
+	RawDocuments bool
+
+	// Strict requires each decoder to consume exactly MessageLength bytes,
+	// reporting any trailing bytes as a *LengthError.
+	Strict bool
+}
+
+// Document is a BSON document decoded from a message. The raw bytes are always
+// retained and the bson.D form is produced on demand, unless the document was
+// decoded eagerly.
+type Document struct {
+	raw bson.Raw
+	doc bson.D
+}
+
+// NewDocument wraps raw document bytes
+func NewDocument(raw bson.Raw) *Document {
+	return &Document{raw: raw}
+}
+
+// Raw returns the document bytes
+func (d *Document) Raw() bson.Raw {
+	return d.raw
+}
+
+// D unmarshals the document, caching the result
+func (d *Document) D() (bson.D, error) {
+	if d.doc == nil {
+		doc, err := unmarshal(d.raw)
+		if err != nil {
+			return nil, err
+		}
+		d.doc = doc
+	}
+	return d.doc, nil
+}
+
+// Lookup a field by its key path without unmarshaling the document. A zero
+// RawValue is returned if the field is missing.
+func (d *Document) Lookup(key ...string) bson.RawValue {
+	v, err := d.raw.LookupErr(key...)
+	if err != nil {
+		return bson.RawValue{}
+	}
+	return v
+}
+
+// FirstKey returns the key of the document's first element, which for
+// commands is the command name.
+func (d *Document) FirstKey() string {
+	e, err := d.raw.IndexErr(0)
+	if err != nil {
+		return ""
+	}
+	return e.Key()
+}
+
+// MarshalJSON encodes the document as relaxed Extended JSON, see
+// MarshalExtJSON for other modes
+func (d *Document) MarshalJSON() ([]byte, error) {
+	return bson.MarshalExtJSON(d.raw, false, false)
+}
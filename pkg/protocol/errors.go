@@ -0,0 +1,113 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Kinds of decode errors. A *DecodeError matches exactly one of these with
+// errors.Is.
+var (
+	ErrTruncated     = errors.New("truncated")
+	ErrBadLength     = errors.New("bad length")
+	ErrUnknownOpCode = errors.New("unknown opcode")
+	ErrBadBSON       = errors.New("bad bson")
+	ErrDecompress    = errors.New("decompress")
+	ErrBadSection    = errors.New("bad section")
+)
+
+var errorKinds = []struct {
+	err  error
+	name string
+}{
+	{ErrTruncated, "truncated"},
+	{ErrBadLength, "bad_length"},
+	{ErrUnknownOpCode, "unknown_opcode"},
+	{ErrBadBSON, "bad_bson"},
+	{ErrDecompress, "decompress"},
+	{ErrBadSection, "bad_section"},
+}
+
+// DecodeError describes where and why decoding a message failed
+type DecodeError struct {
+	Err    error  // kind of error, one of the Err* values
+	OpCode OpCode // opcode of the message, if the header was decoded
+	Offset int    // byte offset within the message including the header, or -1 if unknown
+	Field  string // name of the field being decoded, if known
+	Cause  error  // underlying error, if any
+}
+
+// ErrorKind returns a short name for the kind of a decode error, suitable for
+// aggregating errors. Errors that are not decode errors return "unknown".
+func ErrorKind(err error) string {
+	for _, k := range errorKinds {
+		if errors.Is(err, k.err) {
+			return k.name
+		}
+	}
+	return "unknown"
+}
+
+func (e *DecodeError) Error() string {
+	var b strings.Builder
+	if e.OpCode != OpInvalid {
+		b.WriteString(e.OpCode.String())
+		b.WriteString(" ")
+	}
+	if e.Field != "" {
+		b.WriteString(e.Field)
+		b.WriteString(": ")
+	}
+	b.WriteString(e.Err.Error())
+	if e.Offset >= 0 {
+		fmt.Fprintf(&b, " at offset %d", e.Offset)
+	}
+	if e.Cause != nil {
+		b.WriteString(": ")
+		b.WriteString(e.Cause.Error())
+	}
+	return b.String()
+}
+
+// Is reports whether target is the kind of this error
+func (e *DecodeError) Is(target error) bool {
+	return target == e.Err
+}
+
+// Unwrap returns the underlying error
+func (e *DecodeError) Unwrap() error {
+	return e.Cause
+}
+
+// LengthError reports a message whose decoded size disagrees with the
+// MessageLength in its header. Missing bytes are always reported, while
+// trailing bytes are only reported in strict mode.
+type LengthError struct {
+	OpCode   OpCode
+	Length   int // MessageLength from the header
+	Consumed int // bytes consumed or required by the decoder, including the header
+}
+
+// Missing returns the number of bytes the decoder needed beyond the end of the message
+func (e *LengthError) Missing() int {
+	if e.Consumed > e.Length {
+		return e.Consumed - e.Length
+	}
+	return 0
+}
+
+// Trailing returns the number of bytes left over after decoding the message
+func (e *LengthError) Trailing() int {
+	if e.Length > e.Consumed {
+		return e.Length - e.Consumed
+	}
+	return 0
+}
+
+func (e *LengthError) Error() string {
+	if n := e.Missing(); n > 0 {
+		return fmt.Sprintf("%s message length %d is missing %d bytes", e.OpCode, e.Length, n)
+	}
+	return fmt.Sprintf("%s message length %d has %d trailing bytes", e.OpCode, e.Length, e.Trailing())
+}
@@ -0,0 +1,103 @@
+package protocol
+
+import (
+	"fmt"
+	"reflect"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ExtJSONMode selects the flavor of MongoDB Extended JSON used for output
+type ExtJSONMode int
+
+// Extended JSON modes
+const (
+	// ExtJSONRelaxed uses plain JSON numbers and ISO-8601 dates where they
+	// can be represented without loss, for readability
+	ExtJSONRelaxed ExtJSONMode = iota
+
+	// ExtJSONCanonical wraps every value whose type JSON can't represent,
+	// such as {"$numberLong": "1"}, so that types are preserved exactly
+	ExtJSONCanonical
+)
+
+// ParseExtJSONMode parses "relaxed" or "canonical"
+func ParseExtJSONMode(s string) (ExtJSONMode, error) {
+	switch s {
+	case "relaxed":
+		return ExtJSONRelaxed, nil
+	case "canonical":
+		return ExtJSONCanonical, nil
+	}
+	return ExtJSONRelaxed, fmt.Errorf("unknown extended JSON mode %q", s)
+}
+
+func (m ExtJSONMode) String() string {
+	if m == ExtJSONCanonical {
+		return "canonical"
+	}
+	return "relaxed"
+}
+
+// MarshalExtJSON encodes an op as a single Extended JSON document, with the
+// header and op fields at the top level and the op's documents embedded as
+// they were sent. The output can be loaded with mongoimport or pasted into
+// mongosh.
+func MarshalExtJSON(op Op, mode ExtJSONMode) ([]byte, error) {
+	return bson.MarshalExtJSON(structDocument(reflect.ValueOf(op)), mode == ExtJSONCanonical, false)
+}
+
+// Convert the exported fields of an op struct, including the embedded
+// header, to a document
+func structDocument(v reflect.Value) bson.D {
+	d := bson.D{}
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return d
+		}
+		v = v.Elem()
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		if f.Anonymous {
+			d = append(d, structDocument(v.Field(i))...)
+			continue
+		}
+		d = append(d, bson.E{Key: f.Name, Value: extValue(v.Field(i).Interface())})
+	}
+	return d
+}
+
+// Documents are embedded as raw BSON so that their types are preserved
+func extValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case *Document:
+		if x == nil {
+			return nil
+		}
+		return x.Raw()
+
+	case []*Document:
+		a := bson.A{}
+		for _, d := range x {
+			a = append(a, d.Raw())
+		}
+		return a
+
+	case []*Section:
+		a := bson.A{}
+		for _, s := range x {
+			a = append(a, bson.D{
+				{Key: "Size", Value: s.Size},
+				{Key: "Seq", Value: s.Seq},
+				{Key: "Documents", Value: extValue(s.Documents())},
+			})
+		}
+		return a
+	}
+	return v
+}
@@ -0,0 +1,65 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMarshalExtJSON(t *testing.T) {
+	dec, err := primitive.ParseDecimal128("1.50")
+	if err != nil {
+		t.Fatal(err)
+	}
+	op := decodeMsg(t, bson.D{{Key: "insert", Value: "orders"}, {Key: "$db", Value: "shop"}}, "documents",
+		bson.D{
+			{Key: "at", Value: primitive.NewDateTimeFromTime(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))},
+			{Key: "n", Value: int64(5)},
+			{Key: "i", Value: int32(6)},
+			{Key: "bin", Value: primitive.Binary{Subtype: 4, Data: []byte{1, 2, 3}}},
+			{Key: "total", Value: dec},
+		})
+
+	tests := []struct {
+		mode ExtJSONMode
+		want string
+	}{
+		{ExtJSONRelaxed, `"Documents":[{"at":{"$date":"2020-01-02T03:04:05Z"},"n":5,"i":6,` +
+			`"bin":{"$binary":{"base64":"AQID","subType":"04"}},"total":{"$numberDecimal":"1.50"}}]`},
+		{ExtJSONCanonical, `"Documents":[{"at":{"$date":{"$numberLong":"1577934245000"}},"n":{"$numberLong":"5"},"i":{"$numberInt":"6"},` +
+			`"bin":{"$binary":{"base64":"AQID","subType":"04"}},"total":{"$numberDecimal":"1.50"}}]`},
+	}
+	for _, tt := range tests {
+		b, err := MarshalExtJSON(op, tt.mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(b), tt.want) {
+			t.Errorf("%s: got %s, want it to contain %s", tt.mode, b, tt.want)
+		}
+
+		// The output loads back with its types
+		var d bson.M
+		if err := bson.UnmarshalExtJSON(b, tt.mode == ExtJSONCanonical, &d); err != nil {
+			t.Fatalf("%s: %s", tt.mode, err)
+		}
+		if d["OpCode"] == nil || d["Body"] == nil {
+			t.Errorf("%s: header or body missing from %s", tt.mode, b)
+		}
+	}
+}
+
+func TestParseExtJSONMode(t *testing.T) {
+	for _, m := range []ExtJSONMode{ExtJSONRelaxed, ExtJSONCanonical} {
+		got, err := ParseExtJSONMode(m.String())
+		if err != nil || got != m {
+			t.Errorf("%s: got %s, %v", m, got, err)
+		}
+	}
+	if _, err := ParseExtJSONMode("shell"); err == nil {
+		t.Error("shell: no error")
+	}
+}
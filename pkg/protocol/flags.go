@@ -0,0 +1,90 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+)
+
+type flagName struct {
+	bit  uint32
+	name string
+}
+
+var msgFlagNames = []flagName{
+	{uint32(MsgFlagChecksumPresent), "checksumPresent"},
+	{uint32(MsgFlagMoreToCome), "moreToCome"},
+	{uint32(MsgFmagExhaustAllowed), "exhaustAllowed"},
+}
+
+var queryFlagNames = []flagName{
+	{uint32(QueryFlagTailableCursor), "tailableCursor"},
+	{uint32(QueryFlagSlaveOK), "slaveOk"},
+	{uint32(QueryFlagOplogReplay), "oplogReplay"},
+	{uint32(QueryFlagNoCursorTimeout), "noCursorTimeout"},
+	{uint32(QueryFlagAwaitData), "awaitData"},
+	{uint32(QueryFlagExhaust), "exhaust"},
+	{uint32(QueryFlagPartial), "partial"},
+}
+
+var replyFlagNames = []flagName{
+	{uint32(ReplyFlagCursorNotFound), "cursorNotFound"},
+	{uint32(ReplyFlagQueryFailure), "queryFailure"},
+	{uint32(ReplyFlagShardConfigState), "shardConfigStale"},
+	{uint32(ReplyFlagAwaitCapable), "awaitCapable"},
+}
+
+var insertFlagNames = []flagName{
+	{uint32(InsertFlagContinueOnError), "continueOnError"},
+}
+
+var updateFlagNames = []flagName{
+	{uint32(UpdateFlagUpsert), "upsert"},
+	{uint32(UpdateFlagMulti), "multi"},
+}
+
+var deleteFlagNames = []flagName{
+	{uint32(DeleteFlagSingleRemove), "singleRemove"},
+}
+
+// Names of the bits set in flags joined with |, with any unknown bits in
+// hex. No flags is "0".
+func flagString(flags uint32, names []flagName) string {
+	if flags == 0 {
+		return "0"
+	}
+	var s []string
+	for _, n := range names {
+		if flags&n.bit != 0 {
+			s = append(s, n.name)
+			flags &^= n.bit
+		}
+	}
+	if flags != 0 {
+		s = append(s, fmt.Sprintf("0x%x", flags))
+	}
+	return strings.Join(s, "|")
+}
+
+func (f MsgFlags) String() string {
+	return flagString(uint32(f), msgFlagNames)
+}
+
+func (f QueryFlags) String() string {
+	return flagString(uint32(f), queryFlagNames)
+}
+
+func (f ReplyFlags) String() string {
+	return flagString(uint32(f), replyFlagNames)
+}
+
+func (f InsertFlags) String() string {
+	return flagString(uint32(f), insertFlagNames)
+}
+
+func (f UpdateFlags) String() string {
+	return flagString(uint32(f), updateFlagNames)
+}
+
+func (f DeleteFlags) String() string {
+	return flagString(uint32(f), deleteFlagNames)
+}
@@ -1,9 +1,6 @@
 package protocol
 
-import (
-	"bufio"
-	"io"
-)
+import "bufio"
 
 // GetMore is a message used to query the database
 type GetMore struct {
@@ -20,33 +17,42 @@ func (o *GetMore) GetHeader() *Header {
 
 // Read a GetMore message off the wire
 func (o *GetMore) Read(r *bufio.Reader, h *Header) error {
+	b, err := readBody(r, h)
+	if err != nil {
+		return err
+	}
+	return o.Decode(b, h, nil)
+}
+
+// Decode a GetMore message body
+func (o *GetMore) Decode(b []byte, h *Header, opts *DecodeOptions) error {
 	o.Header = h
 
+	p := newBuffer(b, h, opts)
+
 	// Skip reserved field
-	if _, err := r.Discard(4); err != nil {
+	if _, err := p.next(4, "ZERO"); err != nil {
 		return err
 	}
 
 	// Decode name
-	name, err := cstring(r)
+	name, err := p.cstring("fullCollectionName")
 	if err != nil {
 		return err
 	}
 	o.FullCollectionName = name
 
-	var raw [12]byte
-	d := raw[:]
-
 	// Decode number to return / cursor id
-	if _, err := io.ReadFull(r, d); err != nil {
+	d, err := p.next(12, "numberToReturn")
+	if err != nil {
 		return err
 	}
 	o.NumberToReturn = DecodeInt32LE(d, 0)
 	o.CursorID = decodeInt64LE(d, 4)
-	return nil
+	return p.done()
 }
 
-// String representation
+// String summarizes the op, see Summary
 func (o *GetMore) String() string {
-	return o.Header.String()
+	return Summary(o, MaxStringLength)
 }
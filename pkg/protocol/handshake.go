@@ -0,0 +1,103 @@
+package protocol
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Hello is the handshake a client sends when it opens a connection, either
+// hello or the legacy isMaster. Drivers repeat the handshake to monitor the
+// server, but only the first one on a connection carries client metadata.
+type Hello struct {
+	HasClient          bool // the handshake carried client metadata
+	AppName            string
+	DriverName         string
+	DriverVersion      string
+	OSType             string
+	OSName             string
+	OSArchitecture     string
+	OSVersion          string
+	Platform           string
+	Compression        []string // compressors the client supports
+	SaslSupportedMechs string   // user whose authentication mechanisms were requested
+}
+
+// HelloReply is the server's response to a handshake
+type HelloReply struct {
+	MaxWireVersion      int64
+	MinWireVersion      int64
+	Compression         []string // compressors chosen from those the client offered
+	ConnectionID        int64
+	MaxMessageSizeBytes int64
+	MaxBsonObjectSize   int64
+	SaslSupportedMechs  []string // authentication mechanisms available to the user
+}
+
+// IsHello checks if a command name is a handshake
+func IsHello(name string) bool {
+	switch name {
+	case "hello", "isMaster", "ismaster":
+		return true
+	}
+	return false
+}
+
+// HelloOf returns the handshake carried by a command, or nil if the command
+// is not a handshake.
+func HelloOf(cmd *Command) *Hello {
+	if cmd == nil || !IsHello(cmd.Name) {
+		return nil
+	}
+	h := &Hello{}
+	body := cmd.Body
+	if _, ok := body.Lookup("client").DocumentOK(); ok {
+		h.HasClient = true
+		h.AppName, _ = body.Lookup("client", "application", "name").StringValueOK()
+		h.DriverName, _ = body.Lookup("client", "driver", "name").StringValueOK()
+		h.DriverVersion, _ = body.Lookup("client", "driver", "version").StringValueOK()
+		h.OSType, _ = body.Lookup("client", "os", "type").StringValueOK()
+		h.OSName, _ = body.Lookup("client", "os", "name").StringValueOK()
+		h.OSArchitecture, _ = body.Lookup("client", "os", "architecture").StringValueOK()
+		h.OSVersion, _ = body.Lookup("client", "os", "version").StringValueOK()
+		h.Platform, _ = body.Lookup("client", "platform").StringValueOK()
+	}
+	h.Compression = stringValues(body.Lookup("compression"))
+	h.SaslSupportedMechs, _ = body.Lookup("saslSupportedMechs").StringValueOK()
+	return h
+}
+
+// HelloReplyOf extracts the server's handshake details from a reply document
+func HelloReplyOf(doc *Document) *HelloReply {
+	r := &HelloReply{}
+	r.MaxWireVersion, _ = IntValue(doc.Lookup("maxWireVersion"))
+	r.MinWireVersion, _ = IntValue(doc.Lookup("minWireVersion"))
+	r.Compression = stringValues(doc.Lookup("compression"))
+	r.ConnectionID, _ = IntValue(doc.Lookup("connectionId"))
+	r.MaxMessageSizeBytes, _ = IntValue(doc.Lookup("maxMessageSizeBytes"))
+	r.MaxBsonObjectSize, _ = IntValue(doc.Lookup("maxBsonObjectSize"))
+	r.SaslSupportedMechs = stringValues(doc.Lookup("saslSupportedMechs"))
+	return r
+}
+
+// Driver returns the driver name and version
+func (h *Hello) Driver() string {
+	if h.DriverVersion == "" {
+		return h.DriverName
+	}
+	return h.DriverName + " " + h.DriverVersion
+}
+
+// The strings in a BSON array, ignoring other types
+func stringValues(v bson.RawValue) []string {
+	arr, ok := v.ArrayOK()
+	if !ok {
+		return nil
+	}
+	vals, _ := arr.Values()
+	var s []string
+	for _, v := range vals {
+		if str, ok := v.StringValueOK(); ok {
+			s = append(s, str)
+		}
+	}
+	return s
+}
@@ -33,7 +33,8 @@ type Header struct {
 	// OP_QUERY or OP_GET_MORE messages from the client
 	ResponseTo uint32
 
-	// Type of message
+	// Type of message as sent on the wire. For compressed messages this is
+	// OpCompressed, see Type
 	OpCode OpCode
 
 	// Indicates the message was compressed
@@ -41,13 +42,30 @@ type Header struct {
 
 	// Size of the compressed message, if compressed. Otherwise -1
 	CompressedLength int32
+
+	// Opcode of the message before it was compressed, if compressed
+	OriginalOpCode OpCode
+
+	// Compressor used for the message, if compressed
+	CompressorID CompressorID
+
+	// Uncompressed size divided by compressed size, if compressed
+	CompressionRatio float64
 }
 
 func (h *Header) Read(r *bufio.Reader) error {
 	var raw [HeaderLen]byte
 	var d = raw[:]
 	if _, err := io.ReadFull(r, d); err != nil {
-		return fmt.Errorf("header read: %s", err)
+		return &DecodeError{Err: ErrTruncated, Field: "header", Cause: err}
+	}
+	return h.Decode(d)
+}
+
+// Decode the header from the start of a byte slice
+func (h *Header) Decode(d []byte) error {
+	if len(d) < HeaderLen {
+		return &DecodeError{Err: ErrTruncated, Field: "header", Cause: errHeaderNeedMore}
 	}
 	h.MessageLength = DecodeInt32LE(d, 0)
 	h.RequestID = DecodeUint32LE(d, 4)
@@ -57,8 +75,29 @@ func (h *Header) Read(r *bufio.Reader) error {
 	return nil
 }
 
+// Type returns the opcode that determines how the message body is decoded,
+// which for compressed messages is the original opcode.
+func (h *Header) Type() OpCode {
+	if h.Compressed && h.OriginalOpCode != OpInvalid {
+		return h.OriginalOpCode
+	}
+	return h.OpCode
+}
+
 // String representation
 func (h *Header) String() string {
+	if h.Compressed {
+		return fmt.Sprintf("Header{len=%d opcode=%s requestID=%d responseTo=%d comp=%v clen=%d compressor=%s ratio=%.2f}",
+			h.MessageLength,
+			h.Type(),
+			h.RequestID,
+			h.ResponseTo,
+			h.Compressed,
+			h.CompressedLength,
+			h.CompressorID,
+			h.CompressionRatio,
+		)
+	}
 	return fmt.Sprintf("Header{len=%d opcode=%s requestID=%d responseTo=%d comp=%v clen=%d}",
 		h.MessageLength,
 		h.OpCode,
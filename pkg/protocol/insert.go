@@ -1,11 +1,6 @@
 package protocol
 
-import (
-	"bufio"
-	"io"
-
-	"go.mongodb.org/mongo-driver/bson"
-)
+import "bufio"
 
 // InsertFlags ..
 type InsertFlags int32
@@ -21,7 +16,7 @@ type Insert struct {
 	*Header
 	Flags              InsertFlags
 	FullCollectionName string
-	Documents          []bson.D
+	Documents          []*Document
 }
 
 // GetHeader ..
@@ -31,41 +26,46 @@ func (o *Insert) GetHeader() *Header {
 
 // Read an Insert message off the wire
 func (o *Insert) Read(r *bufio.Reader, h *Header) error {
+	b, err := readBody(r, h)
+	if err != nil {
+		return err
+	}
+	return o.Decode(b, h, nil)
+}
+
+// Decode an Insert message body
+func (o *Insert) Decode(b []byte, h *Header, opts *DecodeOptions) error {
 	o.Header = h
 
-	var raw [4]byte
-	d := raw[:]
+	p := newBuffer(b, h, opts)
 
 	// Decode flags
-	if _, err := io.ReadFull(r, d); err != nil {
+	flags, err := p.int32("flags")
+	if err != nil {
 		return err
 	}
-	o.Flags = InsertFlags(DecodeInt32LE(d, 0))
+	o.Flags = InsertFlags(flags)
 
 	// Decode full collection name
-	name, err := cstring(r)
-	if err != nil {
+	if o.FullCollectionName, err = p.cstring("fullCollectionName"); err != nil {
 		return err
 	}
-	o.FullCollectionName = name
 
 	// Decode one or more documents
-	docs := []bson.D{}
-	sz := int(h.MessageLength) - HeaderLen - len(name) - 1
-	for sz > 0 {
-		doc, length, err := document(r)
+	docs := []*Document{}
+	for p.remaining() > 0 {
+		doc, err := p.decodeDocument("documents")
 		if err != nil {
 			return err
 		}
 		docs = append(docs, doc)
-		sz -= length
 	}
 	o.Documents = docs
 
-	return nil
+	return p.done()
 }
 
-// String representation
+// String summarizes the op, see Summary
 func (o *Insert) String() string {
-	return o.Header.String()
+	return Summary(o, MaxStringLength)
 }
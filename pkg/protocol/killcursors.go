@@ -1,9 +1,6 @@
 package protocol
 
-import (
-	"bufio"
-	"io"
-)
+import "bufio"
 
 // KillCursors ..
 type KillCursors struct {
@@ -19,34 +16,46 @@ func (o *KillCursors) GetHeader() *Header {
 
 // Read a KillCursors message off the wire
 func (o *KillCursors) Read(r *bufio.Reader, h *Header) error {
+	b, err := readBody(r, h)
+	if err != nil {
+		return err
+	}
+	return o.Decode(b, h, nil)
+}
+
+// Decode a KillCursors message body
+func (o *KillCursors) Decode(b []byte, h *Header, opts *DecodeOptions) error {
 	o.Header = h
 
-	var raw [8]byte
-	d := raw[:]
+	p := newBuffer(b, h, opts)
+
+	// Skip reserved field
+	if _, err := p.next(4, "ZERO"); err != nil {
+		return err
+	}
 
 	// Decode number of cursor ids
-	if _, err := io.ReadFull(r, d); err != nil {
+	n, err := p.int32("numberOfCursorIDs")
+	if err != nil {
 		return err
 	}
-	o.NumberOfCursorIDs = DecodeInt32LE(d, 4)
+	o.NumberOfCursorIDs = n
 
 	// Decode cursor ids
-	n := int(o.NumberOfCursorIDs)
 	ids := []int64{}
-	for n > 0 {
-		if _, err := io.ReadFull(r, d); err != nil {
+	for ; n > 0; n-- {
+		id, err := p.int64("cursorIDs")
+		if err != nil {
 			return err
 		}
-		id := decodeInt64LE(d, 0)
 		ids = append(ids, id)
-		n -= 8
 	}
 	o.CursorIDs = ids
 
-	return nil
+	return p.done()
 }
 
-// String representation
+// String summarizes the op, see Summary
 func (o *KillCursors) String() string {
-	return o.Header.String()
+	return Summary(o, MaxStringLength)
 }
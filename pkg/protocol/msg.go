@@ -3,9 +3,9 @@ package protocol
 import (
 	"bufio"
 	"fmt"
-	"io"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
 )
 
 // Msg flags ..
@@ -25,7 +25,7 @@ type MsgFlags uint32
 type Msg struct {
 	*Header
 	Flags    MsgFlags
-	Body     bson.D
+	Body     *Document
 	Sections []*Section
 	Checksum uint32
 }
@@ -53,77 +53,113 @@ func (o *Msg) GetHeader() *Header {
 
 // Read an OP_MSG message
 func (o *Msg) Read(r *bufio.Reader, h *Header) error {
+	b, err := readBody(r, h)
+	if err != nil {
+		return err
+	}
+	return o.Decode(b, h, nil)
+}
+
+// Decode an OP_MSG message body
+func (o *Msg) Decode(b []byte, h *Header, opts *DecodeOptions) error {
 	o.Header = h
 
-	var length int
-	var raw [4]byte
-	var d = raw[:]
+	p := newBuffer(b, h, opts)
 
 	// Decode flags
-	if _, err := io.ReadFull(r, d); err != nil {
-		return fmt.Errorf("op_msg read flags: %s", err)
+	flags, err := p.uint32("flagBits")
+	if err != nil {
+		return err
 	}
-	o.Flags = MsgFlags(DecodeUint32LE(d, 0))
+	o.Flags = MsgFlags(flags)
 
-	// Track the remaining bytes in this message
-	sz := int(h.MessageLength) - HeaderLen - 4
-	for sz > 0 {
+	for p.remaining() > 0 {
 
 		// If we expect a checksum at the end of the message, see if we have 4 bytes left
-		if sz == 4 && (o.Flags&MsgFlagChecksumPresent) != 0 {
-			if _, err := io.ReadFull(r, d); err != nil {
-				return fmt.Errorf("op_msg read checksum sz=%d %s", sz, err)
+		if p.remaining() == 4 && (o.Flags&MsgFlagChecksumPresent) != 0 {
+			if o.Checksum, err = p.uint32("checksum"); err != nil {
+				return err
 			}
-			o.Checksum = DecodeUint32LE(d, 0)
-			sz -= 4
 			break
 		}
 
 		// Determine kind of section
-		kind, err := r.ReadByte()
+		off := p.off
+		kind, err := p.byte("section.kind")
 		if err != nil {
-			return fmt.Errorf("op_msg read section kind byte sz=%d %s", sz, err)
+			return err
 		}
-		sz--
 
 		// Decode section(s)
 		switch kind {
 
 		case SectionKindBody:
 			// Decode section body
-			o.Body, length, err = document(r)
+			o.Body, err = p.decodeDocument("section.body")
 			if err != nil {
-				return fmt.Errorf("op_msg read document byte sz=%d %s", sz, err)
+				return err
 			}
-			sz -= length
 
 		case SectionKindDocSeq:
-			// Decode document sequence
-			if _, err := io.ReadFull(r, d); err != nil {
-				return fmt.Errorf("op_msg read doc seq size sz=%d %s", sz, err)
+			// Decode document sequence size, which includes the size itself
+			size, err := p.int32("section.size")
+			if err != nil {
+				return err
 			}
-
-			// Decode section size
-			size := int(DecodeInt32LE(d, 0))
-
-			// TODO: decode section object sequence
-
-			// NOTE: I haven't seen any of these in our packet traces so I have not
-			// yet bothered to decode it.
-			_, err = r.Discard(size - 4)
+			seq, err := p.next(int(size)-4, "section.documents")
 			if err != nil {
-				return fmt.Errorf("op_msg doc seq discard size=%d sz=%d %s", size-4, sz, err)
+				return err
 			}
 
-			sz -= size
-			break
+			// Decode the sequence identifier. The documents that follow are
+			// kept as raw bytes.
+			q := p.sub(seq, p.off-len(seq))
+			id, err := q.cstring("section.identifier")
+			if err != nil {
+				return err
+			}
+			o.Sections = append(o.Sections, &Section{
+				Size:    size,
+				Seq:     id,
+				Objects: seq[q.off:],
+			})
+
+		default:
+			return p.error(ErrBadSection, "section.kind", off, fmt.Errorf("kind %d", kind))
 		}
 
 	}
+	return p.done()
+}
+
+// Sequence returns the documents in the document sequence section with the
+// given identifier, or nil if there is no such section.
+func (o *Msg) Sequence(id string) []*Document {
+	for _, s := range o.Sections {
+		if s.Seq == id {
+			return s.Documents()
+		}
+	}
 	return nil
 }
 
-// String representation
+// Documents splits the section's objects into documents, stopping at the
+// first malformed one.
+func (s *Section) Documents() []*Document {
+	var docs []*Document
+	rest := s.Objects
+	for len(rest) > 0 {
+		doc, tail, ok := bsoncore.ReadDocument(rest)
+		if !ok {
+			break
+		}
+		docs = append(docs, NewDocument(bson.Raw(doc)))
+		rest = tail
+	}
+	return docs
+}
+
+// String summarizes the op, see Summary
 func (o *Msg) String() string {
-	return o.Header.String()
+	return Summary(o, MaxStringLength)
 }
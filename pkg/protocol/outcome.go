@@ -0,0 +1,128 @@
+package protocol
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// CodeCursorNotFound is the error code the database uses for an unknown cursor
+const CodeCursorNotFound = 43
+
+// Outcome describes whether the request a reply responds to succeeded, and
+// why it failed if it did not.
+type Outcome struct {
+	OK bool // the reply reported success, although individual writes may have failed
+
+	// The top-level error if there is one, otherwise the write concern error,
+	// otherwise the first write error.
+	Code     int64
+	CodeName string
+	Message  string
+
+	WriteErrors       int  // number of entries in writeErrors
+	WriteConcernError bool // the reply carried a writeConcernError
+	ErrorLabels       []string
+}
+
+// OutcomeOf returns the outcome carried by a response op, or nil if the op is
+// not a response.
+func OutcomeOf(op Op) *Outcome {
+	switch o := op.(type) {
+	case *Msg:
+		if o.ResponseTo == 0 || o.Body == nil {
+			return nil
+		}
+		return DocumentOutcome(o.Body)
+
+	case *Reply:
+		var out *Outcome
+		if len(o.Documents) > 0 {
+			out = DocumentOutcome(o.Documents[0])
+		} else {
+			out = &Outcome{OK: true}
+		}
+		if o.Flags&ReplyFlagQueryFailure != 0 {
+			out.OK = false
+		}
+		if o.Flags&ReplyFlagCursorNotFound != 0 {
+			out.OK = false
+			if out.Code == 0 {
+				out.Code = CodeCursorNotFound
+				out.CodeName = "CursorNotFound"
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// DocumentOutcome extracts the outcome from a reply document. Only command
+// replies, which carry ok, report error codes and write errors. Other
+// documents, such as legacy query results, succeed unless they carry $err,
+// so that fields named code or errmsg in a user's documents are ignored.
+func DocumentOutcome(doc *Document) *Outcome {
+	out := &Outcome{}
+
+	ok, found := IntValue(doc.Lookup("ok"))
+	if !found {
+		// A legacy query failure
+		if v := doc.Lookup("$err"); !v.IsZero() {
+			out.Message, _ = v.StringValueOK()
+			out.Code, _ = IntValue(doc.Lookup("code"))
+			return out
+		}
+		out.OK = true
+		return out
+	}
+	out.OK = ok != 0
+
+	out.Code, _ = IntValue(doc.Lookup("code"))
+	out.CodeName, _ = doc.Lookup("codeName").StringValueOK()
+	out.Message, _ = doc.Lookup("errmsg").StringValueOK()
+
+	// Fall back to the write concern error, then the first write error
+	if wce, found := doc.Lookup("writeConcernError").DocumentOK(); found {
+		out.WriteConcernError = true
+		out.fallback(NewDocument(wce))
+	}
+	if arr, found := doc.Lookup("writeErrors").ArrayOK(); found {
+		vals, _ := arr.Values()
+		out.WriteErrors = len(vals)
+		if len(vals) > 0 {
+			if we, found := vals[0].DocumentOK(); found {
+				out.fallback(NewDocument(we))
+			}
+		}
+	}
+
+	out.ErrorLabels = stringValues(doc.Lookup("errorLabels"))
+	return out
+}
+
+// Take the error from a nested error document if there isn't one yet
+func (o *Outcome) fallback(doc *Document) {
+	if o.Code != 0 || o.Message != "" {
+		return
+	}
+	o.Code, _ = IntValue(doc.Lookup("code"))
+	o.CodeName, _ = doc.Lookup("codeName").StringValueOK()
+	o.Message, _ = doc.Lookup("errmsg").StringValueOK()
+}
+
+// HasError checks if the reply reported any error, including write errors
+func (o *Outcome) HasError() bool {
+	return !o.OK || o.WriteErrors > 0 || o.WriteConcernError
+}
+
+// IntValue converts a numeric BSON value to an int64
+func IntValue(v bson.RawValue) (int64, bool) {
+	switch v.Type {
+	case bsontype.Int32:
+		return int64(v.Int32()), true
+	case bsontype.Int64:
+		return v.Int64(), true
+	case bsontype.Double:
+		return int64(v.Double()), true
+	}
+	return 0, false
+}
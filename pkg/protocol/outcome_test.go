@@ -0,0 +1,78 @@
+package protocol
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestOutcomeOf(t *testing.T) {
+	dupKey := bson.D{{Key: "index", Value: int32(0)}, {Key: "code", Value: int32(11000)}, {Key: "errmsg", Value: "dup key"}}
+
+	tests := []struct {
+		name    string
+		op      OpCode
+		flags   ReplyFlags
+		doc     bson.D
+		want    Outcome
+		isError bool
+	}{
+		{"msg ok", OpMsg, 0, bson.D{{Key: "ok", Value: 1.0}},
+			Outcome{OK: true}, false},
+		{"msg write error", OpMsg, 0,
+			bson.D{{Key: "ok", Value: 1.0}, {Key: "writeErrors", Value: bson.A{dupKey}}},
+			Outcome{OK: true, Code: 11000, Message: "dup key", WriteErrors: 1}, true},
+		{"msg command error", OpMsg, 0,
+			bson.D{{Key: "ok", Value: 0.0}, {Key: "code", Value: int32(251)}, {Key: "codeName", Value: "NoSuchTransaction"},
+				{Key: "errmsg", Value: "no txn"}, {Key: "errorLabels", Value: bson.A{"TransientTransactionError"}}},
+			Outcome{Code: 251, CodeName: "NoSuchTransaction", Message: "no txn", ErrorLabels: []string{"TransientTransactionError"}}, true},
+		{"msg write concern error", OpMsg, 0,
+			bson.D{{Key: "ok", Value: 1.0}, {Key: "writeConcernError", Value: bson.D{{Key: "code", Value: int32(64)}, {Key: "errmsg", Value: "timeout"}}}},
+			Outcome{OK: true, Code: 64, Message: "timeout", WriteConcernError: true}, true},
+
+		// Legacy command replies carry ok, while query results don't
+		{"reply command error", OpReply, 0,
+			bson.D{{Key: "ok", Value: 0.0}, {Key: "code", Value: int32(13)}, {Key: "errmsg", Value: "unauthorized"}},
+			Outcome{Code: 13, Message: "unauthorized"}, true},
+		{"reply query result", OpReply, 0,
+			bson.D{{Key: "_id", Value: int32(1)}, {Key: "code", Value: int32(500)}, {Key: "errmsg", Value: "user data"},
+				{Key: "writeErrors", Value: bson.A{dupKey}}},
+			Outcome{OK: true}, false},
+		{"reply query failure", OpReply, ReplyFlagQueryFailure,
+			bson.D{{Key: "$err", Value: "bad query"}, {Key: "code", Value: int32(2)}},
+			Outcome{Code: 2, Message: "bad query"}, true},
+		{"reply cursor not found", OpReply, ReplyFlagCursorNotFound, nil,
+			Outcome{Code: CodeCursorNotFound, CodeName: "CursorNotFound"}, true},
+	}
+	for _, tt := range tests {
+		var op Op
+		h := &Header{OpCode: tt.op, ResponseTo: 1}
+		var doc *Document
+		if tt.doc != nil {
+			raw, err := bson.Marshal(tt.doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			doc = NewDocument(raw)
+		}
+		if tt.op == OpMsg {
+			op = &Msg{Header: h, Body: doc}
+		} else {
+			r := &Reply{Header: h, Flags: tt.flags}
+			if doc != nil {
+				r.Documents = []*Document{doc}
+			}
+			op = r
+		}
+
+		out := OutcomeOf(op)
+		if out.OK != tt.want.OK || out.Code != tt.want.Code || out.CodeName != tt.want.CodeName ||
+			out.Message != tt.want.Message || out.WriteErrors != tt.want.WriteErrors ||
+			out.WriteConcernError != tt.want.WriteConcernError || len(out.ErrorLabels) != len(tt.want.ErrorLabels) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, out, tt.want)
+		}
+		if out.HasError() != tt.isError {
+			t.Errorf("%s: HasError %v, want %v", tt.name, out.HasError(), tt.isError)
+		}
+	}
+}
@@ -2,7 +2,6 @@ package protocol
 
 import (
 	"bufio"
-	"bytes"
 	"fmt"
 )
 
@@ -13,33 +12,79 @@ import (
 type Op interface {
 	GetHeader() *Header
 	Read(r *bufio.Reader, h *Header) error
+	Decode(b []byte, h *Header, opts *DecodeOptions) error
 	String() string
 }
 
 // Read a single Op
 func Read(r *bufio.Reader) (Op, error) {
+	return ReadWithOptions(r, nil)
+}
+
+// ReadWithOptions reads a single Op, decoding it with the given options
+func ReadWithOptions(r *bufio.Reader, opts *DecodeOptions) (Op, error) {
 	h := &Header{
 		CompressedLength: -1,
 	}
 
 	if err := h.Read(r); err != nil {
-		return nil, fmt.Errorf("header: %s", err)
+		return nil, err
+	}
+
+	// Read the entire message body so exactly MessageLength bytes are consumed
+	// from the reader, even if the body fails to decode.
+	body, err := readBody(r, h)
+	if err != nil {
+		return nil, err
+	}
+	return decode(body, h, opts)
+}
+
+// Decode a single Op from a byte slice holding at least one complete message.
+// Decoded strings and documents may reference the slice, so it must not be
+// modified while the Op is in use.
+func Decode(b []byte) (Op, error) {
+	return DecodeWithOptions(b, nil)
+}
+
+// DecodeWithOptions decodes a single Op from a byte slice with the given options
+func DecodeWithOptions(b []byte, opts *DecodeOptions) (Op, error) {
+	h := &Header{
+		CompressedLength: -1,
+	}
+
+	if err := h.Decode(b); err != nil {
+		return nil, err
 	}
 
+	n := int(h.MessageLength)
+	if n < HeaderLen || n > MaxMessageSize {
+		return nil, &DecodeError{Err: ErrBadLength, OpCode: h.OpCode, Field: "messageLength",
+			Cause: fmt.Errorf("message length %d", n)}
+	}
+	if n > len(b) {
+		return nil, &DecodeError{Err: ErrTruncated, OpCode: h.OpCode, Offset: len(b), Field: "body",
+			Cause: fmt.Errorf("message length %d, have %d bytes", n, len(b))}
+	}
+	return decode(b[HeaderLen:n], h, opts)
+}
+
+// Decode the message body following the header
+func decode(body []byte, h *Header, opts *DecodeOptions) (Op, error) {
 	if h.Compressed {
 		// Decode the compression header and decompress the message bytes
-		data, err := Decompress(r, h)
+		data, err := DecompressBytes(body, h)
 		if err != nil {
-			return nil, fmt.Errorf("decompress: %s", err)
+			return nil, err
 		}
-		// Read from the uncompressed buffer
+		// Decode from the uncompressed buffer
 		h.CompressedLength = h.MessageLength
-		h.MessageLength = int32(len(data))
-		r = bufio.NewReader(bytes.NewReader(data))
+		h.MessageLength = int32(HeaderLen + len(data))
+		body = data
 	}
 
 	var o Op
-	switch h.OpCode {
+	switch h.Type() {
 	case OpReply:
 		o = &Reply{}
 	case OpUpdate:
@@ -58,17 +103,11 @@ func Read(r *bufio.Reader) (Op, error) {
 		o = &Msg{}
 
 	default:
-		// Discard the unknown message's body, but only if we haven't read it yet.
-		if !h.Compressed {
-			sz := int(h.MessageLength) - HeaderLen
-			if _, err := r.Discard(sz); err != nil {
-				return nil, fmt.Errorf("discard %s  %d - %d: %s", h, h.MessageLength, HeaderLen, err)
-			}
-		}
-		return nil, fmt.Errorf("unsupported opcode %d message size %d", h.OpCode, h.MessageLength)
+		return nil, &DecodeError{Err: ErrUnknownOpCode, OpCode: h.Type(), Offset: 12, Field: "opCode",
+			Cause: fmt.Errorf("opcode %d message size %d", int32(h.Type()), h.MessageLength)}
 	}
 
-	err := o.Read(r, h)
+	err := o.Decode(body, h, opts)
 	if err != nil {
 		return nil, err
 	}
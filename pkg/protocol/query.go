@@ -1,12 +1,6 @@
 package protocol
 
-import (
-	"bufio"
-	"fmt"
-	"io"
-
-	"go.mongodb.org/mongo-driver/bson"
-)
+import "bufio"
 
 // QueryFlags ..
 type QueryFlags int32
@@ -31,8 +25,8 @@ type Query struct {
 	FullCollectionName   string
 	NumberToSkip         int32
 	NumberToReturn       int32
-	Query                bson.D
-	ReturnFieldsSelector bson.D
+	Query                *Document
+	ReturnFieldsSelector *Document
 }
 
 // GetHeader ..
@@ -42,57 +36,54 @@ func (o *Query) GetHeader() *Header {
 
 // Read a Query message off the wire
 func (o *Query) Read(r *bufio.Reader, h *Header) error {
+	b, err := readBody(r, h)
+	if err != nil {
+		return err
+	}
+	return o.Decode(b, h, nil)
+}
+
+// Decode a Query message body
+func (o *Query) Decode(b []byte, h *Header, opts *DecodeOptions) error {
 	o.Header = h
 
-	var length int
-	var raw [8]byte
-	var d = raw[:]
+	p := newBuffer(b, h, opts)
 
 	// Decode flags
-	if _, err := io.ReadFull(r, d[:4]); err != nil {
-		return fmt.Errorf("op_msg flags %s", err)
+	flags, err := p.int32("flags")
+	if err != nil {
+		return err
 	}
-	o.Flags = QueryFlags(DecodeInt32LE(d, 0))
+	o.Flags = QueryFlags(flags)
 
 	// Decode full collection name
-	name, err := cstring(r)
-	if err != nil {
-		return fmt.Errorf("op_msg cstring %s", err)
+	if o.FullCollectionName, err = p.cstring("fullCollectionName"); err != nil {
+		return err
 	}
-	o.FullCollectionName = name
 
 	// Decode skip/return fields
-	if _, err := io.ReadFull(r, d); err != nil {
-		return fmt.Errorf("op_msg skip/return %s", err)
+	if o.NumberToSkip, err = p.int32("numberToSkip"); err != nil {
+		return err
+	}
+	if o.NumberToReturn, err = p.int32("numberToReturn"); err != nil {
+		return err
 	}
-	o.NumberToSkip = DecodeInt32LE(d, 0)
-	o.NumberToReturn = DecodeInt32LE(d, 4)
 
 	// Decode the bson document
-	o.Query, length, err = document(r)
-	if err != nil {
-		return fmt.Errorf("op_msg query %s", err)
+	if o.Query, err = p.decodeDocument("query"); err != nil {
+		return err
 	}
 
-	// Track the remaining bytes in this message
-	sz := int(h.MessageLength) -
-		HeaderLen - // header
-		4 - // flags
-		4 - // skip
-		4 - // return
-		len(name) - 1 - // name and null byte
-		length // query document length
-
 	// If some message remains, read the optional returnFieldsSelector document
-	if sz > 0 {
-		if o.ReturnFieldsSelector, _, err = document(r); err != nil {
-			return fmt.Errorf("op_msg return fields document %d %s", sz, err)
+	if p.remaining() > 0 {
+		if o.ReturnFieldsSelector, err = p.decodeDocument("returnFieldsSelector"); err != nil {
+			return err
 		}
 	}
-	return nil
+	return p.done()
 }
 
-// String representation
+// String summarizes the op, see Summary
 func (o *Query) String() string {
-	return o.Header.String()
+	return Summary(o, MaxStringLength)
 }
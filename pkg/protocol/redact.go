@@ -0,0 +1,225 @@
+package protocol
+
+import (
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// Redacted replaces the values removed from a document
+const Redacted = "REDACTED"
+
+// Redact replaces the values at the given dotted key paths with Redacted.
+// Paths that don't exist in the document are ignored.
+func (d *Document) Redact(paths ...string) {
+	if len(paths) == 0 {
+		return
+	}
+	split := make([][]string, len(paths))
+	for i, p := range paths {
+		split[i] = strings.Split(p, ".")
+	}
+	if raw, changed := redact(d.raw, split); changed {
+		d.raw = raw
+		d.doc = nil
+	}
+}
+
+// Copy a document, replacing the values at the key paths. The original
+// document is returned if nothing was replaced.
+func redact(raw bson.Raw, paths [][]string) (bson.Raw, bool) {
+	elems, err := raw.Elements()
+	if err != nil {
+		return raw, false
+	}
+
+	changed := false
+	idx, dst := bsoncore.AppendDocumentStart(nil)
+	for _, e := range elems {
+		key := e.Key()
+		matched := false
+		var sub [][]string
+		for _, p := range paths {
+			if p[0] != key {
+				continue
+			}
+			if len(p) == 1 {
+				matched = true
+			} else {
+				sub = append(sub, p[1:])
+			}
+		}
+
+		if matched {
+			dst = bsoncore.AppendStringElement(dst, key, Redacted)
+			changed = true
+			continue
+		}
+		if v := e.Value(); sub != nil && v.Type == bsontype.EmbeddedDocument {
+			if doc, ok := redact(v.Document(), sub); ok {
+				dst = bsoncore.AppendDocumentElement(dst, key, doc)
+				changed = true
+				continue
+			}
+		}
+		dst = append(dst, e...)
+	}
+	if !changed {
+		return raw, false
+	}
+	dst, _ = bsoncore.AppendDocumentEnd(dst, idx)
+	return dst, true
+}
+
+// RewriteFunc returns the replacement for a value in a document, given the
+// keys leading to it. Array elements are keyed by their index. Returning
+// false keeps the value.
+type RewriteFunc func(path []string, v bson.RawValue) (bson.RawValue, bool)
+
+// Rewrite returns a copy of the document with each value other than
+// documents and arrays passed through fn. Documents and arrays keep their
+// structure. The document itself is returned if nothing was replaced.
+func (d *Document) Rewrite(fn RewriteFunc) *Document {
+	raw, changed := rewrite(d.raw, nil, fn)
+	if !changed {
+		return d
+	}
+	return NewDocument(raw)
+}
+
+func rewrite(raw bson.Raw, path []string, fn RewriteFunc) (bson.Raw, bool) {
+	elems, err := raw.Elements()
+	if err != nil {
+		return raw, false
+	}
+
+	changed := false
+	idx, dst := bsoncore.AppendDocumentStart(nil)
+	for _, e := range elems {
+		key := e.Key()
+		v := e.Value()
+		p := append(path[:len(path):len(path)], key)
+
+		switch v.Type {
+		case bsontype.EmbeddedDocument, bsontype.Array:
+			if sub, ok := rewrite(v.Value, p, fn); ok {
+				dst = bsoncore.AppendHeader(dst, v.Type, key)
+				dst = append(dst, sub...)
+				changed = true
+				continue
+			}
+		default:
+			if r, ok := fn(p, v); ok {
+				dst = bsoncore.AppendHeader(dst, r.Type, key)
+				dst = append(dst, r.Value...)
+				changed = true
+				continue
+			}
+		}
+		dst = append(dst, e...)
+	}
+	if !changed {
+		return raw, false
+	}
+	dst, _ = bsoncore.AppendDocumentEnd(dst, idx)
+	return dst, true
+}
+
+// MapDocuments returns a copy of an op with each of its documents replaced
+// by the result of fn. The documents of a document sequence section are
+// passed with the section's identifier, other documents with an empty one.
+func MapDocuments(op Op, fn func(d *Document, seq string) *Document) Op {
+	docs := func(in []*Document, seq string) []*Document {
+		out := make([]*Document, len(in))
+		for i, d := range in {
+			out[i] = fn(d, seq)
+		}
+		return out
+	}
+	doc := func(d *Document) *Document {
+		if d == nil {
+			return nil
+		}
+		return fn(d, "")
+	}
+
+	switch o := op.(type) {
+	case *Msg:
+		c := *o
+		c.Body = doc(o.Body)
+		c.Sections = nil
+		for _, s := range o.Sections {
+			var objs []byte
+			for _, d := range docs(s.Documents(), s.Seq) {
+				objs = append(objs, d.Raw()...)
+			}
+			c.Sections = append(c.Sections, &Section{
+				Size:    int32(4 + len(s.Seq) + 1 + len(objs)),
+				Seq:     s.Seq,
+				Objects: objs,
+			})
+		}
+		return &c
+	case *Query:
+		c := *o
+		c.Query = doc(o.Query)
+		c.ReturnFieldsSelector = doc(o.ReturnFieldsSelector)
+		return &c
+	case *Reply:
+		c := *o
+		c.Documents = docs(o.Documents, "")
+		return &c
+	case *Insert:
+		c := *o
+		c.Documents = docs(o.Documents, "")
+		return &c
+	case *Update:
+		c := *o
+		c.Selector = doc(o.Selector)
+		c.Update = doc(o.Update)
+		return &c
+	case *Delete:
+		c := *o
+		c.Selector = doc(o.Selector)
+		return &c
+	}
+	return op
+}
+
+// EachDocument calls fn with each document of an op, in the order MapDocuments
+// passes them.
+func EachDocument(op Op, fn func(d *Document, seq string)) {
+	each := func(d *Document, seq string) {
+		if d != nil {
+			fn(d, seq)
+		}
+	}
+
+	switch o := op.(type) {
+	case *Msg:
+		each(o.Body, "")
+		for _, s := range o.Sections {
+			for _, d := range s.Documents() {
+				each(d, s.Seq)
+			}
+		}
+	case *Query:
+		each(o.Query, "")
+		each(o.ReturnFieldsSelector, "")
+	case *Reply:
+		for _, d := range o.Documents {
+			each(d, "")
+		}
+	case *Insert:
+		for _, d := range o.Documents {
+			each(d, "")
+		}
+	case *Update:
+		each(o.Selector, "")
+		each(o.Update, "")
+	case *Delete:
+		each(o.Selector, "")
+	}
+}
@@ -1,11 +1,6 @@
 package protocol
 
-import (
-	"bufio"
-	"io"
-
-	"go.mongodb.org/mongo-driver/bson"
-)
+import "bufio"
 
 // ReplyFlags ..
 type ReplyFlags int32
@@ -26,7 +21,7 @@ type Reply struct {
 	CursorID       int64
 	StartingFrom   int32
 	NumberReturned int32
-	Documents      []bson.D
+	Documents      []*Document
 }
 
 // GetHeader ..
@@ -36,13 +31,22 @@ func (o *Reply) GetHeader() *Header {
 
 // Read a Reply message off the wire
 func (o *Reply) Read(r *bufio.Reader, h *Header) error {
+	b, err := readBody(r, h)
+	if err != nil {
+		return err
+	}
+	return o.Decode(b, h, nil)
+}
+
+// Decode a Reply message body
+func (o *Reply) Decode(b []byte, h *Header, opts *DecodeOptions) error {
 	o.Header = h
 
-	var raw [20]byte
-	d := raw[:]
+	p := newBuffer(b, h, opts)
 
 	// Decode batch of int fields
-	if _, err := io.ReadFull(r, d); err != nil {
+	d, err := p.next(20, "responseFlags")
+	if err != nil {
 		return err
 	}
 
@@ -54,9 +58,9 @@ func (o *Reply) Read(r *bufio.Reader, h *Header) error {
 
 	// Decode documents
 	n := int(o.NumberReturned)
-	docs := []bson.D{}
+	docs := []*Document{}
 	for n > 0 {
-		doc, _, err := document(r)
+		doc, err := p.decodeDocument("documents")
 		if err != nil {
 			return err
 		}
@@ -65,10 +69,10 @@ func (o *Reply) Read(r *bufio.Reader, h *Header) error {
 	}
 	o.Documents = docs
 
-	return nil
+	return p.done()
 }
 
-// String representation
+// String summarizes the op, see Summary
 func (o *Reply) String() string {
-	return o.Header.String()
+	return Summary(o, MaxStringLength)
 }
@@ -0,0 +1,245 @@
+package protocol
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// Shape is the structure of a query with its literal values replaced by
+// type placeholders, so that the same query run with different values has
+// the same shape.
+type Shape struct {
+	Command   string // find, aggregate, update, delete, count, distinct, or query for a legacy OP_QUERY
+	Namespace string
+	Shape     string // the normalized query as relaxed extended JSON
+	Hash      string // stable hash of the command, namespace and shape
+}
+
+// ShapeOf returns the shape of a query sent by a request op, or nil if the
+// op is not a query.
+func ShapeOf(op Op) *Shape {
+	if q, ok := op.(*Query); ok && q.Query != nil && !strings.HasSuffix(q.FullCollectionName, ".$cmd") {
+		return newShape("query", q.FullCollectionName, legacyShape(q))
+	}
+
+	cmd := CommandOf(op)
+	if cmd == nil {
+		return nil
+	}
+	body := cmd.Body
+
+	var d bson.D
+	switch cmd.Name {
+	case "find":
+		d = shapeFields(body, "filter", "sort", "projection")
+	case "aggregate":
+		d = shapeFields(body, "pipeline")
+	case "count":
+		d = shapeFields(body, "query")
+	case "distinct":
+		d = shapeFields(body, "key", "query")
+	case "update":
+		if stmt := firstStatement(op, body, "updates"); stmt != nil {
+			d = shapeFields(stmt, "q", "u", "multi", "upsert")
+		}
+	case "delete":
+		if stmt := firstStatement(op, body, "deletes"); stmt != nil {
+			d = shapeFields(stmt, "q", "limit")
+		}
+	default:
+		return nil
+	}
+	return newShape(cmd.Name, cmd.Namespace(), d)
+}
+
+func newShape(command, ns string, d bson.D) *Shape {
+	if d == nil {
+		d = bson.D{}
+	}
+	b, err := bson.MarshalExtJSON(d, false, false)
+	if err != nil {
+		return nil
+	}
+	h := fnv.New64a()
+	h.Write([]byte(command + "\x00" + ns + "\x00"))
+	h.Write(b)
+	return &Shape{
+		Command:   command,
+		Namespace: ns,
+		Shape:     string(b),
+		Hash:      fmt.Sprintf("%016x", h.Sum64()),
+	}
+}
+
+// Legacy queries may wrap the filter to add modifiers such as $orderby
+func legacyShape(q *Query) bson.D {
+	filter := q.Query.Raw()
+	var sort bson.RawValue
+	switch key := q.Query.FirstKey(); key {
+	case "$query", "query":
+		if v, ok := q.Query.Lookup(key).DocumentOK(); ok {
+			filter = v
+			sort = q.Query.Lookup("$orderby")
+			if sort.IsZero() {
+				sort = q.Query.Lookup("orderby")
+			}
+		}
+	}
+
+	d := bson.D{{Key: "filter", Value: normalize(bson.RawValue{Type: bsontype.EmbeddedDocument, Value: filter}, false)}}
+	if !sort.IsZero() {
+		d = append(d, bson.E{Key: "sort", Value: sort})
+	}
+	if q.ReturnFieldsSelector != nil {
+		d = append(d, bson.E{Key: "projection", Value: q.ReturnFieldsSelector.Raw()})
+	}
+	return d
+}
+
+// The first statement of a write command, which may be sent in the body or
+// in a document sequence
+func firstStatement(op Op, body *Document, key string) *Document {
+	if arr, ok := body.Lookup(key).ArrayOK(); ok {
+		if v, err := arr.IndexErr(0); err == nil {
+			if doc, ok := v.Value().DocumentOK(); ok {
+				return NewDocument(doc)
+			}
+		}
+		return nil
+	}
+	if m, ok := op.(*Msg); ok {
+		if docs := m.Sequence(key); len(docs) > 0 {
+			return docs[0]
+		}
+	}
+	return nil
+}
+
+// Fields whose values describe structure rather than data, and are kept
+// as they are
+var structural = map[string]bool{
+	"sort":       true,
+	"projection": true,
+	"key":        true,
+	"multi":      true,
+	"upsert":     true,
+	"limit":      true,
+}
+
+// Pipeline stages whose specifications are kept as they are
+var structuralStages = map[string]bool{
+	"$sort":    true,
+	"$project": true,
+}
+
+// Normalize the named fields of a command, in the order given
+func shapeFields(doc *Document, keys ...string) bson.D {
+	var d bson.D
+	for _, key := range keys {
+		v := doc.Lookup(key)
+		switch {
+		case v.IsZero():
+			continue
+		case structural[key]:
+			d = append(d, bson.E{Key: key, Value: v})
+		case key == "pipeline" || (key == "u" && v.Type == bsontype.Array):
+			d = append(d, bson.E{Key: key, Value: normalizePipeline(v)})
+		default:
+			d = append(d, bson.E{Key: key, Value: normalize(v, false)})
+		}
+	}
+	return d
+}
+
+// Normalize each stage of an aggregation pipeline
+func normalizePipeline(v bson.RawValue) interface{} {
+	arr, ok := v.ArrayOK()
+	if !ok {
+		return normalize(v, true)
+	}
+	vals, _ := arr.Values()
+	stages := bson.A{}
+	for _, stage := range vals {
+		doc, ok := stage.DocumentOK()
+		if !ok {
+			stages = append(stages, normalize(stage, true))
+			continue
+		}
+		e, err := doc.IndexErr(0)
+		if err == nil && structuralStages[e.Key()] {
+			stages = append(stages, doc)
+			continue
+		}
+		stages = append(stages, normalize(stage, true))
+	}
+	return stages
+}
+
+// Replace the literal values in a query with placeholders for their types.
+// Arrays of documents, as used by $and and $or, keep their structure, while
+// other arrays are replaced entirely. Query fields are sorted, since their
+// order doesn't change what matches. In aggregation expressions, strings
+// starting with $ are field paths or variables and are kept, as is the
+// order of fields.
+func normalize(v bson.RawValue, agg bool) interface{} {
+	switch v.Type {
+	case bsontype.EmbeddedDocument:
+		elems, _ := v.Document().Elements()
+		d := bson.D{}
+		for _, e := range elems {
+			d = append(d, bson.E{Key: e.Key(), Value: normalize(e.Value(), agg)})
+		}
+		if !agg {
+			sort.SliceStable(d, func(i, j int) bool { return d[i].Key < d[j].Key })
+		}
+		return d
+
+	case bsontype.Array:
+		vals, _ := v.Array().Values()
+		a := bson.A{}
+		for _, elem := range vals {
+			if elem.Type != bsontype.EmbeddedDocument {
+				return "?array"
+			}
+			a = append(a, normalize(elem, agg))
+		}
+		if len(a) == 0 {
+			return "?array"
+		}
+		return a
+
+	case bsontype.String:
+		if s := v.StringValue(); agg && strings.HasPrefix(s, "$") {
+			return s
+		}
+		return "?string"
+	}
+	return placeholder(v.Type)
+}
+
+func placeholder(t bsontype.Type) string {
+	switch t {
+	case bsontype.Double, bsontype.Int32, bsontype.Int64, bsontype.Decimal128:
+		return "?number"
+	case bsontype.Boolean:
+		return "?bool"
+	case bsontype.DateTime:
+		return "?date"
+	case bsontype.ObjectID:
+		return "?objectId"
+	case bsontype.Null, bsontype.Undefined:
+		return "?null"
+	case bsontype.Regex:
+		return "?regex"
+	case bsontype.Binary:
+		return "?binData"
+	case bsontype.Timestamp:
+		return "?timestamp"
+	}
+	return "?" + t.String()
+}
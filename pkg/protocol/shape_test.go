@@ -0,0 +1,172 @@
+package protocol
+
+import (
+	"fmt"
+	"hash/fnv"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Decode an OP_MSG with a body and an optional document sequence
+func decodeMsg(t testing.TB, body interface{}, seq string, docs ...interface{}) Op {
+	b, err := bson.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := append([]byte{0, 0, 0, 0, SectionKindBody}, b...)
+	if seq != "" {
+		objs := []byte{}
+		for _, d := range docs {
+			o, err := bson.Marshal(d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			objs = append(objs, o...)
+		}
+		sec := make([]byte, 4, 4+len(seq)+1+len(objs))
+		sec = append(append(append(sec, seq...), 0), objs...)
+		putInt32LE(sec, 0, int32(len(sec)))
+		msg = append(append(msg, SectionKindDocSeq), sec...)
+	}
+	op, err := Decode(encodeOp(OpMsg, 1, msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return op
+}
+
+func TestShapeOf(t *testing.T) {
+	find := func(filter bson.D) bson.D {
+		return bson.D{
+			{Key: "find", Value: "orders"},
+			{Key: "filter", Value: filter},
+			{Key: "sort", Value: bson.D{{Key: "created", Value: int32(-1)}, {Key: "_id", Value: int32(1)}}},
+			{Key: "limit", Value: int32(20)},
+			{Key: "$db", Value: "shop"},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		op      Op
+		command string
+		ns      string
+		shape   string
+	}{
+		{"find", decodeMsg(t, find(bson.D{
+			{Key: "status", Value: "open"},
+			{Key: "customer", Value: bson.D{{Key: "$in", Value: bson.A{int32(1), int32(2)}}}},
+		}), ""),
+			"find", "shop.orders",
+			`{"filter":{"customer":{"$in":"?array"},"status":"?string"},"sort":{"created":-1,"_id":1}}`},
+
+		// Different literals and field order give the same shape
+		{"find literals", decodeMsg(t, find(bson.D{
+			{Key: "customer", Value: bson.D{{Key: "$in", Value: bson.A{int64(9)}}}},
+			{Key: "status", Value: "closed"},
+		}), ""),
+			"find", "shop.orders",
+			`{"filter":{"customer":{"$in":"?array"},"status":"?string"},"sort":{"created":-1,"_id":1}}`},
+
+		{"find $or", decodeMsg(t, bson.D{
+			{Key: "find", Value: "orders"},
+			{Key: "filter", Value: bson.D{{Key: "$or", Value: bson.A{
+				bson.D{{Key: "total", Value: bson.D{{Key: "$gt", Value: 10.5}}}},
+				bson.D{{Key: "paid", Value: true}, {Key: "at", Value: nil}},
+			}}}},
+			{Key: "$db", Value: "shop"},
+		}, ""),
+			"find", "shop.orders",
+			`{"filter":{"$or":[{"total":{"$gt":"?number"}},{"at":"?null","paid":"?bool"}]}}`},
+
+		// Field paths are kept in pipelines, and $sort is kept as it is
+		{"aggregate", decodeMsg(t, bson.D{
+			{Key: "aggregate", Value: "orders"},
+			{Key: "pipeline", Value: bson.A{
+				bson.D{{Key: "$match", Value: bson.D{{Key: "status", Value: "open"}}}},
+				bson.D{{Key: "$group", Value: bson.D{{Key: "_id", Value: "$customer"}, {Key: "n", Value: bson.D{{Key: "$sum", Value: int32(1)}}}}}},
+				bson.D{{Key: "$sort", Value: bson.D{{Key: "n", Value: int32(-1)}}}},
+			}},
+			{Key: "cursor", Value: bson.D{}},
+			{Key: "$db", Value: "shop"},
+		}, ""),
+			"aggregate", "shop.orders",
+			`{"pipeline":[{"$match":{"status":"?string"}},{"$group":{"_id":"$customer","n":{"$sum":"?number"}}},{"$sort":{"n":-1}}]}`},
+
+		// The first statement of a write, from a document sequence
+		{"update", decodeMsg(t, bson.D{{Key: "update", Value: "orders"}, {Key: "$db", Value: "shop"}}, "updates",
+			bson.D{
+				{Key: "q", Value: bson.D{{Key: "_id", Value: int32(1)}}},
+				{Key: "u", Value: bson.D{{Key: "$set", Value: bson.D{{Key: "status", Value: "paid"}}}}},
+				{Key: "upsert", Value: true},
+			},
+			bson.D{{Key: "q", Value: bson.D{{Key: "other", Value: int32(2)}}}}),
+			"update", "shop.orders",
+			`{"q":{"_id":"?number"},"u":{"$set":{"status":"?string"}},"upsert":true}`},
+
+		{"delete", decodeMsg(t, bson.D{
+			{Key: "delete", Value: "orders"},
+			{Key: "deletes", Value: bson.A{bson.D{{Key: "q", Value: bson.D{{Key: "status", Value: "void"}}}, {Key: "limit", Value: int32(0)}}}},
+			{Key: "$db", Value: "shop"},
+		}, ""),
+			"delete", "shop.orders",
+			`{"q":{"status":"?string"},"limit":0}`},
+
+		{"count", decodeMsg(t, bson.D{{Key: "count", Value: "orders"}, {Key: "query", Value: bson.D{{Key: "n", Value: int32(3)}}}, {Key: "$db", Value: "shop"}}, ""),
+			"count", "shop.orders", `{"query":{"n":"?number"}}`},
+
+		{"distinct", decodeMsg(t, bson.D{{Key: "distinct", Value: "orders"}, {Key: "key", Value: "sku"}, {Key: "$db", Value: "shop"}}, ""),
+			"distinct", "shop.orders", `{"key":"sku"}`},
+
+		{"legacy query", &Query{
+			Header:             &Header{OpCode: OpQuery},
+			FullCollectionName: "shop.orders",
+			Query: document(t, bson.D{
+				{Key: "$query", Value: bson.D{{Key: "status", Value: "open"}}},
+				{Key: "$orderby", Value: bson.D{{Key: "created", Value: int32(-1)}}},
+			}),
+		}, "query", "shop.orders", `{"filter":{"status":"?string"},"sort":{"created":-1}}`},
+	}
+
+	hashes := map[string]string{}
+	for _, tt := range tests {
+		s := ShapeOf(tt.op)
+		if s == nil {
+			t.Errorf("%s: no shape", tt.name)
+			continue
+		}
+		if s.Command != tt.command || s.Namespace != tt.ns || s.Shape != tt.shape {
+			t.Errorf("%s: got %s %s %s, want %s %s %s", tt.name, s.Command, s.Namespace, s.Shape, tt.command, tt.ns, tt.shape)
+		}
+
+		// The hash is FNV-1a of the command, namespace and shape, so it is
+		// stable across runs and builds
+		h := fnv.New64a()
+		h.Write([]byte(tt.command + "\x00" + tt.ns + "\x00" + tt.shape))
+		if want := fmt.Sprintf("%016x", h.Sum64()); s.Hash != want {
+			t.Errorf("%s: got hash %s, want %s", tt.name, s.Hash, want)
+		}
+		if other, ok := hashes[tt.shape]; ok && other != s.Hash {
+			t.Errorf("%s: hash %s differs from %s for the same shape", tt.name, s.Hash, other)
+		}
+		hashes[tt.shape] = s.Hash
+	}
+	if len(hashes) != len(tests)-1 {
+		t.Errorf("got %d distinct shapes, want %d", len(hashes), len(tests)-1)
+	}
+
+	// Commands that aren't queries have no shape
+	if s := ShapeOf(decodeMsg(t, bson.D{{Key: "ping", Value: int32(1)}, {Key: "$db", Value: "admin"}}, "")); s != nil {
+		t.Errorf("ping: got shape %s", s.Shape)
+	}
+}
+
+// Marshal a document for a test
+func document(t testing.TB, v interface{}) *Document {
+	b, err := bson.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewDocument(b)
+}
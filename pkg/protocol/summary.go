@@ -0,0 +1,293 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// MaxStringLength limits the length of the summaries returned by each op's
+// String method. Zero means no limit.
+var MaxStringLength = 512
+
+// Summary describes an op on one line: its opcode and ids, the command and
+// namespace, a compact filter, the documents and cursor returned, decoded
+// flags and the message size. Summaries longer than max are cut short and
+// end with "...", unless max is zero.
+func Summary(op Op, max int) string {
+	var s string
+	switch o := op.(type) {
+	case *Msg:
+		s = o.summary()
+	case *Query:
+		s = o.summary()
+	case *Reply:
+		s = o.summary()
+	case *Insert:
+		s = o.summary()
+	case *Update:
+		s = o.summary()
+	case *Delete:
+		s = o.summary()
+	case *GetMore:
+		s = o.summary()
+	case *KillCursors:
+		s = o.summary()
+	default:
+		s = op.GetHeader().String()
+	}
+	return clip(s, max)
+}
+
+// Cut a string to at most max bytes, ending with "...", without splitting
+// a character
+func clip(s string, max int) string {
+	if max <= 0 || len(s) <= max {
+		return s
+	}
+	n, tail := max-3, "..."
+	if max <= 3 {
+		n, tail = max, ""
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n] + tail
+}
+
+// Builds a summary from space separated parts
+type summary struct {
+	b strings.Builder
+}
+
+func newSummary(h *Header) *summary {
+	s := &summary{}
+	s.add(h.Type().String())
+	s.add(fmt.Sprintf("id=%d", h.RequestID))
+	if h.ResponseTo != 0 {
+		s.add(fmt.Sprintf("to=%d", h.ResponseTo))
+	}
+	return s
+}
+
+func (s *summary) add(part string) {
+	if part == "" {
+		return
+	}
+	if s.b.Len() > 0 {
+		s.b.WriteByte(' ')
+	}
+	s.b.WriteString(part)
+}
+
+func (s *summary) field(key string, v bson.RawValue) {
+	if !v.IsZero() {
+		s.add(key + "=" + CompactJSON(v))
+	}
+}
+
+func (s *summary) doc(key string, d *Document) {
+	if d != nil {
+		s.add(key + "=" + d.String())
+	}
+}
+
+func (s *summary) done(h *Header, flags fmt.Stringer) string {
+	if f := flags.String(); f != "0" {
+		s.add("flags=" + f)
+	}
+	if h.Compressed {
+		s.add(fmt.Sprintf("len=%d compressed=%s/%d", h.MessageLength, h.CompressorID, h.CompressedLength))
+	} else {
+		s.add(fmt.Sprintf("len=%d", h.MessageLength))
+	}
+	return s.b.String()
+}
+
+// String returns the document as compact relaxed Extended JSON
+func (d *Document) String() string {
+	b, err := d.MarshalJSON()
+	if err != nil {
+		return "<invalid>"
+	}
+	return string(b)
+}
+
+// CompactJSON returns a single value as compact relaxed Extended JSON
+func CompactJSON(v bson.RawValue) string {
+	b, err := bson.MarshalExtJSON(bson.D{{Key: "v", Value: v}}, false, false)
+	if err != nil {
+		return "<invalid>"
+	}
+	// Strip the wrapping {"v": ... }
+	return string(b[5 : len(b)-1])
+}
+
+// Summarize a command request: its name, namespace and the fields that
+// describe what it does
+func (s *summary) command(cmd *Command, op Op) {
+	s.add(cmd.Name)
+	s.add(cmd.Namespace())
+	body := cmd.Body
+	switch cmd.Name {
+	case "find":
+		s.field("filter", body.Lookup("filter"))
+		s.field("sort", body.Lookup("sort"))
+		s.field("projection", body.Lookup("projection"))
+		s.field("limit", body.Lookup("limit"))
+	case "aggregate":
+		s.field("pipeline", body.Lookup("pipeline"))
+	case "count", "distinct":
+		s.field("key", body.Lookup("key"))
+		s.field("query", body.Lookup("query"))
+	case "findAndModify":
+		s.field("query", body.Lookup("query"))
+		s.field("update", body.Lookup("update"))
+	case "getMore":
+		s.field("cursor", body.Lookup("getMore"))
+	case "killCursors":
+		s.field("cursors", body.Lookup("cursors"))
+	case "insert":
+		s.add(fmt.Sprintf("docs=%d", statements(op, body, "documents")))
+	case "update":
+		s.add(fmt.Sprintf("updates=%d", statements(op, body, "updates")))
+		if stmt := firstStatement(op, body, "updates"); stmt != nil {
+			s.field("q", stmt.Lookup("q"))
+			s.field("u", stmt.Lookup("u"))
+		}
+	case "delete":
+		s.add(fmt.Sprintf("deletes=%d", statements(op, body, "deletes")))
+		if stmt := firstStatement(op, body, "deletes"); stmt != nil {
+			s.field("q", stmt.Lookup("q"))
+		}
+	}
+}
+
+// Number of statements in a write command, sent in the body or in a
+// document sequence
+func statements(op Op, body *Document, key string) int {
+	if arr, ok := body.Lookup(key).ArrayOK(); ok {
+		vals, _ := arr.Values()
+		return len(vals)
+	}
+	if m, ok := op.(*Msg); ok {
+		return len(m.Sequence(key))
+	}
+	return 0
+}
+
+// Summarize a command reply: its outcome, and the cursor or count it returns
+func (s *summary) reply(doc *Document) {
+	out := DocumentOutcome(doc)
+	if out.OK {
+		s.add("ok")
+	} else {
+		s.add("error")
+	}
+	if out.Code != 0 {
+		s.add(fmt.Sprintf("code=%d", out.Code))
+	}
+	if out.CodeName != "" {
+		s.add("codeName=" + out.CodeName)
+	}
+	if out.Message != "" {
+		s.add(fmt.Sprintf("errmsg=%q", out.Message))
+	}
+	if out.WriteErrors > 0 {
+		s.add(fmt.Sprintf("writeErrors=%d", out.WriteErrors))
+	}
+
+	if cursor, ok := doc.Lookup("cursor").DocumentOK(); ok {
+		c := NewDocument(cursor)
+		for _, key := range []string{"firstBatch", "nextBatch"} {
+			if arr, ok := c.Lookup(key).ArrayOK(); ok {
+				vals, _ := arr.Values()
+				s.add(fmt.Sprintf("docs=%d", len(vals)))
+			}
+		}
+		s.field("cursor", c.Lookup("id"))
+	}
+	s.field("n", doc.Lookup("n"))
+}
+
+func (o *Msg) summary() string {
+	s := newSummary(o.Header)
+	if o.ResponseTo != 0 {
+		if o.Body != nil {
+			s.reply(o.Body)
+		}
+	} else if cmd := CommandOf(o); cmd != nil {
+		s.command(cmd, o)
+	}
+	return s.done(o.Header, o.Flags)
+}
+
+func (o *Query) summary() string {
+	s := newSummary(o.Header)
+	if cmd := CommandOf(o); cmd != nil {
+		s.command(cmd, o)
+	} else {
+		s.add(o.FullCollectionName)
+		s.doc("filter", o.Query)
+		s.doc("projection", o.ReturnFieldsSelector)
+		s.add(fmt.Sprintf("skip=%d limit=%d", o.NumberToSkip, o.NumberToReturn))
+	}
+	return s.done(o.Header, o.Flags)
+}
+
+func (o *Reply) summary() string {
+	s := newSummary(o.Header)
+	s.add(fmt.Sprintf("docs=%d cursor=%d from=%d", o.NumberReturned, o.CursorID, o.StartingFrom))
+	if len(o.Documents) == 1 {
+		s.doc("doc", o.Documents[0])
+	}
+	return s.done(o.Header, o.Flags)
+}
+
+func (o *Insert) summary() string {
+	s := newSummary(o.Header)
+	s.add(o.FullCollectionName)
+	s.add(fmt.Sprintf("docs=%d", len(o.Documents)))
+	return s.done(o.Header, o.Flags)
+}
+
+func (o *Update) summary() string {
+	s := newSummary(o.Header)
+	s.add(o.FullCollectionName)
+	s.doc("q", o.Selector)
+	s.doc("u", o.Update)
+	return s.done(o.Header, o.Flags)
+}
+
+func (o *Delete) summary() string {
+	s := newSummary(o.Header)
+	s.add(o.FullCollectionName)
+	s.doc("q", o.Selector)
+	return s.done(o.Header, o.Flags)
+}
+
+func (o *GetMore) summary() string {
+	s := newSummary(o.Header)
+	s.add(o.FullCollectionName)
+	s.add(fmt.Sprintf("cursor=%d limit=%d", o.CursorID, o.NumberToReturn))
+	return s.done(o.Header, noFlags{})
+}
+
+func (o *KillCursors) summary() string {
+	s := newSummary(o.Header)
+	ids := make([]string, len(o.CursorIDs))
+	for i, id := range o.CursorIDs {
+		ids[i] = fmt.Sprintf("%d", id)
+	}
+	s.add("cursors=[" + strings.Join(ids, ",") + "]")
+	return s.done(o.Header, noFlags{})
+}
+
+// For ops without flags
+type noFlags struct{}
+
+func (noFlags) String() string {
+	return "0"
+}
@@ -0,0 +1,46 @@
+package protocol
+
+import (
+	"testing"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestClip(t *testing.T) {
+	tests := []struct {
+		s    string
+		max  int
+		want string
+	}{
+		{"hello world", 0, "hello world"},
+		{"hello world", 11, "hello world"},
+		{"hello world", 8, "hello..."},
+		{"hello world", 3, "hel"},
+		{"héllo world", 5, "h..."},  // é is 2 bytes, at 1 and 2
+		{"héllo world", 6, "hé..."}, // ends after é
+		{"日本語です", 8, "日..."},
+		{"日本語です", 2, ""},
+	}
+	for _, tt := range tests {
+		got := clip(tt.s, tt.max)
+		if got != tt.want || !utf8.ValidString(got) {
+			t.Errorf("clip(%q, %d): got %q, want %q", tt.s, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestSummaryClipped(t *testing.T) {
+	op := decodeMsg(t, bson.D{
+		{Key: "find", Value: "orders"},
+		{Key: "filter", Value: bson.D{{Key: "name", Value: "日本語日本語日本語日本語"}}},
+		{Key: "$db", Value: "shop"},
+	}, "")
+	full := Summary(op, 0)
+	for max := 1; max < len(full); max++ {
+		s := Summary(op, max)
+		if len(s) > max || !utf8.ValidString(s) {
+			t.Fatalf("max %d: got %q", max, s)
+		}
+	}
+}
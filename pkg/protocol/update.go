@@ -1,12 +1,6 @@
 package protocol
 
-import (
-	"bufio"
-	"fmt"
-	"io"
-
-	"go.mongodb.org/mongo-driver/bson"
-)
+import "bufio"
 
 // UpdateFlags ..
 type UpdateFlags int32
@@ -23,8 +17,8 @@ type Update struct {
 	*Header
 	FullCollectionName string
 	Flags              UpdateFlags
-	Selector           bson.D
-	Update             bson.D
+	Selector           *Document
+	Update             *Document
 }
 
 // GetHeader ..
@@ -34,44 +28,53 @@ func (o *Update) GetHeader() *Header {
 
 // Read an Update message off the wire
 func (o *Update) Read(r *bufio.Reader, h *Header) error {
+	b, err := readBody(r, h)
+	if err != nil {
+		return err
+	}
+	return o.Decode(b, h, nil)
+}
+
+// Decode an Update message body
+func (o *Update) Decode(b []byte, h *Header, opts *DecodeOptions) error {
 	o.Header = h
 
+	p := newBuffer(b, h, opts)
+
 	// Skip reserved field
-	if _, err := r.Discard(4); err != nil {
-		return fmt.Errorf("op_update reserved field: %s", err)
+	if _, err := p.next(4, "ZERO"); err != nil {
+		return err
 	}
 
-	var raw [4]byte
-	d := raw[:]
-
 	// Decode full collection name
-	name, err := cstring(r)
+	name, err := p.cstring("fullCollectionName")
 	if err != nil {
-		return fmt.Errorf("op_update name: %s", err)
+		return err
 	}
 	o.FullCollectionName = name
 
 	// Decode flags
-	if _, err := io.ReadFull(r, d); err != nil {
-		return fmt.Errorf("op_update flags: %s", err)
+	flags, err := p.int32("flags")
+	if err != nil {
+		return err
 	}
-	o.Flags = UpdateFlags(DecodeInt32LE(d, 0))
+	o.Flags = UpdateFlags(flags)
 
 	// Decode selector
-	o.Selector, _, err = document(r)
+	o.Selector, err = p.decodeDocument("selector")
 	if err != nil {
-		return fmt.Errorf("op_update selector: %s", err)
+		return err
 	}
 
 	// Decode update
-	o.Update, _, err = document(r)
+	o.Update, err = p.decodeDocument("update")
 	if err != nil {
-		return fmt.Errorf("op_update update: %s", err)
+		return err
 	}
-	return nil
+	return p.done()
 }
 
-// String representation
+// String summarizes the op, see Summary
 func (o *Update) String() string {
-	return o.Header.String()
+	return Summary(o, MaxStringLength)
 }